@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	ptp "github.com/subutai-io/p2p/lib"
+)
+
+// CommandCapture starts or stops recording of instance traffic
+// Status of the capture is displayed when neither output file
+// nor stop flag was specified
+func CommandCapture(rpcPort int, hash, peer, output string, outer, stop bool) {
+	if hash == "" {
+		fmt.Printf("Hash was not specified\n")
+		os.Exit(1)
+	}
+	args := &DaemonArgs{Hash: hash, Command: "status"}
+	if stop {
+		args.Command = "stop"
+	} else if output != "" {
+		args.Command = "start"
+		args.Args = output
+		args.Peer = peer
+		args.Outer = outer
+	}
+	out, err := sendRequest(rpcPort, "capture", args)
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	fmt.Println(out.Message)
+	os.Exit(out.Code)
+}
+
+func (d *Daemon) execRESTCapture(w http.ResponseWriter, r *http.Request) {
+	if !ReadyToServe {
+		resp, _ := getResponse(105, "P2P Daemon is in initialization state")
+		w.Write(resp)
+	}
+	args := new(DaemonArgs)
+	err := getJSON(r.Body, args)
+	if handleMarshalError(err, w) != nil {
+		return
+	}
+	response := new(Response)
+	d.Capture(args, response)
+	resp, err := getResponse(response.ExitCode, response.Output)
+	if err != nil {
+		ptp.Log(ptp.Error, "Internal error: %s", err)
+		return
+	}
+	w.Write(resp)
+}
+
+// Capture controls packet capture of an instance
+func (p *Daemon) Capture(args *DaemonArgs, resp *Response) error {
+	resp.ExitCode = 0
+	inst := p.Instances.GetInstance(args.Hash)
+	if inst == nil {
+		resp.ExitCode = 1
+		resp.Output = "Instance with hash " + args.Hash + " was not found"
+		return nil
+	}
+	switch args.Command {
+	case "start":
+		err := inst.PTP.StartCapture(args.Args, args.Peer, args.Outer)
+		if err != nil {
+			resp.ExitCode = 1
+			resp.Output = err.Error()
+			return nil
+		}
+		resp.Output = "Capture has been started"
+		if c := inst.PTP.ActiveCapture(); c != nil {
+			resp.Output += " into " + c.Path
+		}
+	case "stop":
+		c, err := inst.PTP.StopCapture()
+		if c == nil {
+			resp.ExitCode = 1
+			resp.Output = err.Error()
+			return nil
+		}
+		frames, packets := c.Stats()
+		resp.Output = fmt.Sprintf("Capture has been stopped. %d frames and %d messages were written into %s", frames, packets, c.Path)
+		if err != nil {
+			resp.Output += fmt.Sprintf("\nFailed to close file: %s", err)
+		}
+	default:
+		c := inst.PTP.ActiveCapture()
+		if c == nil {
+			resp.Output = "Capture is not running"
+			return nil
+		}
+		frames, packets := c.Stats()
+		resp.Output = fmt.Sprintf("Capturing into %s for %s. Frames: %d, Messages: %d", c.Path, time.Since(c.Started).Round(time.Second), frames, packets)
+		if c.Peer != "" {
+			resp.Output += ", Peer: " + c.Peer
+		}
+	}
+	return nil
+}
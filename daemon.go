@@ -28,10 +28,38 @@ type DaemonArgs struct {
 	Args       string `json:"args"`
 	Log        string `json:"log"`
 	Bind       bool   `json:"bind"`
+	Flood      string `json:"flood"`
+	Snooping   bool   `json:"snooping"`
+	StormLimit int    `json:"stormLimit"`
+	Bridge     bool   `json:"bridge"`
+	Mode       string `json:"mode"`
+	Routes     string `json:"routes"`
+	Rules      string `json:"rules"`
+	Peer       string `json:"peer"`
+	Outer      bool   `json:"outer"`
+	Name       string `json:"name"`
+	DNS        bool   `json:"dns"`
+	Upstream   string `json:"upstream"`
+	DHCPPool   string `json:"dhcpPool"`
+	Exit       bool   `json:"exit"`
+	ExitNode   string `json:"exitNode"`
+	Weights    string `json:"weights"`
+	Endpoint   string `json:"endpoint"`
+	Profile    string `json:"profile"`
+	Tune       string `json:"tune"`
+	Static     string `json:"static"`
+	Reconnect  bool   `json:"reconnect"`
+	Relay      bool   `json:"relay"`
+	Lazy       bool   `json:"lazy"`
+	MaxPeers   int    `json:"maxPeers"`
 }
 
 var bootstrap DHTConnection
 
+// BootstrapWaitTimeout limits how long daemon waits for bootstrap nodes
+// on start. Without them only instances with static peers can operate
+const BootstrapWaitTimeout = time.Second * 15
+
 // ExecDaemon starts P2P daemon
 func ExecDaemon(port int, sFile, profiling, syslog string) {
 	if syslog != "" {
@@ -61,8 +89,13 @@ func ExecDaemon(port int, sFile, profiling, syslog string) {
 
 	err := bootstrap.init(DefaultDHT)
 	if err != nil {
-		ptp.Log(ptp.Error, "Failed to initilize bootstrap node connection")
-		os.Exit(152)
+		if !ptp.HasStaticPeers(ptp.ConfigDir + "/p2p/config.yaml") {
+			ptp.Log(ptp.Error, "Failed to initilize bootstrap node connection")
+			os.Exit(152)
+		}
+		// Air-gapped daemon works with static peers only
+		ptp.Log(ptp.Warning, "Bootstrap nodes are unavailable: %s. Only static peers will be available", err)
+		bootstrap.routers = nil
 	}
 	go bootstrap.run()
 	for _, r := range bootstrap.routers {
@@ -71,24 +104,37 @@ func ExecDaemon(port int, sFile, profiling, syslog string) {
 		}
 	}
 
-	for bootstrap.ip == "" {
+	bootstrapStarted := time.Now()
+	for bootstrap.ip == "" && len(bootstrap.routers) > 0 {
+		if time.Since(bootstrapStarted) > BootstrapWaitTimeout {
+			ptp.Log(ptp.Warning, "Bootstrap nodes are unreachable. Only static peers will be available")
+			break
+		}
 		time.Sleep(time.Millisecond * 100)
 	}
 
+	outboundLock.Lock()
 	OutboundIP = net.ParseIP(bootstrap.ip)
+	outboundLock.Unlock()
 	proc := new(Daemon)
 	proc.Initialize(sFile)
 	setupRESTHandlers(port, proc)
 
-	// ptp.Log(ptp.Info, "Determining outbound IP")
-	// nat, host, err := stun.NewClient().Discover()
-	// if err != nil {
-	// 	ptp.Log(ptp.Error, "Failed to discover outbound IP: %s", err)
-	// 	OutboundIP = nil
-	// } else {
-	// 	OutboundIP = net.ParseIP(host.IP())
-	// 	ptp.Log(ptp.Info, "Public IP is %s. %s", OutboundIP.String(), nat)
-	// }
+	// STUN servers may be slow or unreachable, so instances are restored
+	// without waiting for the result
+	go func() {
+		ptp.Log(ptp.Info, "Determining outbound IP")
+		nat, err := ptp.DiscoverNAT(ptp.LoadSTUNServers(ptp.ConfigDir + "/p2p/config.yaml"))
+		if err != nil {
+			ptp.Log(ptp.Warning, "Failed to discover outbound IP with STUN: %s", err)
+			return
+		}
+		outboundLock.Lock()
+		OutboundNAT = nat
+		OutboundIP = nat.Mapped.IP
+		outboundLock.Unlock()
+		ptp.Log(ptp.Info, "Public IP is %s. %s", nat.Mapped.IP.String(), nat.String())
+	}()
 
 	if sFile != "" {
 		ptp.Log(ptp.Info, "Restore file provided")
@@ -109,21 +155,25 @@ func ExecDaemon(port int, sFile, profiling, syslog string) {
 	SignalChannel = make(chan os.Signal, 1)
 	signal.Notify(SignalChannel, os.Interrupt)
 
-	go func() {
-		for {
-			active := 0
-			for _, r := range bootstrap.routers {
-				if !r.stop {
-					active++
+	// Daemon exits when every bootstrap node was stopped. Without
+	// bootstrap nodes it serves static peers only
+	if len(bootstrap.routers) > 0 {
+		go func() {
+			for {
+				active := 0
+				for _, r := range bootstrap.routers {
+					if !r.stop {
+						active++
+					}
 				}
+				if active == 0 {
+					ptp.Log(ptp.Info, "No active bootstrap nodes")
+					os.Exit(0)
+				}
+				time.Sleep(time.Millisecond * 100)
 			}
-			if active == 0 {
-				ptp.Log(ptp.Info, "No active bootstrap nodes")
-				os.Exit(0)
-			}
-			time.Sleep(time.Millisecond * 100)
-		}
-	}()
+		}()
+	}
 
 	go func() {
 		for sig := range SignalChannel {
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"os"
 	"runtime"
+	"strings"
 	"time"
 
 	ptp "github.com/subutai-io/p2p/lib"
@@ -57,6 +58,9 @@ func (p *Daemon) Debug(args *Args, resp *Response) error {
 			resp.Output += fmt.Sprintf("  %s Rx: %d Tx: %d\n", node.addr.String(), node.rx, node.tx)
 		}
 	}
+	if _, nat := getOutbound(); nat != nil {
+		resp.Output += fmt.Sprintf("Outbound NAT: %s\n", nat.String())
+	}
 	resp.Output += fmt.Sprintf("Instances information:\n")
 	instances := p.Instances.Get()
 	for _, inst := range instances {
@@ -67,6 +71,31 @@ func (p *Daemon) Debug(args *Args, resp *Response) error {
 		resp.Output += fmt.Sprintf("Hash: %s\n", inst.ID)
 		resp.Output += fmt.Sprintf("ID: %s\n", inst.PTP.Dht.ID)
 		resp.Output += fmt.Sprintf("UDP Port: %d\n", inst.PTP.UDPSocket.GetPort())
+		if nat := inst.PTP.GetNAT(); nat != nil {
+			resp.Output += fmt.Sprintf("NAT: %s, checked %s ago\n", nat.String(), time.Since(nat.Checked).Round(time.Second))
+		} else {
+			resp.Output += fmt.Sprintf("NAT: not discovered\n")
+		}
+		if mapping := inst.PTP.GetPortMapping(); mapping != nil {
+			resp.Output += fmt.Sprintf("Port mapping: %s\n", mapping.String())
+		} else {
+			resp.Output += fmt.Sprintf("Port mapping: none\n")
+		}
+		resp.Output += fmt.Sprintf("Port prediction: %s\n", inst.PTP.Prediction.String())
+		resp.Output += fmt.Sprintf("Relay: %s\n", inst.PTP.Relays.String())
+		resp.Output += fmt.Sprintf("Lazy connections: %s\n", inst.PTP.LazyStatus())
+		if inst.PTP.Tuning != nil {
+			resp.Output += fmt.Sprintf("Tuning: %s\n", inst.PTP.Tuning.String())
+		}
+		if len(inst.PTP.StaticPeers) > 0 {
+			resp.Output += fmt.Sprintf("Static peers:\n")
+			for _, addr := range inst.PTP.StaticPeers {
+				resp.Output += fmt.Sprintf("\t%s\n", addr.String())
+			}
+		}
+		if inst.PTP.Discovery != nil {
+			resp.Output += fmt.Sprintf("LAN discovery: %s\n", strings.Join(inst.PTP.Discovery.Addresses(), ", "))
+		}
 		resp.Output += fmt.Sprintf("Network interfaces:\n")
 		for _, ip := range inst.PTP.LocalIPs {
 			resp.Output += fmt.Sprintf("\tIP: %s\n", ip.String())
@@ -80,33 +109,84 @@ func (p *Daemon) Debug(args *Args, resp *Response) error {
 		for _, proxy := range proxyList {
 			resp.Output += fmt.Sprintf("\tProxy address: %s Assigned Endpoint: %s\n", proxy.Addr.String(), proxy.Endpoint.String())
 		}
+		flood, snooping, limit := inst.PTP.Multicast.Settings()
+		resp.Output += fmt.Sprintf("Flooding: %s, Snooping: %t, Storm limit: %d\n", ptp.StringifyFloodMode(flood), snooping, limit)
+		for group, members := range inst.PTP.Multicast.Groups() {
+			resp.Output += fmt.Sprintf("\tGroup %s: %s\n", group, strings.Join(members, ", "))
+		}
+		if inst.PTP.BridgeMode {
+			resp.Output += fmt.Sprintf("Bridge MAC table:\n")
+			for mac, id := range inst.PTP.MACTable.Get() {
+				if id == "" {
+					id = "local"
+				}
+				resp.Output += fmt.Sprintf("\t%s %s\n", mac, id)
+			}
+		}
+		if len(inst.PTP.Routes) > 0 {
+			resp.Output += fmt.Sprintf("Advertised networks: %s\n", ptp.StringifyRoutes(inst.PTP.Routes, ", "))
+		}
+		routes := inst.PTP.RouteTable.Get()
+		if len(routes) > 0 {
+			resp.Output += fmt.Sprintf("Routes:\n")
+			for network, id := range routes {
+				resp.Output += fmt.Sprintf("\t%s via %s\n", network, id)
+			}
+		}
+		if inst.PTP.ExitGateway {
+			resp.Output += fmt.Sprintf("Serving as exit node\n")
+		}
+		if inst.PTP.ExitNode != "" {
+			gateway, bypass := inst.PTP.ExitRoute()
+			if gateway != nil {
+				resp.Output += fmt.Sprintf("Exit node: %s (%s), bypass routes: %d\n", inst.PTP.ExitNode, gateway.String(), bypass)
+			} else {
+				resp.Output += fmt.Sprintf("Exit node: %s (not connected)\n", inst.PTP.ExitNode)
+			}
+		}
 		resp.Output += fmt.Sprintf("Peers:\n")
 
 		peers := inst.PTP.Peers.Get()
 		for _, peer := range peers {
 			resp.Output += fmt.Sprintf("\t--- %s ---\n", peer.ID)
-			resp.Output += fmt.Sprintf("\tState: %s\n", ptp.StringifyState(peer.State))
-			resp.Output += fmt.Sprintf("\tRemote State: %s\n", ptp.StringifyState(peer.RemoteState))
-			if peer.PeerLocalIP == nil {
+			if peer.Static {
+				resp.Output += fmt.Sprintf("\tStatic peer\n")
+			}
+			if peer.Discovered {
+				resp.Output += fmt.Sprintf("\tDiscovered in LAN\n")
+			}
+			resp.Output += fmt.Sprintf("\tState: %s\n", ptp.StringifyState(peer.GetState()))
+			resp.Output += fmt.Sprintf("\tRemote State: %s\n", ptp.StringifyState(peer.GetRemoteState()))
+			ip := peer.GetIP()
+			hw := peer.GetHardwareAddress()
+			if ip == nil {
 				resp.Output += "\tNo IP assigned\n"
-			} else if peer.PeerHW == nil {
+			} else if hw == nil {
 				resp.Output += "\tNo MAC assigned\n"
 			} else {
-				resp.Output += fmt.Sprintf("\tHWAddr: %s\n", peer.PeerHW.String())
-				resp.Output += fmt.Sprintf("\tIP: %s\n", peer.PeerLocalIP.String())
-				resp.Output += fmt.Sprintf("\tEndpoint: %s\n", peer.Endpoint)
+				resp.Output += fmt.Sprintf("\tHWAddr: %s\n", hw.String())
+				resp.Output += fmt.Sprintf("\tIP: %s\n", ip.String())
+				resp.Output += fmt.Sprintf("\tEndpoint: %s\n", peer.GetEndpoint())
+				if pinned := peer.GetPinnedEndpoint(); pinned != "" {
+					resp.Output += fmt.Sprintf("\tPinned Endpoint: %s\n", pinned)
+				}
 				resp.Output += fmt.Sprintf("\tAll Endpoints:\n")
-				for _, ep := range peer.Endpoints {
-					resp.Output += fmt.Sprintf("\t\t%s\n", ep.Addr.String())
+				for _, ep := range peer.GetEndpoints() {
+					class := peer.EndpointClass(ep.Addr)
+					if relay := inst.PTP.RelayOf(ep.Addr); relay != "" {
+						class += " via " + relay
+					}
+					resp.Output += fmt.Sprintf("\t\t%s [%s]\n", ep.String(), class)
 				}
 			}
 			resp.Output += fmt.Sprintf("\tEndpoints pool: \n")
 			pool := []*net.UDPAddr{}
-			pool = append(pool, peer.KnownIPs...)
-			pool = append(pool, peer.Proxies...)
+			pool = append(pool, peer.GetKnownIPs()...)
+			pool = append(pool, peer.GetProxies()...)
+			endpoints := peer.GetEndpoints()
 			for _, v := range pool {
 				resp.Output += fmt.Sprintf("\t  %s", v.String())
-				for _, ep := range peer.Endpoints {
+				for _, ep := range endpoints {
 					if v.String() == ep.Addr.String() {
 						resp.Output += fmt.Sprintf("\tActive")
 					}
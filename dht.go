@@ -46,6 +46,7 @@ type DHTRouter struct {
 func (dht *DHTConnection) init(routersSrc string) error {
 	ptp.Log(ptp.Info, "Initializing connection to a bootstrap nodes")
 	dht.incoming = make(chan *ptp.DHTPacket)
+	dht.instances = make(map[string]*P2PInstance)
 	routers := strings.Split(routersSrc, ",")
 	if len(routers) == 0 {
 		return ErrorNoRouters
@@ -65,7 +66,6 @@ func (dht *DHTConnection) init(routersSrc string) error {
 		router.data = dht.incoming
 		dht.routers = append(dht.routers, router)
 	}
-	dht.instances = make(map[string]*P2PInstance)
 	return nil
 }
 
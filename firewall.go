@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	ptp "github.com/subutai-io/p2p/lib"
+)
+
+// CommandFirewall manages firewall rules of an instance
+// Only one operation is performed per call. Rules are listed
+// when no operation was specified
+func CommandFirewall(rpcPort int, hash, add string, remove int, load, def string) {
+	if hash == "" {
+		fmt.Printf("Hash was not specified\n")
+		os.Exit(1)
+	}
+	args := &DaemonArgs{Hash: hash, Command: "list"}
+	if add != "" {
+		args.Command = "add"
+		args.Args = add
+	} else if remove > 0 {
+		args.Command = "remove"
+		args.Args = strconv.Itoa(remove)
+	} else if load != "" {
+		path, err := filepath.Abs(load)
+		if err != nil {
+			fmt.Printf("Bad rules file path: %s\n", err)
+			os.Exit(1)
+		}
+		args.Command = "load"
+		args.Args = path
+	} else if def != "" {
+		args.Command = "default"
+		args.Args = def
+	}
+	out, err := sendRequest(rpcPort, "firewall", args)
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	fmt.Println(out.Message)
+	os.Exit(out.Code)
+}
+
+func (d *Daemon) execRESTFirewall(w http.ResponseWriter, r *http.Request) {
+	if !ReadyToServe {
+		resp, _ := getResponse(105, "P2P Daemon is in initialization state")
+		w.Write(resp)
+	}
+	args := new(DaemonArgs)
+	err := getJSON(r.Body, args)
+	if handleMarshalError(err, w) != nil {
+		return
+	}
+	response := new(Response)
+	d.Firewall(args, response)
+	resp, err := getResponse(response.ExitCode, response.Output)
+	if err != nil {
+		ptp.Log(ptp.Error, "Internal error: %s", err)
+		return
+	}
+	w.Write(resp)
+}
+
+// Firewall modifies or lists firewall rules of an instance
+func (p *Daemon) Firewall(args *DaemonArgs, resp *Response) error {
+	resp.ExitCode = 0
+	inst := p.Instances.GetInstance(args.Hash)
+	if inst == nil {
+		resp.ExitCode = 1
+		resp.Output = "Instance with hash " + args.Hash + " was not found"
+		return nil
+	}
+	fw := inst.PTP.Firewall
+	switch args.Command {
+	case "add":
+		rule, err := ptp.ParseFirewallRule(args.Args)
+		if err == nil {
+			err = fw.AddRule(rule)
+		}
+		if err != nil {
+			resp.ExitCode = 1
+			resp.Output = "Failed to add rule: " + err.Error()
+			return nil
+		}
+		resp.Output = "Rule has been added"
+	case "remove":
+		index, err := strconv.Atoi(args.Args)
+		if err == nil {
+			err = fw.RemoveRule(index)
+		}
+		if err != nil {
+			resp.ExitCode = 1
+			resp.Output = "Failed to remove rule: " + err.Error()
+			return nil
+		}
+		resp.Output = "Rule has been removed"
+	case "load":
+		err := fw.LoadRules(args.Args)
+		if err != nil {
+			resp.ExitCode = 1
+			resp.Output = err.Error()
+			return nil
+		}
+		resp.Output = "Rules have been loaded"
+	case "default":
+		action, err := ptp.ParseFirewallAction(args.Args)
+		if err != nil {
+			resp.ExitCode = 1
+			resp.Output = err.Error()
+			return nil
+		}
+		fw.SetDefault(action)
+		resp.Output = "Default action has been set to " + ptp.StringifyFirewallAction(action)
+	default:
+		for i, rule := range fw.Rules() {
+			resp.Output += fmt.Sprintf("%d\t%s\thits:%d\n", i+1, rule.String(), rule.Hits)
+		}
+		action, hits := fw.Policy()
+		resp.Output += fmt.Sprintf("default\taction=%s\thits:%d\n", ptp.StringifyFirewallAction(action), hits)
+		resp.Output += fmt.Sprintf("Tracked connections: %d", fw.Connections())
+	}
+	return nil
+}
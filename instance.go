@@ -14,16 +14,36 @@ import (
 // RunArgs is a list of arguments used at instance startup and
 // some other RPC calls
 type RunArgs struct {
-	IP      string `json:"ip"`
-	Mac     string `json:"mac"`
-	Dev     string `json:"dev"`
-	Hash    string `json:"hash"`
-	Dht     string `json:"dht"`
-	Keyfile string `json:"keyfile"`
-	Key     string `json:"key"`
-	TTL     string `json:"ttl"`
-	Fwd     bool   `json:"fwd"`
-	Port    int    `json:"port"`
+	IP         string `json:"ip"`
+	Mac        string `json:"mac"`
+	Dev        string `json:"dev"`
+	Hash       string `json:"hash"`
+	Dht        string `json:"dht"`
+	Keyfile    string `json:"keyfile"`
+	Key        string `json:"key"`
+	TTL        string `json:"ttl"`
+	Fwd        bool   `json:"fwd"`
+	Port       int    `json:"port"`
+	Flood      string `json:"flood"`
+	Snooping   bool   `json:"snooping"`
+	StormLimit int    `json:"stormLimit"`
+	Bridge     bool   `json:"bridge"`
+	Mode       string `json:"mode"`
+	Routes     string `json:"routes"`
+	Rules      string `json:"rules"`
+	Name       string `json:"name"`
+	DNS        bool   `json:"dns"`
+	Upstream   string `json:"upstream"`
+	DHCPPool   string `json:"dhcpPool"`
+	Exit       bool   `json:"exit"`
+	ExitNode   string `json:"exitNode"`
+	Weights    string `json:"weights"`
+	Profile    string `json:"profile"`
+	Tune       string `json:"tune"`
+	Static     string `json:"static"`
+	Relay      bool   `json:"relay"`
+	Lazy       bool   `json:"lazy"`
+	MaxPeers   int    `json:"maxPeers"`
 }
 
 type ShowArgs struct {
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	ptp "github.com/subutai-io/p2p/lib"
+)
+
+type leasesResponse struct {
+	Leases []ptp.DHCPLease `json:"leases"`
+	Error  string          `json:"error"`
+	Code   int             `json:"code"`
+}
+
+// CommandLeases outputs addresses leased by DHCP server of an instance
+func CommandLeases(restPort int, hash string) {
+	out, err := sendRequestRaw(restPort, "leases", &request{Hash: hash})
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	response := new(leasesResponse)
+	err = json.Unmarshal(out, response)
+	if err != nil {
+		fmt.Printf("Failed to unmarshal leases response: %s", err)
+		os.Exit(125)
+	}
+
+	if response.Code != 0 {
+		fmt.Println(response.Error)
+		os.Exit(response.Code)
+	}
+
+	for _, lease := range response.Leases {
+		state := "offered"
+		if lease.Bound {
+			state = "bound"
+		}
+		fmt.Printf("%s|%s|%s|%s|Expires:%s\n", lease.IP, lease.MAC, lease.Hostname, state, lease.Expires.Format(time.RFC3339))
+	}
+	os.Exit(0)
+}
+
+func (d *Daemon) execRESTLeases(w http.ResponseWriter, r *http.Request) {
+	args := new(DaemonArgs)
+	err := getJSON(r.Body, args)
+	if handleMarshalError(err, w) != nil {
+		return
+	}
+	output, err := json.Marshal(d.Leases(args.Hash))
+	if err != nil {
+		ptp.Log(ptp.Error, "Failed to marshal leases response: %s", err)
+		return
+	}
+	w.Write(output)
+}
+
+// Leases returns list of DHCP leases of an instance
+func (d *Daemon) Leases(hash string) *leasesResponse {
+	response := &leasesResponse{Leases: []ptp.DHCPLease{}}
+	if !ReadyToServe {
+		response.Code = 105
+		response.Error = "P2P Daemon is in initialization state"
+		return response
+	}
+	inst := d.Instances.GetInstance(hash)
+	if inst == nil {
+		response.Code = 1
+		response.Error = "Instance with hash " + hash + " was not found"
+		return response
+	}
+	if inst.PTP.DHCP == nil {
+		response.Code = 2
+		response.Error = "DHCP server is not running on this instance"
+		return response
+	}
+	response.Leases = inst.PTP.DHCP.Leases()
+	return response
+}
@@ -0,0 +1,177 @@
+package ptp
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mdlayher/ethernet"
+)
+
+// ARP requests for peers that didn't complete introduction yet are kept
+// in a queue and answered as soon as the real hardware address arrives
+
+// ARP queue limits
+const (
+	ARPRequestTimeout = time.Second * 3 // Request is dropped if peer wasn't introduced during this period
+	ARPQueueSize      = 8               // Maximum number of queued requests per IP
+	ARPQueueTargets   = 256             // Maximum number of IPs with queued requests
+)
+
+type pendingARP struct {
+	SenderHW net.HardwareAddr
+	SenderIP net.IP
+	Added    time.Time
+}
+
+// ARPQueue stores ARP requests waiting for peer introduction
+type ARPQueue struct {
+	pending map[string][]*pendingARP
+	lock    sync.Mutex
+}
+
+// Init will initialize ARP queue
+func (q *ARPQueue) Init() {
+	q.pending = make(map[string][]*pendingARP)
+}
+
+// add queues a request for specified target IP. Expired requests
+// are removed during this call
+func (q *ARPQueue) add(target string, senderHW net.HardwareAddr, senderIP net.IP) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.expire()
+	requests, exists := q.pending[target]
+	if !exists && len(q.pending) >= ARPQueueTargets {
+		return false
+	}
+	if len(requests) >= ARPQueueSize {
+		return false
+	}
+	for _, r := range requests {
+		if r.SenderIP.Equal(senderIP) {
+			r.Added = time.Now()
+			return true
+		}
+	}
+	q.pending[target] = append(requests, &pendingARP{SenderHW: senderHW, SenderIP: senderIP, Added: time.Now()})
+	return true
+}
+
+// take removes and returns requests for specified target IP
+func (q *ARPQueue) take(target string) []*pendingARP {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	result := []*pendingARP{}
+	for _, r := range q.pending[target] {
+		if time.Since(r.Added) < ARPRequestTimeout {
+			result = append(result, r)
+		}
+	}
+	delete(q.pending, target)
+	return result
+}
+
+// expire removes outdated requests. Must be called under lock
+func (q *ARPQueue) expire() {
+	for target, requests := range q.pending {
+		alive := requests[:0]
+		for _, r := range requests {
+			if time.Since(r.Added) < ARPRequestTimeout {
+				alive = append(alive, r)
+			}
+		}
+		if len(alive) == 0 {
+			delete(q.pending, target)
+		} else {
+			q.pending[target] = alive
+		}
+	}
+}
+
+// writeARP writes ARP packet into TAP interface
+func (p *PeerToPeer) writeARP(op Operation, srcHW net.HardwareAddr, srcIP net.IP, dstHW net.HardwareAddr, dstIP net.IP, frameDst net.HardwareAddr) {
+	var reply ARPPacket
+	response, err := reply.NewPacket(op, srcHW, srcIP, dstHW, dstIP)
+	if err != nil {
+		Log(Error, "Failed to create ARP packet: %s", err)
+		return
+	}
+	rp, err := response.MarshalBinary()
+	if err != nil {
+		Log(Error, "Failed to marshal ARP packet")
+		return
+	}
+	fr := &ethernet.Frame{
+		Destination: frameDst,
+		Source:      srcHW,
+		EtherType:   ethernet.EtherTypeARP,
+		Payload:     rp,
+	}
+	fb, err := fr.MarshalBinary()
+	if err != nil {
+		Log(Error, "Failed to marshal ARP Ethernet Frame")
+		return
+	}
+	Log(Trace, "%v", response.String())
+	p.WriteToDevice(fb, uint16(PacketARP), false)
+}
+
+// replyARP answers ARP request on behalf of a peer
+func (p *PeerToPeer) replyARP(hw net.HardwareAddr, ip net.IP, dstHW net.HardwareAddr, dstIP net.IP) {
+	p.writeARP(OperationReply, hw, ip, dstHW, dstIP, dstHW)
+}
+
+// gratuitousARP announces new hardware address of a peer, so host updates
+// its neighbor cache without waiting for the entry to expire
+func (p *PeerToPeer) gratuitousARP(hw net.HardwareAddr, ip net.IP) {
+	broadcast := net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	p.writeARP(OperationReply, hw, ip, broadcast, ip, broadcast)
+}
+
+// resolveARP answers queued ARP requests for introduced peer
+func (p *PeerToPeer) resolveARP(hw net.HardwareAddr, ip net.IP) {
+	for _, r := range p.ARPQueue.take(ip.String()) {
+		Log(Debug, "Resolved pending ARP request for %s from %s", ip.String(), r.SenderIP.String())
+		p.replyARP(hw, ip, r.SenderHW, r.SenderIP)
+	}
+}
+
+// updatePeerAddresses handles change of the addresses announced by a peer.
+// Host neighbor entries for previous addresses are removed, and new
+// hardware address is announced with gratuitous ARP
+func (p *PeerToPeer) updatePeerAddresses(id string, hw net.HardwareAddr, ip net.IP) {
+	ips, macs := p.Peers.addressesOf(id)
+	changed := false
+	for _, old := range ips {
+		if old == ip.String() {
+			continue
+		}
+		Log(Info, "Peer %s changed IP from %s to %s", id, old, ip.String())
+		p.Peers.forgetAddresses(old, "")
+		p.deleteNeighbor(net.ParseIP(old))
+		changed = true
+	}
+	for _, old := range macs {
+		if old == hw.String() {
+			continue
+		}
+		Log(Info, "Peer %s changed hardware address from %s to %s", id, old, hw.String())
+		p.Peers.forgetAddresses("", old)
+		changed = true
+	}
+	if changed && p.Interface.GetMode() == InterfaceTAP {
+		p.gratuitousARP(hw, ip)
+	}
+}
+
+// deleteNeighbor removes ARP entry of a peer from the host
+func (p *PeerToPeer) deleteNeighbor(ip net.IP) {
+	if ip == nil || p.Interface.GetMode() != InterfaceTAP {
+		return
+	}
+	err := p.Interface.DelNeighbor(ip)
+	if err != nil {
+		Log(Debug, "Failed to remove neighbor %s: %s", ip.String(), err)
+	}
+}
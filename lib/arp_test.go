@@ -0,0 +1,43 @@
+package ptp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestARPQueue(t *testing.T) {
+	q := new(ARPQueue)
+	q.Init()
+	hw, _ := net.ParseMAC("06:00:00:00:00:01")
+	if !q.add("10.10.10.2", hw, net.ParseIP("10.10.10.1")) {
+		t.Fatal("Request was not queued")
+	}
+	q.add("10.10.10.2", hw, net.ParseIP("10.10.10.1"))
+	q.add("10.10.10.2", hw, net.ParseIP("10.10.10.3"))
+	requests := q.take("10.10.10.2")
+	if len(requests) != 2 {
+		t.Errorf("Wrong number of pending requests: %d", len(requests))
+	}
+	if len(q.take("10.10.10.2")) != 0 {
+		t.Error("Requests were not removed from queue")
+	}
+}
+
+func TestARPQueueLimits(t *testing.T) {
+	q := new(ARPQueue)
+	q.Init()
+	hw, _ := net.ParseMAC("06:00:00:00:00:01")
+	for i := 0; i < ARPQueueSize; i++ {
+		q.add("10.10.10.2", hw, net.IPv4(10, 10, 10, byte(10+i)))
+	}
+	if q.add("10.10.10.2", hw, net.ParseIP("10.10.10.200")) {
+		t.Error("Queue size limit was not applied")
+	}
+	for _, r := range q.pending["10.10.10.2"] {
+		r.Added = time.Now().Add(-ARPRequestTimeout)
+	}
+	if len(q.take("10.10.10.2")) != 0 {
+		t.Error("Expired requests were returned")
+	}
+}
@@ -0,0 +1,228 @@
+package ptp
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bridge mode turns the swarm into a distributed L2 switch: every instance
+// learns hardware addresses seen on its TAP interface (e.g. VMs and containers
+// attached to the same Linux bridge) and advertises them to peers
+
+// Bridge mode timings
+const (
+	MACAgingTime         = time.Second * 300 // Learned address is removed if not seen during this period
+	MACAdvertiseInterval = time.Second * 60  // How often local addresses are advertised to peers
+)
+
+type macEntry struct {
+	ID       string    // ID of a peer behind which address was seen. Empty for local addresses
+	LastSeen time.Time // Last time address was seen or advertised
+}
+
+// MACTable stores hardware addresses learned in bridge mode
+type MACTable struct {
+	entries    map[string]*macEntry
+	lock       sync.RWMutex
+	advertised time.Time // Last time local addresses were advertised
+}
+
+// Init will initialize MAC table
+func (t *MACTable) Init() {
+	t.entries = make(map[string]*macEntry)
+}
+
+// learn records address as seen behind specified peer. Empty ID
+// means that address was seen on local TAP interface. Returns true
+// if address is new or has been moved
+func (t *MACTable) learn(mac, id string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	entry, exists := t.entries[mac]
+	if exists && entry.ID == id && time.Since(entry.LastSeen) < MACAgingTime {
+		entry.LastSeen = time.Now()
+		return false
+	}
+	t.entries[mac] = &macEntry{ID: id, LastSeen: time.Now()}
+	return true
+}
+
+// lookup returns ID of a peer behind which address was learned
+func (t *MACTable) lookup(mac string) (string, bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	entry, exists := t.entries[mac]
+	if !exists || time.Since(entry.LastSeen) > MACAgingTime {
+		return "", false
+	}
+	return entry.ID, true
+}
+
+// locals returns addresses learned on local TAP interface
+func (t *MACTable) locals() []string {
+	result := []string{}
+	t.lock.RLock()
+	for mac, entry := range t.entries {
+		if entry.ID == "" && time.Since(entry.LastSeen) < MACAgingTime {
+			result = append(result, mac)
+		}
+	}
+	t.lock.RUnlock()
+	return result
+}
+
+// expire removes aged entries
+func (t *MACTable) expire() {
+	t.lock.Lock()
+	for mac, entry := range t.entries {
+		if time.Since(entry.LastSeen) > MACAgingTime {
+			delete(t.entries, mac)
+		}
+	}
+	t.lock.Unlock()
+}
+
+// forget removes every address learned behind specified peer
+func (t *MACTable) forget(id string) {
+	t.lock.Lock()
+	for mac, entry := range t.entries {
+		if entry.ID == id {
+			delete(t.entries, mac)
+		}
+	}
+	t.lock.Unlock()
+}
+
+// Get returns copy of the table in a form of MAC -> Peer ID
+func (t *MACTable) Get() map[string]string {
+	result := make(map[string]string)
+	t.lock.RLock()
+	for mac, entry := range t.entries {
+		result[mac] = entry.ID
+	}
+	t.lock.RUnlock()
+	return result
+}
+
+// markAdvertised remembers time of the last advertisement
+func (t *MACTable) markAdvertised() {
+	t.lock.Lock()
+	t.advertised = time.Now()
+	t.lock.Unlock()
+}
+
+// sinceAdvertised returns time passed since the last advertisement
+func (t *MACTable) sinceAdvertised() time.Duration {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return time.Since(t.advertised)
+}
+
+// learnLocalFrame learns source address of a frame captured on TAP interface
+func (p *PeerToPeer) learnLocalFrame(contents []byte) {
+	if len(contents) < 14 {
+		return
+	}
+	src := net.HardwareAddr(contents[6:12])
+	if isMulticastMAC(src) || bytes.Equal(src, p.Interface.GetHardwareAddress()) {
+		return
+	}
+	if p.MACTable.learn(src.String(), "") {
+		Log(Debug, "Learned local hardware address %s", src.String())
+		go p.advertiseMACs()
+	}
+}
+
+// advertiseMACs sends list of locally learned addresses to every connected peer
+func (p *PeerToPeer) advertiseMACs() {
+	p.MACTable.markAdvertised()
+	locals := p.MACTable.locals()
+	if len(locals) == 0 {
+		return
+	}
+	payload := []byte(p.Dht.ID + strings.Join(locals, ","))
+	msg, err := p.CreateMessage(MsgTypeMacs, payload, 0, true)
+	if err != nil {
+		Log(Error, "Failed to create MAC advertisement: %s", err)
+		return
+	}
+	for _, peer := range p.Peers.Get() {
+		endpoint := peer.GetEndpoint()
+		if peer.GetState() == PeerStateConnected && endpoint != nil {
+			p.sendMessage(msg, endpoint)
+		}
+	}
+}
+
+// checkBridge removes aged addresses and periodically advertises local ones
+func (p *PeerToPeer) checkBridge() {
+	if !p.BridgeMode {
+		return
+	}
+	p.MACTable.expire()
+	if p.MACTable.sinceAdvertised() > MACAdvertiseInterval {
+		p.advertiseMACs()
+	}
+}
+
+// sendBridged sends a frame to the peer behind which destination address
+// was learned. Frames for unknown addresses are flooded to every connected peer
+func (p *PeerToPeer) sendBridged(dst net.HardwareAddr, msg *P2PMessage) (int, error) {
+	id, known := p.MACTable.lookup(dst.String())
+	if known {
+		if id == "" {
+			// Destination is behind our own TAP interface
+			return 0, nil
+		}
+		peer := p.Peers.GetPeer(id)
+		if peer != nil {
+			if endpoint := peer.GetEndpoint(); endpoint != nil {
+				return p.sendMessage(msg, endpoint)
+			}
+		}
+		return 0, nil
+	}
+	sent := 0
+	for _, peer := range p.Peers.Get() {
+		endpoint := peer.GetEndpoint()
+		if peer.GetState() != PeerStateConnected || endpoint == nil {
+			continue
+		}
+		n, err := p.sendMessage(msg, endpoint)
+		if err == nil {
+			sent += n
+		}
+	}
+	return sent, nil
+}
+
+// HandleMacsMessage receives list of hardware addresses learned by another peer
+// First 36 bytes is an ID of a peer followed by comma-separated list of addresses.
+// List is accepted only from an active endpoint of the peer
+func (p *PeerToPeer) HandleMacsMessage(msg *P2PMessage, srcAddr *net.UDPAddr) {
+	if !p.BridgeMode || len(msg.Data) < 36 {
+		return
+	}
+	id := string(msg.Data[0:36])
+	peer := p.Peers.GetPeer(id)
+	if peer == nil {
+		Log(Trace, "Hardware addresses received from unknown peer %s", id)
+		return
+	}
+	if !peer.isEndpointActive(srcAddr) {
+		Log(Debug, "Hardware addresses of %s came from unknown endpoint %s", id, srcAddr.String())
+		return
+	}
+	for _, mac := range strings.Split(string(msg.Data[36:]), ",") {
+		hw, err := net.ParseMAC(mac)
+		if err != nil {
+			continue
+		}
+		if p.MACTable.learn(hw.String(), id) {
+			Log(Debug, "Learned hardware address %s behind peer %s", hw.String(), id)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package ptp
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMACTableLearn(t *testing.T) {
+	table := new(MACTable)
+	table.Init()
+	if !table.learn("06:00:00:00:00:01", "peer1") {
+		t.Error("Error. New address wasn't learned")
+	}
+	if table.learn("06:00:00:00:00:01", "peer1") {
+		t.Error("Error. Known address reported as new")
+	}
+	if !table.learn("06:00:00:00:00:01", "") {
+		t.Error("Error. Moved address wasn't reported")
+	}
+	id, known := table.lookup("06:00:00:00:00:01")
+	if !known || id != "" {
+		t.Errorf("Error. Wait local address, get: %s %v", id, known)
+	}
+	locals := table.locals()
+	if len(locals) != 1 || locals[0] != "06:00:00:00:00:01" {
+		t.Errorf("Error. Wrong list of local addresses: %v", locals)
+	}
+}
+
+func TestMACTableAging(t *testing.T) {
+	table := new(MACTable)
+	table.Init()
+	table.learn("06:00:00:00:00:02", "peer2")
+	table.entries["06:00:00:00:00:02"].LastSeen = time.Now().Add(-MACAgingTime * 2)
+	if _, known := table.lookup("06:00:00:00:00:02"); known {
+		t.Error("Error. Aged address was resolved")
+	}
+	table.expire()
+	if len(table.Get()) != 0 {
+		t.Error("Error. Aged address wasn't removed")
+	}
+}
+
+func TestMACTableForget(t *testing.T) {
+	table := new(MACTable)
+	table.Init()
+	table.learn("06:00:00:00:00:03", "peer3")
+	table.learn("06:00:00:00:00:04", "peer4")
+	table.forget("peer3")
+	if _, known := table.lookup("06:00:00:00:00:03"); known {
+		t.Error("Error. Address of removed peer was resolved")
+	}
+	if _, known := table.lookup("06:00:00:00:00:04"); !known {
+		t.Error("Error. Address of another peer was removed")
+	}
+}
+
+func TestHandleMacsMessage(t *testing.T) {
+	ptpc := new(PeerToPeer)
+	ptpc.BridgeMode = true
+	ptpc.MACTable = new(MACTable)
+	ptpc.MACTable.Init()
+	ptpc.Peers = new(PeerList)
+	ptpc.Peers.Init()
+	addr, _ := net.ResolveUDPAddr("udp4", "192.168.1.2:6881")
+	np := &NetworkPeer{ID: fmt.Sprintf("%036d", 1)}
+	np.addEndpoint(addr)
+	ptpc.Peers.Update(np.ID, np)
+	msg, _ := CreateMessageStatic(MsgTypeMacs, []byte(np.ID+"06:00:00:00:00:05"))
+
+	other, _ := net.ResolveUDPAddr("udp4", "203.0.113.5:6881")
+	ptpc.HandleMacsMessage(msg, other)
+	if _, known := ptpc.MACTable.lookup("06:00:00:00:00:05"); known {
+		t.Error("Error. Address was learned from foreign endpoint")
+	}
+	ptpc.HandleMacsMessage(msg, addr)
+	if id, known := ptpc.MACTable.lookup("06:00:00:00:00:05"); !known || id != np.ID {
+		t.Errorf("Error. Address of the peer wasn't learned: %s", id)
+	}
+}
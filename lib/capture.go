@@ -0,0 +1,340 @@
+package ptp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Capture records overlay traffic of an instance into a pcapng file.
+// Decrypted frames are written as Ethernet (or raw IP in TUN mode) and
+// outer P2P messages are written with a user link type. Every packet is
+// annotated with direction, peer ID and endpoint in the packet comment
+
+// pcapng block types
+const (
+	pcapngSectionHeader  uint32 = 0x0a0d0d0a
+	pcapngInterfaceDesc  uint32 = 0x00000001
+	pcapngEnhancedPacket uint32 = 0x00000006
+	pcapngByteOrderMagic uint32 = 0x1a2b3c4d
+	pcapngSnapLength     uint32 = 65535
+)
+
+// pcapng options
+const (
+	pcapngOptionComment uint16 = 1
+	pcapngOptionIfName  uint16 = 2
+)
+
+// Link types of capture interfaces
+const (
+	LinkTypeEthernet uint16 = 1
+	LinkTypeRaw      uint16 = 101
+	LinkTypeUser0    uint16 = 147 // Used for outer P2P messages
+)
+
+// Interfaces are added to every capture file in this order
+const (
+	captureInterfaceFrames uint32 = 0
+	captureInterfaceIP     uint32 = 1
+	captureInterfaceP2P    uint32 = 2
+)
+
+// Capture directions
+const (
+	captureDirectionIn  = "in"
+	captureDirectionOut = "out"
+)
+
+// PcapngWriter writes packets in pcapng format
+type PcapngWriter struct {
+	w io.Writer
+}
+
+// NewPcapngWriter writes section header and returns new writer
+func NewPcapngWriter(w io.Writer) (*PcapngWriter, error) {
+	pw := &PcapngWriter{w: w}
+	body := make([]byte, 16)
+	binary.LittleEndian.PutUint32(body[0:4], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(body[4:6], 1) // Major version
+	binary.LittleEndian.PutUint16(body[6:8], 0) // Minor version
+	// Section length is not specified
+	binary.LittleEndian.PutUint64(body[8:16], 0xffffffffffffffff)
+	return pw, pw.writeBlock(pcapngSectionHeader, body)
+}
+
+// AddInterface writes interface description block. Interfaces
+// are numbered in order of their addition starting from 0
+func (pw *PcapngWriter) AddInterface(linkType uint16, name string) error {
+	body := make([]byte, 8)
+	binary.LittleEndian.PutUint16(body[0:2], linkType)
+	binary.LittleEndian.PutUint32(body[4:8], pcapngSnapLength)
+	body = append(body, pcapngOptions(pcapngOptionIfName, name)...)
+	return pw.writeBlock(pcapngInterfaceDesc, body)
+}
+
+// WritePacket writes enhanced packet block with optional comment.
+// Timestamps are stored in microseconds
+func (pw *PcapngWriter) WritePacket(iface uint32, ts time.Time, data []byte, comment string) error {
+	if uint32(len(data)) > pcapngSnapLength {
+		data = data[:pcapngSnapLength]
+	}
+	micros := uint64(ts.UnixNano() / 1000)
+	body := make([]byte, 20)
+	binary.LittleEndian.PutUint32(body[0:4], iface)
+	binary.LittleEndian.PutUint32(body[4:8], uint32(micros>>32))
+	binary.LittleEndian.PutUint32(body[8:12], uint32(micros))
+	binary.LittleEndian.PutUint32(body[12:16], uint32(len(data)))
+	binary.LittleEndian.PutUint32(body[16:20], uint32(len(data)))
+	body = append(body, pad32(data)...)
+	if comment != "" {
+		body = append(body, pcapngOptions(pcapngOptionComment, comment)...)
+	}
+	return pw.writeBlock(pcapngEnhancedPacket, body)
+}
+
+func (pw *PcapngWriter) writeBlock(blockType uint32, body []byte) error {
+	length := uint32(12 + len(body))
+	block := make([]byte, 0, length)
+	block = appendUint32(block, blockType)
+	block = appendUint32(block, length)
+	block = append(block, body...)
+	block = appendUint32(block, length)
+	_, err := pw.w.Write(block)
+	return err
+}
+
+// pcapngOptions encodes a single string option followed by end of options
+func pcapngOptions(code uint16, value string) []byte {
+	option := make([]byte, 4)
+	binary.LittleEndian.PutUint16(option[0:2], code)
+	binary.LittleEndian.PutUint16(option[2:4], uint16(len(value)))
+	option = append(option, pad32([]byte(value))...)
+	return append(option, 0, 0, 0, 0) // opt_endofopt
+}
+
+func pad32(data []byte) []byte {
+	padded := make([]byte, (len(data)+3)&^3)
+	copy(padded, data)
+	return padded
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buf, v)
+	return append(b, buf...)
+}
+
+// Capture is an active capture session of an instance
+type Capture struct {
+	Path    string    // Path to the output file
+	Peer    string    // Only traffic of this peer is recorded if not empty
+	Outer   bool      // Whether outer P2P messages are recorded
+	Started time.Time // Time when capture has been started
+	Frames  uint64    // Number of recorded overlay frames
+	Packets uint64    // Number of recorded P2P messages
+	file    *os.File
+	writer  *PcapngWriter
+	lock    sync.Mutex
+}
+
+// createCaptureFile creates new capture file with specified name in the
+// capture directory. Name can't point outside of the directory and
+// existing files are never overwritten
+func createCaptureFile(dir, name string) (*os.File, error) {
+	if name == "" || name != filepath.Base(name) || name == "." || name == ".." {
+		return nil, fmt.Errorf("Bad capture file name: %s. Only a file name is accepted, file is created in %s", name, dir)
+	}
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create capture directory: %s", err)
+	}
+	file, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create capture file: %s", err)
+	}
+	return file, nil
+}
+
+// StartCapture begins recording of overlay traffic into a new file with
+// specified name inside of the CaptureDir
+func (p *PeerToPeer) StartCapture(name, peer string, outer bool) error {
+	p.captureLock.Lock()
+	defer p.captureLock.Unlock()
+	if p.capture != nil {
+		return fmt.Errorf("Capture is already running into %s", p.capture.Path)
+	}
+	file, err := createCaptureFile(CaptureDir, name)
+	if err != nil {
+		return err
+	}
+	path := file.Name()
+	writer, err := NewPcapngWriter(file)
+	if err == nil {
+		err = writer.AddInterface(LinkTypeEthernet, p.Interface.GetName())
+	}
+	if err == nil {
+		err = writer.AddInterface(LinkTypeRaw, p.Interface.GetName())
+	}
+	if err == nil {
+		err = writer.AddInterface(LinkTypeUser0, "p2p")
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(path)
+		return fmt.Errorf("Failed to write capture file: %s", err)
+	}
+	p.capture = &Capture{
+		Path:    path,
+		Peer:    peer,
+		Outer:   outer,
+		Started: time.Now(),
+		file:    file,
+		writer:  writer,
+	}
+	Log(Info, "Started capture of %s into %s", p.Dht.NetworkHash, path)
+	return nil
+}
+
+// StopCapture finishes recording and returns finished session
+func (p *PeerToPeer) StopCapture() (*Capture, error) {
+	p.captureLock.Lock()
+	defer p.captureLock.Unlock()
+	if p.capture == nil {
+		return nil, fmt.Errorf("Capture is not running")
+	}
+	c := p.capture
+	p.capture = nil
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.writer = nil
+	err := c.file.Close()
+	Log(Info, "Stopped capture into %s: %d frames, %d messages", c.Path, c.Frames, c.Packets)
+	return c, err
+}
+
+// ActiveCapture returns running capture session or nil
+func (p *PeerToPeer) ActiveCapture() *Capture {
+	p.captureLock.RLock()
+	defer p.captureLock.RUnlock()
+	return p.capture
+}
+
+// Stats returns number of recorded frames and P2P messages
+func (c *Capture) Stats() (uint64, uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.Frames, c.Packets
+}
+
+// write stores packet in the capture file
+func (c *Capture) write(iface uint32, data []byte, comment string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.writer == nil {
+		return
+	}
+	err := c.writer.WritePacket(iface, time.Now(), data, comment)
+	if err != nil {
+		Log(Error, "Failed to write capture: %s", err)
+		c.writer = nil
+		return
+	}
+	if iface == captureInterfaceP2P {
+		c.Packets++
+	} else {
+		c.Frames++
+	}
+}
+
+// captureFrame records decrypted overlay frame
+func (p *PeerToPeer) captureFrame(direction, peer string, endpoint *net.UDPAddr, data []byte, raw bool) {
+	c := p.ActiveCapture()
+	if c == nil || (c.Peer != "" && c.Peer != peer) {
+		return
+	}
+	iface := captureInterfaceFrames
+	if raw {
+		iface = captureInterfaceIP
+	}
+	c.write(iface, data, captureComment(direction, peer, endpoint, ""))
+}
+
+// captureLocal records frame or packet read from local interface
+func (p *PeerToPeer) captureLocal(data []byte) {
+	if p.ActiveCapture() == nil {
+		return
+	}
+	peer := ""
+	if p.Interface.GetMode() == InterfaceTUN {
+		if len(data) >= 20 {
+			peer, _ = p.Peers.GetID(net.IP(data[16:20]).String())
+		}
+		p.captureFrame(captureDirectionOut, peer, nil, data, true)
+		return
+	}
+	if len(data) >= 14 {
+		peer, _ = p.Peers.GetIDByMac(net.HardwareAddr(data[0:6]).String())
+	}
+	p.captureFrame(captureDirectionOut, peer, nil, data, false)
+}
+
+// captureMessage records outer P2P message received from the network
+func (p *PeerToPeer) captureMessage(data []byte, msgType uint16, srcAddr *net.UDPAddr) {
+	p.captureOuter(captureDirectionIn, data, msgType, srcAddr)
+}
+
+// captureSent records outer P2P message sent to the network
+func (p *PeerToPeer) captureSent(msg *P2PMessage, dstAddr *net.UDPAddr) {
+	c := p.ActiveCapture()
+	if c == nil || !c.Outer || msg == nil {
+		return
+	}
+	p.captureOuter(captureDirectionOut, msg.Serialize(), msg.Header.Type, dstAddr)
+}
+
+func (p *PeerToPeer) captureOuter(direction string, data []byte, msgType uint16, addr *net.UDPAddr) {
+	c := p.ActiveCapture()
+	if c == nil || !c.Outer {
+		return
+	}
+	peer := p.peerByEndpoint(addr)
+	if c.Peer != "" && c.Peer != peer {
+		return
+	}
+	c.write(captureInterfaceP2P, data, captureComment(direction, peer, addr, fmt.Sprintf("type=%d", msgType)))
+}
+
+func captureComment(direction, peer string, endpoint *net.UDPAddr, extra string) string {
+	var comment bytes.Buffer
+	comment.WriteString("dir=" + direction)
+	if peer != "" {
+		comment.WriteString(" peer=" + peer)
+	}
+	if endpoint != nil {
+		comment.WriteString(" endpoint=" + endpoint.String())
+	}
+	if extra != "" {
+		comment.WriteString(" " + extra)
+	}
+	return comment.String()
+}
+
+// peerByEndpoint returns ID of a peer communicating over specified endpoint
+func (p *PeerToPeer) peerByEndpoint(addr *net.UDPAddr) string {
+	if addr == nil {
+		return ""
+	}
+	for id, peer := range p.Peers.Get() {
+		if endpoint := peer.GetEndpoint(); endpoint != nil && endpoint.String() == addr.String() {
+			return id
+		}
+	}
+	return ""
+}
@@ -0,0 +1,118 @@
+package ptp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// readBlocks splits pcapng stream into blocks and validates lengths
+func readBlocks(t *testing.T, data []byte) [][]byte {
+	blocks := [][]byte{}
+	for len(data) > 0 {
+		if len(data) < 12 {
+			t.Fatalf("Truncated block")
+		}
+		length := binary.LittleEndian.Uint32(data[4:8])
+		if length%4 != 0 || int(length) > len(data) {
+			t.Fatalf("Bad block length: %d", length)
+		}
+		if binary.LittleEndian.Uint32(data[length-4:length]) != length {
+			t.Fatalf("Trailing block length doesn't match")
+		}
+		blocks = append(blocks, data[:length])
+		data = data[length:]
+	}
+	return blocks
+}
+
+func TestPcapngWriter(t *testing.T) {
+	var buf bytes.Buffer
+	pw, err := NewPcapngWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pw.AddInterface(LinkTypeEthernet, "vptp1")
+	ts := time.Unix(1500000000, 123456000)
+	pw.WritePacket(0, ts, []byte{1, 2, 3, 4, 5}, "dir=in peer=test")
+	pw.WritePacket(0, ts, []byte{1, 2, 3, 4}, "")
+
+	blocks := readBlocks(t, buf.Bytes())
+	if len(blocks) != 4 {
+		t.Fatalf("Wrong number of blocks: %d", len(blocks))
+	}
+	if binary.LittleEndian.Uint32(blocks[0][0:4]) != pcapngSectionHeader || binary.LittleEndian.Uint32(blocks[0][8:12]) != pcapngByteOrderMagic {
+		t.Error("Bad section header")
+	}
+	if binary.LittleEndian.Uint32(blocks[1][0:4]) != pcapngInterfaceDesc || binary.LittleEndian.Uint16(blocks[1][8:10]) != LinkTypeEthernet {
+		t.Error("Bad interface description")
+	}
+	epb := blocks[2]
+	if binary.LittleEndian.Uint32(epb[0:4]) != pcapngEnhancedPacket {
+		t.Fatal("Bad packet block type")
+	}
+	micros := uint64(binary.LittleEndian.Uint32(epb[12:16]))<<32 | uint64(binary.LittleEndian.Uint32(epb[16:20]))
+	if micros != 1500000000123456 {
+		t.Errorf("Wrong timestamp: %d", micros)
+	}
+	if binary.LittleEndian.Uint32(epb[20:24]) != 5 || !bytes.Equal(epb[28:33], []byte{1, 2, 3, 4, 5}) {
+		t.Error("Wrong packet data")
+	}
+	if !bytes.Contains(epb, []byte("dir=in peer=test")) {
+		t.Error("Comment was not written")
+	}
+	if len(blocks[3]) != 12+20+4 {
+		t.Errorf("Packet without comment has wrong length: %d", len(blocks[3]))
+	}
+}
+
+func TestCaptureComment(t *testing.T) {
+	comment := captureComment(captureDirectionIn, "peer", nil, "type=3")
+	if comment != "dir=in peer=peer type=3" {
+		t.Errorf("Wrong comment: %s", comment)
+	}
+}
+
+func TestCreateCaptureFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"", ".", "..", "../escape.pcapng", "/etc/passwd", "sub/file.pcapng"} {
+		if file, err := createCaptureFile(dir, name); err == nil {
+			file.Close()
+			t.Errorf("Capture file with bad name was created: %s", name)
+		}
+	}
+	file, err := createCaptureFile(dir, "test.pcapng")
+	if err != nil {
+		t.Fatalf("Failed to create capture file: %s", err)
+	}
+	file.Close()
+	if file.Name() != filepath.Join(dir, "test.pcapng") {
+		t.Errorf("Capture file was created outside of directory: %s", file.Name())
+	}
+	if _, err := createCaptureFile(dir, "test.pcapng"); err == nil {
+		t.Errorf("Existing capture file was overwritten")
+	}
+}
+
+func TestCaptureSent(t *testing.T) {
+	var buf bytes.Buffer
+	writer, _ := NewPcapngWriter(&buf)
+	ptpc := new(PeerToPeer)
+	ptpc.capture = &Capture{Outer: true, writer: writer}
+	msg, _ := CreateMessageStatic(MsgTypeNenc, []byte("payload"))
+	ptpc.captureSent(msg, nil)
+	if _, packets := ptpc.capture.Stats(); packets != 1 {
+		t.Fatalf("Sent message wasn't recorded")
+	}
+	if !bytes.Contains(buf.Bytes(), []byte("dir=out type=")) {
+		t.Errorf("Sent message has wrong direction")
+	}
+}
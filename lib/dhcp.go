@@ -0,0 +1,575 @@
+package ptp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mdlayher/ethernet"
+)
+
+// DHCP server hands out addresses to hosts bridged onto the TAP interface.
+// Requests are intercepted in the frame path before they're flooded to
+// peers, and replies are written back into the interface. Addresses used
+// by peers of the swarm are never offered.
+//
+// Servers announce their pools in introduction. When pools of connected
+// peers overlap, only the server of the peer with the lowest ID answers:
+// others forward requests to it over the overlay and it sends replies back
+// to the forwarding peer, so the same address is never handed out twice.
+// Servers with separate pools work independently
+
+// DHCP server parameters
+const (
+	DHCPLeaseTime     = time.Hour
+	DHCPOfferTimeout  = time.Second * 30 // Offered address is reserved during this period
+	DHCPDeclinePeriod = time.Minute * 10 // Declined address is not offered during this period
+	dhcpServerPort    = 67
+	dhcpClientPort    = 68
+	dhcpMagicCookie   = 0x63825363
+	dhcpMinLength     = 240
+)
+
+// DHCP message types
+const (
+	dhcpDiscover = 1
+	dhcpOffer    = 2
+	dhcpRequest  = 3
+	dhcpDecline  = 4
+	dhcpAck      = 5
+	dhcpNak      = 6
+	dhcpRelease  = 7
+	dhcpInform   = 8
+)
+
+// DHCP options
+const (
+	dhcpOptSubnetMask     = 1
+	dhcpOptDNS            = 6
+	dhcpOptHostname       = 12
+	dhcpOptRequestedIP    = 50
+	dhcpOptLeaseTime      = 51
+	dhcpOptMessageType    = 53
+	dhcpOptServerID       = 54
+	dhcpOptClasslessRoute = 121
+	dhcpOptEnd            = 255
+	dhcpOptPad            = 0
+)
+
+// DHCPLease is an address assigned to a host
+type DHCPLease struct {
+	MAC      string    `json:"mac"`
+	IP       string    `json:"ip"`
+	Hostname string    `json:"hostname"`
+	Expires  time.Time `json:"expires"`
+	Bound    bool      `json:"bound"` // False for addresses that were offered but not requested yet
+}
+
+// DHCPServer allocates addresses from a pool
+type DHCPServer struct {
+	Start    net.IP
+	End      net.IP
+	leases   map[string]*DHCPLease // MAC -> Lease
+	declined map[string]time.Time  // IP -> Time of decline
+	lock     sync.Mutex
+}
+
+type dhcpMessage struct {
+	Op       byte
+	XID      []byte
+	Flags    uint16
+	CIAddr   net.IP
+	GIAddr   net.IP
+	CHAddr   net.HardwareAddr
+	Options  map[byte][]byte
+	Type     byte
+	raw      []byte
+	clientIP net.IP // Source IP of the packet
+}
+
+// ParseDHCPPool parses range of addresses in format start-end
+func ParseDHCPPool(pool string) (net.IP, net.IP, error) {
+	parts := strings.Split(pool, "-")
+	if len(parts) != 2 {
+		return nil, nil, fmt.Errorf("DHCP pool must be specified as start-end")
+	}
+	start := net.ParseIP(strings.TrimSpace(parts[0])).To4()
+	end := net.ParseIP(strings.TrimSpace(parts[1])).To4()
+	if start == nil || end == nil {
+		return nil, nil, fmt.Errorf("Bad DHCP pool: %s", pool)
+	}
+	if binary.BigEndian.Uint32(start) > binary.BigEndian.Uint32(end) {
+		return nil, nil, fmt.Errorf("DHCP pool start is greater than end: %s", pool)
+	}
+	return start, end, nil
+}
+
+// StartDHCP enables DHCP server with specified pool. Pool must be
+// within the network of the instance
+func (p *PeerToPeer) StartDHCP(pool string) error {
+	start, end, err := ParseDHCPPool(pool)
+	if err != nil {
+		return err
+	}
+	if p.Dht.Network != nil && (!p.Dht.Network.Contains(start) || !p.Dht.Network.Contains(end)) {
+		return fmt.Errorf("DHCP pool %s is outside of network %s", pool, p.Dht.Network.String())
+	}
+	p.DHCP = &DHCPServer{
+		Start:    start,
+		End:      end,
+		leases:   make(map[string]*DHCPLease),
+		declined: make(map[string]time.Time),
+	}
+	Log(Info, "DHCP server is serving %s", pool)
+	return nil
+}
+
+// Pool returns range of served addresses in format start-end
+func (s *DHCPServer) Pool() string {
+	return s.Start.String() + "-" + s.End.String()
+}
+
+// overlaps returns true if pool in format start-end shares addresses with the pool of the server
+func (s *DHCPServer) overlaps(pool string) bool {
+	start, end, err := ParseDHCPPool(pool)
+	if err != nil {
+		return false
+	}
+	return binary.BigEndian.Uint32(start) <= binary.BigEndian.Uint32(s.End) && binary.BigEndian.Uint32(end) >= binary.BigEndian.Uint32(s.Start)
+}
+
+// dhcpOwner returns ID of a connected peer which DHCP server takes
+// precedence over ours, or empty string if this instance should answer
+func (p *PeerToPeer) dhcpOwner() string {
+	owner := ""
+	for id, peer := range p.Peers.Get() {
+		if id > p.Dht.ID || peer.GetState() != PeerStateConnected {
+			continue
+		}
+		if pool := peer.GetDHCPPool(); pool != "" && p.DHCP.overlaps(pool) && (owner == "" || id < owner) {
+			owner = id
+		}
+	}
+	return owner
+}
+
+// Leases returns copy of active leases sorted by IP
+func (s *DHCPServer) Leases() []DHCPLease {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	result := []DHCPLease{}
+	for _, lease := range s.leases {
+		if time.Now().Before(lease.Expires) {
+			result = append(result, *lease)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return bytes.Compare(net.ParseIP(result[i].IP).To4(), net.ParseIP(result[j].IP).To4()) < 0
+	})
+	return result
+}
+
+// inPool returns true if address belongs to the pool
+func (s *DHCPServer) inPool(ip net.IP) bool {
+	ip = ip.To4()
+	if ip == nil {
+		return false
+	}
+	v := binary.BigEndian.Uint32(ip)
+	return v >= binary.BigEndian.Uint32(s.Start) && v <= binary.BigEndian.Uint32(s.End)
+}
+
+// available checks that address is not leased to another host, declined
+// or used by someone in the swarm. Must be called under lock
+func (s *DHCPServer) available(ip net.IP, mac string, used func(net.IP) bool) bool {
+	if !s.inPool(ip) || used(ip) {
+		return false
+	}
+	if declined, exists := s.declined[ip.String()]; exists && time.Since(declined) < DHCPDeclinePeriod {
+		return false
+	}
+	for owner, lease := range s.leases {
+		if lease.IP == ip.String() && owner != mac && time.Now().Before(lease.Expires) {
+			return false
+		}
+	}
+	return true
+}
+
+// allocate picks an address for a host. Previous lease and requested
+// address are preferred. Must be called under lock
+func (s *DHCPServer) allocate(mac string, requested net.IP, used func(net.IP) bool) net.IP {
+	if lease, exists := s.leases[mac]; exists {
+		ip := net.ParseIP(lease.IP)
+		if s.available(ip, mac, used) {
+			return ip.To4()
+		}
+	}
+	if requested != nil && s.available(requested, mac, used) {
+		return requested.To4()
+	}
+	for v := binary.BigEndian.Uint32(s.Start); v <= binary.BigEndian.Uint32(s.End); v++ {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, v)
+		if s.available(ip, mac, used) {
+			return ip
+		}
+		if v == 0xffffffff {
+			break
+		}
+	}
+	return nil
+}
+
+// handle processes a DHCP message and returns reply type and assigned
+// address. Zero type means that no reply should be sent
+func (s *DHCPServer) handle(msg *dhcpMessage, serverID net.IP, used func(net.IP) bool) (byte, net.IP) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	mac := msg.CHAddr.String()
+	requested := net.IP(msg.Options[dhcpOptRequestedIP])
+	if len(requested) != 4 {
+		requested = nil
+	}
+	switch msg.Type {
+	case dhcpDiscover:
+		ip := s.allocate(mac, requested, used)
+		if ip == nil {
+			Log(Warning, "DHCP pool is exhausted")
+			return 0, nil
+		}
+		lease, exists := s.leases[mac]
+		if !exists || !lease.Bound || lease.IP != ip.String() {
+			s.leases[mac] = &DHCPLease{MAC: mac, IP: ip.String(), Expires: time.Now().Add(DHCPOfferTimeout)}
+		}
+		return dhcpOffer, ip
+	case dhcpRequest:
+		if id := msg.Options[dhcpOptServerID]; id != nil && !net.IP(id).Equal(serverID) {
+			// Client has chosen another server
+			if lease, exists := s.leases[mac]; exists && !lease.Bound {
+				delete(s.leases, mac)
+			}
+			return 0, nil
+		}
+		if requested == nil && !msg.CIAddr.Equal(net.IPv4zero) {
+			requested = msg.CIAddr
+		}
+		if requested == nil || !s.available(requested, mac, used) {
+			return dhcpNak, nil
+		}
+		s.leases[mac] = &DHCPLease{
+			MAC:      mac,
+			IP:       requested.String(),
+			Hostname: string(msg.Options[dhcpOptHostname]),
+			Expires:  time.Now().Add(DHCPLeaseTime),
+			Bound:    true,
+		}
+		Log(Info, "DHCP leased %s to %s", requested.String(), mac)
+		return dhcpAck, requested.To4()
+	case dhcpDecline:
+		if requested != nil {
+			Log(Warning, "DHCP address %s was declined by %s", requested.String(), mac)
+			s.declined[requested.String()] = time.Now()
+		}
+		delete(s.leases, mac)
+	case dhcpRelease:
+		if lease, exists := s.leases[mac]; exists && lease.IP == msg.CIAddr.String() {
+			delete(s.leases, mac)
+		}
+	case dhcpInform:
+		return dhcpAck, nil
+	}
+	return 0, nil
+}
+
+// parseDHCPMessage parses BOOTP message with DHCP options
+func parseDHCPMessage(b []byte) (*dhcpMessage, error) {
+	if len(b) < dhcpMinLength {
+		return nil, fmt.Errorf("DHCP message is too short")
+	}
+	if binary.BigEndian.Uint32(b[236:240]) != dhcpMagicCookie {
+		return nil, fmt.Errorf("Bad DHCP magic cookie")
+	}
+	if b[1] != 1 || b[2] != 6 {
+		return nil, fmt.Errorf("Unsupported hardware type")
+	}
+	msg := &dhcpMessage{
+		Op:      b[0],
+		XID:     b[4:8],
+		Flags:   binary.BigEndian.Uint16(b[10:12]),
+		CIAddr:  net.IP(b[12:16]),
+		GIAddr:  net.IP(b[24:28]),
+		CHAddr:  net.HardwareAddr(b[28:34]),
+		Options: make(map[byte][]byte),
+		raw:     b,
+	}
+	n := dhcpMinLength
+	for n < len(b) {
+		code := b[n]
+		if code == dhcpOptEnd {
+			break
+		}
+		if code == dhcpOptPad {
+			n++
+			continue
+		}
+		if n+2 > len(b) || n+2+int(b[n+1]) > len(b) {
+			return nil, fmt.Errorf("Truncated DHCP option %d", code)
+		}
+		msg.Options[code] = b[n+2 : n+2+int(b[n+1])]
+		n += 2 + int(b[n+1])
+	}
+	if t := msg.Options[dhcpOptMessageType]; len(t) == 1 {
+		msg.Type = t[0]
+	}
+	if msg.Op != 1 || msg.Type == 0 {
+		return nil, fmt.Errorf("Not a DHCP request")
+	}
+	return msg, nil
+}
+
+// buildDHCPReply creates BOOTP reply with specified options
+func buildDHCPReply(msg *dhcpMessage, replyType byte, yiaddr, serverID net.IP, options [][]byte) []byte {
+	b := make([]byte, dhcpMinLength)
+	b[0] = 2 // BOOTREPLY
+	b[1] = 1
+	b[2] = 6
+	copy(b[4:8], msg.XID)
+	binary.BigEndian.PutUint16(b[10:12], msg.Flags)
+	if replyType == dhcpAck && yiaddr == nil {
+		copy(b[12:16], msg.CIAddr) // Reply to DHCPINFORM
+	}
+	if yiaddr != nil {
+		copy(b[16:20], yiaddr.To4())
+	}
+	copy(b[20:24], serverID.To4())
+	copy(b[24:28], msg.GIAddr)
+	copy(b[28:34], msg.CHAddr)
+	binary.BigEndian.PutUint32(b[236:240], dhcpMagicCookie)
+	b = append(b, dhcpOptMessageType, 1, replyType)
+	b = append(b, dhcpOptServerID, 4)
+	b = append(b, serverID.To4()...)
+	for _, option := range options {
+		b = append(b, option...)
+	}
+	return append(b, dhcpOptEnd)
+}
+
+func dhcpOption(code byte, value []byte) []byte {
+	return append([]byte{code, byte(len(value))}, value...)
+}
+
+// classlessRoutes encodes networks for option 121 (RFC 3442)
+func classlessRoutes(networks []*net.IPNet, gateways []net.IP) []byte {
+	result := []byte{}
+	for i, network := range networks {
+		ones, bits := network.Mask.Size()
+		if bits != 32 {
+			continue
+		}
+		result = append(result, byte(ones))
+		result = append(result, network.IP.To4()[:(ones+7)/8]...)
+		result = append(result, gateways[i].To4()...)
+	}
+	return result
+}
+
+// handleDHCP answers DHCP request captured on TAP interface or forwarded
+// by a peer with specified ID. Request is forwarded to the server of the
+// owner peer when pools overlap. Returns true if frame was consumed
+func (p *PeerToPeer) handleDHCP(f *ethernet.Frame, from string) bool {
+	if p.DHCP == nil || len(f.Payload) < 28 || f.Payload[9] != protoUDP {
+		return false
+	}
+	ihl := int(f.Payload[0]&0x0f) * 4
+	if len(f.Payload) < ihl+8 || binary.BigEndian.Uint16(f.Payload[ihl+2:ihl+4]) != dhcpServerPort {
+		return false
+	}
+	if from != "" {
+		// Only requests of peers that defer to our server are answered
+		peer := p.Peers.GetPeer(from)
+		if peer == nil || !p.DHCP.overlaps(peer.GetDHCPPool()) {
+			return false
+		}
+	}
+	if owner := p.dhcpOwner(); owner != "" {
+		if from != "" {
+			return false
+		}
+		Log(Trace, "DHCP request is forwarded to the server of %s", owner)
+		return p.forwardDHCP(owner, f)
+	}
+	msg, err := parseDHCPMessage(f.Payload[ihl+8:])
+	if err != nil {
+		Log(Debug, "Failed to parse DHCP message: %s", err)
+		return true
+	}
+	msg.clientIP = net.IP(f.Payload[12:16])
+	serverID := p.Interface.GetIP().To4()
+	replyType, yiaddr := p.DHCP.handle(msg, serverID, p.isAddressUsed)
+	if replyType == 0 {
+		return true
+	}
+	options := [][]byte{}
+	if replyType != dhcpNak {
+		mask := p.Interface.GetMask()
+		if len(mask) == 0 && p.Dht.Network != nil {
+			mask = p.Dht.Network.Mask
+		}
+		if len(mask) == 16 {
+			mask = mask[12:]
+		}
+		if len(mask) == 4 {
+			options = append(options, dhcpOption(dhcpOptSubnetMask, mask))
+		}
+		if yiaddr != nil {
+			lease := make([]byte, 4)
+			binary.BigEndian.PutUint32(lease, uint32(DHCPLeaseTime/time.Second))
+			options = append(options, dhcpOption(dhcpOptLeaseTime, lease))
+		}
+		if p.DNS != nil {
+			options = append(options, dhcpOption(dhcpOptDNS, serverID))
+		}
+		networks, gateways := p.dhcpRoutes()
+		if len(networks) > 0 {
+			options = append(options, dhcpOption(dhcpOptClasslessRoute, classlessRoutes(networks, gateways)))
+		}
+	}
+	reply := buildDHCPReply(msg, replyType, yiaddr, serverID, options)
+	p.writeDHCPReply(msg, yiaddr, serverID, reply, from)
+	return true
+}
+
+// handlePeerDHCP answers DHCP request received from a peer.
+// Returns true if frame was consumed by DHCP server
+func (p *PeerToPeer) handlePeerDHCP(frame []byte, from string) bool {
+	if p.DHCP == nil {
+		return false
+	}
+	f := new(ethernet.Frame)
+	if err := f.UnmarshalBinary(frame); err != nil || f.EtherType != ethernet.EtherTypeIPv4 {
+		return false
+	}
+	return p.handleDHCP(f, from)
+}
+
+// forwardDHCP sends DHCP request to the peer which server answers it
+func (p *PeerToPeer) forwardDHCP(owner string, f *ethernet.Frame) bool {
+	frame, err := f.MarshalBinary()
+	if err != nil {
+		return false
+	}
+	return p.sendFrame(owner, frame)
+}
+
+// sendFrame sends Ethernet frame to the peer over its current endpoint
+func (p *PeerToPeer) sendFrame(id string, frame []byte) bool {
+	peer := p.Peers.GetPeer(id)
+	if peer == nil || peer.GetEndpoint() == nil {
+		return false
+	}
+	msg, err := p.CreateMessage(MsgTypeNenc, frame, uint16(PacketIPv4), true)
+	if err != nil || msg == nil {
+		return false
+	}
+	_, err = p.sendMessage(msg, peer.GetEndpoint())
+	return err == nil
+}
+
+// dhcpRoutes returns networks advertised by peers along with
+// overlay IPs of these peers
+func (p *PeerToPeer) dhcpRoutes() ([]*net.IPNet, []net.IP) {
+	networks := []*net.IPNet{}
+	gateways := []net.IP{}
+	for cidr, id := range p.RouteTable.Get() {
+		peer := p.Peers.GetPeer(id)
+		if peer == nil {
+			continue
+		}
+		gateway := peer.GetIP()
+		if gateway == nil {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			continue
+		}
+		networks = append(networks, network)
+		gateways = append(gateways, gateway)
+	}
+	return networks, gateways
+}
+
+// isAddressUsed returns true if address belongs to this instance or any peer
+func (p *PeerToPeer) isAddressUsed(ip net.IP) bool {
+	if ip.Equal(p.Interface.GetIP()) {
+		return true
+	}
+	if p.Dht.Network != nil {
+		// Network and broadcast addresses
+		network := p.Dht.Network.IP.To4()
+		broadcast := make(net.IP, 4)
+		for i := range network {
+			broadcast[i] = network[i] | ^p.Dht.Network.Mask[len(p.Dht.Network.Mask)-4+i]
+		}
+		if ip.Equal(network) || ip.Equal(broadcast) {
+			return true
+		}
+	}
+	_, err := p.Peers.GetID(ip.String())
+	return err == nil
+}
+
+// writeDHCPReply wraps DHCP reply into UDP, IPv4 and Ethernet headers
+// and writes it into TAP interface, or sends it to the peer which
+// forwarded the request
+func (p *PeerToPeer) writeDHCPReply(msg *dhcpMessage, yiaddr, serverID net.IP, reply []byte, to string) {
+	dstIP := net.IPv4bcast.To4()
+	dstHW := net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	if msg.Flags&0x8000 == 0 && yiaddr != nil {
+		dstIP = yiaddr.To4()
+		dstHW = msg.CHAddr
+	} else if msg.Flags&0x8000 == 0 && !msg.clientIP.Equal(net.IPv4zero) {
+		dstIP = msg.clientIP.To4()
+		dstHW = msg.CHAddr
+	}
+	udp := make([]byte, 8+len(reply))
+	binary.BigEndian.PutUint16(udp[0:2], dhcpServerPort)
+	binary.BigEndian.PutUint16(udp[2:4], dhcpClientPort)
+	binary.BigEndian.PutUint16(udp[4:6], uint16(len(udp)))
+	copy(udp[8:], reply)
+
+	ip := make([]byte, 20+len(udp))
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:4], uint16(len(ip)))
+	ip[8] = 64
+	ip[9] = protoUDP
+	copy(ip[12:16], serverID)
+	copy(ip[16:20], dstIP)
+	binary.BigEndian.PutUint16(ip[10:12], ipChecksum(ip[:20]))
+	copy(ip[20:], udp)
+
+	frame := wrapFrame(dstHW, p.Interface.GetHardwareAddress(), int(PacketIPv4), ip)
+	if to != "" {
+		p.sendFrame(to, frame)
+		return
+	}
+	p.WriteToDevice(frame, uint16(PacketIPv4), false)
+}
+
+// ipChecksum calculates checksum of IPv4 header
+func ipChecksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i : i+2]))
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
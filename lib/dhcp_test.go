@@ -0,0 +1,252 @@
+package ptp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// buildDHCPRequest creates client message of specified type
+func buildDHCPRequest(msgType byte, mac net.HardwareAddr, requested net.IP) []byte {
+	b := make([]byte, dhcpMinLength)
+	b[0] = 1
+	b[1] = 1
+	b[2] = 6
+	copy(b[4:8], []byte{1, 2, 3, 4})
+	copy(b[28:34], mac)
+	binary.BigEndian.PutUint32(b[236:240], dhcpMagicCookie)
+	b = append(b, dhcpOptMessageType, 1, msgType)
+	if requested != nil {
+		b = append(b, dhcpOptRequestedIP, 4)
+		b = append(b, requested.To4()...)
+	}
+	b = append(b, dhcpOptHostname, 4, 'h', 'o', 's', 't', dhcpOptEnd)
+	return b
+}
+
+func testDHCPServer(t *testing.T, pool string) *DHCPServer {
+	start, end, err := ParseDHCPPool(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &DHCPServer{
+		Start:    start,
+		End:      end,
+		leases:   make(map[string]*DHCPLease),
+		declined: make(map[string]time.Time),
+	}
+}
+
+func TestParseDHCPPool(t *testing.T) {
+	start, end, err := ParseDHCPPool("10.10.10.100-10.10.10.150")
+	if err != nil || !start.Equal(net.ParseIP("10.10.10.100")) || !end.Equal(net.ParseIP("10.10.10.150")) {
+		t.Errorf("Failed to parse pool: %v", err)
+	}
+	bad := []string{"10.10.10.100", "10.10.10.150-10.10.10.100", "a-b"}
+	for _, pool := range bad {
+		if _, _, err := ParseDHCPPool(pool); err == nil {
+			t.Errorf("Bad pool was accepted: %s", pool)
+		}
+	}
+}
+
+func TestDHCPLease(t *testing.T) {
+	s := testDHCPServer(t, "10.10.10.100-10.10.10.102")
+	server := net.ParseIP("10.10.10.1").To4()
+	used := func(ip net.IP) bool {
+		return ip.Equal(net.ParseIP("10.10.10.100"))
+	}
+	mac, _ := net.ParseMAC("06:00:00:00:00:01")
+
+	msg, err := parseDHCPMessage(buildDHCPRequest(dhcpDiscover, mac, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, offered := s.handle(msg, server, used)
+	if reply != dhcpOffer || !offered.Equal(net.ParseIP("10.10.10.101")) {
+		t.Fatalf("Wrong offer: %d %s", reply, offered)
+	}
+
+	msg, _ = parseDHCPMessage(buildDHCPRequest(dhcpRequest, mac, offered))
+	reply, leased := s.handle(msg, server, used)
+	if reply != dhcpAck || !leased.Equal(offered) {
+		t.Fatalf("Wrong acknowledgement: %d %s", reply, leased)
+	}
+	leases := s.Leases()
+	if len(leases) != 1 || !leases[0].Bound || leases[0].Hostname != "host" {
+		t.Errorf("Wrong leases: %v", leases)
+	}
+
+	// Address leased to another host and address in use by peer must be refused
+	other, _ := net.ParseMAC("06:00:00:00:00:02")
+	msg, _ = parseDHCPMessage(buildDHCPRequest(dhcpRequest, other, offered))
+	if reply, _ := s.handle(msg, server, used); reply != dhcpNak {
+		t.Error("Leased address was given to another host")
+	}
+	msg, _ = parseDHCPMessage(buildDHCPRequest(dhcpRequest, other, net.ParseIP("10.10.10.100")))
+	if reply, _ := s.handle(msg, server, used); reply != dhcpNak {
+		t.Error("Address of a peer was leased")
+	}
+	msg, _ = parseDHCPMessage(buildDHCPRequest(dhcpDiscover, other, nil))
+	if _, ip := s.handle(msg, server, used); !ip.Equal(net.ParseIP("10.10.10.102")) {
+		t.Errorf("Wrong address offered to second host: %s", ip)
+	}
+}
+
+func TestParseDHCPMessage(t *testing.T) {
+	mac, _ := net.ParseMAC("06:00:00:00:00:01")
+	if _, err := parseDHCPMessage(buildDHCPRequest(dhcpDiscover, mac, nil)[:100]); err == nil {
+		t.Error("Short message was accepted")
+	}
+	b := buildDHCPRequest(dhcpDiscover, mac, nil)
+	b[236] = 0
+	if _, err := parseDHCPMessage(b); err == nil {
+		t.Error("Message with bad cookie was accepted")
+	}
+}
+
+func TestClasslessRoutes(t *testing.T) {
+	_, a, _ := net.ParseCIDR("192.168.1.0/24")
+	_, b, _ := net.ParseCIDR("10.0.0.0/8")
+	gw := net.ParseIP("10.10.10.2")
+	encoded := classlessRoutes([]*net.IPNet{a, b}, []net.IP{gw, gw})
+	wait := []byte{24, 192, 168, 1, 10, 10, 10, 2, 8, 10, 10, 10, 10, 2}
+	if string(encoded) != string(wait) {
+		t.Errorf("Wrong encoding: %v", encoded)
+	}
+}
+
+func TestIPChecksum(t *testing.T) {
+	header := []byte{0x45, 0x00, 0x00, 0x73, 0x00, 0x00, 0x40, 0x00, 0x40, 0x11, 0x00, 0x00, 0xc0, 0xa8, 0x00, 0x01, 0xc0, 0xa8, 0x00, 0xc7}
+	if ipChecksum(header) != 0xb861 {
+		t.Errorf("Wrong checksum: %x", ipChecksum(header))
+	}
+}
+
+func TestDHCPOwner(t *testing.T) {
+	ptpc := new(PeerToPeer)
+	ptpc.Dht = &DHTClient{ID: "b"}
+	ptpc.Peers = new(PeerList)
+	ptpc.Peers.Init()
+	ptpc.DHCP = testDHCPServer(t, "10.10.10.100-10.10.10.150")
+	if !ptpc.DHCP.overlaps("10.10.10.150-10.10.10.200") || ptpc.DHCP.overlaps("10.10.10.151-10.10.10.200") {
+		t.Error("Wrong overlap of pools")
+	}
+	separate := &NetworkPeer{ID: "a", State: PeerStateConnected, DHCPPool: "10.10.10.200-10.10.10.250"}
+	higher := &NetworkPeer{ID: "c", State: PeerStateConnected, DHCPPool: "10.10.10.100-10.10.10.150"}
+	ptpc.Peers.Update(separate.ID, separate)
+	ptpc.Peers.Update(higher.ID, higher)
+	if owner := ptpc.dhcpOwner(); owner != "" {
+		t.Errorf("Server yielded to %s", owner)
+	}
+	lower := &NetworkPeer{ID: "a", State: PeerStateConnected, DHCPPool: "10.10.10.120-10.10.10.130"}
+	ptpc.Peers.Update(lower.ID, lower)
+	if owner := ptpc.dhcpOwner(); owner != "a" {
+		t.Errorf("Server didn't yield to peer with overlapping pool: %s", owner)
+	}
+	hs, err := ptpc.ParseIntroString("a,01:02:03:04:05:06,10.10.10.2,192.168.1.1:6881,dhcp=10.10.10.120-10.10.10.130")
+	if err != nil || hs.DHCPPool != "10.10.10.120-10.10.10.130" {
+		t.Errorf("DHCP pool wasn't parsed from introduction: %v", err)
+	}
+}
+
+// dhcpTestTAP provides addresses of the interface to DHCP server
+type dhcpTestTAP struct {
+	TAP
+	ip net.IP
+	hw net.HardwareAddr
+}
+
+func (t *dhcpTestTAP) GetIP() net.IP                        { return t.ip }
+func (t *dhcpTestTAP) GetMask() net.IPMask                  { return net.CIDRMask(24, 32) }
+func (t *dhcpTestTAP) GetHardwareAddress() net.HardwareAddr { return t.hw }
+
+func TestDHCPForward(t *testing.T) {
+	conns := []*net.UDPConn{}
+	instances := []*PeerToPeer{}
+	for i := 1; i <= 2; i++ {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+		if err != nil {
+			t.Fatalf("Failed to create socket: %s", err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+		ptpc := new(PeerToPeer)
+		ptpc.Init()
+		ptpc.Dht = &DHTClient{ID: fmt.Sprintf("%036d", i)}
+		ptpc.UDPSocket = new(Network)
+		if err := ptpc.UDPSocket.Init("127.0.0.1", 0); err != nil {
+			t.Fatalf("Failed to create socket: %s", err)
+		}
+		defer ptpc.UDPSocket.Stop()
+		hw, _ := net.ParseMAC(fmt.Sprintf("06:00:00:00:00:%02d", i))
+		ptpc.Interface = &dhcpTestTAP{ip: net.IPv4(10, 10, 10, byte(i)), hw: hw}
+		ptpc.DHCP = testDHCPServer(t, fmt.Sprintf("10.10.10.%d-10.10.10.150", 100+i))
+		instances = append(instances, ptpc)
+	}
+	// Sockets of the test stand for addresses of instances
+	for i, ptpc := range instances {
+		other := instances[1-i]
+		addr := conns[1-i].LocalAddr().(*net.UDPAddr)
+		np := &NetworkPeer{ID: other.Dht.ID, State: PeerStateConnected, Endpoint: addr, DHCPPool: other.DHCP.Pool()}
+		np.PeerHW = other.Interface.GetHardwareAddress()
+		np.Endpoints = []PeerEndpoint{{Addr: addr, LastContact: time.Now()}}
+		ptpc.Peers.Update(np.ID, np)
+	}
+	owner, guest := instances[0], instances[1]
+	receive := func(conn *net.UDPConn) *P2PMessage {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 1500)
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("Message wasn't received: %s", err)
+		}
+		msg, err := P2PMessageFromBytes(buf[:n])
+		if err != nil || msg.Header.Type != MsgTypeNenc {
+			t.Fatalf("Wrong message received: %v", err)
+		}
+		return msg
+	}
+
+	// Request of a host behind the instance with higher ID is forwarded
+	client, _ := net.ParseMAC("06:00:00:00:00:10")
+	udp := make([]byte, 8)
+	binary.BigEndian.PutUint16(udp[0:2], dhcpClientPort)
+	binary.BigEndian.PutUint16(udp[2:4], dhcpServerPort)
+	ip := make([]byte, 20)
+	ip[0] = 0x45
+	ip[9] = protoUDP
+	copy(ip[16:20], net.IPv4bcast.To4())
+	payload := append(append(ip, udp...), buildDHCPRequest(dhcpDiscover, client, nil)...)
+	request := wrapFrame(net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, client, int(PacketIPv4), payload)
+	if !guest.handlePeerDHCP(request, "") {
+		t.Fatal("Request wasn't forwarded to the owner")
+	}
+	forwarded := receive(conns[0])
+
+	// Owner replies to the instance that forwarded the request
+	owner.HandleNotEncryptedMessage(forwarded, conns[1].LocalAddr().(*net.UDPAddr))
+	reply := receive(conns[1])
+	if len(reply.Data) < 14+28+dhcpMinLength || !bytes.Equal(reply.Data[6:12], owner.Interface.GetHardwareAddress()) {
+		t.Fatalf("Wrong reply frame")
+	}
+	offer := reply.Data[14+28:]
+	if offer[0] != 2 || !bytes.Equal(offer[28:34], client) || !owner.DHCP.inPool(net.IP(offer[16:20])) {
+		t.Fatalf("Wrong reply received: %v", offer[:34])
+	}
+	if leases := owner.DHCP.Leases(); len(leases) != 1 {
+		t.Errorf("Owner didn't reserve address: %d", len(leases))
+	}
+	if leases := guest.DHCP.Leases(); len(leases) != 0 {
+		t.Errorf("Deferred server reserved address: %d", len(leases))
+	}
+
+	// Peers with separate pools don't get answers
+	owner.DHCP = testDHCPServer(t, "10.10.10.200-10.10.10.250")
+	if owner.handlePeerDHCP(request, guest.Dht.ID) {
+		t.Errorf("Request of peer with separate pool was answered")
+	}
+}
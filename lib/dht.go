@@ -3,6 +3,7 @@ package ptp
 import (
 	fmt "fmt"
 	"net"
+	"sync/atomic"
 	"time"
 
 	uuid "github.com/wayn3h0/go-uuid"
@@ -45,6 +46,7 @@ type DHTClient struct {
 	ListenerIsRunning bool      // True if listener is runnning
 	IncomingData      chan *DHTPacket
 	OutgoingData      chan *DHTPacket
+	mappedPort        int32 // External UDP port forwarded by the gateway
 }
 
 // Forwarder structure represents a Proxy received from DHT server
@@ -76,6 +78,11 @@ func (dht *DHTClient) Connect(ipList []net.IP, proxyList []*proxyServer) error {
 	if dht.RemotePort == 0 {
 		dht.RemotePort = dht.LocalPort
 	}
+	remotePort := dht.RemotePort
+	if mapped := atomic.LoadInt32(&dht.mappedPort); mapped != 0 {
+		// Port forwarded by the gateway is reachable by every peer
+		remotePort = int(mapped)
+	}
 
 	ips := []string{}
 	proxies := []string{}
@@ -101,7 +108,7 @@ func (dht *DHTClient) Connect(ipList []net.IP, proxyList []*proxyServer) error {
 		Id:        dht.ID,
 		Version:   PacketVersion,
 		Data:      fmt.Sprintf("%d", dht.LocalPort),
-		Query:     fmt.Sprintf("%d", dht.RemotePort),
+		Query:     fmt.Sprintf("%d", remotePort),
 		Arguments: ips,
 		Proxies:   proxies,
 	}
@@ -121,6 +128,12 @@ func (dht *DHTClient) Connect(ipList []net.IP, proxyList []*proxyServer) error {
 	return fmt.Errorf("Couldn't handshake with bootstrap node")
 }
 
+// SetMappedPort sets port advertised to bootstrap nodes instead of the
+// remote port. Zero restores the remote port
+func (dht *DHTClient) SetMappedPort(port int) {
+	atomic.StoreInt32(&dht.mappedPort, int32(port))
+}
+
 func (dht *DHTClient) read() (*DHTPacket, error) {
 	packet := <-dht.IncomingData
 	if packet == nil {
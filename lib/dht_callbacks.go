@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"net"
 	"strconv"
-	"time"
 )
 
 type dhtCallback func(*DHTPacket) error
@@ -88,63 +87,10 @@ func (p *PeerToPeer) packetFind(packet *DHTPacket) error {
 	peer := p.Peers.GetPeer(packet.Data)
 
 	if peer == nil {
-		peer := new(NetworkPeer)
 		Log(Debug, "Received new peer %s", packet.Data)
-		peer.ID = packet.Data
-		for _, ip := range packet.Arguments {
-			addr, err := net.ResolveUDPAddr("udp4", ip)
-			if err != nil {
-				continue
-			}
-			isNew := true
-			for _, eip := range peer.KnownIPs {
-				if eip.String() == addr.String() {
-					isNew = false
-				}
-			}
-
-			// Check if this endpoint is not local (own) ep
-			for _, ip := range p.LocalIPs {
-				if ip.Equal(addr.IP) {
-					isNew = false
-				}
-			}
-
-			if isNew {
-				peer.KnownIPs = append(peer.KnownIPs, addr)
-				Log(Debug, "Adding endpoint: %s", addr.String())
-			}
-		}
-		for _, proxy := range packet.Proxies {
-			addr, err := net.ResolveUDPAddr("udp4", proxy)
-			if err != nil {
-				continue
-			}
-			isNew := true
-			for _, eproxy := range peer.Proxies {
-				if eproxy.String() == addr.String() {
-					isNew = false
-				}
-			}
-
-			// Check if this proxy is not ours
-			for _, epr := range p.ProxyManager.get() {
-				if epr.Endpoint.String() == addr.String() {
-					isNew = false
-				}
-			}
-
-			if isNew {
-				peer.Proxies = append(peer.Proxies, addr)
-				Log(Debug, "Adding proxy: %s", addr.String())
-			}
-		}
-		peer.SetState(PeerStateInit, p)
-		peer.LastFind = time.Now()
-		p.Peers.Update(peer.ID, peer)
-		p.Peers.RunPeer(peer.ID, p)
+		p.addFoundPeer(&NetworkPeer{ID: packet.Data}, packet.Arguments, packet.Proxies, "Found in DHT")
 	} else {
-		peer.LastFind = time.Now()
+		peer.found()
 
 		ips := []*net.UDPAddr{}
 		proxies := []*net.UDPAddr{}
@@ -168,7 +114,7 @@ func (p *PeerToPeer) packetFind(packet *DHTPacket) error {
 				Log(Debug, "Updating endpoint: %s", addr.String())
 			}
 		}
-		peer.KnownIPs = ips
+		peer.setKnownIPs(ips)
 		for _, proxy := range packet.Proxies {
 			if proxy == "" {
 				continue
@@ -188,12 +134,73 @@ func (p *PeerToPeer) packetFind(packet *DHTPacket) error {
 				Log(Debug, "Updating proxy: %s", addr.String())
 			}
 		}
-		peer.Proxies = proxies
+		peer.setProxies(proxies)
 		p.Peers.Update(peer.ID, peer)
+		peer.notify(PeerEventDHT)
 	}
 	return nil
 }
 
+// addFoundPeer starts a new peer with addresses received from DHT or LAN
+func (p *PeerToPeer) addFoundPeer(peer *NetworkPeer, ips, proxies []string, reason string) {
+	for _, ip := range ips {
+		addr, err := net.ResolveUDPAddr("udp4", ip)
+		if err != nil {
+			continue
+		}
+		isNew := true
+		for _, eip := range peer.KnownIPs {
+			if eip.String() == addr.String() {
+				isNew = false
+			}
+		}
+
+		// Check if this endpoint is not local (own) ep
+		for _, ip := range p.LocalIPs {
+			if ip.Equal(addr.IP) {
+				isNew = false
+			}
+		}
+
+		if isNew {
+			peer.KnownIPs = append(peer.KnownIPs, addr)
+			Log(Debug, "Adding endpoint: %s", addr.String())
+		}
+	}
+	for _, proxy := range proxies {
+		addr, err := net.ResolveUDPAddr("udp4", proxy)
+		if err != nil {
+			continue
+		}
+		isNew := true
+		for _, eproxy := range peer.Proxies {
+			if eproxy.String() == addr.String() {
+				isNew = false
+			}
+		}
+
+		// Check if this proxy is not ours
+		for _, epr := range p.ProxyManager.get() {
+			if epr.Endpoint.String() == addr.String() {
+				isNew = false
+			}
+		}
+
+		if isNew {
+			peer.Proxies = append(peer.Proxies, addr)
+			Log(Debug, "Adding proxy: %s", addr.String())
+		}
+	}
+	if p.Lazy {
+		peer.transition(PeerStateIdle, reason, p)
+	} else {
+		peer.transition(PeerStateInit, reason, p)
+	}
+	peer.found()
+	p.Peers.Update(peer.ID, peer)
+	p.Peers.RunPeer(peer.ID, p)
+}
+
 func (p *PeerToPeer) packetForward(packet *DHTPacket) error {
 	return nil
 }
@@ -223,8 +230,9 @@ func (p *PeerToPeer) packetNode(packet *DHTPacket) error {
 		list = append(list, ip)
 	}
 	if len(list) > 0 {
-		peer.KnownIPs = list
+		peer.setKnownIPs(list)
 	}
+	peer.notify(PeerEventDHT)
 	return nil
 }
 
@@ -247,7 +255,7 @@ func (p *PeerToPeer) packetProxy(packet *DHTPacket) error {
 			go func() {
 				msg, err := p.CreateMessage(MsgTypeProxy, []byte(p.Dht.ID), 0, false)
 				if err == nil {
-					p.UDPSocket.SendMessage(msg, proxyAddr)
+					p.sendMessage(msg, proxyAddr)
 				}
 			}()
 		}
@@ -270,8 +278,8 @@ func (p *PeerToPeer) packetRequestProxy(packet *DHTPacket) error {
 	peers := p.Peers.Get()
 	for _, proxy := range list {
 		for _, existingPeer := range peers {
-			if existingPeer.Endpoint.String() == proxy.String() && existingPeer.ID != packet.Data {
-				existingPeer.SetState(PeerStateDisconnect, p)
+			if existingPeer.GetEndpoint().String() == proxy.String() && existingPeer.ID != packet.Data {
+				existingPeer.transition(PeerStateDisconnect, "Address "+proxy.String()+" belongs to a proxy", p)
 				Log(Info, "Peer %s was associated with address %s. Disconnecting", existingPeer.ID, proxy.String())
 			}
 		}
@@ -279,7 +287,8 @@ func (p *PeerToPeer) packetRequestProxy(packet *DHTPacket) error {
 
 	peer := p.Peers.GetPeer(packet.Data)
 	if peer != nil {
-		peer.Proxies = list
+		peer.setProxies(list)
+		peer.notify(PeerEventProxy)
 	}
 	return nil
 }
@@ -314,9 +323,10 @@ func (p *PeerToPeer) packetState(packet *DHTPacket) error {
 
 	peer := p.Peers.GetPeer(packet.Data)
 	if peer != nil {
-		peer.RemoteState = PeerState(numericState)
+		peer.setRemoteState(PeerState(numericState))
 		p.Peers.Update(packet.Data, peer)
-		Log(Debug, "Peer %s reported state '%s'", peer.ID, StringifyState(peer.RemoteState))
+		Log(Debug, "Peer %s reported state '%s'", peer.ID, StringifyState(PeerState(numericState)))
+		peer.notify(PeerEventRemoteState)
 	} else {
 		Log(Trace, "Received state of unknown peer. Updating peers")
 		//p.Dht.sendFind()
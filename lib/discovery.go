@@ -0,0 +1,340 @@
+package ptp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Local discovery lets peers on the same LAN find each other without
+// bootstrap node. Every instance periodically sends announcement to the
+// multicast group from each local interface. Announcement carries digest
+// of the swarm hash, peer ID and endpoints, and is signed with HMAC keyed
+// by the instance crypto key. Swarm hash is sent to bootstrap nodes in
+// clear text, so without crypto key announcements are signed with the
+// hash and discovery is unauthenticated: any host in LAN that knows the
+// hash can announce peers. Announced peers are added the same way as
+// peers found in DHT
+
+// Discovery constants
+const (
+	DiscoveryPort      = 6879
+	DiscoveryGroup     = "239.255.68.80"
+	DiscoveryInterval  = time.Second * 10 // How often announcements are sent
+	DiscoveryMaxSkew   = time.Minute * 2  // Announcements older or newer than this are dropped
+	discoveryMagic     = "P2PD"
+	discoveryVersion   = 1
+	discoveryMaxPacket = 1500
+	discoveryMaxEPs    = 32
+)
+
+var errForeignSwarm = errors.New("Announcement belongs to another swarm")
+
+// Discovery sends and receives announcements of a swarm in LAN
+type Discovery struct {
+	key          []byte         // HMAC key
+	digest       []byte         // Digest of the swarm hash
+	group        *net.UDPAddr   // Multicast group
+	listeners    []*net.UDPConn // Sockets joined to the group on each interface
+	senders      []*net.UDPConn // Sockets bound to each local IP
+	lastAnnounce time.Time      // When announcement was sent last time
+	lock         sync.Mutex     // Serializes handling of announcements
+}
+
+type announcement struct {
+	ID        string
+	Time      time.Time
+	Endpoints []*net.UDPAddr
+}
+
+// authKey returns key that signs messages between members of the swarm
+// and whether it's secret. Crypto key of the instance is used when
+// configured, otherwise the swarm hash known to bootstrap nodes is used
+func (p *PeerToPeer) authKey() ([]byte, bool) {
+	if p.Crypter.Active && len(p.Crypter.ActiveKey.Key) > 0 {
+		return p.Crypter.ActiveKey.Key, true
+	}
+	return []byte(p.Dht.NetworkHash), false
+}
+
+// StartDiscovery joins discovery group on interfaces with local IPs
+func (p *PeerToPeer) StartDiscovery() error {
+	key, secret := p.authKey()
+	d := &Discovery{
+		key:    key,
+		digest: discoveryDigest(p.Dht.NetworkHash),
+		group:  &net.UDPAddr{IP: net.ParseIP(DiscoveryGroup), Port: DiscoveryPort},
+	}
+	if !secret {
+		Log(Warning, "No crypto key specified: LAN discovery is unauthenticated")
+	}
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return fmt.Errorf("Failed to start LAN discovery: %s", err)
+	}
+	for _, ip := range p.announcedIPs() {
+		ifi := interfaceByIP(interfaces, ip)
+		if ifi == nil || ifi.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+		listener, err := net.ListenMulticastUDP("udp4", ifi, d.group)
+		if err != nil {
+			Log(Debug, "Failed to join discovery group on %s: %s", ifi.Name, err)
+			continue
+		}
+		// Multicast goes out of the interface that owns source address
+		sender, err := net.ListenUDP("udp4", &net.UDPAddr{IP: ip})
+		if err != nil {
+			Log(Debug, "Failed to create discovery socket on %s: %s", ip.String(), err)
+			listener.Close()
+			continue
+		}
+		d.listeners = append(d.listeners, listener)
+		d.senders = append(d.senders, sender)
+		go d.listen(listener, func(data []byte, src *net.UDPAddr) {
+			p.handleAnnouncement(d, data, src)
+		})
+	}
+	if len(d.listeners) == 0 {
+		return fmt.Errorf("Failed to start LAN discovery: no multicast interfaces")
+	}
+	p.Discovery = d
+	Log(Info, "LAN discovery is running on %d interfaces", len(d.listeners))
+	return nil
+}
+
+// StopDiscovery closes discovery sockets
+func (p *PeerToPeer) StopDiscovery() {
+	if p.Discovery == nil {
+		return
+	}
+	for _, conn := range p.Discovery.listeners {
+		conn.Close()
+	}
+	for _, conn := range p.Discovery.senders {
+		conn.Close()
+	}
+}
+
+// Addresses returns local addresses announcements are sent from
+func (d *Discovery) Addresses() []string {
+	result := []string{}
+	for _, conn := range d.senders {
+		result = append(result, conn.LocalAddr().(*net.UDPAddr).IP.String())
+	}
+	return result
+}
+
+// announcedIPs returns local IPs that are not used by TAP interfaces
+func (p *PeerToPeer) announcedIPs() []net.IP {
+	result := []net.IP{}
+	for _, ip := range p.LocalIPs {
+		active := false
+		for _, a := range ActiveInterfaces {
+			if a.Equal(ip) {
+				active = true
+				break
+			}
+		}
+		if !active && ip.To4() != nil {
+			result = append(result, ip)
+		}
+	}
+	return result
+}
+
+func interfaceByIP(interfaces []net.Interface, ip net.IP) *net.Interface {
+	for i, ifi := range interfaces {
+		if ifi.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addresses, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addresses {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+				return &interfaces[i]
+			}
+		}
+	}
+	return nil
+}
+
+// announceLocal sends announcement from every interface
+func (p *PeerToPeer) announceLocal() {
+	d := p.Discovery
+	if d == nil || time.Since(d.lastAnnounce) < DiscoveryInterval {
+		return
+	}
+	d.lastAnnounce = time.Now()
+	endpoints := []*net.UDPAddr{}
+	for _, ip := range p.announcedIPs() {
+		endpoints = append(endpoints, &net.UDPAddr{IP: ip, Port: p.UDPSocket.GetPort()})
+	}
+	data, err := encodeAnnouncement(d.key, d.digest, &announcement{ID: p.Dht.ID, Time: time.Now(), Endpoints: endpoints})
+	if err != nil {
+		Log(Error, "Failed to create announcement: %s", err)
+		return
+	}
+	for _, conn := range d.senders {
+		_, err = conn.WriteToUDP(data, d.group)
+		if err != nil {
+			Log(Debug, "Failed to send announcement from %s: %s", conn.LocalAddr().String(), err)
+		}
+	}
+}
+
+func (d *Discovery) listen(conn *net.UDPConn, handle func([]byte, *net.UDPAddr)) {
+	buf := make([]byte, discoveryMaxPacket)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			Log(Debug, "Discovery listener stopped: %s", err)
+			return
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		handle(data, src)
+	}
+}
+
+// handleAnnouncement adds announced peer or updates its endpoints
+func (p *PeerToPeer) handleAnnouncement(d *Discovery, data []byte, src *net.UDPAddr) {
+	a, err := decodeAnnouncement(d.key, d.digest, data)
+	if err == errForeignSwarm {
+		return
+	} else if err != nil {
+		Log(Debug, "Bad announcement from %s: %s", src.String(), err)
+		return
+	}
+	if a.ID == p.Dht.ID {
+		return
+	}
+	if skew := time.Since(a.Time); skew > DiscoveryMaxSkew || skew < -DiscoveryMaxSkew {
+		Log(Debug, "Announcement of %s from %s is out of time", a.ID, src.String())
+		return
+	}
+	endpoints := []*net.UDPAddr{}
+	for _, ep := range a.Endpoints {
+		own := false
+		for _, ip := range p.LocalIPs {
+			if ip.Equal(ep.IP) {
+				own = true
+				break
+			}
+		}
+		if !own {
+			endpoints = appendUniqueAddr(endpoints, ep)
+		}
+	}
+	if len(endpoints) == 0 {
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	peer := p.Peers.GetPeer(a.ID)
+	if peer == nil {
+		Log(Info, "Discovered peer %s in LAN at %s", a.ID, src.String())
+		list := []string{}
+		for _, ep := range endpoints {
+			list = append(list, ep.String())
+		}
+		p.addFoundPeer(&NetworkPeer{ID: a.ID, Discovered: true}, list, nil, "Discovered in LAN")
+		return
+	}
+	peer.found()
+	known := peer.GetKnownIPs()
+	count := len(known)
+	for _, ep := range endpoints {
+		known = appendUniqueAddr(known, ep)
+	}
+	if len(known) != count {
+		Log(Debug, "Peer %s announced new endpoints in LAN", a.ID)
+		peer.setKnownIPs(known)
+		peer.notify(PeerEventDHT)
+	}
+}
+
+func discoveryDigest(hash string) []byte {
+	digest := sha256.Sum256([]byte(discoveryMagic + hash))
+	return digest[:]
+}
+
+// encodeAnnouncement serializes announcement:
+// magic | version | digest | unix time | ID | count | count * (IPv4, port) | HMAC
+func encodeAnnouncement(key, digest []byte, a *announcement) ([]byte, error) {
+	if len(a.ID) != 36 {
+		return nil, fmt.Errorf("Wrong peer ID: %s", a.ID)
+	}
+	buf := new(bytes.Buffer)
+	buf.WriteString(discoveryMagic)
+	buf.WriteByte(discoveryVersion)
+	buf.Write(digest)
+	binary.Write(buf, binary.BigEndian, a.Time.Unix())
+	buf.WriteString(a.ID)
+	endpoints := []*net.UDPAddr{}
+	for _, ep := range a.Endpoints {
+		if ep.IP.To4() != nil && len(endpoints) < discoveryMaxEPs {
+			endpoints = append(endpoints, ep)
+		}
+	}
+	buf.WriteByte(byte(len(endpoints)))
+	for _, ep := range endpoints {
+		buf.Write(ep.IP.To4())
+		binary.Write(buf, binary.BigEndian, uint16(ep.Port))
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(buf.Bytes())
+	buf.Write(mac.Sum(nil))
+	return buf.Bytes(), nil
+}
+
+// decodeAnnouncement verifies and parses announcement of the swarm
+func decodeAnnouncement(key, digest, data []byte) (*announcement, error) {
+	header := len(discoveryMagic) + 1 + sha256.Size + 8 + 36 + 1
+	if len(data) < header+sha256.Size || string(data[:len(discoveryMagic)]) != discoveryMagic {
+		return nil, errForeignSwarm
+	}
+	offset := len(discoveryMagic)
+	if data[offset] != discoveryVersion {
+		return nil, fmt.Errorf("Unsupported version %d", data[offset])
+	}
+	offset++
+	if !bytes.Equal(data[offset:offset+sha256.Size], digest) {
+		return nil, errForeignSwarm
+	}
+	offset += sha256.Size
+	signed := data[:len(data)-sha256.Size]
+	mac := hmac.New(sha256.New, key)
+	mac.Write(signed)
+	if !hmac.Equal(mac.Sum(nil), data[len(signed):]) {
+		return nil, fmt.Errorf("Signature mismatch")
+	}
+	a := &announcement{}
+	a.Time = time.Unix(int64(binary.BigEndian.Uint64(data[offset:])), 0)
+	offset += 8
+	a.ID = string(data[offset : offset+36])
+	offset += 36
+	count := int(data[offset])
+	offset++
+	if len(signed) != offset+count*6 {
+		return nil, fmt.Errorf("Wrong number of endpoints")
+	}
+	for i := 0; i < count; i++ {
+		ip := net.IP(append([]byte{}, data[offset:offset+4]...))
+		port := int(binary.BigEndian.Uint16(data[offset+4:]))
+		offset += 6
+		if port != 0 {
+			a.Endpoints = append(a.Endpoints, &net.UDPAddr{IP: ip, Port: port})
+		}
+	}
+	return a, nil
+}
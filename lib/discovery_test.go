@@ -0,0 +1,115 @@
+package ptp
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAnnouncementEncoding(t *testing.T) {
+	key := []byte("swarm")
+	digest := discoveryDigest("swarm")
+	ep1, _ := net.ResolveUDPAddr("udp4", "192.168.1.10:6881")
+	ep2, _ := net.ResolveUDPAddr("udp4", "10.0.0.5:40000")
+	a := &announcement{ID: fmt.Sprintf("%036d", 1), Time: time.Unix(1500000000, 0), Endpoints: []*net.UDPAddr{ep1, ep2}}
+	data, err := encodeAnnouncement(key, digest, a)
+	if err != nil {
+		t.Fatalf("Failed to encode announcement: %s", err)
+	}
+	decoded, err := decodeAnnouncement(key, digest, data)
+	if err != nil {
+		t.Fatalf("Failed to decode announcement: %s", err)
+	}
+	if decoded.ID != a.ID || !decoded.Time.Equal(a.Time) || len(decoded.Endpoints) != 2 ||
+		decoded.Endpoints[0].String() != ep1.String() || decoded.Endpoints[1].String() != ep2.String() {
+		t.Errorf("Wrong announcement decoded: %+v", decoded)
+	}
+
+	if _, err := decodeAnnouncement(key, discoveryDigest("other"), data); err != errForeignSwarm {
+		t.Errorf("Announcement of another swarm was accepted: %v", err)
+	}
+	if _, err := decodeAnnouncement([]byte("other"), digest, data); err == nil {
+		t.Errorf("Announcement signed with another key was accepted")
+	}
+	tampered := append([]byte{}, data...)
+	tampered[len(tampered)-40]++
+	if _, err := decodeAnnouncement(key, digest, tampered); err == nil {
+		t.Errorf("Tampered announcement was accepted")
+	}
+	if _, err := decodeAnnouncement(key, digest, data[:20]); err != errForeignSwarm {
+		t.Errorf("Short packet was accepted: %v", err)
+	}
+	if _, err := encodeAnnouncement(key, digest, &announcement{ID: "short"}); err == nil {
+		t.Errorf("Wrong ID was accepted")
+	}
+}
+
+func TestHandleAnnouncement(t *testing.T) {
+	ptpc := new(PeerToPeer)
+	ptpc.Init()
+	ptpc.Dht = new(DHTClient)
+	ptpc.Dht.ID = fmt.Sprintf("%036d", 0)
+	ptpc.UDPSocket = new(Network)
+	err := ptpc.UDPSocket.Init("127.0.0.1", 0)
+	if err != nil {
+		t.Fatalf("Failed to create socket: %s", err)
+	}
+	defer ptpc.UDPSocket.Stop()
+	ptpc.LocalIPs = []net.IP{net.ParseIP("192.168.1.2")}
+	d := &Discovery{key: []byte("swarm"), digest: discoveryDigest("swarm")}
+	src, _ := net.ResolveUDPAddr("udp4", "192.168.1.10:50000")
+	own, _ := net.ResolveUDPAddr("udp4", "192.168.1.2:6881")
+	ep1, _ := net.ResolveUDPAddr("udp4", "192.168.1.10:6881")
+	ep2, _ := net.ResolveUDPAddr("udp4", "172.16.0.10:6881")
+	announce := func(id string, ts time.Time, endpoints ...*net.UDPAddr) {
+		data, _ := encodeAnnouncement(d.key, d.digest, &announcement{ID: id, Time: ts, Endpoints: endpoints})
+		ptpc.handleAnnouncement(d, data, src)
+	}
+
+	announce(ptpc.Dht.ID, time.Now(), ep1)
+	id := fmt.Sprintf("%036d", 1)
+	announce(id, time.Now().Add(-DiscoveryMaxSkew*2), ep1)
+	announce(id, time.Now(), own)
+	if ptpc.Peers.Length() != 0 {
+		t.Fatalf("Peer was added from own, stale or empty announcement")
+	}
+
+	announce(id, time.Now(), ep1, own)
+	peer := ptpc.Peers.GetPeer(id)
+	if peer == nil || !peer.Discovered {
+		t.Fatalf("Announced peer wasn't added")
+	}
+	known := peer.GetKnownIPs()
+	if len(known) != 1 || known[0].String() != ep1.String() {
+		t.Errorf("Wrong addresses of announced peer: %v", known)
+	}
+	announce(id, time.Now(), ep1, ep2)
+	known = peer.GetKnownIPs()
+	if len(known) != 2 || known[1].String() != ep2.String() {
+		t.Errorf("New endpoint wasn't merged: %v", known)
+	}
+
+	// Discovered peer doesn't wait for DHT and starts connecting at once
+	deadline := time.Now().Add(time.Second)
+	for peer.GetState() != PeerStateConnecting {
+		if time.Now().After(deadline) {
+			t.Fatalf("Announced peer didn't start connecting: %s", StringifyState(peer.GetState()))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	stopPeer(t, peer, ptpc)
+}
+
+func TestAuthKey(t *testing.T) {
+	ptpc := new(PeerToPeer)
+	ptpc.Dht = &DHTClient{NetworkHash: "swarm"}
+	if key, secret := ptpc.authKey(); secret || string(key) != "swarm" {
+		t.Errorf("Wrong key without crypto: %s %v", key, secret)
+	}
+	ptpc.Crypter.ActiveKey = CryptoKey{Key: []byte("secret-key")}
+	ptpc.Crypter.Active = true
+	if key, secret := ptpc.authKey(); !secret || string(key) != "secret-key" {
+		t.Errorf("Crypto key wasn't used: %s %v", key, secret)
+	}
+}
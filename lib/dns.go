@@ -0,0 +1,295 @@
+package ptp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Overlay DNS resolves names announced by peers in the introduction.
+// Records are served under the swarm domain, i.e. <peer-name>.<hash>.
+// Every other query is forwarded to upstream server
+
+// DNS constants
+const (
+	DNSPort           = 53
+	DNSTTL            = 60              // TTL of overlay records in seconds
+	DNSForwardTimeout = time.Second * 3 // How long to wait for upstream response
+	DNSMaxForwards    = 64              // Queries forwarded upstream at once
+	DNSDefaultServer  = "8.8.8.8:53"    // Used when upstream can't be detected
+	dnsTypeA          = 1
+	dnsClassIN        = 1
+	dnsRcodeOK        = 0
+	dnsRcodeFormErr   = 1
+	dnsRcodeServFail  = 2
+	dnsRcodeNXDomain  = 3
+	dnsMaxPacket      = 1500
+)
+
+// DNSServer is a DNS responder bound to the instance interface
+type DNSServer struct {
+	Upstream string // Address of upstream server
+	Domain   string // Swarm domain without trailing dot
+	conn     *net.UDPConn
+	resolve  func(name string) (net.IP, bool)
+	forwards chan struct{} // Limits queries forwarded at once
+}
+
+type dnsQuestion struct {
+	Name  string // Lowercased name without trailing dot
+	Type  uint16
+	Class uint16
+	end   int // Offset of the first byte after question
+}
+
+// ValidatePeerName checks that name can be used as a DNS label
+func ValidatePeerName(name string) error {
+	if len(name) == 0 || len(name) > 63 {
+		return fmt.Errorf("Name must be 1 to 63 characters long")
+	}
+	for i, c := range name {
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') {
+			continue
+		}
+		if c == '-' && i != 0 && i != len(name)-1 {
+			continue
+		}
+		return fmt.Errorf("Name may contain only letters, digits and hyphens: %s", name)
+	}
+	return nil
+}
+
+// DetectUpstreamDNS returns first name server from resolv.conf
+// that is not the specified address
+func DetectUpstreamDNS(exclude net.IP) string {
+	file, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return DNSDefaultServer
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		ip := net.ParseIP(fields[1])
+		if ip == nil || ip.To4() == nil || ip.Equal(exclude) {
+			continue
+		}
+		return net.JoinHostPort(ip.String(), "53")
+	}
+	return DNSDefaultServer
+}
+
+// StartDNS runs DNS responder on the interface IP
+func (p *PeerToPeer) StartDNS(upstream string) error {
+	if upstream == "" {
+		upstream = DetectUpstreamDNS(p.Interface.GetIP())
+	} else if _, _, err := net.SplitHostPort(upstream); err != nil {
+		upstream = net.JoinHostPort(upstream, "53")
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: p.Interface.GetIP(), Port: DNSPort})
+	if err != nil {
+		return fmt.Errorf("Failed to start DNS server: %s", err)
+	}
+	p.DNS = &DNSServer{
+		Upstream: upstream,
+		Domain:   strings.ToLower(p.Dht.NetworkHash),
+		conn:     conn,
+		resolve:  p.resolveName,
+		forwards: make(chan struct{}, DNSMaxForwards),
+	}
+	Log(Info, "DNS server is listening on %s. Upstream: %s", conn.LocalAddr().String(), upstream)
+	go p.DNS.serve()
+	return nil
+}
+
+// StopDNS shuts down DNS responder
+func (p *PeerToPeer) StopDNS() {
+	if p.DNS != nil && p.DNS.conn != nil {
+		p.DNS.conn.Close()
+	}
+}
+
+// resolveName returns overlay IP of a peer or this instance by name
+func (p *PeerToPeer) resolveName(name string) (net.IP, bool) {
+	if p.Name != "" && strings.EqualFold(p.Name, name) {
+		return p.Interface.GetIP(), true
+	}
+	for _, peer := range p.Peers.Get() {
+		ip := peer.GetIP()
+		if peerName := peer.GetName(); peerName != "" && strings.EqualFold(peerName, name) && ip != nil {
+			return ip, true
+		}
+	}
+	return nil, false
+}
+
+// Names returns names announced by peers in a form of ID -> Name
+func (p *PeerToPeer) Names() map[string]string {
+	result := make(map[string]string)
+	for id, peer := range p.Peers.Get() {
+		if name := peer.GetName(); name != "" {
+			result[id] = name
+		}
+	}
+	return result
+}
+
+func (s *DNSServer) serve() {
+	buf := make([]byte, dnsMaxPacket)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			Log(Debug, "DNS server stopped: %s", err)
+			return
+		}
+		query := make([]byte, n)
+		copy(query, buf[:n])
+		response := s.handle(query)
+		if response != nil {
+			s.conn.WriteToUDP(response, addr)
+			continue
+		}
+		if !s.startForward(query, addr) {
+			Log(Trace, "Dropping DNS query from %s: too many queries are forwarded", addr.String())
+		}
+	}
+}
+
+// startForward forwards query upstream in background. Returns false
+// if limit of queries forwarded at once is reached
+func (s *DNSServer) startForward(query []byte, client *net.UDPAddr) bool {
+	select {
+	case s.forwards <- struct{}{}:
+	default:
+		return false
+	}
+	go func() {
+		s.forward(query, client)
+		<-s.forwards
+	}()
+	return true
+}
+
+// handle answers queries for the swarm domain. Nil is returned
+// for queries that must be forwarded upstream
+func (s *DNSServer) handle(query []byte) []byte {
+	q, err := parseDNSQuery(query)
+	if err != nil {
+		if len(query) >= 12 {
+			return buildDNSResponse(query, nil, dnsRcodeFormErr, nil)
+		}
+		return nil
+	}
+	if q.Name != s.Domain && !strings.HasSuffix(q.Name, "."+s.Domain) {
+		return nil
+	}
+	label := strings.TrimSuffix(strings.TrimSuffix(q.Name, s.Domain), ".")
+	if label == "" || strings.Contains(label, ".") {
+		return buildDNSResponse(query, q, dnsRcodeNXDomain, nil)
+	}
+	ip, exists := s.resolve(label)
+	if !exists {
+		return buildDNSResponse(query, q, dnsRcodeNXDomain, nil)
+	}
+	if q.Type != dnsTypeA || q.Class != dnsClassIN || ip.To4() == nil {
+		// Name exists but has no records of requested type
+		return buildDNSResponse(query, q, dnsRcodeOK, nil)
+	}
+	return buildDNSResponse(query, q, dnsRcodeOK, []net.IP{ip})
+}
+
+// forward sends query to upstream server and relays response back
+func (s *DNSServer) forward(query []byte, client *net.UDPAddr) {
+	conn, err := net.Dial("udp", s.Upstream)
+	if err != nil {
+		Log(Debug, "Failed to reach upstream DNS %s: %s", s.Upstream, err)
+		s.conn.WriteToUDP(buildDNSResponse(query, nil, dnsRcodeServFail, nil), client)
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(DNSForwardTimeout))
+	_, err = conn.Write(query)
+	if err != nil {
+		return
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		Log(Debug, "No response from upstream DNS %s: %s", s.Upstream, err)
+		s.conn.WriteToUDP(buildDNSResponse(query, nil, dnsRcodeServFail, nil), client)
+		return
+	}
+	s.conn.WriteToUDP(buf[:n], client)
+}
+
+// parseDNSQuery extracts the only question from DNS query
+func parseDNSQuery(b []byte) (*dnsQuestion, error) {
+	if len(b) < 12 {
+		return nil, fmt.Errorf("DNS message is too short")
+	}
+	if b[2]&0x80 != 0 {
+		return nil, fmt.Errorf("DNS message is not a query")
+	}
+	if binary.BigEndian.Uint16(b[4:6]) != 1 {
+		return nil, fmt.Errorf("Only one question is supported")
+	}
+	labels := []string{}
+	n := 12
+	for {
+		if n >= len(b) {
+			return nil, fmt.Errorf("Truncated question")
+		}
+		length := int(b[n])
+		n++
+		if length == 0 {
+			break
+		}
+		if length > 63 || n+length > len(b) {
+			return nil, fmt.Errorf("Bad label")
+		}
+		labels = append(labels, string(b[n:n+length]))
+		n += length
+	}
+	if n+4 > len(b) {
+		return nil, fmt.Errorf("Truncated question")
+	}
+	return &dnsQuestion{
+		Name:  strings.ToLower(strings.Join(labels, ".")),
+		Type:  binary.BigEndian.Uint16(b[n : n+2]),
+		Class: binary.BigEndian.Uint16(b[n+2 : n+4]),
+		end:   n + 4,
+	}, nil
+}
+
+// buildDNSResponse creates response to the query with specified
+// code and A records. Question is omitted when it wasn't parsed
+func buildDNSResponse(query []byte, q *dnsQuestion, rcode int, answers []net.IP) []byte {
+	response := make([]byte, 12)
+	copy(response[0:2], query[0:2])
+	flags := uint16(0x8000|0x0400|0x0080) | binary.BigEndian.Uint16(query[2:4])&0x0100 | uint16(rcode)
+	binary.BigEndian.PutUint16(response[2:4], flags)
+	if q == nil {
+		return response
+	}
+	binary.BigEndian.PutUint16(response[4:6], 1)
+	binary.BigEndian.PutUint16(response[6:8], uint16(len(answers)))
+	response = append(response, query[12:q.end]...)
+	for _, ip := range answers {
+		record := make([]byte, 16)
+		binary.BigEndian.PutUint16(record[0:2], 0xc00c) // Pointer to the name in question
+		binary.BigEndian.PutUint16(record[2:4], dnsTypeA)
+		binary.BigEndian.PutUint16(record[4:6], dnsClassIN)
+		binary.BigEndian.PutUint32(record[6:10], DNSTTL)
+		binary.BigEndian.PutUint16(record[10:12], 4)
+		copy(record[12:16], ip.To4())
+		response = append(response, record...)
+	}
+	return response
+}
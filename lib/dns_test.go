@@ -0,0 +1,117 @@
+package ptp
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// buildDNSQuery creates query with a single question
+func buildDNSQuery(name string, qtype uint16) []byte {
+	query := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range splitLabels(name) {
+		query = append(query, byte(len(label)))
+		query = append(query, label...)
+	}
+	query = append(query, 0, byte(qtype>>8), byte(qtype), 0, 1)
+	return query
+}
+
+func splitLabels(name string) []string {
+	labels := []string{}
+	start := 0
+	for i := 0; i <= len(name); i++ {
+		if i == len(name) || name[i] == '.' {
+			labels = append(labels, name[start:i])
+			start = i + 1
+		}
+	}
+	return labels
+}
+
+func testDNSServer() *DNSServer {
+	return &DNSServer{
+		Domain: "swarm",
+		resolve: func(name string) (net.IP, bool) {
+			if name == "web" {
+				return net.ParseIP("10.10.10.2"), true
+			}
+			return nil, false
+		},
+	}
+}
+
+func TestValidatePeerName(t *testing.T) {
+	good := []string{"web", "Web-01", "a"}
+	for _, name := range good {
+		if ValidatePeerName(name) != nil {
+			t.Errorf("Good name was rejected: %s", name)
+		}
+	}
+	bad := []string{"", "-web", "web-", "web.local", "web_1", "web,routes=1"}
+	for _, name := range bad {
+		if ValidatePeerName(name) == nil {
+			t.Errorf("Bad name was accepted: %s", name)
+		}
+	}
+}
+
+func TestParseDNSQuery(t *testing.T) {
+	q, err := parseDNSQuery(buildDNSQuery("Web.Swarm", dnsTypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Name != "web.swarm" || q.Type != dnsTypeA || q.Class != dnsClassIN {
+		t.Errorf("Wrong question: %+v", q)
+	}
+	if _, err := parseDNSQuery([]byte{0, 1, 2}); err == nil {
+		t.Error("Short message was accepted")
+	}
+	truncated := buildDNSQuery("web.swarm", dnsTypeA)
+	if _, err := parseDNSQuery(truncated[:len(truncated)-3]); err == nil {
+		t.Error("Truncated question was accepted")
+	}
+}
+
+func TestDNSResolve(t *testing.T) {
+	s := testDNSServer()
+	response := s.handle(buildDNSQuery("web.swarm", dnsTypeA))
+	if response == nil {
+		t.Fatal("Swarm query was not answered")
+	}
+	if response[0] != 0x12 || response[1] != 0x34 {
+		t.Error("Query ID was not copied")
+	}
+	flags := binary.BigEndian.Uint16(response[2:4])
+	if flags&0x8000 == 0 || flags&0x000f != dnsRcodeOK || flags&0x0100 == 0 {
+		t.Errorf("Wrong flags: %x", flags)
+	}
+	if binary.BigEndian.Uint16(response[6:8]) != 1 {
+		t.Fatal("No answer in response")
+	}
+	if !net.IP(response[len(response)-4:]).Equal(net.ParseIP("10.10.10.2")) {
+		t.Error("Wrong address in answer")
+	}
+
+	response = s.handle(buildDNSQuery("db.swarm", dnsTypeA))
+	if binary.BigEndian.Uint16(response[2:4])&0x000f != dnsRcodeNXDomain {
+		t.Error("Unknown name was not answered with NXDOMAIN")
+	}
+	response = s.handle(buildDNSQuery("web.swarm", 28))
+	if binary.BigEndian.Uint16(response[2:4])&0x000f != dnsRcodeOK || binary.BigEndian.Uint16(response[6:8]) != 0 {
+		t.Error("AAAA query for existing name must return empty answer")
+	}
+	if s.handle(buildDNSQuery("example.com", dnsTypeA)) != nil {
+		t.Error("Query outside of swarm was not forwarded")
+	}
+}
+
+func TestDNSForwardLimit(t *testing.T) {
+	s := testDNSServer()
+	s.forwards = make(chan struct{}, 1)
+	s.forwards <- struct{}{}
+	client := &net.UDPAddr{IP: net.ParseIP("10.10.10.3"), Port: 5353}
+	if s.startForward(buildDNSQuery("example.com", dnsTypeA), client) {
+		t.Error("Query was forwarded over the limit")
+	}
+}
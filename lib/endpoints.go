@@ -0,0 +1,207 @@
+package ptp
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Endpoint of a peer is chosen by score calculated from measured RTT
+// and loss, multiplied by the weight of endpoint class. Lower score is
+// better. Current endpoint is replaced only when another one is better
+// by the hysteresis ratio, so endpoints with similar quality don't flap
+
+// EndpointUnmeasuredRTT is used as RTT of endpoints that didn't reply to pings yet
+const EndpointUnmeasuredRTT = time.Millisecond * 100
+
+// EndpointHysteresisMin is the minimal score difference required to switch endpoint
+const EndpointHysteresisMin = 1.0
+
+// Classes of endpoints
+const (
+	EndpointLAN      = "lan"
+	EndpointInternet = "internet"
+	EndpointProxy    = "proxy"
+	EndpointRelay    = "relay"
+)
+
+// EndpointWeights configures endpoint selection
+type EndpointWeights struct {
+	LAN        float64 // Multiplier of LAN endpoint score
+	Internet   float64 // Multiplier of internet endpoint score
+	Proxy      float64 // Multiplier of proxy endpoint score
+	Relay      float64 // Multiplier of score of endpoint over relaying peer
+	Loss       float64 // Milliseconds added to RTT for every percent of loss
+	Hysteresis float64 // How much better another endpoint must be to replace current one
+}
+
+// DefaultEndpointWeights prefers LAN, then internet, then proxies,
+// then relaying peers when their RTT is comparable
+var DefaultEndpointWeights = EndpointWeights{
+	LAN:        0.5,
+	Internet:   1,
+	Proxy:      1.5,
+	Relay:      2,
+	Loss:       10,
+	Hysteresis: 0.2,
+}
+
+// ParseEndpointWeights reads comma-separated list of key=value pairs.
+// Weights that are not specified keep their default values
+func ParseEndpointWeights(list string) (EndpointWeights, error) {
+	weights := DefaultEndpointWeights
+	for _, pair := range strings.Split(list, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return weights, fmt.Errorf("Malformed endpoint weight: %s", pair)
+		}
+		value, err := strconv.ParseFloat(kv[1], 64)
+		if err != nil || value < 0 {
+			return weights, fmt.Errorf("Bad value of endpoint weight %s: %s", kv[0], kv[1])
+		}
+		switch kv[0] {
+		case EndpointLAN:
+			weights.LAN = value
+		case EndpointInternet:
+			weights.Internet = value
+		case EndpointProxy:
+			weights.Proxy = value
+		case EndpointRelay:
+			weights.Relay = value
+		case "loss":
+			weights.Loss = value
+		case "hysteresis":
+			if value >= 1 {
+				return weights, fmt.Errorf("Hysteresis must be less than 1")
+			}
+			weights.Hysteresis = value
+		default:
+			return weights, fmt.Errorf("Unknown endpoint weight: %s", kv[0])
+		}
+	}
+	return weights, nil
+}
+
+// String returns weights in a form accepted by ParseEndpointWeights
+func (w EndpointWeights) String() string {
+	return fmt.Sprintf("lan=%g,internet=%g,proxy=%g,relay=%g,loss=%g,hysteresis=%g", w.LAN, w.Internet, w.Proxy, w.Relay, w.Loss, w.Hysteresis)
+}
+
+// score returns score of the endpoint. Lower is better
+func (w EndpointWeights) score(class string, ep *PeerEndpoint) float64 {
+	rtt := ep.RTT
+	if rtt == 0 {
+		// Endpoint didn't answer any ping yet, including pings in flight
+		rtt = EndpointUnmeasuredRTT
+	}
+	score := float64(rtt)/float64(time.Millisecond) + ep.Loss*w.Loss
+	switch class {
+	case EndpointLAN:
+		return score * w.LAN
+	case EndpointProxy:
+		return score * w.Proxy
+	case EndpointRelay:
+		return score * w.Relay
+	}
+	return score * w.Internet
+}
+
+// classify returns class of the endpoint
+func classify(addr *net.UDPAddr, proxies []*net.UDPAddr) string {
+	if isRelayAddr(addr) {
+		return EndpointRelay
+	}
+	for _, proxy := range proxies {
+		if proxy.String() == addr.String() {
+			return EndpointProxy
+		}
+	}
+	if private, err := isPrivateIP(addr.IP); err == nil && private {
+		return EndpointLAN
+	}
+	return EndpointInternet
+}
+
+// EndpointClass returns class of the peer endpoint: lan, internet, proxy or relay
+func (np *NetworkPeer) EndpointClass(addr *net.UDPAddr) string {
+	return classify(addr, np.GetProxies())
+}
+
+// selectEndpoint returns endpoint that should be used for communication
+// with the peer. Pinned endpoint is used whenever it's active
+func (np *NetworkPeer) selectEndpoint(weights EndpointWeights) *net.UDPAddr {
+	endpoint := np.GetEndpoint()
+	pinned := np.GetPinnedEndpoint()
+	proxies := np.GetProxies()
+	np.EndpointsLock.RLock()
+	defer np.EndpointsLock.RUnlock()
+	var current, best *PeerEndpoint
+	currentScore, bestScore := 0.0, 0.0
+	for i := range np.Endpoints {
+		ep := &np.Endpoints[i]
+		if pinned != "" && ep.Addr.String() == pinned {
+			return ep.Addr
+		}
+		score := weights.score(classify(ep.Addr, proxies), ep)
+		if endpoint != nil && ep.Addr.String() == endpoint.String() {
+			current = ep
+			currentScore = score
+		}
+		if best == nil || score < bestScore {
+			best = ep
+			bestScore = score
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	if current == nil || current == best {
+		return best.Addr
+	}
+	if bestScore < currentScore*(1-weights.Hysteresis) && currentScore-bestScore > EndpointHysteresisMin {
+		Log(Debug, "Switching peer %s from %s (%.1f) to %s (%.1f)", np.ID, current.Addr.String(), currentScore, best.Addr.String(), bestScore)
+		return best.Addr
+	}
+	return current.Addr
+}
+
+// PinEndpoint forces peer to use specified endpoint while it's active.
+// Empty endpoint or "auto" restores automatic selection
+func (p *PeerToPeer) PinEndpoint(id, endpoint string) error {
+	peer := p.Peers.GetPeer(id)
+	if peer == nil {
+		return fmt.Errorf("Peer %s was not found", id)
+	}
+	if endpoint == "" || endpoint == "auto" {
+		peer.setPinnedEndpoint("")
+		Log(Info, "Endpoint of peer %s will be selected automatically", id)
+		return nil
+	}
+	addr, err := net.ResolveUDPAddr("udp4", endpoint)
+	if err != nil {
+		return fmt.Errorf("Bad endpoint: %s", err)
+	}
+	known := false
+	for _, ep := range peer.GetEndpoints() {
+		if ep.Addr.String() == addr.String() {
+			known = true
+		}
+	}
+	for _, ep := range append(peer.GetKnownIPs(), peer.GetProxies()...) {
+		if ep.String() == addr.String() {
+			known = true
+		}
+	}
+	if !known {
+		return fmt.Errorf("Endpoint %s is not known for peer %s", addr.String(), id)
+	}
+	peer.setPinnedEndpoint(addr.String())
+	Log(Info, "Endpoint of peer %s is pinned to %s", id, addr.String())
+	return nil
+}
@@ -0,0 +1,72 @@
+package ptp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseEndpointWeights(t *testing.T) {
+	weights, err := ParseEndpointWeights("proxy=3, hysteresis=0.5")
+	if err != nil || weights.Proxy != 3 || weights.Hysteresis != 0.5 || weights.LAN != DefaultEndpointWeights.LAN {
+		t.Errorf("Wrong weights: %s %v", weights.String(), err)
+	}
+	parsed, err := ParseEndpointWeights(DefaultEndpointWeights.String())
+	if err != nil || parsed != DefaultEndpointWeights {
+		t.Errorf("Weights were changed by formatting: %s", parsed.String())
+	}
+	bad := []string{"proxy", "proxy=-1", "wan=1", "hysteresis=1"}
+	for _, list := range bad {
+		if _, err := ParseEndpointWeights(list); err == nil {
+			t.Errorf("Bad weights were accepted: %s", list)
+		}
+	}
+}
+
+func measuredEndpoint(addr string, rtt time.Duration) PeerEndpoint {
+	ep := PeerEndpoint{LastContact: time.Now()}
+	ep.Addr, _ = net.ResolveUDPAddr("udp4", addr)
+	now := time.Now()
+	ep.pong(ep.nextPing(now, DefaultTuning.PingInterval), now.Add(rtt))
+	return ep
+}
+
+func TestSelectEndpoint(t *testing.T) {
+	np := new(NetworkPeer)
+	direct := measuredEndpoint("8.8.8.8:6881", time.Millisecond*200)
+	proxy := measuredEndpoint("9.9.9.9:6881", time.Millisecond*20)
+	np.Proxies = []*net.UDPAddr{proxy.Addr}
+	np.Endpoints = []PeerEndpoint{direct, proxy}
+
+	// Proxy that is much faster than congested direct path wins
+	np.Endpoint = np.selectEndpoint(DefaultEndpointWeights)
+	if np.Endpoint.String() != proxy.Addr.String() {
+		t.Errorf("Wrong endpoint selected: %s", np.Endpoint)
+	}
+
+	// Slightly better endpoint doesn't replace current one
+	np.Endpoints[0] = measuredEndpoint("8.8.8.8:6881", time.Millisecond*27)
+	if ep := np.selectEndpoint(DefaultEndpointWeights); ep.String() != proxy.Addr.String() {
+		t.Errorf("Endpoint was switched within hysteresis: %s", ep)
+	}
+	np.Endpoints[0] = measuredEndpoint("8.8.8.8:6881", time.Millisecond*10)
+	if ep := np.selectEndpoint(DefaultEndpointWeights); ep.String() != direct.Addr.String() {
+		t.Errorf("Endpoint wasn't switched to a better one: %s", ep)
+	}
+
+	// Endpoint that was pinged but didn't answer yet doesn't replace current one
+	pending := PeerEndpoint{LastContact: time.Now()}
+	pending.Addr, _ = net.ResolveUDPAddr("udp4", "192.168.1.5:6881")
+	pending.nextPing(time.Now(), DefaultTuning.PingInterval)
+	np.Endpoint = direct.Addr
+	np.Endpoints = append(np.Endpoints, pending)
+	if ep := np.selectEndpoint(DefaultEndpointWeights); ep.String() != direct.Addr.String() {
+		t.Errorf("Endpoint was switched to one that never answered: %s", ep)
+	}
+
+	// Pinned endpoint is used regardless of its score
+	np.PinnedEndpoint = proxy.Addr.String()
+	if ep := np.selectEndpoint(DefaultEndpointWeights); ep.String() != proxy.Addr.String() {
+		t.Errorf("Pinned endpoint wasn't used: %s", ep)
+	}
+}
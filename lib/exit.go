@@ -0,0 +1,294 @@
+package ptp
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Exit node is a peer that routes internet traffic of the swarm. It
+// advertises a default route and masquerades traffic of the overlay
+// network. Clients that opted in replace their default route with two
+// halves (0.0.0.0/1 and 128.0.0.0/1) pointing to the exit node, and keep
+// underlay endpoints reachable through the original gateway. Bypass route
+// is added before the first message is sent to a new underlay address,
+// so endpoint changes never send the overlay into its own tunnel
+
+// ExitBypassInterval is how often host routes for underlay endpoints are updated
+const ExitBypassInterval = time.Second * 5
+
+// exitRoutes are installed instead of the default route on clients
+var exitRoutes = []*net.IPNet{
+	{IP: net.IPv4(0, 0, 0, 0).To4(), Mask: net.CIDRMask(1, 32)},
+	{IP: net.IPv4(128, 0, 0, 0).To4(), Mask: net.CIDRMask(1, 32)},
+}
+
+// exitClient holds state of the routes installed to use an exit node
+type exitClient struct {
+	Gateway     net.IP          // Overlay IP of the exit node
+	Uplink      net.IP          // Original default gateway
+	UplinkDev   string          // Interface of the original default gateway
+	bypass      map[string]bool // Checked underlay addresses, true if routed through the original gateway
+	lastUpdated time.Time
+	lock        sync.Mutex
+}
+
+// isDefaultRoute returns true for 0.0.0.0/0
+func isDefaultRoute(network *net.IPNet) bool {
+	ones, bits := network.Mask.Size()
+	return ones == 0 && bits == 32
+}
+
+// EnableExitGateway turns this instance into exit node
+func (p *PeerToPeer) EnableExitGateway() error {
+	err := setupNAT(p.Interface.GetName(), p.Dht.Network)
+	if err != nil {
+		return err
+	}
+	p.ExitGateway = true
+	_, network, _ := net.ParseCIDR("0.0.0.0/0")
+	p.Routes = append(p.Routes, network)
+	Log(Info, "Instance is serving as exit node for %s", p.Dht.Network.String())
+	return nil
+}
+
+// DisableExitGateway stops routing internet traffic of peers
+func (p *PeerToPeer) DisableExitGateway() {
+	if !p.ExitGateway {
+		return
+	}
+	p.ExitGateway = false
+	err := teardownNAT(p.Interface.GetName(), p.Dht.Network)
+	if err != nil {
+		Log(Error, "Failed to remove NAT rules: %s", err)
+	}
+}
+
+// exitState returns routes installed to use exit node or nil
+func (p *PeerToPeer) exitState() *exitClient {
+	p.exitLock.RLock()
+	defer p.exitLock.RUnlock()
+	return p.exit
+}
+
+// useExitNode replaces default route with routes through the exit node
+func (p *PeerToPeer) useExitNode(gateway net.IP) error {
+	uplink, dev, err := defaultGateway()
+	if err != nil {
+		return err
+	}
+	p.exitLock.Lock()
+	p.exit = &exitClient{
+		Gateway:   gateway,
+		Uplink:    uplink,
+		UplinkDev: dev,
+		bypass:    make(map[string]bool),
+	}
+	p.exitLock.Unlock()
+	// Underlay must stay reachable before default route is replaced
+	p.updateExitBypass()
+	for _, network := range exitRoutes {
+		err = p.Interface.AddRoute(network, gateway)
+		if err != nil {
+			p.releaseExitNode()
+			return err
+		}
+	}
+	Log(Info, "Internet traffic is routed through exit node %s", gateway.String())
+	return nil
+}
+
+// ExitRoute returns overlay IP of the exit node in use and number of
+// bypass routes. Nil is returned when exit node is not used
+func (p *PeerToPeer) ExitRoute() (net.IP, int) {
+	c := p.exitState()
+	if c == nil {
+		return nil, 0
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	routes := 0
+	for _, routed := range c.bypass {
+		if routed {
+			routes++
+		}
+	}
+	return c.Gateway, routes
+}
+
+// releaseExitNode restores original routing
+func (p *PeerToPeer) releaseExitNode() {
+	p.exitLock.Lock()
+	c := p.exit
+	p.exit = nil
+	p.exitLock.Unlock()
+	if c == nil {
+		return
+	}
+	for _, network := range exitRoutes {
+		p.Interface.DelRoute(network, c.Gateway)
+	}
+	c.lock.Lock()
+	for ip, routed := range c.bypass {
+		if !routed {
+			continue
+		}
+		err := delHostRoute(net.ParseIP(ip), c.Uplink, c.UplinkDev)
+		if err != nil {
+			Log(Debug, "Failed to remove bypass route to %s: %s", ip, err)
+		}
+	}
+	c.bypass = make(map[string]bool)
+	c.lock.Unlock()
+	Log(Info, "Exit node is no longer used")
+}
+
+// updateExitBypass routes underlay addresses of bootstrap nodes, peers
+// and proxies through the original gateway
+func (p *PeerToPeer) updateExitBypass() {
+	c := p.exitState()
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.lastUpdated = time.Now()
+	for _, ip := range p.underlayAddresses() {
+		c.bypassIP(ip)
+	}
+}
+
+// bypassIP routes underlay address through the original gateway unless
+// it was checked already. Must be called under lock
+func (c *exitClient) bypassIP(ip net.IP) {
+	if ip == nil {
+		return
+	}
+	if _, checked := c.bypass[ip.String()]; checked {
+		return
+	}
+	if isDirectlyConnected(ip) {
+		c.bypass[ip.String()] = false
+		return
+	}
+	err := addHostRoute(ip, c.Uplink, c.UplinkDev)
+	if err != nil {
+		Log(Debug, "Failed to add bypass route to %s: %s", ip.String(), err)
+		return
+	}
+	c.bypass[ip.String()] = true
+}
+
+// exitBypass makes sure that underlay address is routed through the
+// original gateway before a message is sent to it
+func (p *PeerToPeer) exitBypass(addr *net.UDPAddr) {
+	c := p.exitState()
+	if c == nil || addr == nil {
+		return
+	}
+	c.lock.Lock()
+	c.bypassIP(addr.IP)
+	c.lock.Unlock()
+}
+
+// checkExitNode periodically updates bypass routes
+func (p *PeerToPeer) checkExitNode() {
+	c := p.exitState()
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	updated := c.lastUpdated
+	c.lock.Unlock()
+	if time.Since(updated) < ExitBypassInterval {
+		return
+	}
+	p.updateExitBypass()
+}
+
+// underlayAddresses collects remote addresses this instance communicates with
+func (p *PeerToPeer) underlayAddresses() []net.IP {
+	result := []net.IP{}
+	if p.Dht != nil {
+		for _, conn := range p.Dht.Connections {
+			if conn == nil {
+				continue
+			}
+			if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+				result = append(result, addr.IP)
+			}
+		}
+	}
+	if p.Peers != nil {
+		for _, peer := range p.Peers.Get() {
+			for _, addr := range peer.GetKnownIPs() {
+				result = append(result, addr.IP)
+			}
+			for _, addr := range peer.GetProxies() {
+				result = append(result, addr.IP)
+			}
+			for _, ep := range peer.GetEndpoints() {
+				if !isRelayAddr(ep.Addr) {
+					result = append(result, ep.Addr.IP)
+				}
+			}
+		}
+	}
+	if p.ProxyManager != nil {
+		for _, proxy := range p.ProxyManager.get() {
+			result = append(result, proxy.Addr.IP)
+			if proxy.Endpoint != nil {
+				result = append(result, proxy.Endpoint.IP)
+			}
+		}
+	}
+	for _, addr := range p.StaticPeers {
+		result = append(result, addr.IP)
+	}
+	return result
+}
+
+// isDirectlyConnected returns true if address belongs to a network
+// of any local interface
+func isDirectlyConnected(ip net.IP) bool {
+	if ip == nil || ip.To4() == nil || ip.IsLoopback() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if network, ok := addr.(*net.IPNet); ok && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseDefaultRoute extracts gateway and device from the output of
+// `ip route show default`
+func parseDefaultRoute(output string) (net.IP, string, error) {
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] != "default" {
+			continue
+		}
+		var gateway net.IP
+		dev := ""
+		for i := 1; i < len(fields)-1; i++ {
+			switch fields[i] {
+			case "via":
+				gateway = net.ParseIP(fields[i+1])
+			case "dev":
+				dev = fields[i+1]
+			}
+		}
+		if gateway != nil && gateway.To4() != nil {
+			return gateway, dev, nil
+		}
+	}
+	return nil, "", fmt.Errorf("Default gateway was not found")
+}
@@ -0,0 +1,103 @@
+// +build linux
+
+package ptp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+const ipForwardPath = "/proc/sys/net/ipv4/ip_forward"
+
+// routeTool returns path to `ip` without logging it on every call
+func routeTool() string {
+	path, err := exec.LookPath("ip")
+	if err != nil {
+		return "/bin/ip"
+	}
+	return path
+}
+
+// natRules returns iptables rules used to masquerade overlay network
+func natRules(dev string, network *net.IPNet) [][]string {
+	return [][]string{
+		{"-t", "nat", "POSTROUTING", "-s", network.String(), "!", "-o", dev, "-j", "MASQUERADE"},
+		{"-t", "filter", "FORWARD", "-i", dev, "-s", network.String(), "-j", "ACCEPT"},
+		{"-t", "filter", "FORWARD", "-o", dev, "-d", network.String(), "-m", "state", "--state", "RELATED,ESTABLISHED", "-j", "ACCEPT"},
+	}
+}
+
+// iptables inserts or deletes rule. Rule is given as table followed by chain
+func iptables(action string, rule []string) error {
+	args := append([]string{rule[0], rule[1], action, rule[2]}, rule[3:]...)
+	Log(Debug, "Executing: iptables %s", strings.Join(args, " "))
+	out, err := exec.Command("iptables", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("iptables %s: %s", strings.TrimSpace(string(out)), err)
+	}
+	return nil
+}
+
+// setupNAT enables forwarding and masquerades traffic of the overlay network
+func setupNAT(dev string, network *net.IPNet) error {
+	if network == nil {
+		return fmt.Errorf("Overlay network is unknown")
+	}
+	err := ioutil.WriteFile(ipForwardPath, []byte("1"), 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to enable IP forwarding: %s", err)
+	}
+	for _, rule := range natRules(dev, network) {
+		// Rule may be left from previous run
+		if iptables("-C", rule) == nil {
+			continue
+		}
+		err = iptables("-A", rule)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// teardownNAT removes rules added by setupNAT. IP forwarding is left
+// enabled since it may be required by other software
+func teardownNAT(dev string, network *net.IPNet) error {
+	if network == nil {
+		return nil
+	}
+	var result error
+	for _, rule := range natRules(dev, network) {
+		err := iptables("-D", rule)
+		if err != nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// defaultGateway returns gateway and device of the system default route
+func defaultGateway() (net.IP, string, error) {
+	out, err := exec.Command(routeTool(), "-4", "route", "show", "default").Output()
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to read routing table: %s", err)
+	}
+	return parseDefaultRoute(string(out))
+}
+
+// addHostRoute routes single address through specified gateway
+func addHostRoute(ip, gateway net.IP, dev string) error {
+	args := []string{"route", "replace", ip.String() + "/32", "via", gateway.String()}
+	if dev != "" {
+		args = append(args, "dev", dev)
+	}
+	return exec.Command(routeTool(), args...).Run()
+}
+
+// delHostRoute removes route added by addHostRoute
+func delHostRoute(ip, gateway net.IP, dev string) error {
+	return exec.Command(routeTool(), "route", "del", ip.String()+"/32", "via", gateway.String()).Run()
+}
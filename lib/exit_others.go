@@ -0,0 +1,28 @@
+// +build !linux
+
+package ptp
+
+import (
+	"fmt"
+	"net"
+)
+
+func setupNAT(dev string, network *net.IPNet) error {
+	return fmt.Errorf("Exit node is supported on Linux only")
+}
+
+func teardownNAT(dev string, network *net.IPNet) error {
+	return nil
+}
+
+func defaultGateway() (net.IP, string, error) {
+	return nil, "", fmt.Errorf("Exit node is supported on Linux only")
+}
+
+func addHostRoute(ip, gateway net.IP, dev string) error {
+	return fmt.Errorf("Exit node is supported on Linux only")
+}
+
+func delHostRoute(ip, gateway net.IP, dev string) error {
+	return nil
+}
@@ -0,0 +1,47 @@
+package ptp
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseDefaultRoute(t *testing.T) {
+	output := "default via 192.168.1.1 dev eth0 proto dhcp metric 100\ndefault via 10.0.0.1 dev wlan0 metric 600\n"
+	gateway, dev, err := parseDefaultRoute(output)
+	if err != nil || !gateway.Equal(net.ParseIP("192.168.1.1")) || dev != "eth0" {
+		t.Errorf("Wrong default route: %s %s %v", gateway, dev, err)
+	}
+	if _, _, err := parseDefaultRoute("10.0.0.0/8 dev eth0 scope link\n"); err == nil {
+		t.Error("Default route was found in routing table without it")
+	}
+	if _, _, err := parseDefaultRoute("default dev tun0 scope link\n"); err == nil {
+		t.Error("Default route without gateway was accepted")
+	}
+}
+
+func TestIsDefaultRoute(t *testing.T) {
+	_, def, _ := net.ParseCIDR("0.0.0.0/0")
+	_, half, _ := net.ParseCIDR("0.0.0.0/1")
+	if !isDefaultRoute(def) {
+		t.Error("0.0.0.0/0 is not recognized as default route")
+	}
+	if isDefaultRoute(half) {
+		t.Error("0.0.0.0/1 is recognized as default route")
+	}
+}
+
+func TestExitBypass(t *testing.T) {
+	ptpc := new(PeerToPeer)
+	ptpc.exitBypass(&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 6881})
+	if gateway, _ := ptpc.ExitRoute(); gateway != nil {
+		t.Fatalf("Exit node is used without routes")
+	}
+	ptpc.exit = &exitClient{Gateway: net.ParseIP("10.10.10.1"), bypass: make(map[string]bool)}
+	ptpc.exitBypass(&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 6881})
+	if _, checked := ptpc.exit.bypass["127.0.0.1"]; !checked {
+		t.Errorf("Address of new endpoint wasn't checked")
+	}
+	if gateway, routes := ptpc.ExitRoute(); !gateway.Equal(net.ParseIP("10.10.10.1")) || routes != 0 {
+		t.Errorf("Directly connected address was routed: %d", routes)
+	}
+}
@@ -0,0 +1,610 @@
+package ptp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Firewall filters IPv4 and IPv6 traffic between this instance and its
+// peers. Rules are evaluated in order and the first matching rule wins.
+// Packets belonging to a connection that was already allowed in any
+// direction are accepted without evaluation. ARP is always allowed and
+// frames of other protocols get the default action
+
+// FirewallAction is a verdict of a firewall rule
+type FirewallAction int
+
+// Firewall actions
+const (
+	FirewallAllow FirewallAction = 0
+	FirewallDeny  FirewallAction = 1
+)
+
+// FirewallDirection specifies traffic direction relative to this instance
+type FirewallDirection int
+
+// Firewall directions
+const (
+	FirewallAny FirewallDirection = 0 // Rule matches traffic in both directions
+	FirewallIn  FirewallDirection = 1 // Traffic received from peers
+	FirewallOut FirewallDirection = 2 // Traffic sent to peers
+)
+
+// Connection tracking timeouts
+const (
+	ConntrackTCPTimeout   = time.Minute * 5
+	ConntrackUDPTimeout   = time.Second * 60
+	ConntrackOtherTimeout = time.Second * 30
+	ConntrackMaxEntries   = 65536 // New connections aren't tracked when table is full
+)
+
+// IP protocol numbers supported by rules
+const (
+	protoICMP uint8 = 1
+	protoTCP  uint8 = 6
+	protoUDP  uint8 = 17
+)
+
+// IPv6 next header values
+const (
+	ipv6HopByHop    uint8 = 0
+	ipv6Routing     uint8 = 43
+	ipv6Fragment    uint8 = 44
+	ipv6AuthHeader  uint8 = 51
+	ipv6DestOptions uint8 = 60
+	ipv6ICMP        uint8 = 58
+)
+
+// FirewallRule describes a single filtering rule. Empty fields match
+// everything. Network and port are matched against remote side of the
+// connection for outbound traffic and port against local side for inbound
+type FirewallRule struct {
+	Hits      uint64 `yaml:"-" json:"hits"`              // Must be first to stay aligned for atomic access
+	Action    string `yaml:"action" json:"action"`       // allow or deny
+	Direction string `yaml:"direction" json:"direction"` // in, out or empty for both
+	Peer      string `yaml:"peer" json:"peer"`           // ID of a remote peer
+	Network   string `yaml:"network" json:"network"`     // Remote IPv4 or IPv6 address or network in CIDR notation
+	Protocol  string `yaml:"protocol" json:"protocol"`   // tcp, udp, icmp (ICMPv6 included) or empty for any
+	Port      int    `yaml:"port" json:"port"`           // Destination port of TCP or UDP
+
+	action    FirewallAction
+	direction FirewallDirection
+	network   *net.IPNet
+	protocol  uint8
+}
+
+// FirewallConfig is a format of a rules file
+type FirewallConfig struct {
+	Default string          `yaml:"default"` // Action for packets that didn't match any rule
+	Rules   []*FirewallRule `yaml:"rules"`
+}
+
+type connKey struct {
+	Protocol   uint8
+	Remote     [16]byte
+	RemotePort uint16
+	LocalPort  uint16
+}
+
+// Firewall is a stateful packet filter of a single instance
+type Firewall struct {
+	DefaultHits uint64 // Packets that didn't match any rule
+	rules       []*FirewallRule
+	Default     FirewallAction
+	conntrack   map[connKey]time.Time
+	lock        sync.RWMutex
+	lastExpire  time.Time
+}
+
+// ipFlow holds fields of an IP packet that are used by firewall
+type ipFlow struct {
+	Protocol uint8
+	Src      net.IP
+	Dst      net.IP
+	SrcPort  uint16
+	DstPort  uint16
+}
+
+// Init will initialize firewall with no rules and allow policy
+func (f *Firewall) Init() {
+	f.rules = []*FirewallRule{}
+	f.conntrack = make(map[connKey]time.Time)
+	f.Default = FirewallAllow
+}
+
+// ParseFirewallAction converts name of the action
+func ParseFirewallAction(action string) (FirewallAction, error) {
+	switch strings.ToLower(action) {
+	case "allow", "accept":
+		return FirewallAllow, nil
+	case "deny", "drop":
+		return FirewallDeny, nil
+	}
+	return FirewallAllow, fmt.Errorf("Unknown firewall action: %s", action)
+}
+
+// StringifyFirewallAction returns name of the action
+func StringifyFirewallAction(action FirewallAction) string {
+	if action == FirewallDeny {
+		return "deny"
+	}
+	return "allow"
+}
+
+// compile validates rule and fills parsed fields
+func (r *FirewallRule) compile() error {
+	var err error
+	r.action, err = ParseFirewallAction(r.Action)
+	if err != nil {
+		return err
+	}
+	r.Action = StringifyFirewallAction(r.action)
+	switch strings.ToLower(r.Direction) {
+	case "", "any":
+		r.direction = FirewallAny
+		r.Direction = ""
+	case "in":
+		r.direction = FirewallIn
+	case "out":
+		r.direction = FirewallOut
+	default:
+		return fmt.Errorf("Unknown direction: %s", r.Direction)
+	}
+	r.network = nil
+	if r.Network != "" {
+		cidr := r.Network
+		if !strings.Contains(cidr, "/") {
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+		_, r.network, err = net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("Bad network: %s", r.Network)
+		}
+	}
+	switch strings.ToLower(r.Protocol) {
+	case "", "any":
+		r.protocol = 0
+		r.Protocol = ""
+	case "icmp":
+		r.protocol = protoICMP
+	case "tcp":
+		r.protocol = protoTCP
+	case "udp":
+		r.protocol = protoUDP
+	default:
+		return fmt.Errorf("Unknown protocol: %s", r.Protocol)
+	}
+	if r.Port < 0 || r.Port > 65535 {
+		return fmt.Errorf("Bad port: %d", r.Port)
+	}
+	if r.Port != 0 && r.protocol != protoTCP && r.protocol != protoUDP {
+		return fmt.Errorf("Port can be used only with tcp or udp protocol")
+	}
+	return nil
+}
+
+// ParseFirewallRule parses rule from comma-separated key=value list, e.g.
+// "action=allow,direction=in,protocol=tcp,port=22,network=10.10.10.0/24"
+func ParseFirewallRule(spec string) (*FirewallRule, error) {
+	rule := &FirewallRule{}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Bad rule part: %s", part)
+		}
+		switch strings.ToLower(kv[0]) {
+		case "action":
+			rule.Action = kv[1]
+		case "direction", "dir":
+			rule.Direction = kv[1]
+		case "peer", "id":
+			rule.Peer = kv[1]
+		case "network", "ip":
+			rule.Network = kv[1]
+		case "protocol", "proto":
+			rule.Protocol = kv[1]
+		case "port":
+			port, err := strconv.Atoi(kv[1])
+			if err != nil {
+				return nil, fmt.Errorf("Bad port: %s", kv[1])
+			}
+			rule.Port = port
+		default:
+			return nil, fmt.Errorf("Unknown rule field: %s", kv[0])
+		}
+	}
+	err := rule.compile()
+	if err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+// String returns rule in the format accepted by ParseFirewallRule
+func (r *FirewallRule) String() string {
+	parts := []string{"action=" + r.Action}
+	if r.Direction != "" {
+		parts = append(parts, "direction="+r.Direction)
+	}
+	if r.Peer != "" {
+		parts = append(parts, "peer="+r.Peer)
+	}
+	if r.Network != "" {
+		parts = append(parts, "network="+r.Network)
+	}
+	if r.Protocol != "" {
+		parts = append(parts, "protocol="+r.Protocol)
+	}
+	if r.Port != 0 {
+		parts = append(parts, fmt.Sprintf("port=%d", r.Port))
+	}
+	return strings.Join(parts, ",")
+}
+
+// LoadRules replaces rules and default policy with contents of a YAML file
+func (f *Firewall) LoadRules(filepath string) error {
+	data, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		return fmt.Errorf("Failed to read rules file: %s", err)
+	}
+	config := &FirewallConfig{}
+	err = yaml.Unmarshal(data, config)
+	if err != nil {
+		return fmt.Errorf("Failed to parse rules file: %s", err)
+	}
+	def := FirewallAllow
+	if config.Default != "" {
+		def, err = ParseFirewallAction(config.Default)
+		if err != nil {
+			return err
+		}
+	}
+	for i, rule := range config.Rules {
+		err = rule.compile()
+		if err != nil {
+			return fmt.Errorf("Rule %d: %s", i+1, err)
+		}
+	}
+	f.lock.Lock()
+	f.rules = config.Rules
+	f.Default = def
+	f.conntrack = make(map[connKey]time.Time)
+	f.lock.Unlock()
+	return nil
+}
+
+// AddRule appends a rule to the end of the list
+func (f *Firewall) AddRule(rule *FirewallRule) error {
+	err := rule.compile()
+	if err != nil {
+		return err
+	}
+	f.lock.Lock()
+	f.rules = append(f.rules, rule)
+	f.lock.Unlock()
+	return nil
+}
+
+// RemoveRule removes rule by its position starting from 1
+func (f *Firewall) RemoveRule(index int) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if index < 1 || index > len(f.rules) {
+		return fmt.Errorf("Rule %d doesn't exist", index)
+	}
+	f.rules = append(f.rules[:index-1], f.rules[index:]...)
+	return nil
+}
+
+// SetDefault changes action for packets that didn't match any rule
+func (f *Firewall) SetDefault(action FirewallAction) {
+	f.lock.Lock()
+	f.Default = action
+	f.lock.Unlock()
+}
+
+// Rules returns copy of the rules list with hit counters
+func (f *Firewall) Rules() []FirewallRule {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	result := []FirewallRule{}
+	for _, rule := range f.rules {
+		r := *rule
+		r.Hits = atomic.LoadUint64(&rule.Hits)
+		result = append(result, r)
+	}
+	return result
+}
+
+// Policy returns default action and number of packets it was applied to
+func (f *Firewall) Policy() (FirewallAction, uint64) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return f.Default, atomic.LoadUint64(&f.DefaultHits)
+}
+
+// active returns false when firewall would accept every packet
+func (f *Firewall) active() bool {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return len(f.rules) > 0 || f.Default != FirewallAllow
+}
+
+// Allow checks whether IPv4 or IPv6 packet may pass in specified direction.
+// Peer is an ID of the remote peer or empty string if it's unknown
+func (f *Firewall) Allow(direction FirewallDirection, peer string, packet []byte) bool {
+	if !f.active() {
+		return true
+	}
+	flow, err := parseIPFlow(packet)
+	if err != nil {
+		return false
+	}
+	key := connKey{Protocol: flow.Protocol}
+	remote := flow.Dst
+	port := flow.DstPort
+	if direction == FirewallIn {
+		remote = flow.Src
+		copy(key.Remote[:], flow.Src.To16())
+		key.RemotePort = flow.SrcPort
+		key.LocalPort = flow.DstPort
+	} else {
+		copy(key.Remote[:], flow.Dst.To16())
+		key.RemotePort = flow.DstPort
+		key.LocalPort = flow.SrcPort
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.expire()
+	if seen, exists := f.conntrack[key]; exists && time.Since(seen) < conntrackTimeout(flow.Protocol) {
+		f.conntrack[key] = time.Now()
+		return true
+	}
+	action := f.Default
+	matched := false
+	for _, rule := range f.rules {
+		if rule.match(direction, peer, flow.Protocol, remote, port) {
+			atomic.AddUint64(&rule.Hits, 1)
+			action = rule.action
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		atomic.AddUint64(&f.DefaultHits, 1)
+	}
+	if action == FirewallAllow {
+		f.track(key)
+		return true
+	}
+	return false
+}
+
+// AllowOther applies default action to a frame that is neither IP nor ARP
+func (f *Firewall) AllowOther() bool {
+	if !f.active() {
+		return true
+	}
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	atomic.AddUint64(&f.DefaultHits, 1)
+	return f.Default == FirewallAllow
+}
+
+// track adds connection to the table unless it's full even after
+// outdated connections were removed. Must be called under lock
+func (f *Firewall) track(key connKey) {
+	if _, exists := f.conntrack[key]; !exists && len(f.conntrack) >= ConntrackMaxEntries {
+		f.lastExpire = time.Time{}
+		f.expire()
+		if len(f.conntrack) >= ConntrackMaxEntries {
+			return
+		}
+	}
+	f.conntrack[key] = time.Now()
+}
+
+func (r *FirewallRule) match(direction FirewallDirection, peer string, protocol uint8, remote net.IP, port uint16) bool {
+	if r.direction != FirewallAny && r.direction != direction {
+		return false
+	}
+	if r.Peer != "" && r.Peer != peer {
+		return false
+	}
+	if r.network != nil && !r.network.Contains(remote) {
+		return false
+	}
+	if r.protocol != 0 && r.protocol != protocol {
+		return false
+	}
+	if r.Port != 0 && int(port) != r.Port {
+		return false
+	}
+	return true
+}
+
+// expire removes outdated connections once in a while. Must be called under lock
+func (f *Firewall) expire() {
+	if time.Since(f.lastExpire) < time.Second*10 {
+		return
+	}
+	f.lastExpire = time.Now()
+	for key, seen := range f.conntrack {
+		if time.Since(seen) > conntrackTimeout(key.Protocol) {
+			delete(f.conntrack, key)
+		}
+	}
+}
+
+// Connections returns number of tracked connections
+func (f *Firewall) Connections() int {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return len(f.conntrack)
+}
+
+func conntrackTimeout(protocol uint8) time.Duration {
+	switch protocol {
+	case protoTCP:
+		return ConntrackTCPTimeout
+	case protoUDP:
+		return ConntrackUDPTimeout
+	}
+	return ConntrackOtherTimeout
+}
+
+// parseIPFlow extracts addresses, protocol and ports from IPv4 or IPv6 packet
+func parseIPFlow(packet []byte) (*ipFlow, error) {
+	if len(packet) > 0 && packet[0]>>4 == 6 {
+		return parseIPv6Flow(packet)
+	}
+	return parseIPv4Flow(packet)
+}
+
+// parseIPv4Flow extracts addresses, protocol and ports from IPv4 packet
+func parseIPv4Flow(packet []byte) (*ipFlow, error) {
+	if len(packet) < 20 || packet[0]>>4 != 4 {
+		return nil, fmt.Errorf("Not an IPv4 packet")
+	}
+	ihl := int(packet[0]&0x0f) * 4
+	if ihl < 20 || len(packet) < ihl {
+		return nil, fmt.Errorf("Malformed IPv4 header")
+	}
+	flow := &ipFlow{
+		Protocol: packet[9],
+		Src:      net.IP(packet[12:16]),
+		Dst:      net.IP(packet[16:20]),
+	}
+	// Only first fragment carries ports
+	fragmentOffset := binary.BigEndian.Uint16(packet[6:8]) & 0x1fff
+	if (flow.Protocol == protoTCP || flow.Protocol == protoUDP) && fragmentOffset == 0 && len(packet) >= ihl+4 {
+		flow.SrcPort = binary.BigEndian.Uint16(packet[ihl : ihl+2])
+		flow.DstPort = binary.BigEndian.Uint16(packet[ihl+2 : ihl+4])
+	}
+	return flow, nil
+}
+
+// parseIPv6Flow extracts addresses, protocol and ports from IPv6 packet.
+// Extension headers are skipped and ICMPv6 is reported as ICMP
+func parseIPv6Flow(packet []byte) (*ipFlow, error) {
+	if len(packet) < 40 || packet[0]>>4 != 6 {
+		return nil, fmt.Errorf("Not an IPv6 packet")
+	}
+	flow := &ipFlow{
+		Protocol: packet[6],
+		Src:      net.IP(packet[8:24]),
+		Dst:      net.IP(packet[24:40]),
+	}
+	offset := 40
+	fragmented := false
+	for {
+		var length int
+		switch flow.Protocol {
+		case ipv6HopByHop, ipv6Routing, ipv6DestOptions:
+			if len(packet) < offset+2 {
+				return nil, fmt.Errorf("Malformed IPv6 extension header")
+			}
+			length = (int(packet[offset+1]) + 1) * 8
+		case ipv6Fragment:
+			if len(packet) < offset+8 {
+				return nil, fmt.Errorf("Malformed IPv6 fragment header")
+			}
+			fragmented = binary.BigEndian.Uint16(packet[offset+2:offset+4])>>3 != 0
+			length = 8
+		case ipv6AuthHeader:
+			if len(packet) < offset+2 {
+				return nil, fmt.Errorf("Malformed IPv6 authentication header")
+			}
+			length = (int(packet[offset+1]) + 2) * 4
+		case ipv6ICMP:
+			flow.Protocol = protoICMP
+			return flow, nil
+		default:
+			if (flow.Protocol == protoTCP || flow.Protocol == protoUDP) && !fragmented && len(packet) >= offset+4 {
+				flow.SrcPort = binary.BigEndian.Uint16(packet[offset : offset+2])
+				flow.DstPort = binary.BigEndian.Uint16(packet[offset+2 : offset+4])
+			}
+			return flow, nil
+		}
+		if len(packet) < offset+length {
+			return nil, fmt.Errorf("Truncated IPv6 extension header")
+		}
+		flow.Protocol = packet[offset]
+		offset += length
+	}
+}
+
+// filterFrame applies firewall to an Ethernet frame. ARP frames are
+// allowed and frames other than IPv4 and IPv6 get the default action
+func (p *PeerToPeer) filterFrame(direction FirewallDirection, peer string, frame []byte) bool {
+	if len(frame) < 14 {
+		return true
+	}
+	switch PacketType(binary.BigEndian.Uint16(frame[12:14])) {
+	case PacketIPv4, PacketIPv6:
+		return p.Firewall.Allow(direction, peer, frame[14:])
+	case PacketARP:
+		return true
+	}
+	return p.Firewall.AllowOther()
+}
+
+// frameSender returns ID of a peer which sent Ethernet frame from specified
+// address. Sender is resolved from the address, and frame is valid when it
+// came from active endpoint of the peer and its source hardware address
+// doesn't belong to another peer or local host. Unknown address is learned
+// behind the sender in bridge mode, since first frames of a new host may
+// arrive before the sender advertises it
+func (p *PeerToPeer) frameSender(frame []byte, srcAddr *net.UDPAddr) (string, bool) {
+	sender := p.peerBySource(srcAddr)
+	if len(frame) < 14 || sender == "" {
+		return sender, false
+	}
+	src := net.HardwareAddr(frame[6:12]).String()
+	owner, err := p.Peers.GetIDByMac(src)
+	if err == nil {
+		return sender, owner == sender
+	}
+	if !p.BridgeMode {
+		return sender, true
+	}
+	if owner, exists := p.MACTable.lookup(src); exists {
+		return sender, owner == sender
+	}
+	if p.MACTable.learn(src, sender) {
+		Log(Debug, "Learned hardware address %s behind peer %s from traffic", src, sender)
+	}
+	return sender, true
+}
+
+// peerBySource returns ID of a peer with specified active endpoint
+// or relay path
+func (p *PeerToPeer) peerBySource(addr *net.UDPAddr) string {
+	if path, exists := p.Relays.lookup(addr); exists {
+		return path.peer
+	}
+	for id, peer := range p.Peers.Get() {
+		if peer.isEndpointActive(addr) {
+			return id
+		}
+	}
+	return ""
+}
@@ -0,0 +1,262 @@
+package ptp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+// buildIPv4 creates IPv4 packet with TCP/UDP ports
+func buildIPv4(proto uint8, src, dst [4]byte, srcPort, dstPort uint16) []byte {
+	packet := make([]byte, 28)
+	packet[0] = 0x45
+	packet[9] = proto
+	copy(packet[12:16], src[:])
+	copy(packet[16:20], dst[:])
+	packet[20] = byte(srcPort >> 8)
+	packet[21] = byte(srcPort)
+	packet[22] = byte(dstPort >> 8)
+	packet[23] = byte(dstPort)
+	return packet
+}
+
+func TestParseFirewallRule(t *testing.T) {
+	rule, err := ParseFirewallRule("action=allow, direction=in, proto=tcp, port=22, ip=10.10.10.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.String() != "action=allow,direction=in,network=10.10.10.0/24,protocol=tcp,port=22" {
+		t.Errorf("Wrong rule: %s", rule.String())
+	}
+	bad := []string{"action=reject", "action=allow,port=22", "action=allow,network=10.0.0.0/33", "action=allow,foo=bar", "action=deny,direction=up"}
+	for _, spec := range bad {
+		if _, err := ParseFirewallRule(spec); err == nil {
+			t.Errorf("Bad rule was accepted: %s", spec)
+		}
+	}
+}
+
+func TestFirewallRules(t *testing.T) {
+	fw := new(Firewall)
+	fw.Init()
+	local := [4]byte{10, 10, 10, 1}
+	remote := [4]byte{10, 10, 10, 2}
+	ssh := buildIPv4(protoTCP, remote, local, 40000, 22)
+	if !fw.Allow(FirewallIn, "peer", ssh) {
+		t.Error("Packet was dropped by empty firewall")
+	}
+	allow, _ := ParseFirewallRule("action=allow,direction=in,protocol=tcp,port=22,peer=peer")
+	fw.AddRule(allow)
+	fw.SetDefault(FirewallDeny)
+	if !fw.Allow(FirewallIn, "peer", ssh) {
+		t.Error("Allowed packet was dropped")
+	}
+	if fw.Allow(FirewallIn, "other", buildIPv4(protoTCP, remote, local, 40001, 22)) {
+		t.Error("Packet from other peer was allowed")
+	}
+	if fw.Allow(FirewallIn, "peer", buildIPv4(protoTCP, remote, local, 40000, 80)) {
+		t.Error("Packet to other port was allowed")
+	}
+	rules := fw.Rules()
+	if len(rules) != 1 || rules[0].Hits != 1 {
+		t.Errorf("Wrong hit counter: %v", rules)
+	}
+	if _, hits := fw.Policy(); hits != 2 {
+		t.Errorf("Wrong default hit counter: %d", hits)
+	}
+	if fw.RemoveRule(2) == nil || fw.RemoveRule(1) != nil {
+		t.Error("Wrong rule removal result")
+	}
+}
+
+func TestFirewallConntrack(t *testing.T) {
+	fw := new(Firewall)
+	fw.Init()
+	deny, _ := ParseFirewallRule("action=deny,direction=in")
+	fw.AddRule(deny)
+	local := [4]byte{10, 10, 10, 1}
+	remote := [4]byte{10, 10, 10, 2}
+	if !fw.Allow(FirewallOut, "peer", buildIPv4(protoUDP, local, remote, 5000, 53)) {
+		t.Fatal("Outbound packet was dropped")
+	}
+	if !fw.Allow(FirewallIn, "peer", buildIPv4(protoUDP, remote, local, 53, 5000)) {
+		t.Error("Reply to tracked connection was dropped")
+	}
+	if fw.Allow(FirewallIn, "peer", buildIPv4(protoUDP, remote, local, 53, 5001)) {
+		t.Error("Untracked inbound packet was allowed")
+	}
+	if fw.Connections() != 1 {
+		t.Errorf("Wrong number of tracked connections: %d", fw.Connections())
+	}
+}
+
+func TestFirewallLoadRules(t *testing.T) {
+	file, err := ioutil.TempFile("", "p2p-rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("default: deny\nrules:\n  - action: allow\n    protocol: icmp\n  - action: allow\n    direction: in\n    protocol: tcp\n    port: 22\n")
+	file.Close()
+	fw := new(Firewall)
+	fw.Init()
+	err = fw.LoadRules(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if action, _ := fw.Policy(); action != FirewallDeny || len(fw.Rules()) != 2 {
+		t.Error("Rules were not loaded")
+	}
+	ioutil.WriteFile(file.Name(), []byte("rules:\n  - action: maybe\n"), 0644)
+	if fw.LoadRules(file.Name()) == nil {
+		t.Error("Malformed rules file was accepted")
+	}
+}
+
+// buildIPv6 creates IPv6 packet with a hop-by-hop header before TCP/UDP ports
+func buildIPv6(proto uint8, src, dst net.IP, srcPort, dstPort uint16) []byte {
+	packet := make([]byte, 52)
+	packet[0] = 0x60
+	packet[6] = ipv6HopByHop
+	copy(packet[8:24], src.To16())
+	copy(packet[24:40], dst.To16())
+	packet[40] = proto
+	packet[48] = byte(srcPort >> 8)
+	packet[49] = byte(srcPort)
+	packet[50] = byte(dstPort >> 8)
+	packet[51] = byte(dstPort)
+	return packet
+}
+
+func TestFirewallIPv6(t *testing.T) {
+	fw := new(Firewall)
+	fw.Init()
+	allow, err := ParseFirewallRule("action=allow,direction=in,protocol=tcp,port=22,network=fd00::/64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.AddRule(allow)
+	fw.SetDefault(FirewallDeny)
+	local := net.ParseIP("fd00::1")
+	remote := net.ParseIP("fd00::2")
+	if !fw.Allow(FirewallIn, "peer", buildIPv6(protoTCP, remote, local, 40000, 22)) {
+		t.Error("Allowed IPv6 packet was dropped")
+	}
+	if fw.Allow(FirewallIn, "peer", buildIPv6(protoTCP, remote, local, 40000, 80)) {
+		t.Error("IPv6 packet to other port was allowed")
+	}
+	if fw.Allow(FirewallIn, "peer", buildIPv6(protoTCP, net.ParseIP("fd01::2"), local, 40000, 22)) {
+		t.Error("IPv6 packet from other network was allowed")
+	}
+}
+
+func TestFirewallFrames(t *testing.T) {
+	ptpc := new(PeerToPeer)
+	ptpc.Firewall = new(Firewall)
+	ptpc.Firewall.Init()
+	ptpc.Firewall.SetDefault(FirewallDeny)
+	frame := func(proto PacketType, payload []byte) []byte {
+		f := make([]byte, 14, 14+len(payload))
+		binary.BigEndian.PutUint16(f[12:14], uint16(proto))
+		return append(f, payload...)
+	}
+	local := net.ParseIP("fd00::1")
+	remote := net.ParseIP("fd00::2")
+	if ptpc.filterFrame(FirewallIn, "peer", frame(PacketIPv6, buildIPv6(protoUDP, remote, local, 53, 5000))) {
+		t.Error("IPv6 frame skipped default policy")
+	}
+	if ptpc.filterFrame(FirewallIn, "peer", frame(PacketType(0x88b5), []byte{1, 2, 3})) {
+		t.Error("Frame of unknown protocol skipped default policy")
+	}
+	if !ptpc.filterFrame(FirewallIn, "peer", frame(PacketARP, make([]byte, 28))) {
+		t.Error("ARP frame was dropped")
+	}
+}
+
+func TestFirewallConntrackLimit(t *testing.T) {
+	fw := new(Firewall)
+	fw.Init()
+	deny, _ := ParseFirewallRule("action=deny,direction=in")
+	fw.AddRule(deny)
+	local := [4]byte{10, 10, 10, 1}
+	for i := 0; i < ConntrackMaxEntries+10; i++ {
+		remote := [4]byte{10, byte(i >> 16), byte(i >> 8), byte(i)}
+		fw.Allow(FirewallOut, "peer", buildIPv4(protoUDP, local, remote, 5000, 53))
+	}
+	if fw.Connections() != ConntrackMaxEntries {
+		t.Errorf("Connection table exceeded its limit: %d", fw.Connections())
+	}
+}
+
+func TestFrameSender(t *testing.T) {
+	ptpc := new(PeerToPeer)
+	ptpc.Peers = new(PeerList)
+	ptpc.Peers.Init()
+	ptpc.MACTable = new(MACTable)
+	ptpc.MACTable.Init()
+	ptpc.Relays = new(RelayManager)
+	ptpc.Relays.init()
+	addrs := []*net.UDPAddr{}
+	for i := 1; i <= 2; i++ {
+		addr, _ := net.ResolveUDPAddr("udp4", fmt.Sprintf("192.168.1.%d:6881", i))
+		np := &NetworkPeer{ID: fmt.Sprintf("%036d", i)}
+		np.PeerHW, _ = net.ParseMAC(fmt.Sprintf("06:00:00:00:00:%02d", i))
+		np.addEndpoint(addr)
+		ptpc.Peers.Update(np.ID, np)
+		addrs = append(addrs, addr)
+	}
+	first := fmt.Sprintf("%036d", 1)
+	second := fmt.Sprintf("%036d", 2)
+	frame := func(src string) []byte {
+		f := make([]byte, 14)
+		hw, _ := net.ParseMAC(src)
+		copy(f[6:12], hw)
+		binary.BigEndian.PutUint16(f[12:14], uint16(PacketIPv4))
+		return f
+	}
+
+	if id, valid := ptpc.frameSender(frame("06:00:00:00:00:01"), addrs[0]); !valid || id != first {
+		t.Errorf("Frame of the peer wasn't accepted: %s", id)
+	}
+	if id, valid := ptpc.frameSender(frame("06:00:00:00:00:01"), addrs[1]); valid || id != second {
+		t.Errorf("Frame with forged source address was accepted: %s", id)
+	}
+	unknown, _ := net.ResolveUDPAddr("udp4", "203.0.113.5:6881")
+	if id, valid := ptpc.frameSender(frame("06:00:00:00:00:01"), unknown); valid || id != "" {
+		t.Errorf("Frame from unknown endpoint was accepted: %s", id)
+	}
+
+	if id, valid := ptpc.frameSender(frame("06:00:00:00:00:07"), addrs[0]); !valid || id != first {
+		t.Errorf("Frame of unknown address from the peer wasn't accepted: %s", id)
+	}
+
+	ptpc.BridgeMode = true
+	ptpc.MACTable.learn("06:00:00:00:00:05", second)
+	ptpc.MACTable.learn("06:00:00:00:00:06", "")
+	if id, valid := ptpc.frameSender(frame("06:00:00:00:00:07"), addrs[0]); !valid || id != first {
+		t.Errorf("Frame of new host behind the peer wasn't accepted: %s", id)
+	}
+	if owner, _ := ptpc.MACTable.lookup("06:00:00:00:00:07"); owner != first {
+		t.Errorf("Address of new host wasn't learned behind the peer: %s", owner)
+	}
+	if _, valid := ptpc.frameSender(frame("06:00:00:00:00:06"), addrs[0]); valid {
+		t.Error("Frame of local host was accepted from the peer")
+	}
+	if id, valid := ptpc.frameSender(frame("06:00:00:00:00:05"), addrs[1]); !valid || id != second {
+		t.Errorf("Frame of address learned behind the peer wasn't accepted: %s", id)
+	}
+	if _, valid := ptpc.frameSender(frame("06:00:00:00:00:05"), addrs[0]); valid {
+		t.Error("Frame of address learned behind other peer was accepted")
+	}
+
+	path := ptpc.Relays.path(second, first)
+	if id, valid := ptpc.frameSender(frame("06:00:00:00:00:01"), path); !valid || id != first {
+		t.Errorf("Frame received over relay wasn't accepted: %s", id)
+	}
+	if _, valid := ptpc.frameSender(frame("06:00:00:00:00:02"), path); valid {
+		t.Error("Frame of relaying peer was accepted from relay path")
+	}
+}
@@ -0,0 +1,143 @@
+package ptp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Peer that leaves the swarm says goodbye to every peer over their active
+// endpoints, so they drop its routes at once instead of waiting for the
+// state relayed by bootstrap node. Goodbye is signed with the same key as
+// LAN announcements, so it can't be forged by hosts outside of the swarm
+// when crypto key is configured. It's bound to the recipient and time and
+// carries a random nonce: every nonce is accepted once, so a captured
+// goodbye can't disconnect the peer again after it reconnects
+
+// GoodbyeMaxSkew limits age of accepted goodbye messages
+const GoodbyeMaxSkew = time.Minute
+
+// goodbyeNonceSize is a size of random nonce of goodbye message
+const goodbyeNonceSize = 16
+
+// goodbyeSize is sender ID, recipient ID, unix time in nanoseconds, nonce and HMAC
+const goodbyeSize = 36 + 36 + 8 + goodbyeNonceSize + sha256.Size
+
+// goodbyeNonces remembers nonces of accepted goodbye messages for as long
+// as such messages are considered fresh
+type goodbyeNonces struct {
+	seen map[string]time.Time
+	lock sync.Mutex
+}
+
+// accept returns false if the nonce was already used
+func (g *goodbyeNonces) accept(nonce []byte, now time.Time) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.seen == nil {
+		g.seen = make(map[string]time.Time)
+	}
+	for key, accepted := range g.seen {
+		if now.Sub(accepted) > GoodbyeMaxSkew*2 {
+			delete(g.seen, key)
+		}
+	}
+	if _, exists := g.seen[string(nonce)]; exists {
+		return false
+	}
+	g.seen[string(nonce)] = now
+	return true
+}
+
+func encodeGoodbye(key []byte, from, to string, sent time.Time) []byte {
+	data := make([]byte, goodbyeSize-sha256.Size, goodbyeSize)
+	copy(data[0:36], from)
+	copy(data[36:72], to)
+	binary.BigEndian.PutUint64(data[72:80], uint64(sent.UnixNano()))
+	rand.Read(data[80 : 80+goodbyeNonceSize])
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(data)
+}
+
+// decodeGoodbye verifies goodbye sent to the recipient and returns ID of
+// the sender and nonce of the message
+func decodeGoodbye(key []byte, to string, data []byte, now time.Time) (string, []byte, error) {
+	if len(data) != goodbyeSize {
+		return "", nil, fmt.Errorf("Wrong size of goodbye message: %d", len(data))
+	}
+	signed := data[:len(data)-sha256.Size]
+	mac := hmac.New(sha256.New, key)
+	mac.Write(signed)
+	if !hmac.Equal(mac.Sum(nil), data[len(signed):]) {
+		return "", nil, fmt.Errorf("Signature mismatch")
+	}
+	if string(data[36:72]) != to {
+		return "", nil, fmt.Errorf("Goodbye was sent to another peer")
+	}
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64(data[72:80])))
+	if skew := now.Sub(sent); skew > GoodbyeMaxSkew || skew < -GoodbyeMaxSkew {
+		return "", nil, fmt.Errorf("Goodbye is outdated: sent at %s", sent)
+	}
+	return string(data[0:36]), data[80 : 80+goodbyeNonceSize], nil
+}
+
+// sayGoodbye notifies the peer over its active endpoints that we are
+// leaving. Goodbye is sent once: peer that said goodbye to us isn't answered
+func (np *NetworkPeer) sayGoodbye(ptpc *PeerToPeer) {
+	if !atomic.CompareAndSwapUint32(&np.farewell, 0, 1) {
+		return
+	}
+	endpoints := np.GetEndpoints()
+	if len(endpoints) == 0 || ptpc.Dht == nil || ptpc.UDPSocket == nil {
+		return
+	}
+	key, _ := ptpc.authKey()
+	payload := encodeGoodbye(key, ptpc.Dht.ID, np.ID, time.Now())
+	msg, err := ptpc.CreateMessage(MsgTypeGoodbye, payload, 0, true)
+	if err != nil {
+		Log(Error, "Couldn't create goodbye message: %s", err)
+		return
+	}
+	for _, ep := range endpoints {
+		_, err = ptpc.sendMessage(msg, ep.Addr)
+		if err != nil {
+			Log(Debug, "Failed to send goodbye to %s: %s", ep.Addr.String(), err)
+		}
+	}
+	Log(Debug, "Said goodbye to %s over %d endpoints", np.ID, len(endpoints))
+}
+
+// HandleGoodbyeMessage disconnects peer that is leaving the swarm
+func (p *PeerToPeer) HandleGoodbyeMessage(msg *P2PMessage, srcAddr *net.UDPAddr) {
+	key, _ := p.authKey()
+	now := time.Now()
+	id, nonce, err := decodeGoodbye(key, p.Dht.ID, msg.Data, now)
+	if err != nil {
+		Log(Debug, "Dropping goodbye from %s: %s", srcAddr.String(), err)
+		return
+	}
+	peer := p.Peers.GetPeer(id)
+	if peer == nil || !peer.isEndpointActive(srcAddr) {
+		Log(Debug, "Goodbye from %s came from unknown endpoint %s", id, srcAddr.String())
+		return
+	}
+	if !p.goodbyes.accept(nonce, now) {
+		Log(Debug, "Dropping replayed goodbye of %s from %s", id, srcAddr.String())
+		return
+	}
+	atomic.StoreUint32(&peer.farewell, 1)
+	peer.setRemoteState(PeerStateStop)
+	state := peer.GetState()
+	if state == PeerStateDisconnect || state == PeerStateStop {
+		return
+	}
+	Log(Info, "Peer %s said goodbye", id)
+	peer.transitionFrom(state, PeerStateDisconnect, "Remote peer said goodbye", p)
+}
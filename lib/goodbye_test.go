@@ -0,0 +1,101 @@
+package ptp
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestGoodbyeEncoding(t *testing.T) {
+	key := []byte("swarm-hash")
+	from := fmt.Sprintf("%036d", 1)
+	to := fmt.Sprintf("%036d", 2)
+	now := time.Now()
+	data := encodeGoodbye(key, from, to, now)
+	id, nonce, err := decodeGoodbye(key, to, data, now)
+	if err != nil || id != from || len(nonce) != goodbyeNonceSize {
+		t.Errorf("Failed to decode goodbye: %s %v", id, err)
+	}
+	if _, other, _ := decodeGoodbye(key, to, encodeGoodbye(key, from, to, now), now); string(other) == string(nonce) {
+		t.Errorf("Goodbye messages share nonce")
+	}
+	if _, _, err := decodeGoodbye([]byte("another-swarm"), to, data, now); err == nil {
+		t.Errorf("Goodbye of another swarm was accepted")
+	}
+	if _, _, err := decodeGoodbye(key, from, data, now); err == nil {
+		t.Errorf("Goodbye to another peer was accepted")
+	}
+	if _, _, err := decodeGoodbye(key, to, data, now.Add(GoodbyeMaxSkew*2)); err == nil {
+		t.Errorf("Outdated goodbye was accepted")
+	}
+	if _, _, err := decodeGoodbye(key, to, data[:len(data)-1], now); err == nil {
+		t.Errorf("Truncated goodbye was accepted")
+	}
+}
+
+func TestGoodbyeMessage(t *testing.T) {
+	ptpc := new(PeerToPeer)
+	ptpc.Init()
+	ptpc.Dht = new(DHTClient)
+	ptpc.Dht.ID = fmt.Sprintf("%036d", 0)
+	ptpc.Dht.NetworkHash = "swarm-hash"
+	ptpc.UDPSocket = new(Network)
+	err := ptpc.UDPSocket.Init("127.0.0.1", 0)
+	if err != nil {
+		t.Fatalf("Failed to create socket: %s", err)
+	}
+	defer ptpc.UDPSocket.Stop()
+	remote, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("Failed to create socket: %s", err)
+	}
+	defer remote.Close()
+	addr := remote.LocalAddr().(*net.UDPAddr)
+	np := &NetworkPeer{ID: fmt.Sprintf("%036d", 1), State: PeerStateConnected, Endpoint: addr}
+	np.Endpoints = []PeerEndpoint{{Addr: addr, LastContact: time.Now()}}
+	ptpc.Peers.Update(np.ID, np)
+
+	// Goodbye is sent to active endpoints once
+	np.sayGoodbye(ptpc)
+	np.sayGoodbye(ptpc)
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1500)
+	n, _, err := remote.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("Goodbye wasn't received: %s", err)
+	}
+	msg, err := P2PMessageFromBytes(buf[:n])
+	if err != nil || msg.Header.Type != MsgTypeGoodbye {
+		t.Fatalf("Wrong message received: %v %v", msg, err)
+	}
+	if id, _, err := decodeGoodbye([]byte(ptpc.Dht.NetworkHash), np.ID, msg.Data, time.Now()); err != nil || id != ptpc.Dht.ID {
+		t.Errorf("Wrong goodbye received: %s %v", id, err)
+	}
+	remote.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+	if _, _, err := remote.ReadFromUDP(buf); err == nil {
+		t.Errorf("Goodbye was sent twice")
+	}
+
+	// Goodbye of the peer is accepted from its active endpoint only
+	np.farewell = 0
+	payload := encodeGoodbye([]byte(ptpc.Dht.NetworkHash), np.ID, ptpc.Dht.ID, time.Now())
+	goodbye, _ := CreateMessageStatic(MsgTypeGoodbye, payload)
+	ptpc.HandleGoodbyeMessage(goodbye, &net.UDPAddr{IP: net.ParseIP("203.0.113.5"), Port: 6881})
+	if np.GetState() != PeerStateConnected {
+		t.Errorf("Goodbye from unknown endpoint was accepted")
+	}
+	ptpc.HandleGoodbyeMessage(goodbye, addr)
+	if np.GetState() != PeerStateDisconnect || np.GetRemoteState() != PeerStateStop || np.farewell != 1 {
+		t.Errorf("Peer wasn't disconnected by goodbye: %s", StringifyState(np.GetState()))
+	}
+
+	// Captured goodbye doesn't disconnect reconnected peer
+	np.State = PeerStateConnected
+	np.setRemoteState(PeerStateConnected)
+	np.farewell = 0
+	ptpc.HandleGoodbyeMessage(goodbye, addr)
+	if np.GetState() != PeerStateConnected || np.farewell != 0 {
+		t.Errorf("Replayed goodbye was accepted")
+	}
+}
@@ -0,0 +1,213 @@
+package ptp
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// In lazy mode peers found in DHT or LAN are kept idle: they have no
+// endpoints and their loops neither ping nor punch. Peer is woken up when
+// traffic for its overlay address appears on the interface, or when it
+// starts connecting to us. Connected peer becomes idle again after no data
+// was exchanged with it for the idle timeout. Overlay addresses of idle
+// peers are kept, so the next packet wakes exactly the peer it's sent to.
+//
+// Number of active peers may be limited. Least recently used connected
+// peer is put to idle to make room for the woken one.
+
+// Lazy mode constants
+const (
+	LazyWakeBatch    = 8                // Peers with unknown overlay address woken up for unknown destination
+	LazyWakeInterval = time.Second * 10 // Unknown destination wakes peers once in this interval
+)
+
+// stateIdle drops endpoints of the peer and waits for traffic
+func (np *NetworkPeer) stateIdle(ptpc *PeerToPeer) error {
+	Log(Debug, "Peer %s is idle", np.ID)
+	np.ConnectionAttempts = 0
+	np.cooldowns = 0
+	atomic.StoreUint32(&np.punchRounds, 0)
+	np.EndpointsLock.Lock()
+	np.Endpoints = np.Endpoints[:0]
+	np.EndpointsLock.Unlock()
+	np.setEndpoint(nil)
+	return nil
+}
+
+func (np *NetworkPeer) onWake(ptpc *PeerToPeer) PeerState {
+	if !ptpc.admitPeer(np) {
+		return np.GetState()
+	}
+	np.used()
+	return PeerStateInit
+}
+
+// onIdleRemoteState wakes the peer when it tries to connect to us
+func (np *NetworkPeer) onIdleRemoteState(ptpc *PeerToPeer) PeerState {
+	switch np.GetRemoteState() {
+	case PeerStateWaitingToConnect, PeerStateConnecting:
+		return np.onWake(ptpc)
+	}
+	return np.GetState()
+}
+
+// used marks the moment data was exchanged with the peer
+func (np *NetworkPeer) used() {
+	atomic.StoreInt64(&np.lastUsed, time.Now().UnixNano())
+}
+
+// unusedFor returns time passed since data was exchanged with the peer
+func (np *NetworkPeer) unusedFor() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&np.lastUsed)))
+}
+
+// usePeer records traffic of the peer and wakes it up if it's idle
+func (p *PeerToPeer) usePeer(peer *NetworkPeer) {
+	if !p.Lazy || peer == nil {
+		return
+	}
+	peer.used()
+	if peer.GetState() == PeerStateIdle {
+		peer.notify(PeerEventWake)
+	}
+}
+
+// usePeerID records traffic of the peer with specified ID
+func (p *PeerToPeer) usePeerID(id string) {
+	if !p.Lazy || id == "" {
+		return
+	}
+	p.usePeer(p.Peers.GetPeer(id))
+}
+
+// wakeBySource wakes idle peer that sent traffic from one of its known
+// addresses or over the relay. Idle peer has no endpoints, so its frames
+// are dropped until connection is established again, but remote side may
+// still consider itself connected after we've put the peer to idle
+func (p *PeerToPeer) wakeBySource(addr *net.UDPAddr) {
+	if !p.Lazy || addr == nil {
+		return
+	}
+	if path, exists := p.Relays.lookup(addr); exists {
+		if peer := p.Peers.GetPeer(path.peer); peer != nil && peer.GetState() == PeerStateIdle {
+			p.usePeer(peer)
+		}
+		return
+	}
+	for _, peer := range p.Peers.Get() {
+		if peer.GetState() != PeerStateIdle {
+			continue
+		}
+		for _, known := range append(peer.GetKnownIPs(), peer.GetProxies()...) {
+			if known.IP.Equal(addr.IP) && known.Port == addr.Port {
+				Log(Debug, "Traffic from idle peer %s at %s", peer.ID, addr.String())
+				p.usePeer(peer)
+				return
+			}
+		}
+	}
+}
+
+// activePeers returns number of peers other than specified one that are
+// connected or connecting, and connected peer that was used least recently
+func (p *PeerToPeer) activePeers(except string) (int, *NetworkPeer) {
+	active := 0
+	var lru *NetworkPeer
+	for id, peer := range p.Peers.Get() {
+		if id == except {
+			continue
+		}
+		state := peer.GetState()
+		if state == PeerStateIdle || state == PeerStateDisconnect || state == PeerStateStop {
+			continue
+		}
+		active++
+		if state == PeerStateConnected && (lru == nil || peer.unusedFor() > lru.unusedFor()) {
+			lru = peer
+		}
+	}
+	return active, lru
+}
+
+// admitPeer checks limit of active peers before the peer is woken up.
+// Least recently used peer is put to idle when the limit is reached
+func (p *PeerToPeer) admitPeer(np *NetworkPeer) bool {
+	if p.MaxActivePeers <= 0 {
+		return true
+	}
+	p.lazyLock.Lock()
+	defer p.lazyLock.Unlock()
+	active, lru := p.activePeers(np.ID)
+	if active < p.MaxActivePeers {
+		return true
+	}
+	if lru == nil || !lru.transitionFrom(PeerStateConnected, PeerStateIdle, "Making room for "+np.ID, p) {
+		np.setLastError(fmt.Sprintf("Limit of %d active peers is reached", p.MaxActivePeers))
+		Log(Debug, "Can't wake peer %s: %d peers are active", np.ID, active)
+		return false
+	}
+	Log(Debug, "Peer %s was put to idle to make room for %s", lru.ID, np.ID)
+	return true
+}
+
+// wakeUnknown wakes idle peers which overlay addresses are unknown, since
+// traffic for unknown address may be sent to one of them
+func (p *PeerToPeer) wakeUnknown(dst net.IP) {
+	if !p.Lazy || !p.allowWake(dst) {
+		return
+	}
+	batch := LazyWakeBatch
+	if p.MaxActivePeers > 0 {
+		active, _ := p.activePeers("")
+		if free := p.MaxActivePeers - active; free < batch {
+			batch = free
+		}
+	}
+	for _, peer := range p.Peers.Get() {
+		if batch <= 0 {
+			return
+		}
+		if peer.GetState() != PeerStateIdle || peer.GetIP() != nil {
+			continue
+		}
+		peer.notify(PeerEventWake)
+		batch--
+	}
+}
+
+// allowWake rate limits wakes for unknown destinations. Every destination
+// wakes peers once in LazyWakeInterval and no more than LazyWakeBatch
+// destinations do it in the interval, so scan of overlay subnet doesn't
+// connect all idle peers
+func (p *PeerToPeer) allowWake(dst net.IP) bool {
+	p.lazyLock.Lock()
+	defer p.lazyLock.Unlock()
+	if p.wakes == nil {
+		p.wakes = make(map[string]time.Time)
+	}
+	for ip, woken := range p.wakes {
+		if time.Since(woken) >= LazyWakeInterval {
+			delete(p.wakes, ip)
+		}
+	}
+	if _, exists := p.wakes[dst.String()]; exists || len(p.wakes) >= LazyWakeBatch {
+		return false
+	}
+	p.wakes[dst.String()] = time.Now()
+	return true
+}
+
+// LazyStatus returns number of active peers for debug output
+func (p *PeerToPeer) LazyStatus() string {
+	if !p.Lazy {
+		return "disabled"
+	}
+	active, _ := p.activePeers("")
+	limit := "unlimited"
+	if p.MaxActivePeers > 0 {
+		limit = fmt.Sprintf("limit %d", p.MaxActivePeers)
+	}
+	return fmt.Sprintf("%d of %d peers active, %s, idle after %s", active, p.Peers.Length(), limit, p.tuning().IdleTimeout)
+}
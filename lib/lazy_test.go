@@ -0,0 +1,149 @@
+package ptp
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func lazyInstance(limit int) *PeerToPeer {
+	ptpc := new(PeerToPeer)
+	ptpc.Init()
+	ptpc.Dht = new(DHTClient)
+	ptpc.Dht.ID = fmt.Sprintf("%036d", 0)
+	ptpc.Lazy = true
+	ptpc.MaxActivePeers = limit
+	return ptpc
+}
+
+func lazyPeer(ptpc *PeerToPeer, n int, state PeerState, unused time.Duration) *NetworkPeer {
+	np := &NetworkPeer{ID: fmt.Sprintf("%036d", n), State: state}
+	np.lastUsed = time.Now().Add(-unused).UnixNano()
+	ptpc.Peers.Update(np.ID, np)
+	return np
+}
+
+func TestLazyActivePeersLimit(t *testing.T) {
+	ptpc := lazyInstance(2)
+	recent := lazyPeer(ptpc, 1, PeerStateConnected, time.Second)
+	old := lazyPeer(ptpc, 2, PeerStateConnected, time.Minute)
+	idle := lazyPeer(ptpc, 3, PeerStateIdle, time.Hour)
+
+	// Least recently used peer makes room for the woken one
+	idle.handleEvent(PeerEventWake, ptpc)
+	if idle.GetState() != PeerStateInit || old.GetState() != PeerStateIdle || recent.GetState() != PeerStateConnected {
+		t.Fatalf("Wrong states after wake: %s %s %s", StringifyState(idle.GetState()), StringifyState(old.GetState()), StringifyState(recent.GetState()))
+	}
+	if idle.unusedFor() > time.Second {
+		t.Errorf("Woken peer wasn't marked as used")
+	}
+
+	// Connecting peers are never put to idle
+	recent.transition(PeerStateConnecting, "", ptpc)
+	old.handleEvent(PeerEventWake, ptpc)
+	if old.GetState() != PeerStateIdle || old.GetLastError() == "" {
+		t.Errorf("Peer was woken over the limit: %s", StringifyState(old.GetState()))
+	}
+	if s := ptpc.LazyStatus(); s != "2 of 3 peers active, limit 2, idle after 5m0s" {
+		t.Errorf("Wrong lazy status: %s", s)
+	}
+}
+
+func TestLazyTraffic(t *testing.T) {
+	ptpc := lazyInstance(0)
+	known := lazyPeer(ptpc, 1, PeerStateIdle, time.Hour)
+	known.PeerLocalIP = net.ParseIP("10.10.10.2")
+	unknown := lazyPeer(ptpc, 2, PeerStateIdle, time.Hour)
+	ptpc.Peers.Update(known.ID, known)
+
+	ptpc.usePeerID(known.ID)
+	if len(known.events) != 1 || known.unusedFor() > time.Second {
+		t.Errorf("Traffic didn't wake idle peer")
+	}
+	ptpc.wakeUnknown(net.ParseIP("10.10.10.3"))
+	if len(known.events) != 1 || len(unknown.events) != 1 {
+		t.Errorf("Wrong peers were woken for unknown address: %d %d", len(known.events), len(unknown.events))
+	}
+
+	// Repeated traffic and scan of the subnet are rate limited
+	<-unknown.events
+	ptpc.wakeUnknown(net.ParseIP("10.10.10.3"))
+	for i := 4; i < 4+LazyWakeBatch*2; i++ {
+		ptpc.wakeUnknown(net.IPv4(10, 10, 10, byte(i)))
+	}
+	if woken := len(unknown.events); woken != LazyWakeBatch-1 {
+		t.Errorf("Wakes weren't rate limited: %d", woken)
+	}
+	ptpc.wakes[net.ParseIP("10.10.10.3").String()] = time.Now().Add(-LazyWakeInterval)
+	if !ptpc.allowWake(net.ParseIP("10.10.10.3")) {
+		t.Errorf("Destination wasn't allowed to wake peers after interval")
+	}
+
+	// Nothing is woken when limit is reached or lazy mode is off
+	full := lazyInstance(1)
+	lazyPeer(full, 1, PeerStateConnected, 0)
+	waiting := lazyPeer(full, 2, PeerStateIdle, time.Hour)
+	full.wakeUnknown(net.ParseIP("10.10.10.3"))
+	full.Lazy = false
+	full.usePeer(waiting)
+	if len(waiting.events) != 0 {
+		t.Errorf("Peer was woken without free slots")
+	}
+}
+
+func TestLazyIdleTimeout(t *testing.T) {
+	ptpc := lazyInstance(0)
+	addr, _ := net.ResolveUDPAddr("udp4", "192.168.1.2:6881")
+	np := lazyPeer(ptpc, 1, PeerStateConnected, DefaultTuning.IdleTimeout+time.Second)
+	np.PeerLocalIP = net.ParseIP("10.10.10.2")
+	np.addEndpoint(addr)
+	np.handleEvent(PeerEventTimeout, ptpc)
+	np.disarm()
+	if np.GetState() != PeerStateIdle {
+		t.Fatalf("Unused peer wasn't put to idle: %s", StringifyState(np.GetState()))
+	}
+	np.stateIdle(ptpc)
+	if np.endpointsCount() != 0 || np.GetEndpoint() != nil || np.GetIP() == nil {
+		t.Errorf("Idle peer kept endpoints or lost its address")
+	}
+
+	// Failed peer waits for traffic instead of retrying
+	np.State = PeerStateCooldown
+	np.handleEvent(PeerEventTimeout, ptpc)
+	if np.GetState() != PeerStateIdle {
+		t.Errorf("Peer after cooldown isn't idle: %s", StringifyState(np.GetState()))
+	}
+}
+
+func TestLazyInboundTraffic(t *testing.T) {
+	ptpc := lazyInstance(0)
+	addr, _ := net.ResolveUDPAddr("udp4", "192.168.1.2:6881")
+	np := lazyPeer(ptpc, 1, PeerStateIdle, time.Hour)
+	np.PeerHW, _ = net.ParseMAC("06:00:00:00:00:02")
+	np.setKnownIPs([]*net.UDPAddr{addr})
+	other := lazyPeer(ptpc, 2, PeerStateIdle, time.Hour)
+
+	// Remote side still considers itself connected and sends data
+	frame := make([]byte, 60)
+	copy(frame, []byte{0x06, 0, 0, 0, 0, 0x01})
+	copy(frame[6:], np.PeerHW)
+	ptpc.HandleNotEncryptedMessage(&P2PMessage{Data: frame}, addr)
+	if len(np.events) != 1 || len(other.events) != 0 {
+		t.Fatalf("Inbound traffic didn't wake idle peer: %d %d", len(np.events), len(other.events))
+	}
+
+	// Connected peer follows remote side going idle
+	np.State = PeerStateConnected
+	np.setRemoteState(PeerStateIdle)
+	np.syncWithRemoteState(ptpc)
+	if np.GetState() != PeerStateIdle {
+		t.Errorf("Peer didn't follow idle remote: %s", StringifyState(np.GetState()))
+	}
+	ptpc.Lazy = false
+	np.State = PeerStateConnected
+	np.syncWithRemoteState(ptpc)
+	if np.GetState() != PeerStateInit {
+		t.Errorf("Peer didn't reconnect to idle remote: %s", StringifyState(np.GetState()))
+	}
+}
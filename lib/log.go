@@ -3,6 +3,8 @@ package ptp
 import (
 	"log"
 	"os"
+	"sync"
+	"sync/atomic"
 )
 
 // LogLevel is a level of the log message
@@ -26,6 +28,7 @@ var logFlags = [...]int{log.Ldate | log.Ltime,
 
 var logLevelMin = Info
 var syslogSocket = ""
+var syslogLock sync.RWMutex
 var stdLoggers = [...]*log.Logger{log.New(os.Stdout, logPrefixes[Trace], logFlags[Trace]),
 	log.New(os.Stdout, logPrefixes[Debug], logFlags[Debug]),
 	log.New(os.Stdout, logPrefixes[Info], logFlags[Info]),
@@ -34,24 +37,32 @@ var stdLoggers = [...]*log.Logger{log.New(os.Stdout, logPrefixes[Trace], logFlag
 
 // SetMinLogLevel sets a minimal logging level
 func SetMinLogLevel(level LogLevel) {
-	logLevelMin = level
+	atomic.StoreInt32((*int32)(&logLevelMin), int32(level))
 }
 
 // MinLogLevel returns minimal log level
-func MinLogLevel() LogLevel { return logLevelMin }
+func MinLogLevel() LogLevel { return LogLevel(atomic.LoadInt32((*int32)(&logLevelMin))) }
 
 // Log writes a log message
 func Log(level LogLevel, format string, v ...interface{}) {
-	if level < logLevelMin {
+	if level < MinLogLevel() {
 		return
 	}
 	stdLoggers[level].Printf(format, v...)
-	if level != Trace && len(syslogSocket) != 0 {
+	if level != Trace && len(syslogAddress()) != 0 {
 		go Syslog(level, format, v...)
 	}
 }
 
 // SetSyslogSocket sets an adders of the syslog server
 func SetSyslogSocket(socket string) {
+	syslogLock.Lock()
 	syslogSocket = socket
+	syslogLock.Unlock()
+}
+
+func syslogAddress() string {
+	syslogLock.RLock()
+	defer syslogLock.RUnlock()
+	return syslogSocket
 }
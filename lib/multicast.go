@@ -0,0 +1,450 @@
+package ptp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mdlayher/ethernet"
+)
+
+// FloodMode specifies which non-unicast frames captured on TAP
+// interface will be flooded to connected peers
+type FloodMode int
+
+// Flood modes
+const (
+	FloodNone      FloodMode = 0 // Broadcast and multicast frames are dropped
+	FloodBroadcast FloodMode = 1 // Only broadcast frames are flooded
+	FloodAll       FloodMode = 2 // Both broadcast and multicast frames are flooded
+)
+
+// MulticastMembershipTimeout is a period after which peer is considered
+// unsubscribed from a group if no new reports were received. Matches
+// default group membership interval of IGMP and MLD
+const MulticastMembershipTimeout = time.Second * 260
+
+// IP protocol numbers used by snooping
+const (
+	protoIGMP   uint8 = 2
+	protoICMPv6 uint8 = 58
+	protoHopOpt uint8 = 0
+)
+
+// ParseFloodMode converts name of the flood mode into FloodMode
+func ParseFloodMode(mode string) (FloodMode, error) {
+	switch mode {
+	case "", "none":
+		return FloodNone, nil
+	case "broadcast":
+		return FloodBroadcast, nil
+	case "all", "multicast":
+		return FloodAll, nil
+	}
+	return FloodNone, fmt.Errorf("Unknown flood mode: %s", mode)
+}
+
+// StringifyFloodMode returns name of the flood mode
+func StringifyFloodMode(mode FloodMode) string {
+	switch mode {
+	case FloodBroadcast:
+		return "broadcast"
+	case FloodAll:
+		return "all"
+	}
+	return "none"
+}
+
+// MulticastManager decides which broadcast and multicast frames should be
+// flooded to peers. When snooping is enabled it keeps track of peers
+// subscribed to multicast groups by watching IGMP and MLD reports
+type MulticastManager struct {
+	Mode       FloodMode                       // Which frames should be flooded
+	Snooping   bool                            // Whether IGMP/MLD snooping is enabled
+	StormLimit int                             // Maximum number of flooded frames per second of each kind. 0 means unlimited
+	groups     map[string]map[string]time.Time // Group -> Peer ID -> Last report
+	lock       sync.RWMutex                    // Protects settings and groups map
+	broadcast  stormLimiter                    // Rate limiter for broadcast frames
+	multicast  stormLimiter                    // Rate limiter for multicast frames
+}
+
+// Configure sets flood mode, snooping and storm control limit
+func (m *MulticastManager) Configure(mode FloodMode, snooping bool, limit int) {
+	m.lock.Lock()
+	if m.groups == nil {
+		m.groups = make(map[string]map[string]time.Time)
+	}
+	m.Mode = mode
+	m.Snooping = snooping
+	m.StormLimit = limit
+	m.lock.Unlock()
+	m.broadcast.setRate(limit)
+	m.multicast.setRate(limit)
+}
+
+// Settings returns flood mode, whether snooping is enabled and storm
+// control limit
+func (m *MulticastManager) Settings() (FloodMode, bool, int) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.Mode, m.Snooping, m.StormLimit
+}
+
+// enableBroadcasts makes sure that at least broadcast frames are flooded
+func (m *MulticastManager) enableBroadcasts() {
+	m.lock.Lock()
+	if m.Mode < FloodBroadcast {
+		m.Mode = FloodBroadcast
+	}
+	m.lock.Unlock()
+}
+
+// allow returns true if frame with specified destination
+// should be flooded according to mode and storm control limits
+func (m *MulticastManager) allow(dst net.HardwareAddr) bool {
+	mode, _, _ := m.Settings()
+	if bytes.Equal(dst, ethernet.Broadcast) {
+		return mode >= FloodBroadcast && m.broadcast.allow()
+	}
+	return mode == FloodAll && m.multicast.allow()
+}
+
+// join registers peer as a member of the group
+func (m *MulticastManager) join(group net.IP, id string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	members, exists := m.groups[group.String()]
+	if !exists {
+		members = make(map[string]time.Time)
+		m.groups[group.String()] = members
+	}
+	if _, known := members[id]; !known {
+		Log(Debug, "Peer %s joined multicast group %s", id, group.String())
+	}
+	members[id] = time.Now()
+}
+
+// leave removes peer from the group members
+func (m *MulticastManager) leave(group net.IP, id string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	members, exists := m.groups[group.String()]
+	if !exists {
+		return
+	}
+	delete(members, id)
+	Log(Debug, "Peer %s left multicast group %s", id, group.String())
+	if len(members) == 0 {
+		delete(m.groups, group.String())
+	}
+}
+
+// forget removes peer from every group. Used when peer is disconnected
+func (m *MulticastManager) forget(id string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for group, members := range m.groups {
+		delete(members, id)
+		if len(members) == 0 {
+			delete(m.groups, group)
+		}
+	}
+}
+
+// isSubscribed returns true if frame for the group should be sent to the peer.
+// Groups without known members are flooded to everyone, same as switches
+// do with unregistered multicast
+func (m *MulticastManager) isSubscribed(group net.IP, id string) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if !m.Snooping || group == nil {
+		return true
+	}
+	members, exists := m.groups[group.String()]
+	if !exists {
+		return true
+	}
+	active := false
+	for _, seen := range members {
+		if time.Since(seen) < MulticastMembershipTimeout {
+			active = true
+			break
+		}
+	}
+	if !active {
+		return true
+	}
+	seen, exists := members[id]
+	return exists && time.Since(seen) < MulticastMembershipTimeout
+}
+
+// Groups returns a copy of group membership table
+func (m *MulticastManager) Groups() map[string][]string {
+	result := make(map[string][]string)
+	m.lock.RLock()
+	for group, members := range m.groups {
+		for id, seen := range members {
+			if time.Since(seen) < MulticastMembershipTimeout {
+				result[group] = append(result[group], id)
+			}
+		}
+	}
+	m.lock.RUnlock()
+	return result
+}
+
+// stormLimiter is a token bucket used for storm control
+type stormLimiter struct {
+	rate   int
+	tokens float64
+	last   time.Time
+	lock   sync.Mutex
+}
+
+func (s *stormLimiter) setRate(rate int) {
+	s.lock.Lock()
+	s.rate = rate
+	s.tokens = float64(rate)
+	s.last = time.Now()
+	s.lock.Unlock()
+}
+
+func (s *stormLimiter) allow() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.rate <= 0 {
+		return true
+	}
+	now := time.Now()
+	s.tokens += now.Sub(s.last).Seconds() * float64(s.rate)
+	s.last = now
+	if s.tokens > float64(s.rate) {
+		s.tokens = float64(s.rate)
+	}
+	if s.tokens < 1 {
+		return false
+	}
+	s.tokens--
+	return true
+}
+
+// isMulticastMAC returns true for both broadcast and multicast hardware addresses
+func isMulticastMAC(hw net.HardwareAddr) bool {
+	return len(hw) > 0 && hw[0]&0x01 == 0x01
+}
+
+// floodFrame sends broadcast or multicast frame captured on TAP
+// interface to every connected peer that should receive it
+func (p *PeerToPeer) floodFrame(f *ethernet.Frame, contents []byte, proto int) {
+	if p.Multicast == nil || !p.Multicast.allow(f.Destination) {
+		return
+	}
+	group := floodGroup(f)
+	msg, err := p.CreateMessage(MsgTypeNenc, contents, uint16(proto), true)
+	if err != nil || msg == nil {
+		return
+	}
+	for id, peer := range p.Peers.Get() {
+		endpoint := peer.GetEndpoint()
+		if peer.GetState() != PeerStateConnected || endpoint == nil {
+			continue
+		}
+		if !p.Multicast.isSubscribed(group, id) {
+			continue
+		}
+		p.sendMessage(msg, endpoint)
+	}
+}
+
+// snoopFrame looks for IGMP and MLD reports in frames received from peers
+// and updates group membership table
+func (p *PeerToPeer) snoopFrame(data []byte) {
+	if p.Multicast == nil {
+		return
+	}
+	if _, snooping, _ := p.Multicast.Settings(); !snooping {
+		return
+	}
+	f := new(ethernet.Frame)
+	if err := f.UnmarshalBinary(data); err != nil {
+		return
+	}
+	if !isMulticastMAC(f.Destination) {
+		return
+	}
+	var joins, leaves []net.IP
+	switch f.EtherType {
+	case ethernet.EtherTypeIPv4:
+		payload, proto := ipv4Payload(f.Payload)
+		if proto != protoIGMP {
+			return
+		}
+		joins, leaves = parseIGMP(payload)
+	case ethernet.EtherTypeIPv6:
+		payload, proto := ipv6Payload(f.Payload)
+		if proto != protoICMPv6 {
+			return
+		}
+		joins, leaves = parseMLD(payload)
+	default:
+		return
+	}
+	if len(joins) == 0 && len(leaves) == 0 {
+		return
+	}
+	id, err := p.Peers.GetIDByMac(f.Source.String())
+	if err != nil {
+		Log(Trace, "Membership report from unknown hardware address %s", f.Source.String())
+		return
+	}
+	for _, group := range joins {
+		p.Multicast.join(group, id)
+	}
+	for _, group := range leaves {
+		p.Multicast.leave(group, id)
+	}
+}
+
+// floodGroup returns multicast group that frame is addressed to. Nil is returned
+// for broadcasts, link-local groups and membership reports since they
+// must reach every peer
+func floodGroup(f *ethernet.Frame) net.IP {
+	if bytes.Equal(f.Destination, ethernet.Broadcast) {
+		return nil
+	}
+	switch f.EtherType {
+	case ethernet.EtherTypeIPv4:
+		if len(f.Payload) < 20 {
+			return nil
+		}
+		_, proto := ipv4Payload(f.Payload)
+		group := net.IP(f.Payload[16:20])
+		if proto == protoIGMP || group.IsLinkLocalMulticast() {
+			return nil
+		}
+		return group
+	case ethernet.EtherTypeIPv6:
+		if len(f.Payload) < 40 {
+			return nil
+		}
+		_, proto := ipv6Payload(f.Payload)
+		group := net.IP(f.Payload[24:40])
+		if proto == protoICMPv6 || group.IsLinkLocalMulticast() || group.IsInterfaceLocalMulticast() {
+			return nil
+		}
+		return group
+	}
+	return nil
+}
+
+// ipv4Payload returns payload and protocol number of IPv4 packet
+func ipv4Payload(b []byte) ([]byte, uint8) {
+	if len(b) < 20 {
+		return nil, 0xff
+	}
+	ihl := int(b[0]&0x0f) * 4
+	if ihl < 20 || len(b) < ihl {
+		return nil, 0xff
+	}
+	return b[ihl:], b[9]
+}
+
+// ipv6Payload returns payload and next header of IPv6 packet
+// skipping Hop-by-Hop options header used by MLD
+func ipv6Payload(b []byte) ([]byte, uint8) {
+	if len(b) < 40 {
+		return nil, 0xff
+	}
+	next := b[6]
+	payload := b[40:]
+	if next == protoHopOpt {
+		if len(payload) < 8 {
+			return nil, 0xff
+		}
+		size := (int(payload[1]) + 1) * 8
+		if len(payload) < size {
+			return nil, 0xff
+		}
+		next = payload[0]
+		payload = payload[size:]
+	}
+	return payload, next
+}
+
+// parseIGMP extracts groups joined and left from IGMPv1, v2 and v3 reports
+func parseIGMP(b []byte) ([]net.IP, []net.IP) {
+	if len(b) < 8 {
+		return nil, nil
+	}
+	switch b[0] {
+	case 0x12, 0x16: // v1 and v2 membership reports
+		return []net.IP{copyIP(b[4:8])}, nil
+	case 0x17: // v2 leave group
+		return nil, []net.IP{copyIP(b[4:8])}
+	case 0x22: // v3 membership report
+		return parseGroupRecords(b[8:], int(binary.BigEndian.Uint16(b[6:8])), net.IPv4len)
+	}
+	return nil, nil
+}
+
+// parseMLD extracts groups joined and left from MLDv1 and MLDv2 reports
+func parseMLD(b []byte) ([]net.IP, []net.IP) {
+	if len(b) < 8 {
+		return nil, nil
+	}
+	switch b[0] {
+	case 131: // v1 listener report
+		if len(b) < 24 {
+			return nil, nil
+		}
+		return []net.IP{copyIP(b[8:24])}, nil
+	case 132: // v1 listener done
+		if len(b) < 24 {
+			return nil, nil
+		}
+		return nil, []net.IP{copyIP(b[8:24])}
+	case 143: // v2 listener report
+		return parseGroupRecords(b[8:], int(binary.BigEndian.Uint16(b[6:8])), net.IPv6len)
+	}
+	return nil, nil
+}
+
+// parseGroupRecords walks through IGMPv3/MLDv2 group records. Include mode
+// with empty source list means that host is no longer interested in the group
+func parseGroupRecords(b []byte, count, size int) ([]net.IP, []net.IP) {
+	var joins, leaves []net.IP
+	for i := 0; i < count; i++ {
+		if len(b) < 4+size {
+			break
+		}
+		recordType := b[0]
+		aux := int(b[1]) * 4
+		sources := int(binary.BigEndian.Uint16(b[2:4]))
+		group := copyIP(b[4 : 4+size])
+		length := 4 + size + sources*size + aux
+		if len(b) < length {
+			break
+		}
+		b = b[length:]
+		switch recordType {
+		case 1, 3: // MODE_IS_INCLUDE, CHANGE_TO_INCLUDE_MODE
+			if sources == 0 {
+				leaves = append(leaves, group)
+			} else {
+				joins = append(joins, group)
+			}
+		case 2, 4, 5: // MODE_IS_EXCLUDE, CHANGE_TO_EXCLUDE_MODE, ALLOW_NEW_SOURCES
+			joins = append(joins, group)
+		}
+	}
+	return joins, leaves
+}
+
+func copyIP(b []byte) net.IP {
+	ip := make(net.IP, len(b))
+	copy(ip, b)
+	return ip
+}
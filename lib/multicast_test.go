@@ -0,0 +1,146 @@
+package ptp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/ethernet"
+)
+
+func TestParseFloodMode(t *testing.T) {
+	modes := map[string]FloodMode{
+		"":          FloodNone,
+		"none":      FloodNone,
+		"broadcast": FloodBroadcast,
+		"all":       FloodAll,
+	}
+	for name, wait := range modes {
+		get, err := ParseFloodMode(name)
+		if err != nil || get != wait {
+			t.Errorf("Error. Wait: %v, get: %v (%v)", wait, get, err)
+		}
+	}
+	_, err := ParseFloodMode("everything")
+	if err == nil {
+		t.Error("Error. Unknown mode was accepted")
+	}
+}
+
+func TestParseIGMP(t *testing.T) {
+	report := []byte{0x16, 0, 0, 0, 239, 255, 255, 250}
+	joins, leaves := parseIGMP(report)
+	if len(joins) != 1 || !joins[0].Equal(net.ParseIP("239.255.255.250")) || len(leaves) != 0 {
+		t.Errorf("Error in v2 report: %v %v", joins, leaves)
+	}
+	leave := []byte{0x17, 0, 0, 0, 239, 1, 1, 1}
+	joins, leaves = parseIGMP(leave)
+	if len(leaves) != 1 || !leaves[0].Equal(net.ParseIP("239.1.1.1")) || len(joins) != 0 {
+		t.Errorf("Error in v2 leave: %v %v", joins, leaves)
+	}
+	v3 := []byte{0x22, 0, 0, 0, 0, 0, 0, 2,
+		4, 0, 0, 0, 239, 2, 2, 2, // CHANGE_TO_EXCLUDE: join
+		3, 0, 0, 0, 239, 3, 3, 3, // CHANGE_TO_INCLUDE with no sources: leave
+	}
+	joins, leaves = parseIGMP(v3)
+	if len(joins) != 1 || !joins[0].Equal(net.ParseIP("239.2.2.2")) {
+		t.Errorf("Error in v3 joins: %v", joins)
+	}
+	if len(leaves) != 1 || !leaves[0].Equal(net.ParseIP("239.3.3.3")) {
+		t.Errorf("Error in v3 leaves: %v", leaves)
+	}
+	joins, leaves = parseIGMP([]byte{0x22, 0, 0, 0, 0, 0, 0, 5, 4})
+	if len(joins) != 0 || len(leaves) != 0 {
+		t.Error("Error. Truncated report produced groups")
+	}
+}
+
+func TestParseMLD(t *testing.T) {
+	group := net.ParseIP("ff05::1:3")
+	report := append([]byte{131, 0, 0, 0, 0, 0, 0, 0}, group...)
+	joins, _ := parseMLD(report)
+	if len(joins) != 1 || !joins[0].Equal(group) {
+		t.Errorf("Error in MLDv1 report: %v", joins)
+	}
+	v2 := append([]byte{143, 0, 0, 0, 0, 0, 0, 1, 2, 0, 0, 0}, group...)
+	joins, _ = parseMLD(v2)
+	if len(joins) != 1 || !joins[0].Equal(group) {
+		t.Errorf("Error in MLDv2 report: %v", joins)
+	}
+}
+
+func TestMulticastSubscription(t *testing.T) {
+	m := new(MulticastManager)
+	m.Configure(FloodAll, true, 0)
+	group := net.ParseIP("239.255.255.250")
+	if !m.isSubscribed(group, "peer1") {
+		t.Error("Error. Unregistered group should be flooded")
+	}
+	m.join(group, "peer1")
+	if !m.isSubscribed(group, "peer1") {
+		t.Error("Error. Member didn't receive group traffic")
+	}
+	if m.isSubscribed(group, "peer2") {
+		t.Error("Error. Non-member received group traffic")
+	}
+	m.forget("peer1")
+	if !m.isSubscribed(group, "peer2") {
+		t.Error("Error. Group without members should be flooded")
+	}
+}
+
+func TestMulticastAllow(t *testing.T) {
+	m := new(MulticastManager)
+	m.Configure(FloodBroadcast, false, 0)
+	if !m.allow(ethernet.Broadcast) {
+		t.Error("Error. Broadcast was not allowed")
+	}
+	if m.allow(net.HardwareAddr{0x01, 0x00, 0x5e, 0x7f, 0xff, 0xfa}) {
+		t.Error("Error. Multicast allowed in broadcast mode")
+	}
+}
+
+func TestMulticastConfigureConcurrency(t *testing.T) {
+	m := new(MulticastManager)
+	m.Configure(FloodNone, false, 0)
+	group := net.ParseIP("239.255.255.250")
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 1000; i++ {
+			m.allow(ethernet.Broadcast)
+			m.isSubscribed(group, "peer1")
+		}
+		done <- true
+	}()
+	for i := 0; i < 100; i++ {
+		m.Configure(FloodAll, i%2 == 0, i)
+	}
+	m.enableBroadcasts()
+	<-done
+	if mode, _, _ := m.Settings(); mode != FloodAll {
+		t.Errorf("Error. Broadcasts downgraded flood mode: %s", StringifyFloodMode(mode))
+	}
+	m.Configure(FloodNone, false, 0)
+	m.enableBroadcasts()
+	if mode, _, _ := m.Settings(); mode != FloodBroadcast {
+		t.Errorf("Error. Broadcasts were not enabled: %s", StringifyFloodMode(mode))
+	}
+}
+
+func TestStormLimiter(t *testing.T) {
+	s := new(stormLimiter)
+	s.setRate(5)
+	passed := 0
+	for i := 0; i < 20; i++ {
+		if s.allow() {
+			passed++
+		}
+	}
+	if passed > 6 {
+		t.Errorf("Error. Storm limiter passed %d frames", passed)
+	}
+	s.last = time.Now().Add(-time.Second)
+	if !s.allow() {
+		t.Error("Error. Limiter didn't refill")
+	}
+}
@@ -106,6 +106,22 @@ func (p *PeerToPeer) CreateMessage(msgType MsgType, payload []byte, proto uint16
 	return msg, nil
 }
 
+// sendMessage sends message to a peer endpoint over the socket bound to it.
+// Messages to relay paths are wrapped and sent to the relay
+func (p *PeerToPeer) sendMessage(msg *P2PMessage, addr *net.UDPAddr) (int, error) {
+	p.captureSent(msg, addr)
+	if isRelayAddr(addr) {
+		return p.sendRelayed(msg, addr)
+	}
+	p.exitBypass(addr)
+	if p.Prediction != nil {
+		if socket := p.Prediction.socketFor(addr); socket != nil {
+			return socket.SendMessage(msg, addr)
+		}
+	}
+	return p.UDPSocket.SendMessage(msg, addr)
+}
+
 // CreateMessageStatic is a static method for a P2P Message
 func CreateMessageStatic(msgType MsgType, payload []byte) (*P2PMessage, error) {
 	p := PeerToPeer{}
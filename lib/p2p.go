@@ -8,7 +8,6 @@ import (
 	"sync"
 	"time"
 
-	upnp "github.com/NebulousLabs/go-upnp"
 	"gopkg.in/yaml.v2"
 )
 
@@ -33,6 +32,45 @@ type PeerToPeer struct {
 	Peers           *PeerList                            // Known peers
 	HolePunching    sync.Mutex                           // Mutex for hole punching sync
 	ProxyManager    *ProxyManager                        // Proxy manager
+	Multicast       *MulticastManager                    // Broadcast and multicast flooding
+	BridgeMode      bool                                 // Learn hardware addresses behind TAP interface
+	MACTable        *MACTable                            // Hardware addresses learned in bridge mode
+	Routes          []*net.IPNet                         // Networks behind this instance advertised to peers
+	RouteTable      *RouteTable                          // Networks advertised by peers
+	ARPQueue        *ARPQueue                            // ARP requests waiting for peer introduction
+	Firewall        *Firewall                            // Filter of the overlay traffic
+	capture         *Capture                             // Active capture session
+	captureLock     sync.RWMutex                         // Protects capture session
+	Name            string                               // Name of this instance announced to peers
+	DNS             *DNSServer                           // Overlay DNS responder
+	DHCP            *DHCPServer                          // DHCP server for hosts bridged onto TAP
+	ExitGateway     bool                                 // Route internet traffic of peers
+	ExitNode        string                               // ID of a peer used as internet gateway
+	exit            *exitClient                          // Routes installed to use exit node
+	exitLock        sync.RWMutex                         // Protects exit
+	EndpointWeights EndpointWeights                      // Configuration of endpoint selection
+	Tuning          *Tuning                              // Timeouts and retry policies
+	StaticPeers     []*net.UDPAddr                       // Addresses of peers known without DHT
+	lastStaticProbe time.Time                            // When static peers were probed last time
+	Discovery       *Discovery                           // Announcements of peers in LAN
+	STUNServers     []string                             // Servers used to discover NAT of the instance socket
+	stun            *STUNClient                          // STUN client running on the instance socket
+	nat             *NATInfo                             // Last result of STUN discovery
+	natLock         sync.RWMutex                         // Protects result of STUN discovery
+	natChecked      time.Time                            // When STUN discovery was started last time
+	natChecking     uint32                               // Set while STUN discovery is running
+	Prediction      *PortPrediction                      // Probe sockets and statistics of port prediction
+	Relays          *RelayManager                        // Paths over relays and relayed sessions
+	Lazy            bool                                 // Peers are connected only when traffic for them appears
+	MaxActivePeers  int                                  // Limit of connected peers in lazy mode, zero is unlimited
+	lazyLock        sync.Mutex                           // Serializes checks of active peers limit
+	wakes           map[string]time.Time                 // When unknown destinations woke peers last time
+	portMapping     *PortMapping                         // UDP port forwarded by the gateway
+	portMapLock     sync.RWMutex                         // Protects portMapping
+	portMapChecked  time.Time                            // When port mapping was last tried or renewed
+	portMapChecking uint32                               // Set while port mapping is renewed
+	portMapStopped  uint32                               // Set when instance stops mapping its port
+	goodbyes        goodbyeNonces                        // Nonces of accepted goodbye messages
 	outboundIP      net.IP                               // Outbound IP
 }
 
@@ -41,6 +79,10 @@ type PeerHandshake struct {
 	IP           net.IP
 	HardwareAddr net.HardwareAddr
 	Endpoint     *net.UDPAddr
+	Routes       []*net.IPNet
+	Name         string
+	DHCPPool     string
+	Proof        string
 }
 
 var ActiveInterfaces []net.IP
@@ -113,6 +155,7 @@ func (p *PeerToPeer) ListenInterface() {
 			p.Close()
 			break
 		}
+		p.captureLocal(packet.Packet)
 		go p.handlePacket(packet.Packet, packet.Protocol)
 	}
 	Log(Debug, "Shutting down interface listener")
@@ -207,6 +250,7 @@ func New(argIP, argMac, argDev, argDirect, argHash, argDht, argKeyfile, argKey,
 
 	p.UDPSocket = new(Network)
 	p.UDPSocket.Init("", port)
+	p.stun = NewSTUNClient(p.UDPSocket.SendRawBytes)
 	go p.UDPSocket.Listen(p.HandleP2PMessage)
 	go p.UDPSocket.KeepAlive(p.retrieveFirstDHTRouter())
 	p.waitForRemotePort()
@@ -318,24 +362,25 @@ func (p *PeerToPeer) PrepareInterfaces(ip, interfaceName string) error {
 	return nil
 }
 
-func (p *PeerToPeer) attemptPortForward(port uint16, name string) error {
-	Log(Debug, "Trying to forward port %d", port)
-	d, err := upnp.Discover()
-	if err != nil {
-		return err
-	}
-	err = d.Forward(port, "subutai-"+name)
-	if err != nil {
-		return err
-	}
-	Log(Debug, "Port %d has been forwarded", port)
-	return nil
-}
-
 // Init will initialize PeerToPeer
 func (p *PeerToPeer) Init() {
 	p.Peers = new(PeerList)
 	p.Peers.Init()
+	p.Multicast = new(MulticastManager)
+	p.Multicast.Configure(FloodNone, false, 0)
+	p.MACTable = new(MACTable)
+	p.MACTable.Init()
+	p.RouteTable = new(RouteTable)
+	p.RouteTable.Init()
+	p.ARPQueue = new(ARPQueue)
+	p.ARPQueue.Init()
+	p.Firewall = new(Firewall)
+	p.Firewall.Init()
+	p.EndpointWeights = DefaultEndpointWeights
+	p.Prediction = new(PortPrediction)
+	p.Prediction.init()
+	p.Relays = new(RelayManager)
+	p.Relays.init()
 }
 
 func (p *PeerToPeer) validateMac(mac string) net.HardwareAddr {
@@ -375,6 +420,9 @@ func (p *PeerToPeer) setupHandlers() {
 	p.MessageHandlers[MsgTypeIntro] = p.HandleIntroMessage
 	p.MessageHandlers[MsgTypeIntroReq] = p.HandleIntroRequestMessage
 	p.MessageHandlers[MsgTypeProxy] = p.HandleProxyMessage
+	p.MessageHandlers[MsgTypeMacs] = p.HandleMacsMessage
+	p.MessageHandlers[MsgTypeRelay] = p.HandleRelayMessage
+	p.MessageHandlers[MsgTypeGoodbye] = p.HandleGoodbyeMessage
 
 	// Register packet handlers
 	p.PacketHandlers = make(map[PacketType]PacketHandlerCallback)
@@ -393,7 +441,7 @@ func (p *PeerToPeer) setupHandlers() {
 func (p *PeerToPeer) RequestIP(mac, device string) (net.IP, net.IPMask, error) {
 	Log(Debug, "Requesting IP from Bootstrap node")
 	requestedAt := time.Now()
-	interval := time.Duration(3 * time.Second)
+	interval := p.tuning().DHTWaitTimeout
 	p.Dht.sendDHCP(nil, nil)
 	for p.Dht.IP == nil && p.Dht.Network == nil {
 		if time.Since(requestedAt) > interval {
@@ -448,7 +496,7 @@ func (p *PeerToPeer) markPeerForRemoval(id, reason string) error {
 		return fmt.Errorf("Peer was not found")
 	}
 	Log(Debug, "Removing peer %s: Reason %s", id, reason)
-	peer.SetState(PeerStateDisconnect, p)
+	peer.transition(PeerStateDisconnect, reason, p)
 	p.Peers.Update(id, peer)
 	return nil
 }
@@ -472,8 +520,15 @@ func (p *PeerToPeer) Run() {
 		p.removeStoppedPeers()
 		p.checkLastDHTUpdate()
 		p.checkProxies()
+		p.checkBridge()
+		p.checkExitNode()
+		p.probeStaticPeers()
+		p.announceLocal()
+		p.checkNAT()
+		p.Prediction.expire(p.tuning().EndpointTimeout)
+		p.checkPortMapping()
 		time.Sleep(100 * time.Millisecond)
-		if !initialRequestSent && time.Since(started) > time.Duration(time.Millisecond*5000) {
+		if !initialRequestSent && time.Since(started) > p.tuning().InitialFindDelay {
 			initialRequestSent = true
 			p.Dht.sendFind()
 		}
@@ -483,7 +538,7 @@ func (p *PeerToPeer) Run() {
 
 func (p *PeerToPeer) checkLastDHTUpdate() {
 	passed := time.Since(p.Dht.LastUpdate)
-	if passed > time.Duration(30*time.Second) {
+	if passed > p.tuning().DHTUpdateInterval {
 		Log(Debug, "DHT Last Update timeout passed")
 		// Request new proxies if we don't have any more
 		if len(p.ProxyManager.get()) == 0 {
@@ -500,9 +555,14 @@ func (p *PeerToPeer) checkLastDHTUpdate() {
 func (p *PeerToPeer) removeStoppedPeers() {
 	peers := p.Peers.Get()
 	for id, peer := range peers {
-		if peer.State == PeerStateStop {
+		if peer.GetState() == PeerStateStop {
 			Log(Info, "Removing peer %s", id)
 			p.Peers.Delete(id)
+			p.Multicast.forget(id)
+			p.MACTable.forget(id)
+			p.Relays.forget(id)
+			p.removePeerRoutes(id, peer.GetIP())
+			p.deleteNeighbor(peer.GetIP())
 			Log(Info, "Peer %s has been removed", id)
 			break
 		}
@@ -510,7 +570,7 @@ func (p *PeerToPeer) removeStoppedPeers() {
 }
 
 func (p *PeerToPeer) checkProxies() {
-	p.ProxyManager.check()
+	p.ProxyManager.check(p.tuning())
 	// Unlink dead proxies
 	proxies := p.ProxyManager.get()
 	list := []*net.UDPAddr{}
@@ -527,9 +587,25 @@ func (p *PeerToPeer) checkProxies() {
 
 // PrepareIntroductionMessage collects client ID, mac and IP address
 // and create a comma-separated line
-// endpoint is an address that received this introduction message
-func (p *PeerToPeer) PrepareIntroductionMessage(id, endpoint string) *P2PMessage {
+// endpoint is an address that received this introduction message.
+// Signed introduction proves ID to a peer that knows us by static address
+func (p *PeerToPeer) PrepareIntroductionMessage(id, endpoint string, signed bool) *P2PMessage {
 	var intro = id + "," + p.Interface.GetHardwareAddress().String() + "," + p.Interface.GetIP().String() + "," + endpoint
+	// Optional key=value parts are appended only when used, so peers
+	// with default configuration stay compatible with older versions
+	if len(p.Routes) > 0 {
+		intro += ",routes=" + StringifyRoutes(p.Routes, ";")
+	}
+	if p.Name != "" {
+		intro += ",name=" + p.Name
+	}
+	if p.DHCP != nil {
+		intro += ",dhcp=" + p.DHCP.Pool()
+	}
+	if signed {
+		key, _ := p.authKey()
+		intro += ",auth=" + staticProof(key, id, time.Now())
+	}
 	msg, err := p.CreateMessage(MsgTypeIntro, []byte(intro), 0, true)
 	if err != nil {
 		return nil
@@ -546,6 +622,12 @@ func (p *PeerToPeer) WriteToDevice(b []byte, proto uint16, truncated bool) {
 		Log(Error, "TAP Interface not initialized")
 		return
 	}
+	if p.Interface.GetMode() == InterfaceTUN {
+		packet.Packet = unwrapFrame(b)
+		if packet.Packet == nil {
+			return
+		}
+	}
 	err := p.Interface.WritePacket(&packet)
 	if err != nil {
 		Log(Error, "Failed to write to TAP Interface: %v", err)
@@ -553,11 +635,11 @@ func (p *PeerToPeer) WriteToDevice(b []byte, proto uint16, truncated bool) {
 }
 
 // ParseIntroString receives a comma-separated string with ID, MAC and IP of a peer
-// and returns this data
+// and returns this data. Mandatory parts may be followed by optional key=value parts
 func (p *PeerToPeer) ParseIntroString(intro string) (*PeerHandshake, error) {
 	hs := &PeerHandshake{}
 	parts := strings.Split(intro, ",")
-	if len(parts) != 4 {
+	if len(parts) < 4 {
 		return nil, fmt.Errorf("Failed to parse introduction string: %s", intro)
 	}
 	hs.ID = parts[0]
@@ -576,20 +658,60 @@ func (p *PeerToPeer) ParseIntroString(intro string) (*PeerHandshake, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Failed to parse handshake endpoint: %s", parts[3])
 	}
+	for _, part := range parts[4:] {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "routes":
+			hs.Routes, err = ParseRoutes(kv[1], ";")
+			if err != nil {
+				return nil, err
+			}
+		case "name":
+			if ValidatePeerName(kv[1]) == nil {
+				hs.Name = kv[1]
+			}
+		case "dhcp":
+			if _, _, err := ParseDHCPPool(kv[1]); err == nil {
+				hs.DHCPPool = kv[1]
+			}
+		case "auth":
+			hs.Proof = kv[1]
+		}
+	}
 
 	return hs, nil
 }
 
 // SendTo sends a p2p packet by MAC address
+// In bridge mode addresses unknown to peer list are resolved
+// through learned MAC table
 func (p *PeerToPeer) SendTo(dst net.HardwareAddr, msg *P2PMessage) (int, error) {
+	if p.Lazy {
+		id, _ := p.Peers.GetIDByMac(dst.String())
+		p.usePeerID(id)
+	}
 	endpoint, _, err := p.Peers.GetEndpointAndProxy(dst.String())
 	if err == nil && endpoint != nil {
-		size, err := p.UDPSocket.SendMessage(msg, endpoint)
+		size, err := p.sendMessage(msg, endpoint)
 		return size, err
 	}
+	if p.BridgeMode {
+		return p.sendBridged(dst, msg)
+	}
 	return 0, nil
 }
 
+// EnableBridge switches instance into bridge mode. Broadcasts are always
+// flooded in this mode, otherwise hosts behind bridges can't resolve each other
+func (p *PeerToPeer) EnableBridge() {
+	p.BridgeMode = true
+	p.Multicast.enableBroadcasts()
+	Log(Info, "Bridge mode enabled")
+}
+
 // StopInstance stops current instance
 func (p *PeerToPeer) Close() error {
 	for i, ip := range ActiveInterfaces {
@@ -601,8 +723,12 @@ func (p *PeerToPeer) Close() error {
 	hash := p.Dht.NetworkHash
 	Log(Info, "Stopping instance %s", hash)
 	peers := p.Peers.Get()
+	for _, peer := range peers {
+		// Tell peers directly, bootstrap node may be slow or unavailable
+		peer.sayGoodbye(p)
+	}
 	for i, peer := range peers {
-		peer.SetState(PeerStateDisconnect, p)
+		peer.transition(PeerStateDisconnect, "Instance is stopping", p)
 		p.Peers.Update(i, peer)
 	}
 	stopStarted := time.Now()
@@ -615,11 +741,22 @@ func (p *PeerToPeer) Close() error {
 	Log(Debug, "All peers under this instance has been removed")
 
 	p.Shutdown = true
+	// Mapping in progress is awaited and removed before DHT is closed,
+	// so it's neither left on the gateway nor announced to closed DHT
+	p.UnmapPort()
 	err := p.Dht.Close()
 	if err != nil {
 		Log(Error, "Failed to stop DHT: %s", err)
 	}
 	p.UDPSocket.Stop()
+	p.Prediction.close()
+	if p.ActiveCapture() != nil {
+		p.StopCapture()
+	}
+	p.StopDNS()
+	p.StopDiscovery()
+	p.releaseExitNode()
+	p.DisableExitGateway()
 
 	if p.Interface != nil {
 		err := p.Interface.Close()
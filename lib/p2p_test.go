@@ -138,3 +138,18 @@ func TestParseIntroString(t *testing.T) {
 		t.Error("Error")
 	}
 }
+
+func TestParseIntroStringRoutes(t *testing.T) {
+	ptp := new(PeerToPeer)
+	hs, err := ptp.ParseIntroString("1,01:02:03:04:05:06,127.0.0.1,192.168.1.1:24,routes=10.0.0.0/8;192.168.5.0/24,unknown=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hs.Routes) != 2 || hs.Routes[1].String() != "192.168.5.0/24" {
+		t.Errorf("Wrong routes: %v", hs.Routes)
+	}
+	_, err = ptp.ParseIntroString("1,01:02:03:04:05:06,127.0.0.1,192.168.1.1:24,routes=10.0.0.0")
+	if err == nil {
+		t.Error("Malformed route was accepted")
+	}
+}
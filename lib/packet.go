@@ -112,6 +112,13 @@ type ARPPacket struct {
 // packet within a subnet in which our application works.
 // This method calls appropriate gorouting for extracted packet protocol
 func (p *PeerToPeer) handlePacket(contents []byte, proto int) {
+	if p.Interface.GetMode() == InterfaceTUN {
+		p.handleTunPacket(contents, proto)
+		return
+	}
+	if p.BridgeMode {
+		p.learnLocalFrame(contents)
+	}
 	callback, exists := p.PacketHandlers[PacketType(proto)]
 	if exists {
 		callback(contents, proto)
@@ -120,27 +127,117 @@ func (p *PeerToPeer) handlePacket(contents []byte, proto int) {
 	}
 }
 
+// Handles an IP packet received by TUN device. Destination peer is
+// resolved by IP address and packet is wrapped into Ethernet frame, so
+// peers running in TAP mode receive it the same way as regular frames
+func (p *PeerToPeer) handleTunPacket(contents []byte, proto int) {
+	if PacketType(proto) != PacketIPv4 || len(contents) < 20 {
+		return
+	}
+	dst := net.IP(contents[16:20])
+	var peer *NetworkPeer
+	id, err := p.Peers.GetID(dst.String())
+	if err == nil {
+		peer = p.Peers.GetPeer(id)
+	} else {
+		peer = p.routedPeer(dst)
+	}
+	if peer == nil {
+		p.wakeUnknown(dst)
+		return
+	}
+	p.usePeer(peer)
+	endpoint := peer.GetEndpoint()
+	hw := peer.GetHardwareAddress()
+	if endpoint == nil || hw == nil {
+		return
+	}
+	if !p.Firewall.Allow(FirewallOut, peer.ID, contents) {
+		return
+	}
+	frame := wrapFrame(hw, p.Interface.GetHardwareAddress(), proto, contents)
+	msg, err := p.CreateMessage(MsgTypeNenc, frame, uint16(proto), true)
+	if err == nil && msg != nil {
+		p.sendMessage(msg, endpoint)
+	}
+}
+
 // Handles a IPv4 packet and sends it to it's destination
 func (p *PeerToPeer) handlePacketIPv4(contents []byte, proto int) {
 
 	f := new(ethernet.Frame)
 	if err := f.UnmarshalBinary(contents); err != nil {
 		Log(Error, "Failed to unmarshal IPv4 packet")
+		return
 	}
 
 	if f.EtherType != ethernet.EtherTypeIPv4 {
 		return
 	}
+	if p.handleDHCP(f, "") {
+		return
+	}
+	if isMulticastMAC(f.Destination) {
+		if p.Firewall.Allow(FirewallOut, "", f.Payload) {
+			p.floodFrame(f, contents, proto)
+		}
+		return
+	}
+	// Packets for networks behind peers are sent to the peer
+	// which advertised the most specific network
+	var routed *NetworkPeer
+	if len(f.Payload) >= 20 {
+		routed = p.routedPeer(net.IP(f.Payload[16:20]))
+	}
+	dstID := ""
+	if routed != nil {
+		dstID = routed.ID
+	} else {
+		dstID, _ = p.Peers.GetIDByMac(f.Destination.String())
+	}
+	if !p.Firewall.Allow(FirewallOut, dstID, f.Payload) {
+		Log(Trace, "Outbound packet to %s was dropped by firewall", f.Destination.String())
+		return
+	}
 	//msg := CreateNencP2PMessage(p.Crypter, contents, uint16(proto), 1, 1, 1)
 	msg, err := p.CreateMessage(MsgTypeNenc, contents, uint16(proto), true)
-	if err == nil && msg != nil {
-		p.SendTo(f.Destination, msg)
+	if err != nil || msg == nil {
+		return
+	}
+	if routed != nil {
+		p.usePeer(routed)
+		p.sendMessage(msg, routed.GetEndpoint())
+		return
 	}
+	p.SendTo(f.Destination, msg)
 }
 
-// TODO: Implement IPv6 Support
+// Handles a IPv6 packet. Multicast packets (including neighbor discovery)
+// are flooded to peers, unicast packets are sent to their destination
 func (p *PeerToPeer) handlePacketIPv6(contents []byte, proto int) {
-
+	f := new(ethernet.Frame)
+	if err := f.UnmarshalBinary(contents); err != nil {
+		Log(Error, "Failed to unmarshal IPv6 packet")
+		return
+	}
+	if f.EtherType != ethernet.EtherTypeIPv6 {
+		return
+	}
+	if isMulticastMAC(f.Destination) {
+		if p.Firewall.Allow(FirewallOut, "", f.Payload) {
+			p.floodFrame(f, contents, proto)
+		}
+		return
+	}
+	dstID, _ := p.Peers.GetIDByMac(f.Destination.String())
+	if !p.Firewall.Allow(FirewallOut, dstID, f.Payload) {
+		Log(Trace, "Outbound packet to %s was dropped by firewall", f.Destination.String())
+		return
+	}
+	msg, err := p.CreateMessage(MsgTypeNenc, contents, uint16(proto), true)
+	if err == nil && msg != nil {
+		p.SendTo(f.Destination, msg)
+	}
 }
 
 // TODO: Implement PARC Universal Support
@@ -182,54 +279,39 @@ func (p *PeerToPeer) handlePacketARP(contents []byte, proto int) {
 		Log(Error, "Failed to unmarshal arp")
 		return
 	}
-	id, err := p.Peers.GetID(packet.TargetIP.String())
-	if err != nil {
-		Log(Trace, "Unknown IP requested: %s", packet.TargetIP.String())
+	if p.BridgeMode && (packet.Operation != OperationRequest || !isMulticastMAC(f.Destination)) {
+		// Replies from hosts behind the bridge are delivered as regular frames
+		msg, err := p.CreateMessage(MsgTypeNenc, contents, uint16(proto), true)
+		if err == nil && msg != nil {
+			p.SendTo(f.Destination, msg)
+		}
 		return
 	}
-	peer := p.Peers.GetPeer(id)
-	if peer == nil {
-		Log(Debug, "Can't lookup address: Specified peer was not found")
+	id, err := p.Peers.GetID(packet.TargetIP.String())
+	if err != nil && p.BridgeMode {
+		p.floodFrame(f, contents, proto)
 		return
 	}
-	hwAddr := peer.PeerHW
-	if hwAddr == nil {
-		Log(Error, "Cannot find hardware address for requested IP")
-		_, hwAddr = GenerateMAC()
-		peer.PeerHW = hwAddr
-		p.Peers.Update(id, peer)
-	}
-	if hwAddr.String() == "00:00:00:00:00:00" {
-		_, hwAddr = GenerateMAC()
-		peer.PeerHW = hwAddr
-		p.Peers.Update(id, peer)
-	}
-	var reply ARPPacket
-	ip := net.ParseIP(packet.TargetIP.String())
-	response, err := reply.NewPacket(OperationReply, hwAddr, ip, packet.SenderHardwareAddr, packet.SenderIP)
-	if err != nil {
-		Log(Error, "Failed to create ARP reply")
-		return
+	var hwAddr net.HardwareAddr
+	if err == nil {
+		peer := p.Peers.GetPeer(id)
+		if peer != nil {
+			p.usePeer(peer)
+			hwAddr = peer.GetHardwareAddress()
+		}
+	} else {
+		p.wakeUnknown(packet.TargetIP)
 	}
-	rp, err := response.MarshalBinary()
-	if err != nil {
-		Log(Error, "Failed to marshal ARP response packet")
+	if hwAddr == nil || hwAddr.String() == "00:00:00:00:00:00" {
+		// Peer is not introduced yet. Request will be answered
+		// when introduction is completed
+		if p.ARPQueue.add(packet.TargetIP.String(), packet.SenderHardwareAddr, packet.SenderIP) {
+			Log(Trace, "Queued ARP request for %s", packet.TargetIP.String())
+		}
 		return
 	}
-
-	fr := &ethernet.Frame{
-		Destination: response.TargetHardwareAddr,
-		Source:      response.SenderHardwareAddr,
-		EtherType:   ethernet.EtherTypeARP,
-		Payload:     rp,
-	}
-
-	fb, err := fr.MarshalBinary()
-	if err != nil {
-		Log(Error, "Failed to marshal ARP Ethernet Frame")
-	}
 	Log(Trace, "%v", packet.String())
-	p.WriteToDevice(fb, uint16(proto), false)
+	p.replyARP(hwAddr, packet.TargetIP, packet.SenderHardwareAddr, packet.SenderIP)
 }
 
 func (p *PeerToPeer) handlePacketLLDP(contents []byte, proto int) {
@@ -18,6 +18,9 @@ func (p *PeerToPeer) HandleP2PMessage(count int, srcAddr *net.UDPAddr, err error
 	}
 	buf := make([]byte, count)
 	copy(buf[:], rcvBytes[:])
+	if p.stun != nil && p.stun.Handle(buf, srcAddr) {
+		return
+	}
 
 	msg, desErr := P2PMessageFromBytes(buf)
 	if desErr != nil {
@@ -28,8 +31,9 @@ func (p *PeerToPeer) HandleP2PMessage(count int, srcAddr *net.UDPAddr, err error
 		Log(Error, "Received broken message")
 		return
 	}
+	p.captureMessage(buf, msg.Header.Type, srcAddr)
 	// Decrypt message if crypter is active
-	if p.Crypter.Active && (msg.Header.Type == MsgTypeIntro || msg.Header.Type == MsgTypeNenc || msg.Header.Type == MsgTypeIntroReq || msg.Header.Type == MsgTypeTest || msg.Header.Type == MsgTypeXpeerPing) {
+	if p.Crypter.Active && (msg.Header.Type == MsgTypeIntro || msg.Header.Type == MsgTypeNenc || msg.Header.Type == MsgTypeIntroReq || msg.Header.Type == MsgTypeTest || msg.Header.Type == MsgTypeXpeerPing || msg.Header.Type == MsgTypeMacs || msg.Header.Type == MsgTypeRelay || msg.Header.Type == MsgTypeGoodbye) {
 		var decErr error
 		msg.Data, decErr = p.Crypter.decrypt(p.Crypter.ActiveKey.Key, msg.Data)
 		if decErr != nil {
@@ -50,6 +54,22 @@ func (p *PeerToPeer) HandleP2PMessage(count int, srcAddr *net.UDPAddr, err error
 // HandleNotEncryptedMessage is a normal message sent over p2p network
 func (p *PeerToPeer) HandleNotEncryptedMessage(msg *P2PMessage, srcAddr *net.UDPAddr) {
 	Log(Trace, "Data: %s, From: %s", msg.Data, srcAddr.String())
+	sender, valid := p.frameSender(msg.Data, srcAddr)
+	if !valid {
+		p.wakeBySource(srcAddr)
+		Log(Trace, "Dropping frame from %s [%s] with foreign source address", srcAddr.String(), sender)
+		return
+	}
+	if !p.filterFrame(FirewallIn, sender, msg.Data) {
+		Log(Trace, "Inbound packet from %s was dropped by firewall", srcAddr.String())
+		return
+	}
+	p.captureFrame(captureDirectionIn, sender, srcAddr, msg.Data, false)
+	p.usePeerID(sender)
+	if p.handlePeerDHCP(msg.Data, sender) {
+		return
+	}
+	p.snoopFrame(msg.Data)
 	p.WriteToDevice(msg.Data, msg.Header.NetProto, false)
 }
 
@@ -58,7 +78,7 @@ func (p *PeerToPeer) HandlePingMessage(msg *P2PMessage, srcAddr *net.UDPAddr) {
 	addr, err := net.ResolveUDPAddr("udp4", string(msg.Data))
 	if err != nil {
 		if p.ProxyManager.touch(srcAddr.String()) {
-			p.UDPSocket.SendMessage(msg, srcAddr)
+			p.sendMessage(msg, srcAddr)
 		}
 		return
 	}
@@ -79,8 +99,9 @@ func (p *PeerToPeer) HandleXpeerPingMessage(msg *P2PMessage, srcAddr *net.UDPAdd
 	query := string(msg.Data)[:1]
 	if query == "q" {
 		id := string(msg.Data)[1:37]
-		endpoint := string(msg.Data)[37:]
-		response := append([]byte("r"), []byte(endpoint)...)
+		// Sequence number and timestamp are echoed back untouched
+		response := append([]byte("r"), msg.Data[37:]...)
+		endpoint, _, _, _ := parsePing(string(msg.Data)[37:])
 
 		msg, err := p.CreateMessage(MsgTypeXpeerPing, response, 0, true)
 		if err != nil {
@@ -91,12 +112,16 @@ func (p *PeerToPeer) HandleXpeerPingMessage(msg *P2PMessage, srcAddr *net.UDPAdd
 
 		for _, peer := range p.Peers.Get() {
 			if peer.ID == id {
-				for _, ep := range peer.KnownIPs {
+				for _, ep := range peer.GetKnownIPs() {
 					if ep.String() == srcAddr.String() {
-						p.UDPSocket.SendMessage(msg, ep)
+						p.sendMessage(msg, ep)
 						return
 					}
 				}
+				if path, exists := p.Relays.lookup(srcAddr); exists && path.peer == id {
+					p.sendMessage(msg, srcAddr)
+					return
+				}
 				// It is possible that we received ping over proxy. In this case
 				// origin address will not match any of the endpoints. Therefore
 				// we are going to iterate over registered proxies
@@ -107,26 +132,15 @@ func (p *PeerToPeer) HandleXpeerPingMessage(msg *P2PMessage, srcAddr *net.UDPAdd
 						break
 					}
 				}
-				if overProxy && peer.State == PeerStateConnected && peer.RemoteState == PeerStateConnected {
-					p.UDPSocket.SendMessage(msg, peer.Endpoint)
+				if overProxy && peer.GetState() == PeerStateConnected && peer.GetRemoteState() == PeerStateConnected {
+					p.sendMessage(msg, peer.GetEndpoint())
 					return
 				}
 			}
 		}
 		Log(Debug, "Received ping from unknown endpoint: %s [%s ID: %s]", srcAddr.String(), endpoint, id)
 	} else if query == "r" {
-		endpoint := msg.Data[1:]
-		for _, peer := range p.Peers.Get() {
-			if peer == nil {
-				continue
-			}
-			for i, ep := range peer.Endpoints {
-				if ep.Addr.String() == string(endpoint) {
-					peer.Endpoints[i].LastContact = time.Now()
-					return
-				}
-			}
-		}
+		p.handlePong(string(msg.Data[1:]))
 	} else {
 		Log(Trace, "Wrong xpeer ping message")
 	}
@@ -145,6 +159,9 @@ func (p *PeerToPeer) HandleIntroMessage(msg *P2PMessage, srcAddr *net.UDPAddr) {
 		return
 	}
 	peer := p.Peers.GetPeer(hs.ID)
+	if peer == nil {
+		peer = p.addStaticPeer(hs.ID, hs.Proof, srcAddr)
+	}
 	if peer == nil {
 		Log(Trace, "Unknown peer in handshke response")
 		return
@@ -158,13 +175,17 @@ func (p *PeerToPeer) HandleIntroMessage(msg *P2PMessage, srcAddr *net.UDPAddr) {
 		Log(Debug, "No IP received. Skipping")
 		return
 	}
-	peer.PeerHW = hs.HardwareAddr
-	peer.PeerLocalIP = hs.IP
-	peer.LastContact = time.Now()
+	p.updatePeerAddresses(hs.ID, hs.HardwareAddr, hs.IP)
+	peer.introduce(hs.HardwareAddr, hs.IP, hs.Name)
+	peer.setDHCPPool(hs.DHCPPool)
+	p.countIntroduction(peer, hs.Endpoint, srcAddr)
 	peer.addEndpoint(hs.Endpoint)
 	//peer.Endpoints = append(peer.Endpoints, PeerEndpoint{Addr: hs.Endpoint, LastContact: time.Now()})
 	// peer.SetState(PeerStateConnected, p)
 	p.Peers.Update(hs.ID, peer)
+	peer.notify(PeerEventIntro)
+	p.resolveARP(hs.HardwareAddr, hs.IP)
+	p.updatePeerRoutes(hs.ID, hs.IP, hs.Routes)
 	Log(Debug, "Connection with peer %s has been established over %s", hs.ID, hs.Endpoint.String())
 }
 
@@ -175,16 +196,20 @@ func (p *PeerToPeer) HandleIntroMessage(msg *P2PMessage, srcAddr *net.UDPAddr) {
 // replied
 func (p *PeerToPeer) HandleIntroRequestMessage(msg *P2PMessage, srcAddr *net.UDPAddr) {
 	id := string(msg.Data[0:36])
+	endpoint, proof := splitIntroRequest(string(msg.Data[36:]))
 	peer := p.Peers.GetPeer(id)
 	if peer == nil {
-		Log(Trace, "Introduction request came from unknown peer: %s -> %s [%s]", id, msg.Data[36:], srcAddr.String())
+		peer = p.addStaticPeer(id, proof, srcAddr)
+	}
+	if peer == nil {
+		Log(Trace, "Introduction request came from unknown peer: %s -> %s [%s]", id, endpoint, srcAddr.String())
 		//p.Dht.sendFind()
 		return
 	}
-	response := p.PrepareIntroductionMessage(p.Dht.ID, string(msg.Data[36:]))
+	response := p.PrepareIntroductionMessage(p.Dht.ID, endpoint, proof != "" && peer.Static)
 	eps := []*net.UDPAddr{}
-	eps = append(eps, peer.KnownIPs...)
-	eps = append(eps, peer.Proxies...)
+	eps = append(eps, peer.GetKnownIPs()...)
+	eps = append(eps, peer.GetProxies()...)
 	Log(Debug, "Sending handshake response")
 
 	srcFound := false
@@ -199,7 +224,7 @@ func (p *PeerToPeer) HandleIntroRequestMessage(msg *P2PMessage, srcAddr *net.UDP
 
 	for _, ep := range eps {
 		time.Sleep(time.Millisecond * 10)
-		_, err := p.UDPSocket.SendMessage(response, ep)
+		_, err := p.sendMessage(response, ep)
 		if err != nil {
 			Log(Error, "Failed to respond to introduction request: %v", err)
 		}
@@ -5,17 +5,99 @@ import (
 	"net"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// StateHandlerCallback is a peer method callback executed by peer state
+// StateHandlerCallback is a peer method callback executed when peer enters a state
 type StateHandlerCallback func(ptpc *PeerToPeer) error
 
+// PeerTransition handles an event received in some state and returns
+// the next state. Returning current state keeps peer in it
+type PeerTransition func(np *NetworkPeer, ptpc *PeerToPeer) PeerState
+
+// PeerEvent is something that may move peer into another state
+type PeerEvent int
+
+// Peer events
+const (
+	PeerEventState       PeerEvent = iota + 1 // State was changed outside of the peer loop
+	PeerEventDHT                              // Addresses of the peer were received from DHT
+	PeerEventProxy                            // Proxies were assigned to the peer
+	PeerEventRemoteState                      // Peer reported its state
+	PeerEventIntro                            // Introduction was received from the peer
+	PeerEventTimeout                          // Timer of the current state has fired
+	PeerEventReconnect                        // Reconnect was requested by user
+	PeerEventWake                             // Traffic for the idle peer has appeared
+)
+
+// peerEventsBuffer is a size of the peer events queue
+const peerEventsBuffer = 32
+
+// PeerHistorySize is a number of state changes kept for every peer
+const PeerHistorySize = 32
+
+// PeerStateChange is a record in the history of peer state changes
+type PeerStateChange struct {
+	Time     time.Time // When state was changed
+	From     PeerState // Previous state
+	To       PeerState // New state
+	Reason   string    // Why state was changed
+	Endpoint string    // Endpoint used with a peer at the moment of change
+}
+
+// peerTransitions is a table of events handled in every state.
+// Events missing from the table are ignored
+var peerTransitions = map[PeerState]map[PeerEvent]PeerTransition{
+	PeerStateRequestedIP: {
+		PeerEventDHT:       (*NetworkPeer).onAddressesReceived,
+		PeerEventTimeout:   (*NetworkPeer).onRequestIPTimeout,
+		PeerEventReconnect: (*NetworkPeer).onReconnect,
+	},
+	PeerStateWaitingForProxy: {
+		PeerEventProxy:     (*NetworkPeer).onProxiesReceived,
+		PeerEventTimeout:   (*NetworkPeer).onProxiesReceived,
+		PeerEventReconnect: (*NetworkPeer).onReconnect,
+	},
+	PeerStateWaitingToConnect: {
+		PeerEventRemoteState: (*NetworkPeer).onRemoteState,
+		PeerEventTimeout:     (*NetworkPeer).onWaitToConnectTimeout,
+		PeerEventReconnect:   (*NetworkPeer).onReconnect,
+	},
+	PeerStateConnecting: {
+		PeerEventIntro:       (*NetworkPeer).onConnectingProgress,
+		PeerEventRemoteState: (*NetworkPeer).onConnectingProgress,
+		PeerEventTimeout:     (*NetworkPeer).onConnectingTimeout,
+		PeerEventReconnect:   (*NetworkPeer).onReconnect,
+	},
+	PeerStateConnected: {
+		PeerEventIntro:       (*NetworkPeer).onConnectedIntro,
+		PeerEventRemoteState: (*NetworkPeer).onConnectedRemoteState,
+		PeerEventTimeout:     (*NetworkPeer).onMaintenance,
+		PeerEventReconnect:   (*NetworkPeer).onReconnect,
+	},
+	PeerStateCooldown: {
+		PeerEventTimeout:   (*NetworkPeer).onCooldownFinished,
+		PeerEventReconnect: (*NetworkPeer).onReconnect,
+	},
+	PeerStateIdle: {
+		PeerEventWake:        (*NetworkPeer).onWake,
+		PeerEventIntro:       (*NetworkPeer).onWake,
+		PeerEventRemoteState: (*NetworkPeer).onIdleRemoteState,
+		PeerEventReconnect:   (*NetworkPeer).onWake,
+	},
+}
+
 // PeerEndpoint reprsents a UDP address endpoint that instance
 // may use for connection with a peer
 type PeerEndpoint struct {
 	Addr        *net.UDPAddr
 	LastContact time.Time
+	RTT         time.Duration // Smoothed round trip time
+	Jitter      time.Duration // Smoothed variation of round trip time
+	Loss        float64       // Percentage of recent pings left without reply
+	LostInRow   int           // Number of last pings left without reply
+	pings       *pingStats    // Pings waiting for reply and recent results
 }
 
 // NetworkPeer represents a peer
@@ -32,28 +114,295 @@ type NetworkPeer struct {
 	PingCount          uint8                              // Number of pings messages sent without response
 	LastError          string                             // Test of last error occured during state execution
 	ConnectionAttempts uint8                              // How many times we tried to connect
+	cooldowns          int                                // Cooldowns since the last connection
+	lastUsed           int64                              // When data was last exchanged with the peer, in nanoseconds
+	farewell           uint32                             // Set when goodbye was sent to or received from the peer
 	handlers           map[PeerState]StateHandlerCallback // List of callbacks for different peer states
 	Running            bool                               // Whether peer is running or not
 	Endpoints          []PeerEndpoint                     // List of active endpoints
 	EndpointsLock      sync.RWMutex                       // Mutex for endpoints operations
-	punchingInProgress bool                               // Whether or not UDP hole punching is running
+	punching           uint32                             // Set while UDP hole punching is running
+	punchRounds        uint32                             // Punching rounds since the last connection
+	predicted          map[string]PredictionStrategy      // Endpoints guessed by port prediction
 	LastFind           time.Time                          // Moment when we got this peer from DHT
 	LastPunch          time.Time                          // Last time we run hole punch
+	Name               string                             // Name announced in introduction
+	DHCPPool           string                             // Pool of DHCP server announced in introduction
+	events             chan PeerEvent                     // Events processed by peer loop
+	eventsInit         sync.Once                          // Creates events channel
+	timer              *time.Timer                        // Timer of the current state
+	stateSeq           uint32                             // Incremented on every state change
+	stateEntered       time.Time                          // When current state was entered
+	requestAttempts    int                                // Requests of addresses sent in current state
+	PinnedEndpoint     string                             // Endpoint forced by user
+	Static             bool                               // Peer was configured by address and doesn't depend on DHT
+	Discovered         bool                               // Peer was announced in LAN and doesn't depend on DHT
+	history            []PeerStateChange                  // Ring buffer of state changes
+	historyNext        int                                // Position of the next record in history
+	historyLock        sync.Mutex                         // Protects history
+	lock               sync.RWMutex                       // Protects fields shared with other goroutines
+}
+
+// Peer is shared between its own loop, DHT callbacks, UDP handlers and
+// REST requests. State, addresses, identity, endpoint and error of the
+// peer are guarded by lock and must be accessed with methods below.
+// Active endpoints are guarded by EndpointsLock. Timer, handlers and
+// counters of the state machine belong to the peer loop only
+
+// GetState returns local state of the peer
+func (np *NetworkPeer) GetState() PeerState {
+	np.lock.RLock()
+	defer np.lock.RUnlock()
+	return np.State
+}
+
+// GetRemoteState returns last state reported by the peer
+func (np *NetworkPeer) GetRemoteState() PeerState {
+	np.lock.RLock()
+	defer np.lock.RUnlock()
+	return np.RemoteState
+}
+
+func (np *NetworkPeer) setRemoteState(state PeerState) {
+	np.lock.Lock()
+	np.RemoteState = state
+	np.lock.Unlock()
+}
+
+// GetEndpoint returns endpoint currently used for communication with the peer
+func (np *NetworkPeer) GetEndpoint() *net.UDPAddr {
+	np.lock.RLock()
+	defer np.lock.RUnlock()
+	return np.Endpoint
+}
+
+func (np *NetworkPeer) setEndpoint(endpoint *net.UDPAddr) {
+	np.lock.Lock()
+	np.Endpoint = endpoint
+	np.lock.Unlock()
+}
+
+// GetKnownIPs returns copy of addresses of the peer received from DHT
+func (np *NetworkPeer) GetKnownIPs() []*net.UDPAddr {
+	np.lock.RLock()
+	defer np.lock.RUnlock()
+	return append([]*net.UDPAddr{}, np.KnownIPs...)
+}
+
+func (np *NetworkPeer) setKnownIPs(list []*net.UDPAddr) {
+	np.lock.Lock()
+	np.KnownIPs = list
+	np.lock.Unlock()
+}
+
+// GetProxies returns copy of proxies of the peer
+func (np *NetworkPeer) GetProxies() []*net.UDPAddr {
+	np.lock.RLock()
+	defer np.lock.RUnlock()
+	return append([]*net.UDPAddr{}, np.Proxies...)
+}
+
+func (np *NetworkPeer) setProxies(list []*net.UDPAddr) {
+	np.lock.Lock()
+	np.Proxies = list
+	np.lock.Unlock()
+}
+
+// GetIP returns IP of the peer interface
+func (np *NetworkPeer) GetIP() net.IP {
+	np.lock.RLock()
+	defer np.lock.RUnlock()
+	return np.PeerLocalIP
+}
+
+// GetHardwareAddress returns hardware address of the peer interface
+func (np *NetworkPeer) GetHardwareAddress() net.HardwareAddr {
+	np.lock.RLock()
+	defer np.lock.RUnlock()
+	return np.PeerHW
+}
+
+// GetName returns name announced by the peer
+func (np *NetworkPeer) GetName() string {
+	np.lock.RLock()
+	defer np.lock.RUnlock()
+	return np.Name
+}
+
+// GetDHCPPool returns pool of DHCP server running on the peer
+func (np *NetworkPeer) GetDHCPPool() string {
+	np.lock.RLock()
+	defer np.lock.RUnlock()
+	return np.DHCPPool
+}
+
+func (np *NetworkPeer) setDHCPPool(pool string) {
+	np.lock.Lock()
+	np.DHCPPool = pool
+	np.lock.Unlock()
+}
+
+// introduce stores identity received in introduction
+func (np *NetworkPeer) introduce(hw net.HardwareAddr, ip net.IP, name string) {
+	np.lock.Lock()
+	np.PeerHW = hw
+	np.PeerLocalIP = ip
+	np.Name = name
+	np.LastContact = time.Now()
+	np.lock.Unlock()
+}
+
+// GetLastError returns text of the last error
+func (np *NetworkPeer) GetLastError() string {
+	np.lock.RLock()
+	defer np.lock.RUnlock()
+	return np.LastError
+}
+
+func (np *NetworkPeer) setLastError(text string) {
+	np.lock.Lock()
+	np.LastError = text
+	np.lock.Unlock()
+}
+
+// GetPinnedEndpoint returns endpoint forced by user
+func (np *NetworkPeer) GetPinnedEndpoint() string {
+	np.lock.RLock()
+	defer np.lock.RUnlock()
+	return np.PinnedEndpoint
+}
+
+func (np *NetworkPeer) setPinnedEndpoint(endpoint string) {
+	np.lock.Lock()
+	np.PinnedEndpoint = endpoint
+	np.lock.Unlock()
+}
+
+// found marks the moment peer was received from DHT
+func (np *NetworkPeer) found() {
+	np.lock.Lock()
+	np.LastFind = time.Now()
+	np.lock.Unlock()
+}
+
+func (np *NetworkPeer) lastFound() time.Time {
+	np.lock.RLock()
+	defer np.lock.RUnlock()
+	return np.LastFind
+}
+
+// start marks peer as running. Returns false if it was running already
+func (np *NetworkPeer) start() bool {
+	np.lock.Lock()
+	defer np.lock.Unlock()
+	if np.Running {
+		return false
+	}
+	np.Running = true
+	return true
+}
+
+// isPunching returns true while UDP hole punching is running
+func (np *NetworkPeer) isPunching() bool {
+	return atomic.LoadUint32(&np.punching) == 1
+}
+
+// endpointsCount returns number of active endpoints
+func (np *NetworkPeer) endpointsCount() int {
+	np.EndpointsLock.RLock()
+	defer np.EndpointsLock.RUnlock()
+	return len(np.Endpoints)
 }
 
 func (np *NetworkPeer) reportState(ptpc *PeerToPeer) {
-	stateStr := strconv.Itoa(int(np.State))
+	state := np.GetState()
+	stateStr := strconv.Itoa(int(state))
 	if stateStr == "" {
 		return
 	}
-	Log(Trace, "Reporting state %s to %s", StringifyState(np.State), np.ID)
+	Log(Trace, "Reporting state %s to %s", StringifyState(state), np.ID)
 	ptpc.Dht.sendState(np.ID, stateStr)
 }
 
 // SetState modify local state of peer
 func (np *NetworkPeer) SetState(state PeerState, ptpc *PeerToPeer) {
+	np.transition(state, "", ptpc)
+}
+
+// transition modifies local state of peer and records the change in history
+func (np *NetworkPeer) transition(state PeerState, reason string, ptpc *PeerToPeer) {
+	np.lock.Lock()
+	np.record(np.State, state, reason)
 	np.State = state
+	np.lock.Unlock()
+	np.changed(ptpc)
+}
+
+// transitionFrom modifies local state only if peer is still in the
+// expected state. Returns false if state was changed by someone else
+func (np *NetworkPeer) transitionFrom(from, state PeerState, reason string, ptpc *PeerToPeer) bool {
+	np.lock.Lock()
+	if np.State != from {
+		np.lock.Unlock()
+		return false
+	}
+	np.record(from, state, reason)
+	np.State = state
+	np.lock.Unlock()
+	np.changed(ptpc)
+	return true
+}
+
+// changed wakes up peer loop and reports new state to the peer
+func (np *NetworkPeer) changed(ptpc *PeerToPeer) {
+	atomic.AddUint32(&np.stateSeq, 1)
 	np.reportState(ptpc)
+	np.notify(PeerEventState)
+}
+
+// notify delivers event to the peer loop without blocking. Events
+// received before the loop is started are kept in the queue
+func (np *NetworkPeer) notify(event PeerEvent) {
+	np.eventsInit.Do(np.initEvents)
+	if event == PeerEventState && len(np.events) > 0 {
+		// Loop will wake up and notice state change anyway
+		return
+	}
+	select {
+	case np.events <- event:
+	default:
+		Log(Trace, "Event queue of peer %s is full", np.ID)
+	}
+}
+
+// record appends state change to history overwriting the oldest record.
+// Must be called with lock held
+func (np *NetworkPeer) record(from, to PeerState, reason string) {
+	change := PeerStateChange{Time: time.Now(), From: from, To: to, Reason: reason}
+	if np.Endpoint != nil {
+		change.Endpoint = np.Endpoint.String()
+	}
+	np.historyLock.Lock()
+	defer np.historyLock.Unlock()
+	if len(np.history) < PeerHistorySize {
+		np.history = append(np.history, change)
+		return
+	}
+	np.history[np.historyNext] = change
+	np.historyNext = (np.historyNext + 1) % PeerHistorySize
+}
+
+// History returns recorded state changes from the oldest to the newest
+func (np *NetworkPeer) History() []PeerStateChange {
+	np.historyLock.Lock()
+	defer np.historyLock.Unlock()
+	result := make([]PeerStateChange, 0, len(np.history))
+	result = append(result, np.history[np.historyNext:]...)
+	return append(result, np.history[:np.historyNext]...)
+}
+
+func (np *NetworkPeer) initEvents() {
+	np.events = make(chan PeerEvent, peerEventsBuffer)
 }
 
 // NetworkPeerState represents a state for remote peers
@@ -62,50 +411,141 @@ type NetworkPeerState struct {
 	State string // State of peer
 }
 
-// Run is main loop for a peer
+// Run is main loop for a peer. Every state change executes state handler
+// once, after that peer sleeps until an event or state timer wakes it up
 func (np *NetworkPeer) Run(ptpc *PeerToPeer) {
-	np.Running = true
+	np.start()
 	np.ConnectionAttempts = 0
+	np.eventsInit.Do(np.initEvents)
 
 	np.handlers = make(map[PeerState]StateHandlerCallback)
 	np.handlers[PeerStateInit] = np.stateInit
 	np.handlers[PeerStateRequestedIP] = np.stateRequestedIP
 	np.handlers[PeerStateConnecting] = np.stateConnecting
-	np.handlers[PeerStateConnected] = np.stateConnected
+	np.handlers[PeerStateConnected] = np.enterConnected
 	np.handlers[PeerStateDisconnect] = np.stateDisconnect
 	np.handlers[PeerStateStop] = np.stateStop
 	np.handlers[PeerStateRequestingProxy] = np.stateRequestingProxy
 	np.handlers[PeerStateWaitingForProxy] = np.stateWaitingForProxy
 	np.handlers[PeerStateWaitingToConnect] = np.stateWaitingToConnect
 	np.handlers[PeerStateCooldown] = np.stateCooldown
+	np.handlers[PeerStateIdle] = np.stateIdle
 
-	for {
-		if np.State == PeerStateStop {
-			Log(Debug, "Stopping peer %s", np.ID)
-			break
-		}
-		if ptpc.Dht.ID == "" {
-			time.Sleep(time.Millisecond * 500)
+	for np.GetState() != PeerStateStop && ptpc.Dht.ID == "" {
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	entered := atomic.LoadUint32(&np.stateSeq) - 1
+	for np.GetState() != PeerStateStop {
+		seq := atomic.LoadUint32(&np.stateSeq)
+		if seq != entered {
+			entered = seq
+			np.enterState(ptpc)
 			continue
 		}
-
-		if np.ConnectionAttempts > 1 && np.ConnectionAttempts%10 == 0 {
-			np.SetState(PeerStateCooldown, ptpc)
+		select {
+		case event := <-np.events:
+			np.handleEvent(event, ptpc)
+		case <-np.timeout():
+			np.handleEvent(PeerEventTimeout, ptpc)
 		}
+	}
+	np.disarm()
+	Log(Info, "Peer %s has been stopped", np.ID)
+}
 
-		callback, exists := np.handlers[np.State]
-		if !exists {
-			Log(Error, "Peer %s is in unknown state: %d", np.ID, int(np.State))
-			time.Sleep(1 * time.Second)
-			continue
+// enterState arms timer of the current state and executes its handler
+func (np *NetworkPeer) enterState(ptpc *PeerToPeer) {
+	np.disarm()
+	np.stateEntered = time.Now()
+	tuning := ptpc.tuning()
+	state := np.GetState()
+	if np.ConnectionAttempts > 1 && int(np.ConnectionAttempts)%tuning.CooldownAttempts == 0 && state != PeerStateCooldown &&
+		state != PeerStateDisconnect && state != PeerStateStop && state != PeerStateIdle {
+		np.transitionFrom(state, PeerStateCooldown, fmt.Sprintf("%d failed connection attempts", np.ConnectionAttempts), ptpc)
+		return
+	}
+	if timeout, exists := tuning.stateTimeout(state); exists {
+		np.arm(timeout)
+	}
+	callback, exists := np.handlers[state]
+	if !exists {
+		Log(Error, "Peer %s is in unknown state: %d", np.ID, int(state))
+		return
+	}
+	err := callback(ptpc)
+	if err != nil {
+		Log(Warning, "Peer %s: %v", np.ID, err)
+	}
+}
+
+// handleEvent moves peer according to the transition table
+func (np *NetworkPeer) handleEvent(event PeerEvent, ptpc *PeerToPeer) {
+	state := np.GetState()
+	transition, exists := peerTransitions[state][event]
+	if !exists {
+		return
+	}
+	lastError := np.GetLastError()
+	next := transition(np, ptpc)
+	if next != state {
+		reason := np.describeEvent(event)
+		if err := np.GetLastError(); err != lastError && err != "" {
+			reason += ": " + err
 		}
-		err := callback(ptpc)
-		if err != nil {
-			Log(Warning, "Peer %s: %v", np.ID, err)
+		// State could be changed by another goroutine meanwhile
+		np.transitionFrom(state, next, reason, ptpc)
+	}
+}
+
+// describeEvent returns event description used as a reason of state change
+func (np *NetworkPeer) describeEvent(event PeerEvent) string {
+	switch event {
+	case PeerEventDHT:
+		return "Addresses received from DHT"
+	case PeerEventProxy:
+		return "Proxies received from DHT"
+	case PeerEventRemoteState:
+		return "Remote state: " + StringifyState(np.GetRemoteState())
+	case PeerEventIntro:
+		return "Introduction received"
+	case PeerEventTimeout:
+		return "Timeout in " + StringifyState(np.GetState())
+	case PeerEventWake:
+		return "Traffic for the peer"
+	}
+	return ""
+}
+
+// arm (re)starts timer of the current state
+func (np *NetworkPeer) arm(timeout time.Duration) {
+	if np.timer == nil {
+		np.timer = time.NewTimer(timeout)
+		return
+	}
+	np.disarm()
+	np.timer.Reset(timeout)
+}
+
+// disarm stops timer and drops expiration that wasn't received yet
+func (np *NetworkPeer) disarm() {
+	if np.timer == nil {
+		return
+	}
+	if !np.timer.Stop() {
+		select {
+		case <-np.timer.C:
+		default:
 		}
-		time.Sleep(time.Millisecond * 500)
 	}
-	Log(Info, "Peer %s has been stopped", np.ID)
+}
+
+// timeout returns channel of the state timer. Nil channel blocks forever
+func (np *NetworkPeer) timeout() <-chan time.Time {
+	if np.timer == nil {
+		return nil
+	}
+	return np.timer.C
 }
 
 // State: Peer Initialization
@@ -116,16 +556,23 @@ func (np *NetworkPeer) stateInit(ptpc *PeerToPeer) error {
 	// Send request about IPs of a peer
 	Log(Debug, "Initializing new peer: %s", np.ID)
 	ptpc.Dht.sendNode(np.ID, []net.IP{})
+	np.lock.Lock()
 	np.Endpoint = nil
 	np.PeerHW = nil
 	np.PeerLocalIP = nil
+	np.lock.Unlock()
 
-	if len(np.KnownIPs) == 0 {
-		np.SetState(PeerStateRequestedIP, ptpc)
-	} else if len(np.Proxies) == 0 {
-		np.SetState(PeerStateRequestingProxy, ptpc)
+	// Remote state and proxies are delivered by DHT
+	if np.Static {
+		np.transitionFrom(PeerStateInit, PeerStateConnecting, "Static peer", ptpc)
+	} else if np.Discovered {
+		np.transitionFrom(PeerStateInit, PeerStateConnecting, "Peer was discovered in LAN", ptpc)
+	} else if len(np.GetKnownIPs()) == 0 {
+		np.transitionFrom(PeerStateInit, PeerStateRequestedIP, "Addresses are unknown", ptpc)
+	} else if len(np.GetProxies()) == 0 {
+		np.transitionFrom(PeerStateInit, PeerStateRequestingProxy, "Proxies are unknown", ptpc)
 	} else {
-		np.SetState(PeerStateWaitingToConnect, ptpc)
+		np.transitionFrom(PeerStateInit, PeerStateWaitingToConnect, "Addresses and proxies are known", ptpc)
 	}
 
 	return nil
@@ -133,42 +580,46 @@ func (np *NetworkPeer) stateInit(ptpc *PeerToPeer) error {
 
 // stateRequestedIP will wait for a DHT client to receive an IPs for this peer
 // State: Requested peer IP
-// Send `node` request and wait for known IP addresses of the peer from DHT
-// If peer doesn't receive endpoints in the timely manner method will switch to
-// PeerStateDisconnect. On success it will switch to PeerStateConnecting
+// Addresses are requested in stateInit. Request is repeated on timer and
+// peer is switched to PeerStateDisconnect if DHT doesn't respond in the
+// timely manner. On success it will switch to PeerStateRequestingProxy
 func (np *NetworkPeer) stateRequestedIP(ptpc *PeerToPeer) error {
 	Log(Debug, "Waiting network addresses for peer: %s", np.ID)
-	requestSentAt := time.Now()
-	updateInterval := time.Duration(time.Millisecond * 1000)
-	attempts := 0
-	for {
-		if time.Since(requestSentAt) > updateInterval {
-			Log(Warning, "Didn't got network addresses for peer. Requesting again")
-			requestSentAt = time.Now()
-			err := ptpc.Dht.sendNode(np.ID, []net.IP{})
-			if err != nil {
-				np.SetState(PeerStateDisconnect, ptpc)
-				return fmt.Errorf("Failed to request IPs: %s", err)
-			}
-			attempts++
-		}
-		if attempts > 5 {
-			np.SetState(PeerStateDisconnect, ptpc)
-			break
-		}
-		if len(np.KnownIPs) > 0 {
-			np.SetState(PeerStateRequestingProxy, ptpc)
-			return nil
-		}
-		time.Sleep(100 * time.Millisecond)
+	np.requestAttempts = 0
+	if len(np.GetKnownIPs()) > 0 {
+		np.transitionFrom(PeerStateRequestedIP, PeerStateRequestingProxy, "Addresses are known", ptpc)
 	}
 	return nil
 }
 
+func (np *NetworkPeer) onAddressesReceived(ptpc *PeerToPeer) PeerState {
+	if len(np.GetKnownIPs()) > 0 {
+		return PeerStateRequestingProxy
+	}
+	return np.GetState()
+}
+
+func (np *NetworkPeer) onRequestIPTimeout(ptpc *PeerToPeer) PeerState {
+	np.requestAttempts++
+	if np.requestAttempts > ptpc.tuning().RequestIPAttempts {
+		np.setLastError("No addresses received from DHT")
+		return PeerStateDisconnect
+	}
+	Log(Warning, "Didn't got network addresses for peer. Requesting again")
+	err := ptpc.Dht.sendNode(np.ID, []net.IP{})
+	if err != nil {
+		Log(Warning, "Peer %s: Failed to request IPs: %s", np.ID, err)
+		return PeerStateDisconnect
+	}
+	np.arm(ptpc.tuning().RequestIPInterval)
+	return np.GetState()
+}
+
 // stateDisconnect is executed when we've lost or terminated connection with a peer
 func (np *NetworkPeer) stateDisconnect(ptpc *PeerToPeer) error {
 	Log(Debug, "Disconnecting %s", np.ID)
-	np.SetState(PeerStateStop, ptpc)
+	np.sayGoodbye(ptpc)
+	np.transitionFrom(PeerStateDisconnect, PeerStateStop, "Disconnected", ptpc)
 	// TODO: Send stop to DHT
 	return nil
 }
@@ -187,42 +638,73 @@ func (np *NetworkPeer) RequestForwarder(ptpc *PeerToPeer) {
 }
 
 // Run hope punching in a separate goroutine and switch to
-// Routing/Connected mode
+// Routing/Connected mode as soon as the first endpoint responds
 func (np *NetworkPeer) stateConnecting(ptpc *PeerToPeer) error {
 	Log(Debug, "Connecting to %s", np.ID)
+	np.startPunching(ptpc)
+	if np.ConnectionAttempts > 0 {
+		// Previous attempts failed, so ask connected peers for relay
+		ptpc.requestRelays(np)
+	}
+	if next := np.onConnectingProgress(ptpc); next != np.GetState() {
+		np.transitionFrom(PeerStateConnecting, next, "Endpoint is known", ptpc)
+	}
+	return nil
+}
 
-	started := time.Now()
-	go np.punchUDPHole(ptpc)
+func (np *NetworkPeer) onConnectingProgress(ptpc *PeerToPeer) PeerState {
+	if np.endpointsCount() > 0 {
+		return PeerStateConnected
+	}
+	tuning := ptpc.tuning()
+	elapsed := time.Since(np.stateEntered)
+	if elapsed > tuning.DesyncTimeout && np.GetRemoteState() == PeerStateWaitingToConnect {
+		return PeerStateDisconnect
+	}
+	if elapsed > tuning.ConnectTimeout {
+		Log(Debug, "Couldn't connect to the peer in any way")
+		return PeerStateConnected
+	}
+	return np.GetState()
+}
 
-	for time.Since(started) < time.Duration(time.Millisecond*30000) {
-		if len(np.Endpoints) > 0 {
-			np.SetState(PeerStateConnected, ptpc)
-			return nil
-		}
-		if time.Since(started) > time.Duration(time.Millisecond*3000) && np.RemoteState == PeerStateWaitingToConnect {
-			np.SetState(PeerStateDisconnect, ptpc)
-			return nil
+func (np *NetworkPeer) onConnectingTimeout(ptpc *PeerToPeer) PeerState {
+	next := np.onConnectingProgress(ptpc)
+	if next == np.GetState() {
+		tuning := ptpc.tuning()
+		remains := tuning.ConnectTimeout - time.Since(np.stateEntered)
+		if remains < tuning.DesyncTimeout {
+			remains = tuning.DesyncTimeout
 		}
-		time.Sleep(time.Millisecond * 100)
+		np.arm(remains)
 	}
-	Log(Debug, "Couldn't connect to the peer in any way")
-	np.SetState(PeerStateConnected, ptpc)
-	return nil
+	return next
 }
 
-func (np *NetworkPeer) punchUDPHole(ptpc *PeerToPeer) {
-	if np.punchingInProgress {
+// startPunching runs hole punching in background unless it's running already
+func (np *NetworkPeer) startPunching(ptpc *PeerToPeer) {
+	if !atomic.CompareAndSwapUint32(&np.punching, 0, 1) {
 		return
 	}
 	np.LastPunch = time.Now()
+	go func() {
+		np.punchUDPHole(ptpc)
+		atomic.StoreUint32(&np.punching, 0)
+	}()
+}
+
+func (np *NetworkPeer) punchUDPHole(ptpc *PeerToPeer) {
 	eps := []*net.UDPAddr{}
-	eps = append(eps, np.Proxies...)
-	eps = append(eps, np.KnownIPs...)
+	eps = append(eps, np.GetProxies()...)
+	eps = append(eps, np.GetKnownIPs()...)
+	eps = append(eps, ptpc.Relays.pathsTo(np.ID)...)
 	Log(Debug, "Hole punching %s", np.ID)
+	nat := ptpc.GetNAT()
+	predicted, probes := np.prepareStrategies(ptpc, nat)
 
-	np.punchingInProgress = true
+	rounds := ptpc.tuning().PunchRounds
 	round := 0
-	for round < 10 {
+	for round < rounds {
 		for _, ep := range eps {
 			if np.isEndpointActive(ep) {
 				continue
@@ -230,26 +712,85 @@ func (np *NetworkPeer) punchUDPHole(ptpc *PeerToPeer) {
 			if IsInterfaceLocal(ep.IP) {
 				continue
 			}
+			if nat != nil && !nat.Hairpin && nat.Mapped.IP.Equal(ep.IP) {
+				// Peer is behind our NAT and can be reached over LAN only
+				continue
+			}
 			payload := []byte(ptpc.Dht.ID + ep.String())
 			msg, err := ptpc.CreateMessage(MsgTypeIntroReq, payload, 0, true)
 			if err != nil {
 				Log(Error, "Couldn't create an intro message: %s", err)
 				continue
 			}
-			_, err = ptpc.UDPSocket.SendMessage(msg, ep)
+			_, err = ptpc.sendMessage(msg, ep)
 			if err != nil {
 				Log(Error, "Failed to send message to %s: %s", ep.String(), err)
 				continue
 			}
+			if round == 0 {
+				for _, probe := range probes {
+					probe.SendMessage(msg, ep)
+				}
+			}
 			time.Sleep(time.Millisecond * 50)
 		}
+		if round == 0 {
+			np.sendPredicted(ptpc, predicted)
+		}
 		time.Sleep(time.Millisecond * 50)
 		round++
 	}
-	np.punchingInProgress = false
+}
+
+// prepareStrategies selects prediction strategies for this punching round.
+// Returns predicted endpoints of the peer and probe sockets opened
+func (np *NetworkPeer) prepareStrategies(ptpc *PeerToPeer, nat *NATInfo) ([]*net.UDPAddr, []*Network) {
+	round := int(atomic.AddUint32(&np.punchRounds, 1) - 1)
+	public := publicEndpoints(np.GetKnownIPs())
+	np.lock.Lock()
+	np.predicted = nil
+	np.lock.Unlock()
+	if ptpc.Prediction == nil {
+		return nil, nil
+	}
+	if len(public) == 0 {
+		ptpc.Prediction.count(PredictDirect, false)
+		return nil, nil
+	}
+	predicted := []*net.UDPAddr{}
+	probes := []*Network{}
+	for _, s := range selectStrategies(nat, round) {
+		ptpc.Prediction.count(s, false)
+		if s == PredictBirthday && nat.Type == NATSymmetric {
+			probes = ptpc.openProbeSockets(PredictBirthdaySockets)
+			continue
+		}
+		predicted = append(predicted, np.predictEndpoints(s, nat, public)...)
+	}
+	if len(predicted) > 0 || len(probes) > 0 {
+		Log(Debug, "Punching round %d to %s: %d predicted endpoints, %d probe sockets", round, np.ID, len(predicted), len(probes))
+	}
+	return predicted, probes
+}
+
+func (np *NetworkPeer) sendPredicted(ptpc *PeerToPeer, predicted []*net.UDPAddr) {
+	for _, ep := range predicted {
+		if np.endpointsCount() > 0 {
+			return
+		}
+		msg, err := ptpc.CreateMessage(MsgTypeIntroReq, []byte(ptpc.Dht.ID+ep.String()), 0, true)
+		if err != nil {
+			Log(Error, "Couldn't create an intro message: %s", err)
+			return
+		}
+		ptpc.sendMessage(msg, ep)
+		time.Sleep(time.Millisecond * 2)
+	}
 }
 
 func (np *NetworkPeer) isEndpointActive(ep *net.UDPAddr) bool {
+	np.EndpointsLock.RLock()
+	defer np.EndpointsLock.RUnlock()
 	for _, nep := range np.Endpoints {
 		if nep.Addr.String() == ep.String() {
 			return true
@@ -260,71 +801,90 @@ func (np *NetworkPeer) isEndpointActive(ep *net.UDPAddr) bool {
 
 func (np *NetworkPeer) stateRequestingProxy(ptpc *PeerToPeer) error {
 	ptpc.Dht.sendRequestProxy(np.ID)
-	np.SetState(PeerStateWaitingForProxy, ptpc)
+	np.transitionFrom(PeerStateRequestingProxy, PeerStateWaitingForProxy, "Proxies requested", ptpc)
 	return nil
 }
 
+// stateWaitingForProxy waits for DHT to respond with proxies. Peer
+// proceeds without proxies if response didn't arrive in time
 func (np *NetworkPeer) stateWaitingForProxy(ptpc *PeerToPeer) error {
-	started := time.Now()
-	for time.Since(started) < time.Duration(time.Millisecond*4000) {
-		time.Sleep(time.Millisecond * 100)
-	}
-	np.SetState(PeerStateWaitingToConnect, ptpc)
+	Log(Debug, "Waiting proxies for peer %s", np.ID)
 	return nil
 }
 
+func (np *NetworkPeer) onProxiesReceived(ptpc *PeerToPeer) PeerState {
+	return PeerStateWaitingToConnect
+}
+
 func (np *NetworkPeer) stateWaitingToConnect(ptpc *PeerToPeer) error {
 	Log(Debug, "Waiting for peer [%s] to join connection state", np.ID)
-	started := time.Now()
-	timeout := time.Duration(30000 * time.Millisecond)
-	recheck := time.Now()
-	recheckTimeout := time.Duration(5000 * time.Millisecond)
-	for {
-		if np.RemoteState == PeerStateWaitingToConnect || np.RemoteState == PeerStateConnecting || np.RemoteState == PeerStateConnected {
-			Log(Debug, "Peer [%s] have joined required state: %s", np.ID, StringifyState(np.RemoteState))
-			np.SetState(PeerStateConnecting, ptpc)
-			break
-		}
-		time.Sleep(100 * time.Millisecond)
-		if time.Since(started) > timeout {
-			np.LastError = "Peer state desync"
-			np.SetState(PeerStateDisconnect, ptpc)
-			return fmt.Errorf("Wait for connection failed: Peer doesn't responded in a timely manner")
-		}
-		if time.Since(recheck) > recheckTimeout && int(np.RemoteState) != 0 {
-			Log(Debug, "Peer %s is in %s state", np.ID, StringifyState(np.RemoteState))
-			recheck = time.Now()
-			np.reportState(ptpc)
-		}
-		if np.RemoteState == PeerStateDisconnect || np.RemoteState == PeerStateStop {
-			np.SetState(PeerStateDisconnect, ptpc)
-			return fmt.Errorf("Connection refused: remote peer stopped")
-		}
+	if next := np.onRemoteState(ptpc); next != np.GetState() {
+		np.transitionFrom(PeerStateWaitingToConnect, next, "Remote state: "+StringifyState(np.GetRemoteState()), ptpc)
 	}
 	return nil
 }
 
+func (np *NetworkPeer) onRemoteState(ptpc *PeerToPeer) PeerState {
+	switch np.GetRemoteState() {
+	case PeerStateWaitingToConnect, PeerStateConnecting, PeerStateConnected:
+		Log(Debug, "Peer [%s] have joined required state: %s", np.ID, StringifyState(np.GetRemoteState()))
+		return PeerStateConnecting
+	case PeerStateDisconnect, PeerStateStop:
+		Log(Warning, "Peer %s: Connection refused: remote peer stopped", np.ID)
+		return PeerStateDisconnect
+	}
+	return np.GetState()
+}
+
+func (np *NetworkPeer) onWaitToConnectTimeout(ptpc *PeerToPeer) PeerState {
+	if time.Since(np.stateEntered) > ptpc.tuning().WaitConnectTimeout {
+		np.setLastError("Peer state desync")
+		Log(Warning, "Peer %s: Wait for connection failed: Peer doesn't responded in a timely manner", np.ID)
+		return PeerStateDisconnect
+	}
+	if int(np.GetRemoteState()) != 0 {
+		Log(Debug, "Peer %s is in %s state", np.ID, StringifyState(np.GetRemoteState()))
+		np.reportState(ptpc)
+	}
+	np.arm(ptpc.tuning().StateRecheckInterval)
+	return np.GetState()
+}
+
 func (np *NetworkPeer) route(ptpc *PeerToPeer) error {
-	for len(np.Endpoints) == 0 && np.punchingInProgress {
-		time.Sleep(time.Millisecond * 100)
+	if np.endpointsCount() == 0 && np.isPunching() {
+		// Introduction will wake us up when hole punching succeeds
+		return nil
 	}
 	locals := []PeerEndpoint{}
 	internet := []PeerEndpoint{}
 	proxies := []PeerEndpoint{}
-	np.EndpointsLock.RLock()
+	relays := []PeerEndpoint{}
+	peerProxies := np.GetProxies()
+	np.EndpointsLock.Lock()
 	for _, ep := range np.Endpoints {
-		if time.Since(ep.LastContact) > time.Duration(time.Second*10) {
+		if !ep.healthy(ptpc.tuning()) {
+			continue
+		}
+		isNew := true
+		if isRelayAddr(ep.Addr) {
+			for _, sep := range relays {
+				if sep.Addr.String() == ep.Addr.String() {
+					isNew = false
+				}
+			}
+			if isNew {
+				relays = append(relays, ep)
+			}
 			continue
 		}
 		// Check if it's proxy
 		isProxy := false
-		for _, proxy := range np.Proxies {
+		for _, proxy := range peerProxies {
 			if proxy.String() == ep.Addr.String() {
 				isProxy = true
 				break
 			}
 		}
-		isNew := true
 		if isProxy {
 			for _, sep := range proxies {
 				if sep.Addr.String() == ep.Addr.String() {
@@ -362,41 +922,52 @@ func (np *NetworkPeer) route(ptpc *PeerToPeer) error {
 			internet = append(internet, ep)
 		}
 	}
-	np.EndpointsLock.RUnlock()
-
-	np.EndpointsLock.Lock()
 	np.Endpoints = np.Endpoints[:0]
 	np.Endpoints = append(np.Endpoints, locals...)
 	np.Endpoints = append(np.Endpoints, internet...)
 	np.Endpoints = append(np.Endpoints, proxies...)
+	np.Endpoints = append(np.Endpoints, relays...)
+	active := len(np.Endpoints)
 	np.EndpointsLock.Unlock()
 
-	if len(np.Endpoints) > 0 {
-		np.Endpoint = np.Endpoints[0].Addr
+	if active > 0 {
+		np.setEndpoint(np.selectEndpoint(ptpc.EndpointWeights))
 		np.ConnectionAttempts = 0
+		np.cooldowns = 0
+		atomic.StoreUint32(&np.punchRounds, 0)
 	} else {
-		if np.RemoteState == PeerStateWaitingToConnect {
-			np.SetState(PeerStateWaitingToConnect, ptpc)
+		if np.GetRemoteState() == PeerStateWaitingToConnect {
+			np.transitionFrom(PeerStateConnected, PeerStateWaitingToConnect, "No endpoints, peer is waiting to connect", ptpc)
 			return nil
 		}
 		np.ConnectionAttempts++
-		np.LastError = "No more endpoints"
-		if time.Since(np.LastFind) > time.Duration(time.Second*90) {
+		np.setLastError("No more endpoints")
+		if np.Static {
+			np.transitionFrom(PeerStateConnected, PeerStateConnecting, "No endpoints, reconnecting static peer", ptpc)
+			return nil
+		}
+		if time.Since(np.lastFound()) > ptpc.tuning().LastFindTimeout {
 			Log(Debug, "No endpoints and no updates from DHT")
-			np.SetState(PeerStateDisconnect, ptpc)
+			np.transitionFrom(PeerStateConnected, PeerStateDisconnect, "No endpoints and no updates from DHT", ptpc)
 			return nil
 		}
-		if len(np.KnownIPs) > 0 && len(np.Proxies) > 0 {
+		if np.Discovered {
+			// Peer is still announced in LAN
+			np.transitionFrom(PeerStateConnected, PeerStateConnecting, "No endpoints, reconnecting LAN peer", ptpc)
+			return nil
+		}
+		knownIPs := len(np.GetKnownIPs())
+		if knownIPs > 0 && len(peerProxies) > 0 {
 			Log(Debug, "We have IPs and Proxies. Syncing states")
-			np.SetState(PeerStateWaitingToConnect, ptpc)
+			np.transitionFrom(PeerStateConnected, PeerStateWaitingToConnect, "No endpoints, syncing states", ptpc)
 			return nil
-		} else if len(np.KnownIPs) == 0 {
+		} else if knownIPs == 0 {
 			Log(Debug, "Don't know any endpoints. Requesting")
-			np.SetState(PeerStateRequestedIP, ptpc)
+			np.transitionFrom(PeerStateConnected, PeerStateRequestedIP, "No endpoints, addresses are unknown", ptpc)
 			return nil
-		} else if len(np.Proxies) == 0 {
+		} else if len(peerProxies) == 0 {
 			Log(Debug, "Don't know any proxies. Requesting")
-			np.SetState(PeerStateRequestingProxy, ptpc)
+			np.transitionFrom(PeerStateConnected, PeerStateRequestingProxy, "No endpoints, proxies are unknown", ptpc)
 			return nil
 		}
 	}
@@ -407,8 +978,8 @@ func (np *NetworkPeer) route(ptpc *PeerToPeer) error {
 func (np *NetworkPeer) stateConnected(ptpc *PeerToPeer) error {
 	np.route(ptpc)
 
-	if time.Since(np.LastPunch) > time.Duration(time.Millisecond*30000) && len(np.Endpoints) <= 1 {
-		go np.punchUDPHole(ptpc)
+	if time.Since(np.LastPunch) > ptpc.tuning().RepunchInterval && np.endpointsCount() <= 1 {
+		np.startPunching(ptpc)
 	}
 
 	np.pingEndpoints(ptpc)
@@ -417,14 +988,84 @@ func (np *NetworkPeer) stateConnected(ptpc *PeerToPeer) error {
 	return nil
 }
 
+// enterConnected starts operation with a peer. Remote state is not
+// synced here: peer that follows us with delay would bounce between
+// connecting and connected states until the next maintenance
+func (np *NetworkPeer) enterConnected(ptpc *PeerToPeer) error {
+	np.route(ptpc)
+	np.pingEndpoints(ptpc)
+	return nil
+}
+
+func (np *NetworkPeer) onMaintenance(ptpc *PeerToPeer) PeerState {
+	if ptpc.Lazy && np.unusedFor() > ptpc.tuning().IdleTimeout {
+		np.transitionFrom(PeerStateConnected, PeerStateIdle, "No traffic for "+ptpc.tuning().IdleTimeout.String(), ptpc)
+		return np.GetState()
+	}
+	np.stateConnected(ptpc)
+	np.arm(ptpc.tuning().MaintenanceInterval)
+	return np.GetState()
+}
+
+func (np *NetworkPeer) onConnectedIntro(ptpc *PeerToPeer) PeerState {
+	np.route(ptpc)
+	return np.GetState()
+}
+
+func (np *NetworkPeer) onConnectedRemoteState(ptpc *PeerToPeer) PeerState {
+	np.syncWithRemoteState(ptpc)
+	return np.GetState()
+}
+
 func (np *NetworkPeer) stateCooldown(ptpc *PeerToPeer) error {
-	Log(Debug, "Peer %s in cooldown", np.ID)
-	started := time.Now()
-	for time.Since(started) < time.Duration(time.Second*30) {
-		time.Sleep(time.Millisecond * 100)
+	np.cooldowns++
+	pause := ptpc.tuning().backoff(np.cooldowns)
+	np.arm(pause)
+	Log(Debug, "Peer %s in cooldown for %s", np.ID, pause.Round(time.Millisecond))
+	return nil
+}
+
+func (np *NetworkPeer) onCooldownFinished(ptpc *PeerToPeer) PeerState {
+	if ptpc.Lazy {
+		// Next traffic for the peer will try again
+		return PeerStateIdle
 	}
 	np.ConnectionAttempts++
-	np.SetState(PeerStateConnecting, ptpc)
+	return PeerStateConnecting
+}
+
+// onReconnect drops endpoints and backoff and starts connecting at once
+func (np *NetworkPeer) onReconnect(ptpc *PeerToPeer) PeerState {
+	state := np.GetState()
+	np.ConnectionAttempts = 0
+	np.cooldowns = 0
+	atomic.StoreUint32(&np.punchRounds, 0)
+	np.EndpointsLock.Lock()
+	np.Endpoints = np.Endpoints[:0]
+	np.EndpointsLock.Unlock()
+	np.setEndpoint(nil)
+	next := PeerState(PeerStateConnecting)
+	if len(np.GetKnownIPs()) == 0 {
+		next = PeerStateRequestedIP
+	}
+	// Transition is made here, since connecting peer enters the state again
+	np.transitionFrom(state, next, "Reconnect was requested", ptpc)
+	return np.GetState()
+}
+
+// ReconnectPeer makes peer drop its endpoints and connect again skipping
+// backoff after failed attempts
+func (p *PeerToPeer) ReconnectPeer(id string) error {
+	peer := p.Peers.GetPeer(id)
+	if peer == nil {
+		return fmt.Errorf("Peer %s was not found", id)
+	}
+	state := peer.GetState()
+	if state == PeerStateDisconnect || state == PeerStateStop {
+		return fmt.Errorf("Peer %s is disconnecting", id)
+	}
+	Log(Info, "Reconnecting peer %s", id)
+	peer.notify(PeerEventReconnect)
 	return nil
 }
 
@@ -443,20 +1084,30 @@ func (np *NetworkPeer) addEndpoint(addr *net.UDPAddr) error {
 }
 
 // This method will send xpeer ping message to endpoints
-// if ping timeout has been passed
+// if ping timeout has been passed. Every ping carries sequence
+// number and time it was sent, which are echoed back by the peer
 func (np *NetworkPeer) pingEndpoints(ptpc *PeerToPeer) {
-	if time.Since(np.LastContact) > time.Duration(time.Millisecond*3000) {
-		np.LastContact = time.Now()
-		np.EndpointsLock.RLock()
-		for _, ep := range np.Endpoints {
-			payload := append([]byte("q"+ptpc.Dht.ID), []byte(ep.Addr.String())...)
+	tuning := ptpc.tuning()
+	now := time.Now()
+	np.lock.Lock()
+	due := now.Sub(np.LastContact) > tuning.PingInterval
+	if due {
+		np.LastContact = now
+	}
+	np.lock.Unlock()
+	if due {
+		np.EndpointsLock.Lock()
+		for i := range np.Endpoints {
+			ep := &np.Endpoints[i]
+			seq := ep.nextPing(now, tuning.PingInterval)
+			payload := append([]byte("q"+ptpc.Dht.ID), []byte(formatPing(ep.Addr.String(), seq, now))...)
 			msg, err := ptpc.CreateMessage(MsgTypeXpeerPing, payload, 0, true)
 			if err != nil {
 				continue
 			}
-			ptpc.UDPSocket.SendMessage(msg, ep.Addr)
+			ptpc.sendMessage(msg, ep.Addr)
 		}
-		np.EndpointsLock.RUnlock()
+		np.EndpointsLock.Unlock()
 	}
 }
 
@@ -465,18 +1116,27 @@ func (np *NetworkPeer) pingEndpoints(ptpc *PeerToPeer) {
 // This method should be called only when local state is
 // Connected
 func (np *NetworkPeer) syncWithRemoteState(ptpc *PeerToPeer) {
-	if np.RemoteState == PeerStateDisconnect {
+	remote := np.GetRemoteState()
+	if remote == PeerStateDisconnect {
 		Log(Debug, "Peer %s disconnecting", np.ID)
-		np.SetState(PeerStateDisconnect, ptpc)
-	} else if np.RemoteState == PeerStateStop {
+		np.transitionFrom(PeerStateConnected, PeerStateDisconnect, "Remote peer is disconnecting", ptpc)
+	} else if remote == PeerStateStop {
 		Log(Debug, "Peer %s has been stopped", np.ID)
-		np.SetState(PeerStateDisconnect, ptpc)
-	} else if np.RemoteState == PeerStateInit {
+		np.transitionFrom(PeerStateConnected, PeerStateDisconnect, "Remote peer has been stopped", ptpc)
+	} else if remote == PeerStateInit {
 		Log(Debug, "Remote peer %s decided to reconnect", np.ID)
 		// TODO: Consider moving to Disconnect state here
-		np.SetState(PeerStateInit, ptpc)
-	} else if np.RemoteState == PeerStateWaitingToConnect {
+		np.transitionFrom(PeerStateConnected, PeerStateInit, "Remote peer decided to reconnect", ptpc)
+	} else if remote == PeerStateWaitingToConnect {
 		Log(Debug, "Peer %s is waiting for us to connect", np.ID)
-		np.SetState(PeerStateWaitingToConnect, ptpc)
+		np.transitionFrom(PeerStateConnected, PeerStateWaitingToConnect, "Remote peer is waiting for us to connect", ptpc)
+	} else if remote == PeerStateIdle {
+		// Remote peer dropped our endpoints, so data sent to it is lost
+		Log(Debug, "Peer %s went idle", np.ID)
+		if ptpc.Lazy {
+			np.transitionFrom(PeerStateConnected, PeerStateIdle, "Remote peer went idle", ptpc)
+		} else {
+			np.transitionFrom(PeerStateConnected, PeerStateInit, "Remote peer went idle", ptpc)
+		}
 	}
 }
@@ -1,7 +1,10 @@
 package ptp
 
 import (
+	"fmt"
+	"net"
 	"testing"
+	"time"
 )
 
 func TestSetState(t *testing.T) {
@@ -91,3 +94,275 @@ func TestStateStop(t *testing.T) {
 		t.Error("Error")
 	}
 }
+
+func TestPeerTransitions(t *testing.T) {
+	ptpc := new(PeerToPeer)
+	ptpc.Dht = new(DHTClient)
+	addr, _ := net.ResolveUDPAddr("udp4", "192.168.1.2:6881")
+	cases := []struct {
+		name   string
+		state  PeerState
+		remote PeerState
+		event  PeerEvent
+		setup  func(np *NetworkPeer)
+		wait   PeerState
+	}{
+		{"addresses", PeerStateRequestedIP, 0, PeerEventDHT, func(np *NetworkPeer) { np.KnownIPs = []*net.UDPAddr{addr} }, PeerStateRequestingProxy},
+		{"no addresses", PeerStateRequestedIP, 0, PeerEventDHT, nil, PeerStateRequestedIP},
+		{"proxies", PeerStateWaitingForProxy, 0, PeerEventProxy, nil, PeerStateWaitingToConnect},
+		{"remote ready", PeerStateWaitingToConnect, PeerStateConnecting, PeerEventRemoteState, nil, PeerStateConnecting},
+		{"remote stopped", PeerStateWaitingToConnect, PeerStateStop, PeerEventRemoteState, nil, PeerStateDisconnect},
+		{"remote not ready", PeerStateWaitingToConnect, PeerStateRequestedIP, PeerEventRemoteState, nil, PeerStateWaitingToConnect},
+		{"intro", PeerStateConnecting, PeerStateConnecting, PeerEventIntro, func(np *NetworkPeer) { np.addEndpoint(addr) }, PeerStateConnected},
+		{"ignored", PeerStateConnected, PeerStateConnected, PeerEventProxy, nil, PeerStateConnected},
+		{"cooldown", PeerStateCooldown, 0, PeerEventTimeout, nil, PeerStateConnecting},
+		{"reconnect", PeerStateCooldown, 0, PeerEventReconnect, func(np *NetworkPeer) { np.KnownIPs = []*net.UDPAddr{addr} }, PeerStateConnecting},
+		{"reconnect without addresses", PeerStateConnected, PeerStateConnected, PeerEventReconnect, nil, PeerStateRequestedIP},
+		{"reconnect ignored", PeerStateDisconnect, 0, PeerEventReconnect, nil, PeerStateDisconnect},
+		{"wake", PeerStateIdle, 0, PeerEventWake, nil, PeerStateInit},
+		{"idle remote connecting", PeerStateIdle, PeerStateWaitingToConnect, PeerEventRemoteState, nil, PeerStateInit},
+		{"idle remote connected", PeerStateIdle, PeerStateConnected, PeerEventRemoteState, nil, PeerStateIdle},
+	}
+	for _, c := range cases {
+		np := new(NetworkPeer)
+		np.State = c.state
+		np.RemoteState = c.remote
+		np.stateEntered = time.Now()
+		if c.setup != nil {
+			c.setup(np)
+		}
+		np.handleEvent(c.event, ptpc)
+		if np.State != c.wait {
+			t.Errorf("%s: wait %s, get %s", c.name, StringifyState(c.wait), StringifyState(np.State))
+		}
+	}
+}
+
+func TestPeerBackoff(t *testing.T) {
+	ptpc := new(PeerToPeer)
+	ptpc.Dht = new(DHTClient)
+	addr, _ := net.ResolveUDPAddr("udp4", "192.168.1.2:6881")
+	np := new(NetworkPeer)
+	np.KnownIPs = []*net.UDPAddr{addr}
+	np.addEndpoint(addr)
+	np.State = PeerStateCooldown
+	np.ConnectionAttempts = uint8(DefaultTuning.CooldownAttempts)
+	np.stateCooldown(ptpc)
+	np.stateCooldown(ptpc)
+	if np.cooldowns != 2 || np.timer == nil {
+		t.Fatalf("Cooldown wasn't counted or armed: %d", np.cooldowns)
+	}
+	np.handleEvent(PeerEventReconnect, ptpc)
+	np.disarm()
+	if np.State != PeerStateConnecting || np.cooldowns != 0 || np.ConnectionAttempts != 0 || np.endpointsCount() != 0 {
+		t.Errorf("Backoff wasn't reset on reconnect: %s, %d cooldowns, %d attempts", StringifyState(np.State), np.cooldowns, np.ConnectionAttempts)
+	}
+	if history := np.History(); len(history) != 1 || history[0].Reason != "Reconnect was requested" {
+		t.Errorf("Wrong history of reconnect: %+v", history)
+	}
+
+	ptpc.Peers = new(PeerList)
+	ptpc.Peers.Init()
+	if ptpc.ReconnectPeer("unknown") == nil {
+		t.Errorf("Unknown peer was reconnected")
+	}
+}
+
+func TestPeerRequestIPTimeout(t *testing.T) {
+	ptpc := new(PeerToPeer)
+	ptpc.Dht = new(DHTClient)
+	np := new(NetworkPeer)
+	np.State = PeerStateRequestedIP
+	np.requestAttempts = DefaultTuning.RequestIPAttempts
+	np.handleEvent(PeerEventTimeout, ptpc)
+	if np.State != PeerStateDisconnect {
+		t.Errorf("Peer wasn't disconnected after %d attempts: %s", DefaultTuning.RequestIPAttempts, StringifyState(np.State))
+	}
+}
+
+func TestPeerRunEvents(t *testing.T) {
+	ptpc := new(PeerToPeer)
+	ptpc.Dht = new(DHTClient)
+	ptpc.Dht.ID = "local"
+	addr, _ := net.ResolveUDPAddr("udp4", "192.168.1.2:6881")
+	np := new(NetworkPeer)
+	np.ID = "1"
+	np.KnownIPs = []*net.UDPAddr{addr}
+	np.Proxies = []*net.UDPAddr{addr}
+	np.LastContact = time.Now()
+	np.LastPunch = time.Now()
+	np.addEndpoint(addr)
+	np.SetState(PeerStateInit, ptpc)
+
+	done := make(chan bool)
+	go func() {
+		np.Run(ptpc)
+		done <- true
+	}()
+
+	waitState := func(state PeerState) {
+		deadline := time.Now().Add(time.Second)
+		for np.GetState() != state {
+			if time.Now().After(deadline) {
+				t.Fatalf("Peer didn't reach %s: %s", StringifyState(state), StringifyState(np.GetState()))
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitState(PeerStateWaitingToConnect)
+	np.setRemoteState(PeerStateWaitingToConnect)
+	np.notify(PeerEventRemoteState)
+	// Endpoint is known already, so peer must pass connecting state without waiting
+	waitState(PeerStateConnected)
+
+	np.SetState(PeerStateDisconnect, ptpc)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Peer wasn't stopped")
+	}
+}
+
+func TestPeerHistory(t *testing.T) {
+	ptpc := new(PeerToPeer)
+	np := new(NetworkPeer)
+	np.Endpoint, _ = net.ResolveUDPAddr("udp4", "192.168.1.2:6881")
+	for i := 0; i < PeerHistorySize+3; i++ {
+		np.transition(PeerStateConnecting, fmt.Sprintf("%d", i), ptpc)
+	}
+	history := np.History()
+	if len(history) != PeerHistorySize {
+		t.Fatalf("Wrong history length: %d", len(history))
+	}
+	if history[0].Reason != "3" || history[PeerHistorySize-1].Reason != fmt.Sprintf("%d", PeerHistorySize+2) {
+		t.Errorf("Wrong order of history: %s ... %s", history[0].Reason, history[PeerHistorySize-1].Reason)
+	}
+	if history[0].Endpoint != "192.168.1.2:6881" {
+		t.Errorf("Wrong endpoint in history: %s", history[0].Endpoint)
+	}
+
+	np = new(NetworkPeer)
+	np.State = PeerStateWaitingToConnect
+	np.RemoteState = PeerStateStop
+	np.handleEvent(PeerEventRemoteState, ptpc)
+	history = np.History()
+	if len(history) != 1 || history[0].From != PeerStateWaitingToConnect || history[0].To != PeerStateDisconnect ||
+		history[0].Reason != "Remote state: Stopped" {
+		t.Errorf("Wrong history record: %+v", history)
+	}
+}
+
+// TestPeersConcurrency runs many peers while DHT callbacks, UDP handlers
+// and readers touch them from other goroutines. Run with -race
+func TestPeersConcurrency(t *testing.T) {
+	ptpc := new(PeerToPeer)
+	ptpc.Dht = new(DHTClient)
+	ptpc.Dht.ID = fmt.Sprintf("%036d", 0)
+	ptpc.Peers = new(PeerList)
+	ptpc.Peers.Init()
+	ptpc.ProxyManager = new(ProxyManager)
+	ptpc.UDPSocket = new(Network)
+	err := ptpc.UDPSocket.Init("127.0.0.1", 0)
+	if err != nil {
+		t.Fatalf("Failed to create socket: %s", err)
+	}
+	defer ptpc.UDPSocket.Stop()
+	ptpc.Tuning, _ = NewTuning(TuningLAN)
+
+	const count = 16
+	ids := []string{}
+	for i := 1; i <= count; i++ {
+		id := fmt.Sprintf("%036d", i)
+		ids = append(ids, id)
+		np := new(NetworkPeer)
+		np.ID = id
+		np.transition(PeerStateInit, "Test", ptpc)
+		ptpc.Peers.Update(id, np)
+		ptpc.Peers.RunPeer(id, ptpc)
+	}
+
+	stop := make(chan bool)
+	done := make(chan bool)
+	workers := 0
+	run := func(work func(i int)) {
+		workers++
+		go func() {
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					done <- true
+					return
+				default:
+				}
+				work(i)
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+	// DHT
+	run(func(i int) {
+		id := ids[i%count]
+		addr := fmt.Sprintf("127.0.0.%d:%d", i%count+2, 6881+i%3)
+		ptpc.packetNode(&DHTPacket{Data: id, Arguments: []string{addr}})
+		ptpc.packetRequestProxy(&DHTPacket{Data: id, Proxies: []string{"127.0.1.1:6881"}})
+		ptpc.packetState(&DHTPacket{Data: id, Extra: fmt.Sprintf("%d", int(PeerStateWaitingToConnect)+i%3)})
+	})
+	// UDP
+	run(func(i int) {
+		peer := ptpc.Peers.GetPeer(ids[i%count])
+		addr, _ := net.ResolveUDPAddr("udp4", fmt.Sprintf("127.0.0.%d:6881", i%count+2))
+		hw, _ := net.ParseMAC(fmt.Sprintf("06:00:00:00:00:%02x", i%count))
+		peer.introduce(hw, net.IPv4(10, 10, 10, byte(i%count+2)), "peer")
+		peer.addEndpoint(addr)
+		ptpc.Peers.Update(peer.ID, peer)
+		peer.notify(PeerEventIntro)
+		ptpc.handlePong(formatPing(addr.String(), uint32(i), time.Now()))
+	})
+	// REST and packet forwarding
+	run(func(i int) {
+		for _, peer := range ptpc.Peers.Get() {
+			peer.GetState()
+			peer.GetRemoteState()
+			peer.GetEndpoint()
+			peer.GetEndpoints()
+			peer.GetKnownIPs()
+			peer.GetLastError()
+			peer.History()
+		}
+		ptpc.Names()
+		ptpc.Peers.Length()
+		ptpc.Peers.GetEndpointAndProxy(fmt.Sprintf("06:00:00:00:00:%02x", i%count))
+		ptpc.PinEndpoint(ids[i%count], "auto")
+	})
+
+	time.Sleep(time.Millisecond * 500)
+	close(stop)
+	for i := 0; i < workers; i++ {
+		<-done
+	}
+
+	for _, peer := range ptpc.Peers.Get() {
+		peer.transition(PeerStateDisconnect, "Test is over", ptpc)
+	}
+	deadline := time.Now().Add(time.Second * 5)
+	for _, peer := range ptpc.Peers.Get() {
+		for peer.GetState() != PeerStateStop {
+			if time.Now().After(deadline) {
+				t.Fatalf("Peer %s wasn't stopped: %s", peer.ID, StringifyState(peer.GetState()))
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+}
+
+// stopPeer disconnects peer and waits until it stops and finishes hole punching
+func stopPeer(t *testing.T, peer *NetworkPeer, ptpc *PeerToPeer) {
+	peer.transition(PeerStateDisconnect, "Test is over", ptpc)
+	deadline := time.Now().Add(time.Second * 5)
+	for peer.GetState() != PeerStateStop || peer.isPunching() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Peer %s wasn't stopped: %s", peer.ID, StringifyState(peer.GetState()))
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
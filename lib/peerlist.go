@@ -37,11 +37,11 @@ func (l *PeerList) operate(action ListOperation, id string, peer *NetworkPeer) {
 		l.peers[id] = peer
 		ip := ""
 		mac := ""
-		if peer.PeerLocalIP != nil {
-			ip = peer.PeerLocalIP.String()
+		if addr := peer.GetIP(); addr != nil {
+			ip = addr.String()
 		}
-		if peer.PeerHW != nil {
-			mac = peer.PeerHW.String()
+		if hw := peer.GetHardwareAddress(); hw != nil {
+			mac = hw.String()
 		}
 		l.updateTables(id, ip, mac)
 	} else if action == OperateDelete {
@@ -49,7 +49,7 @@ func (l *PeerList) operate(action ListOperation, id string, peer *NetworkPeer) {
 		if !exists {
 			return
 		}
-		l.deleteTables(peer.PeerLocalIP.String(), peer.PeerHW.String())
+		l.deleteTables(peer.GetIP().String(), peer.GetHardwareAddress().String())
 		delete(l.peers, id)
 		return
 	}
@@ -118,8 +118,10 @@ func (l *PeerList) GetEndpointAndProxy(mac string) (*net.UDPAddr, uint16, error)
 	id, exists := l.tableMacID[mac]
 	if exists {
 		peer, exists := l.peers[id]
-		if exists && peer.Endpoint != nil {
-			return peer.Endpoint, uint16(0), nil
+		if exists {
+			if endpoint := peer.GetEndpoint(); endpoint != nil {
+				return endpoint, uint16(0), nil
+			}
 		}
 	}
 	return nil, 0, fmt.Errorf("Specified hardware address was not found in table")
@@ -136,8 +138,47 @@ func (l *PeerList) GetID(ip string) (string, error) {
 	return "", fmt.Errorf("Specified IP was not found in table")
 }
 
+// addressesOf returns IPs and hardware addresses mapped to specified peer
+func (l *PeerList) addressesOf(id string) ([]string, []string) {
+	ips := []string{}
+	macs := []string{}
+	l.lock.RLock()
+	for ip, owner := range l.tableIPID {
+		if owner == id {
+			ips = append(ips, ip)
+		}
+	}
+	for mac, owner := range l.tableMacID {
+		if owner == id {
+			macs = append(macs, mac)
+		}
+	}
+	l.lock.RUnlock()
+	return ips, macs
+}
+
+// forgetAddresses removes outdated IP and hardware address mappings
+func (l *PeerList) forgetAddresses(ip, mac string) {
+	l.lock.Lock()
+	l.deleteTables(ip, mac)
+	l.lock.Unlock()
+}
+
+// GetIDByMac returns ID by specified hardware address
+func (l *PeerList) GetIDByMac(mac string) (string, error) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	id, exists := l.tableMacID[mac]
+	if exists {
+		return id, nil
+	}
+	return "", fmt.Errorf("Specified hardware address was not found in table")
+}
+
 // Length returns size of peer list map
 func (l *PeerList) Length() int {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
 	return len(l.peers)
 }
 
@@ -146,9 +187,13 @@ func (l *PeerList) Length() int {
 func (l *PeerList) RunPeer(id string, p *PeerToPeer) {
 	Log(Info, "Running peer %s", id)
 	l.lock.RLock()
-	defer l.lock.RUnlock()
-	if !l.peers[id].Running {
-		go l.peers[id].Run(p)
+	peer, exists := l.peers[id]
+	l.lock.RUnlock()
+	if !exists {
+		return
+	}
+	if peer.start() {
+		go peer.Run(p)
 	} else {
 		Log(Info, "Peer %s is already running", id)
 	}
@@ -0,0 +1,167 @@
+package ptp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Xpeer pings are used to measure quality of every endpoint. Request
+// payload is "q" + ID + endpoint followed by "|seq|timestamp", and the
+// responder echoes everything after ID back. Peers that don't know
+// about sequence numbers echo them as a part of the endpoint, so
+// measurements work with them as well
+
+// Ping measurements
+const (
+	PeerPingWindow      = 20 // Number of recent pings used to calculate loss
+	pingSeparator       = "|"
+	pingRTTSmoothing    = 8  // RTT = RTT + (sample - RTT) / 8, as in RFC 6298
+	pingJitterSmoothing = 16 // J = J + (|D| - J) / 16, as in RFC 3550
+)
+
+// pingStats holds pings waiting for reply and results of recent pings
+type pingStats struct {
+	seq     uint32               // Sequence number of the last ping
+	pending map[uint32]time.Time // Pings waiting for reply
+	results []bool               // Ring of recent results. True means reply was received
+	next    int                  // Position of the next result
+	lastRTT time.Duration        // Previous RTT sample used for jitter
+}
+
+// formatPing appends sequence number and timestamp to the endpoint
+func formatPing(endpoint string, seq uint32, sent time.Time) string {
+	return endpoint + pingSeparator + strconv.FormatUint(uint64(seq), 10) + pingSeparator + strconv.FormatInt(sent.UnixNano(), 10)
+}
+
+// parsePing splits ping data into endpoint, sequence number and timestamp.
+// Pings of old peers contain only endpoint, in which case ok is false
+func parsePing(data string) (endpoint string, seq uint32, sent time.Time, ok bool) {
+	parts := strings.Split(data, pingSeparator)
+	if len(parts) != 3 {
+		return parts[0], 0, time.Time{}, false
+	}
+	n, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return parts[0], 0, time.Time{}, false
+	}
+	ts, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return parts[0], 0, time.Time{}, false
+	}
+	return parts[0], uint32(n), time.Unix(0, ts), true
+}
+
+// nextPing registers new ping and returns its sequence number. Pings
+// that are waiting for reply longer than ping interval are counted as lost
+func (ep *PeerEndpoint) nextPing(now time.Time, interval time.Duration) uint32 {
+	if ep.pings == nil {
+		ep.pings = &pingStats{pending: make(map[uint32]time.Time)}
+	}
+	for seq, sent := range ep.pings.pending {
+		if now.Sub(sent) >= interval {
+			delete(ep.pings.pending, seq)
+			ep.LostInRow++
+			ep.result(false)
+		}
+	}
+	ep.pings.seq++
+	ep.pings.pending[ep.pings.seq] = now
+	return ep.pings.seq
+}
+
+// pong updates measurements with reply to the ping. RTT is measured from
+// the local send time, since timestamp echoed by the peer can't be trusted
+func (ep *PeerEndpoint) pong(seq uint32, now time.Time) {
+	ep.LastContact = now
+	if ep.pings == nil {
+		return
+	}
+	sent, exists := ep.pings.pending[seq]
+	if !exists {
+		// Duplicate or late reply
+		return
+	}
+	delete(ep.pings.pending, seq)
+	rtt := now.Sub(sent)
+	if rtt < 0 {
+		rtt = 0
+	}
+	if ep.pings.lastRTT == 0 && ep.RTT == 0 {
+		ep.RTT = rtt
+	} else {
+		ep.RTT += (rtt - ep.RTT) / pingRTTSmoothing
+		diff := rtt - ep.pings.lastRTT
+		if diff < 0 {
+			diff = -diff
+		}
+		ep.Jitter += (diff - ep.Jitter) / pingJitterSmoothing
+	}
+	ep.pings.lastRTT = rtt
+	ep.LostInRow = 0
+	ep.result(true)
+}
+
+// result stores result of a ping and recalculates loss percentage
+func (ep *PeerEndpoint) result(received bool) {
+	if len(ep.pings.results) < PeerPingWindow {
+		ep.pings.results = append(ep.pings.results, received)
+	} else {
+		ep.pings.results[ep.pings.next] = received
+		ep.pings.next = (ep.pings.next + 1) % PeerPingWindow
+	}
+	lost := 0
+	for _, r := range ep.pings.results {
+		if !r {
+			lost++
+		}
+	}
+	ep.Loss = float64(lost) * 100 / float64(len(ep.pings.results))
+}
+
+// healthy returns false for endpoints that stopped responding
+func (ep *PeerEndpoint) healthy(tuning *Tuning) bool {
+	return time.Since(ep.LastContact) <= tuning.EndpointTimeout && ep.LostInRow < tuning.PingLossLimit
+}
+
+// String returns measurements of the endpoint in human-readable form
+func (ep *PeerEndpoint) String() string {
+	return fmt.Sprintf("%s RTT: %s Jitter: %s Loss: %.0f%%", ep.Addr.String(),
+		ep.RTT.Round(time.Microsecond*100), ep.Jitter.Round(time.Microsecond*100), ep.Loss)
+}
+
+// GetEndpoints returns copy of active endpoints with their measurements
+func (np *NetworkPeer) GetEndpoints() []PeerEndpoint {
+	np.EndpointsLock.RLock()
+	defer np.EndpointsLock.RUnlock()
+	result := make([]PeerEndpoint, len(np.Endpoints))
+	copy(result, np.Endpoints)
+	return result
+}
+
+// handlePong finds endpoint the reply was received for and updates its measurements
+func (p *PeerToPeer) handlePong(data string) bool {
+	endpoint, seq, _, measured := parsePing(data)
+	now := time.Now()
+	for _, peer := range p.Peers.Get() {
+		if peer == nil {
+			continue
+		}
+		peer.EndpointsLock.Lock()
+		for i, ep := range peer.Endpoints {
+			if ep.Addr.String() != endpoint {
+				continue
+			}
+			if measured {
+				peer.Endpoints[i].pong(seq, now)
+			} else {
+				peer.Endpoints[i].LastContact = now
+			}
+			peer.EndpointsLock.Unlock()
+			return true
+		}
+		peer.EndpointsLock.Unlock()
+	}
+	return false
+}
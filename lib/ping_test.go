@@ -0,0 +1,88 @@
+package ptp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParsePing(t *testing.T) {
+	sent := time.Unix(0, 1500000000123456789)
+	endpoint, seq, ts, ok := parsePing(formatPing("1.2.3.4:5678", 42, sent))
+	if !ok || endpoint != "1.2.3.4:5678" || seq != 42 || !ts.Equal(sent) {
+		t.Errorf("Wrong ping: %s %d %s %v", endpoint, seq, ts, ok)
+	}
+	// Pings of old peers contain only endpoint
+	endpoint, _, _, ok = parsePing("1.2.3.4:5678")
+	if ok || endpoint != "1.2.3.4:5678" {
+		t.Errorf("Wrong legacy ping: %s %v", endpoint, ok)
+	}
+	endpoint, _, _, ok = parsePing("1.2.3.4:5678|x|1")
+	if ok || endpoint != "1.2.3.4:5678" {
+		t.Errorf("Malformed ping was accepted: %s", endpoint)
+	}
+}
+
+func TestPingMeasurements(t *testing.T) {
+	ep := PeerEndpoint{Addr: &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 5678}}
+	now := time.Now()
+	rtts := []time.Duration{10, 20, 10, 20}
+	for _, rtt := range rtts {
+		seq := ep.nextPing(now, DefaultTuning.PingInterval)
+		ep.pong(seq, now.Add(rtt*time.Millisecond))
+		now = now.Add(DefaultTuning.PingInterval)
+	}
+	if ep.RTT < 10*time.Millisecond || ep.RTT > 20*time.Millisecond {
+		t.Errorf("Wrong RTT: %s", ep.RTT)
+	}
+	if ep.Jitter <= 0 {
+		t.Errorf("Jitter wasn't measured: %s", ep.Jitter)
+	}
+	if ep.Loss != 0 {
+		t.Errorf("Wrong loss: %f", ep.Loss)
+	}
+
+	// Duplicate reply doesn't change measurements
+	seq := ep.nextPing(now, DefaultTuning.PingInterval)
+	ep.pong(seq, now.Add(time.Millisecond*15))
+	rtt := ep.RTT
+	ep.pong(seq, now.Add(time.Second))
+	if ep.RTT != rtt {
+		t.Errorf("Duplicate reply changed RTT: %s", ep.RTT)
+	}
+
+	// Pings without reply are counted as lost on the next ping
+	now = now.Add(DefaultTuning.PingInterval)
+	for i := 0; i < DefaultTuning.PingLossLimit+1; i++ {
+		ep.nextPing(now, DefaultTuning.PingInterval)
+		now = now.Add(DefaultTuning.PingInterval)
+	}
+	if ep.LostInRow != DefaultTuning.PingLossLimit {
+		t.Errorf("Wrong number of lost pings: %d", ep.LostInRow)
+	}
+	if ep.Loss != float64(DefaultTuning.PingLossLimit)*100/float64(len(rtts)+1+DefaultTuning.PingLossLimit) {
+		t.Errorf("Wrong loss: %f", ep.Loss)
+	}
+	ep.LastContact = time.Now()
+	if ep.healthy(&DefaultTuning) {
+		t.Error("Endpoint without replies is healthy")
+	}
+}
+
+func TestHandlePong(t *testing.T) {
+	ptpc := new(PeerToPeer)
+	ptpc.Init()
+	peer := &NetworkPeer{ID: "peer"}
+	addr := &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 5678}
+	peer.Endpoints = []PeerEndpoint{{Addr: addr}}
+	ptpc.Peers.Update(peer.ID, peer)
+	seq := peer.Endpoints[0].nextPing(time.Now(), DefaultTuning.PingInterval)
+
+	// Timestamp echoed by the peer doesn't affect RTT
+	if !ptpc.handlePong(formatPing(addr.String(), seq, time.Now().Add(-time.Hour))) {
+		t.Fatalf("Reply wasn't matched to the endpoint")
+	}
+	if rtt := peer.GetEndpoints()[0].RTT; rtt > time.Second {
+		t.Errorf("RTT was taken from echoed timestamp: %s", rtt)
+	}
+}
@@ -30,7 +30,7 @@ func CheckPermissions() bool {
 
 // Syslog provides additional logging to the syslog server
 func Syslog(level LogLevel, format string, v ...interface{}) {
-	if l3, err := syslog.Dial("udp", syslogSocket, syslogLevel[level], "p2p"); err == nil {
+	if l3, err := syslog.Dial("udp", syslogAddress(), syslogLevel[level], "p2p"); err == nil {
 		l3.Write([]byte(fmt.Sprintf(format, v...)))
 		l3.Close()
 	}
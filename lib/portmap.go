@@ -0,0 +1,513 @@
+package ptp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	upnp "github.com/NebulousLabs/go-upnp"
+)
+
+// Port mapping asks the gateway to forward UDP port of the instance, so
+// peers can reach us without hole punching. PCP (RFC 6887) is tried first,
+// then NAT-PMP (RFC 6886) and UPnP IGD. PCP and NAT-PMP share the same
+// gateway port and PCP servers answer NAT-PMP requests as well
+
+// Port mapping constants
+const (
+	PortMapLifetime      = time.Hour * 2          // Requested lifetime of a mapping
+	PortMapRetryInterval = time.Minute * 10       // Failed mapping is retried after this
+	PortMapUPnPTimeout   = time.Second * 3        // Time to search for UPnP gateway
+	portMapPort          = 5351                   // Gateway port of NAT-PMP and PCP
+	portMapRetransmit    = time.Millisecond * 250 // First retransmit of NAT-PMP and PCP request
+	portMapAttempts      = 3
+)
+
+// NAT-PMP and PCP message values
+const (
+	natpmpVersion     = 0
+	natpmpOpExternal  = 0
+	natpmpOpMapUDP    = 1
+	natpmpResponse    = 128
+	pcpVersion        = 2
+	pcpOpMap          = 1
+	pcpResponse       = 0x80
+	pcpHeaderSize     = 24
+	pcpMapSize        = 36
+	pcpProtocolUDP    = 17
+	natpmpUnsupported = 1 // Result code of NAT-PMP server that received PCP request
+)
+
+// portMapper creates and removes mapping of the UDP port on a gateway
+type portMapper interface {
+	Name() string
+	// Map returns external endpoint and lifetime of the mapping
+	Map(port int, lifetime time.Duration) (*net.UDPAddr, time.Duration, error)
+	Unmap(port int) error
+}
+
+// PortMapping is UDP port forwarded by the gateway
+type PortMapping struct {
+	Protocol string       // Protocol that created the mapping
+	Internal int          // Local port of the instance
+	External *net.UDPAddr // Endpoint on the gateway
+	Expires  time.Time    // Mapping must be renewed before this time
+	lifetime time.Duration
+	mapper   portMapper
+}
+
+func (pm *PortMapping) String() string {
+	return fmt.Sprintf("%s %d -> %s, expires in %s", pm.Protocol, pm.Internal, pm.External.String(), time.Until(pm.Expires).Round(time.Second))
+}
+
+// GetPortMapping returns active mapping of the instance port or nil
+func (p *PeerToPeer) GetPortMapping() *PortMapping {
+	p.portMapLock.RLock()
+	defer p.portMapLock.RUnlock()
+	return p.portMapping
+}
+
+// MapPort starts forwarding instance port on the gateway in background,
+// so instance start isn't delayed on networks without a gateway. Mapping
+// is renewed and retried periodically afterwards
+func (p *PeerToPeer) MapPort() {
+	p.portMapChecked = time.Now()
+	if !p.startPortMapping() {
+		return
+	}
+	go func() {
+		defer atomic.StoreUint32(&p.portMapChecking, 0)
+		err := p.mapPort()
+		if err != nil {
+			Log(Info, "%s", err)
+		}
+	}()
+}
+
+// startPortMapping marks mapping or renewal as running. Returns false
+// if it's already running or port mapping was stopped
+func (p *PeerToPeer) startPortMapping() bool {
+	if !atomic.CompareAndSwapUint32(&p.portMapChecking, 0, 1) {
+		return false
+	}
+	if atomic.LoadUint32(&p.portMapStopped) != 0 {
+		atomic.StoreUint32(&p.portMapChecking, 0)
+		return false
+	}
+	return true
+}
+
+func (p *PeerToPeer) mapPort() error {
+	port := p.UDPSocket.GetPort()
+	var result error
+	for _, mapper := range p.portMappers() {
+		external, lifetime, err := mapper.Map(port, PortMapLifetime)
+		if err != nil {
+			Log(Debug, "%s port mapping failed: %s", mapper.Name(), err)
+			result = err
+			continue
+		}
+		mapping := &PortMapping{
+			Protocol: mapper.Name(),
+			Internal: port,
+			External: external,
+			Expires:  time.Now().Add(lifetime),
+			lifetime: lifetime,
+			mapper:   mapper,
+		}
+		if atomic.LoadUint32(&p.portMapStopped) != 0 {
+			mapper.Unmap(port)
+			return nil
+		}
+		Log(Info, "Port %d has been mapped to %s with %s", port, external.String(), mapper.Name())
+		p.portMapLock.Lock()
+		p.portMapping = mapping
+		p.portMapLock.Unlock()
+		p.announceMappedPort(external.Port)
+		return nil
+	}
+	if result == nil {
+		result = fmt.Errorf("No gateway found")
+	}
+	return fmt.Errorf("Failed to map port %d: %s", port, result)
+}
+
+// UnmapPort stops port mapping, waits for mapping or renewal in progress
+// and removes mapping from the gateway
+func (p *PeerToPeer) UnmapPort() {
+	atomic.StoreUint32(&p.portMapStopped, 1)
+	for atomic.LoadUint32(&p.portMapChecking) != 0 {
+		time.Sleep(time.Millisecond * 10)
+	}
+	p.portMapLock.Lock()
+	mapping := p.portMapping
+	p.portMapping = nil
+	p.portMapLock.Unlock()
+	if mapping == nil {
+		return
+	}
+	if p.Dht != nil {
+		p.Dht.SetMappedPort(0)
+	}
+	err := mapping.mapper.Unmap(mapping.Internal)
+	if err != nil {
+		Log(Warning, "Failed to remove %s port mapping: %s", mapping.Protocol, err)
+		return
+	}
+	Log(Info, "Port mapping %s has been removed", mapping.External.String())
+}
+
+// checkPortMapping renews mapping at half of its lifetime and retries
+// failed mapping. Instances that never tried to map their port are skipped
+func (p *PeerToPeer) checkPortMapping() {
+	if p.portMapChecked.IsZero() {
+		return
+	}
+	mapping := p.GetPortMapping()
+	if mapping == nil && time.Since(p.portMapChecked) < PortMapRetryInterval {
+		return
+	}
+	if mapping != nil && time.Until(mapping.Expires) > mapping.lifetime/2 {
+		return
+	}
+	if !p.startPortMapping() {
+		return
+	}
+	p.portMapChecked = time.Now()
+	go func() {
+		defer atomic.StoreUint32(&p.portMapChecking, 0)
+		if mapping == nil {
+			err := p.mapPort()
+			if err != nil {
+				Log(Debug, "%s", err)
+			}
+			return
+		}
+		external, lifetime, err := mapping.mapper.Map(mapping.Internal, PortMapLifetime)
+		if err != nil {
+			Log(Warning, "Failed to renew %s port mapping: %s", mapping.Protocol, err)
+			p.portMapLock.Lock()
+			p.portMapping = nil
+			p.portMapLock.Unlock()
+			p.announceMappedPort(0)
+			return
+		}
+		if atomic.LoadUint32(&p.portMapStopped) != 0 {
+			// Renewed mapping has the same port and is removed by UnmapPort
+			return
+		}
+		renewed := *mapping
+		renewed.External = external
+		renewed.Expires = time.Now().Add(lifetime)
+		renewed.lifetime = lifetime
+		p.portMapLock.Lock()
+		p.portMapping = &renewed
+		p.portMapLock.Unlock()
+		if external.String() != mapping.External.String() {
+			Log(Info, "Port mapping has changed from %s to %s", mapping.External.String(), external.String())
+			p.announceMappedPort(external.Port)
+		}
+	}()
+}
+
+// announceMappedPort sets port advertised to bootstrap nodes and
+// re-sends connect when it has changed, so peers learn the new port
+// without waiting for reconnect
+func (p *PeerToPeer) announceMappedPort(port int) {
+	if p.Dht == nil || atomic.LoadUint32(&p.portMapStopped) != 0 {
+		return
+	}
+	if atomic.SwapInt32(&p.Dht.mappedPort, int32(port)) == int32(port) || !p.Dht.Connected {
+		return
+	}
+	Log(Info, "Announcing port %d to bootstrap node", port)
+	err := p.Dht.Connect(p.LocalIPs, p.ProxyManager.GetList())
+	if err != nil {
+		Log(Warning, "Failed to announce mapped port: %s", err)
+	}
+}
+
+// portMappers returns mappers for all known gateways
+func (p *PeerToPeer) portMappers() []portMapper {
+	result := []portMapper{}
+	for _, gw := range mappingGateways() {
+		addr := &net.UDPAddr{IP: gw, Port: portMapPort}
+		result = append(result, newPCPMapper(addr), &natpmpMapper{gateway: addr})
+	}
+	return append(result, &upnpMapper{description: "subutai-" + p.Hash})
+}
+
+// mappingGateways returns default gateway. When routing table can't be
+// read, first addresses of private networks of local interfaces are used
+func mappingGateways() []net.IP {
+	gw, _, err := defaultGateway()
+	if err == nil && gw.To4() != nil {
+		return []net.IP{gw}
+	}
+	result := []net.IP{}
+	inters, err := net.Interfaces()
+	if err != nil {
+		return result
+	}
+	for _, inter := range inters {
+		if inter.Flags&net.FlagUp == 0 || inter.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, _ := inter.Addrs()
+		for _, addr := range addrs {
+			network, ok := addr.(*net.IPNet)
+			if !ok || network.IP.To4() == nil || isActiveInterface(network.IP) {
+				continue
+			}
+			if private, _ := isPrivateIP(network.IP); !private {
+				continue
+			}
+			first := network.IP.To4().Mask(network.Mask)
+			first[3]++
+			if !first.Equal(network.IP.To4()) {
+				result = append(result, first)
+			}
+		}
+	}
+	return result
+}
+
+func isActiveInterface(ip net.IP) bool {
+	for _, a := range ActiveInterfaces {
+		if a.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// portMapRequest sends request to the gateway until accepted response
+// is received
+func portMapRequest(gateway *net.UDPAddr, request []byte, accept func([]byte) bool) ([]byte, error) {
+	conn, err := net.DialUDP("udp4", nil, gateway)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	buf := make([]byte, 1100)
+	timeout := portMapRetransmit
+	for i := 0; i < portMapAttempts; i++ {
+		_, err = conn.Write(request)
+		if err != nil {
+			return nil, err
+		}
+		deadline := time.Now().Add(timeout)
+		for {
+			conn.SetReadDeadline(deadline)
+			n, err := conn.Read(buf)
+			if err != nil {
+				break
+			}
+			if accept(buf[:n]) {
+				return buf[:n], nil
+			}
+		}
+		timeout *= 2
+	}
+	return nil, fmt.Errorf("No response from %s", gateway.String())
+}
+
+// natpmpMapper maps port with NAT-PMP
+type natpmpMapper struct {
+	gateway  *net.UDPAddr
+	external int // Previously assigned external port
+}
+
+func (m *natpmpMapper) Name() string {
+	return "NAT-PMP"
+}
+
+func (m *natpmpMapper) request(op byte, request []byte) ([]byte, error) {
+	response, err := portMapRequest(m.gateway, request, func(data []byte) bool {
+		return len(data) >= 8 && data[0] == natpmpVersion && data[1] == natpmpResponse+op
+	})
+	if err != nil {
+		return nil, err
+	}
+	if code := binary.BigEndian.Uint16(response[2:4]); code != 0 {
+		return nil, fmt.Errorf("NAT-PMP error %d", code)
+	}
+	return response, nil
+}
+
+func (m *natpmpMapper) Map(port int, lifetime time.Duration) (*net.UDPAddr, time.Duration, error) {
+	response, err := m.request(natpmpOpExternal, []byte{natpmpVersion, natpmpOpExternal})
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(response) < 12 {
+		return nil, 0, fmt.Errorf("Malformed NAT-PMP response")
+	}
+	ip := net.IPv4(response[8], response[9], response[10], response[11])
+	// Renewal asks for the port gateway has assigned before
+	suggested := m.external
+	if suggested == 0 {
+		suggested = port
+	}
+	response, err = m.request(natpmpOpMapUDP, natpmpMapRequest(port, suggested, lifetime))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(response) < 16 || int(binary.BigEndian.Uint16(response[8:10])) != port {
+		return nil, 0, fmt.Errorf("Malformed NAT-PMP response")
+	}
+	external := &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(response[10:12]))}
+	m.external = external.Port
+	return external, time.Duration(binary.BigEndian.Uint32(response[12:16])) * time.Second, nil
+}
+
+func (m *natpmpMapper) Unmap(port int) error {
+	m.external = 0
+	_, err := m.request(natpmpOpMapUDP, natpmpMapRequest(port, 0, 0))
+	return err
+}
+
+func natpmpMapRequest(port, external int, lifetime time.Duration) []byte {
+	request := make([]byte, 12)
+	request[0] = natpmpVersion
+	request[1] = natpmpOpMapUDP
+	binary.BigEndian.PutUint16(request[4:6], uint16(port))
+	binary.BigEndian.PutUint16(request[6:8], uint16(external))
+	binary.BigEndian.PutUint32(request[8:12], uint32(lifetime/time.Second))
+	return request
+}
+
+// pcpMapper maps port with PCP. Nonce identifies our mapping on the
+// gateway and must be the same for renewal and removal
+type pcpMapper struct {
+	gateway  *net.UDPAddr
+	nonce    [12]byte
+	external int // Previously assigned external port
+}
+
+func newPCPMapper(gateway *net.UDPAddr) *pcpMapper {
+	m := &pcpMapper{gateway: gateway}
+	rand.Read(m.nonce[:])
+	return m
+}
+
+func (m *pcpMapper) Name() string {
+	return "PCP"
+}
+
+func (m *pcpMapper) request(port, external int, lifetime time.Duration) (*net.UDPAddr, time.Duration, error) {
+	local, err := localAddressTo(m.gateway)
+	if err != nil {
+		return nil, 0, err
+	}
+	request := new(bytes.Buffer)
+	request.Write([]byte{pcpVersion, pcpOpMap, 0, 0})
+	binary.Write(request, binary.BigEndian, uint32(lifetime/time.Second))
+	request.Write(local.To16())
+	request.Write(m.nonce[:])
+	request.Write([]byte{pcpProtocolUDP, 0, 0, 0})
+	binary.Write(request, binary.BigEndian, uint16(port))
+	binary.Write(request, binary.BigEndian, uint16(external))
+	request.Write(net.IPv4zero.To16())
+
+	response, err := portMapRequest(m.gateway, request.Bytes(), func(data []byte) bool {
+		if len(data) >= 4 && data[0] == natpmpVersion && binary.BigEndian.Uint16(data[2:4]) == natpmpUnsupported {
+			return true
+		}
+		return len(data) >= pcpHeaderSize+pcpMapSize && data[0] == pcpVersion && data[1] == pcpResponse|pcpOpMap &&
+			bytes.Equal(data[pcpHeaderSize:pcpHeaderSize+12], m.nonce[:])
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if response[0] != pcpVersion {
+		return nil, 0, fmt.Errorf("Gateway doesn't support PCP")
+	}
+	if code := response[3]; code != 0 {
+		return nil, 0, fmt.Errorf("PCP error %d", code)
+	}
+	payload := response[pcpHeaderSize:]
+	mapped := &net.UDPAddr{IP: net.IP(append([]byte{}, payload[20:36]...)), Port: int(binary.BigEndian.Uint16(payload[18:20]))}
+	if ip4 := mapped.IP.To4(); ip4 != nil {
+		mapped.IP = ip4
+	}
+	return mapped, time.Duration(binary.BigEndian.Uint32(response[4:8])) * time.Second, nil
+}
+
+func (m *pcpMapper) Map(port int, lifetime time.Duration) (*net.UDPAddr, time.Duration, error) {
+	// Renewal suggests the port gateway has assigned before
+	suggested := m.external
+	if suggested == 0 {
+		suggested = port
+	}
+	external, assigned, err := m.request(port, suggested, lifetime)
+	if err == nil {
+		m.external = external.Port
+	}
+	return external, assigned, err
+}
+
+func (m *pcpMapper) Unmap(port int) error {
+	m.external = 0
+	_, _, err := m.request(port, 0, 0)
+	return err
+}
+
+// localAddressTo returns local IP used to reach the address
+func localAddressTo(addr *net.UDPAddr) (net.IP, error) {
+	conn, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// upnpMapper maps port with UPnP IGD. Gateway is searched on the first use
+type upnpMapper struct {
+	description string
+	igd         *upnp.IGD
+}
+
+func (m *upnpMapper) Name() string {
+	return "UPnP"
+}
+
+func (m *upnpMapper) Map(port int, lifetime time.Duration) (*net.UDPAddr, time.Duration, error) {
+	if m.igd == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), PortMapUPnPTimeout)
+		defer cancel()
+		igd, err := upnp.DiscoverCtx(ctx)
+		if err != nil {
+			return nil, 0, err
+		}
+		m.igd = igd
+	}
+	err := m.igd.Forward(uint16(port), m.description)
+	if err != nil {
+		return nil, 0, err
+	}
+	ip, err := m.igd.ExternalIP()
+	if err != nil {
+		return nil, 0, err
+	}
+	external := net.ParseIP(ip)
+	if external == nil {
+		return nil, 0, fmt.Errorf("Bad external IP: %s", ip)
+	}
+	// UPnP mappings are permanent, but are renewed as others in case
+	// gateway was restarted
+	return &net.UDPAddr{IP: external, Port: port}, lifetime, nil
+}
+
+func (m *upnpMapper) Unmap(port int) error {
+	if m.igd == nil {
+		return nil
+	}
+	return m.igd.Clear(uint16(port))
+}
@@ -0,0 +1,249 @@
+package ptp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeGateway answers NAT-PMP and optionally PCP requests and keeps
+// created mappings
+type fakeGateway struct {
+	conn     *net.UDPConn
+	pcp      bool
+	external net.IP
+	mappings map[int]int // Internal port to external
+	assigned int         // Number of assigned external ports
+	lock     sync.Mutex
+}
+
+func newFakeGateway(t *testing.T, pcp bool) *fakeGateway {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("Failed to create socket: %s", err)
+	}
+	g := &fakeGateway{conn: conn, pcp: pcp, external: net.ParseIP("203.0.113.5").To4(), mappings: make(map[int]int)}
+	go g.serve()
+	return g
+}
+
+func (g *fakeGateway) addr() *net.UDPAddr {
+	return g.conn.LocalAddr().(*net.UDPAddr)
+}
+
+func (g *fakeGateway) mapped(port int) (int, bool) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	external, exists := g.mappings[port]
+	return external, exists
+}
+
+// update creates mapping or removes it. Existing external port is kept
+// only when it was suggested, otherwise a new one is assigned starting
+// from internal port shifted by 1000
+func (g *fakeGateway) update(port, suggested int, lifetime uint32) int {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if lifetime == 0 {
+		delete(g.mappings, port)
+		return 0
+	}
+	if external, exists := g.mappings[port]; exists && external == suggested {
+		return external
+	}
+	g.mappings[port] = port + 1000 + g.assigned
+	g.assigned++
+	return g.mappings[port]
+}
+
+func (g *fakeGateway) serve() {
+	buf := make([]byte, 1500)
+	for {
+		n, src, err := g.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		var response []byte
+		switch {
+		case n == 2 && buf[0] == natpmpVersion && buf[1] == natpmpOpExternal:
+			response = make([]byte, 12)
+			response[1] = natpmpResponse + natpmpOpExternal
+			copy(response[8:12], g.external)
+		case n == 12 && buf[0] == natpmpVersion && buf[1] == natpmpOpMapUDP:
+			port := int(binary.BigEndian.Uint16(buf[4:6]))
+			lifetime := binary.BigEndian.Uint32(buf[8:12])
+			response = make([]byte, 16)
+			response[1] = natpmpResponse + natpmpOpMapUDP
+			binary.BigEndian.PutUint16(response[8:10], uint16(port))
+			suggested := int(binary.BigEndian.Uint16(buf[6:8]))
+			binary.BigEndian.PutUint16(response[10:12], uint16(g.update(port, suggested, lifetime)))
+			binary.BigEndian.PutUint32(response[12:16], lifetime)
+		case n == pcpHeaderSize+pcpMapSize && buf[0] == pcpVersion && !g.pcp:
+			response = []byte{natpmpVersion, natpmpResponse + buf[1], 0, natpmpUnsupported, 0, 0, 0, 0}
+		case n == pcpHeaderSize+pcpMapSize && buf[0] == pcpVersion:
+			response = make([]byte, n)
+			copy(response, buf[:n])
+			response[1] |= pcpResponse
+			copy(response[8:24], make([]byte, 16))
+			port := int(binary.BigEndian.Uint16(buf[pcpHeaderSize+16 : pcpHeaderSize+18]))
+			suggested := int(binary.BigEndian.Uint16(buf[pcpHeaderSize+18 : pcpHeaderSize+20]))
+			lifetime := binary.BigEndian.Uint32(buf[4:8])
+			binary.BigEndian.PutUint16(response[pcpHeaderSize+18:pcpHeaderSize+20], uint16(g.update(port, suggested, lifetime)))
+			copy(response[pcpHeaderSize+20:], g.external.To16())
+		default:
+			continue
+		}
+		g.conn.WriteToUDP(response, src)
+	}
+}
+
+func TestNATPMPMapper(t *testing.T) {
+	g := newFakeGateway(t, false)
+	defer g.conn.Close()
+	m := &natpmpMapper{gateway: g.addr()}
+	external, lifetime, err := m.Map(6881, PortMapLifetime)
+	if err != nil {
+		t.Fatalf("Failed to map port: %s", err)
+	}
+	if external.String() != "203.0.113.5:7881" || lifetime != PortMapLifetime {
+		t.Errorf("Wrong mapping: %s for %s", external.String(), lifetime)
+	}
+	if err := m.Unmap(6881); err != nil {
+		t.Errorf("Failed to unmap port: %s", err)
+	}
+	if _, exists := g.mapped(6881); exists {
+		t.Errorf("Mapping wasn't removed")
+	}
+
+	// PCP request to NAT-PMP server fails at once
+	started := time.Now()
+	if _, _, err := newPCPMapper(g.addr()).Map(6881, PortMapLifetime); err == nil {
+		t.Errorf("PCP mapping succeeded with NAT-PMP server")
+	}
+	if time.Since(started) > portMapRetransmit {
+		t.Errorf("PCP mapper waited for NAT-PMP server")
+	}
+}
+
+func TestPCPMapper(t *testing.T) {
+	g := newFakeGateway(t, true)
+	defer g.conn.Close()
+	m := newPCPMapper(g.addr())
+	external, lifetime, err := m.Map(6881, PortMapLifetime)
+	if err != nil {
+		t.Fatalf("Failed to map port: %s", err)
+	}
+	if external.String() != "203.0.113.5:7881" || lifetime != PortMapLifetime {
+		t.Errorf("Wrong mapping: %s for %s", external.String(), lifetime)
+	}
+	// Renewal keeps previously assigned external port
+	external, _, err = m.Map(6881, PortMapLifetime)
+	if err != nil || external.Port != 7881 {
+		t.Errorf("Renewal changed mapping: %v %v", external, err)
+	}
+	if err := m.Unmap(6881); err != nil {
+		t.Errorf("Failed to unmap port: %s", err)
+	}
+	if _, exists := g.mapped(6881); exists {
+		t.Errorf("Mapping wasn't removed")
+	}
+}
+
+func TestPortMappingLifecycle(t *testing.T) {
+	g := newFakeGateway(t, false)
+	defer g.conn.Close()
+	ptpc := new(PeerToPeer)
+	ptpc.Init()
+	ptpc.Dht = new(DHTClient)
+	ptpc.Dht.ID = fmt.Sprintf("%036d", 0)
+	ptpc.portMapChecked = time.Now()
+
+	// Mapping that passed half of its lifetime is renewed
+	mapper := &natpmpMapper{gateway: g.addr()}
+	ptpc.portMapping = &PortMapping{
+		Protocol: mapper.Name(),
+		Internal: 6881,
+		External: &net.UDPAddr{IP: g.external, Port: 6881},
+		Expires:  time.Now().Add(time.Minute),
+		lifetime: PortMapLifetime,
+		mapper:   mapper,
+	}
+	ptpc.checkPortMapping()
+	deadline := time.Now().Add(time.Second)
+	for ptpc.GetPortMapping().External.Port != 7881 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Port mapping wasn't renewed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for atomic.LoadUint32(&ptpc.portMapChecking) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	advertised := atomic.LoadInt32(&ptpc.Dht.mappedPort)
+	if mapping := ptpc.GetPortMapping(); time.Until(mapping.Expires) < PortMapLifetime-time.Minute || advertised != 7881 {
+		t.Errorf("Wrong renewed mapping: %s, advertised port %d", mapping.String(), advertised)
+	}
+
+	ptpc.UnmapPort()
+	if _, exists := g.mapped(6881); exists || ptpc.GetPortMapping() != nil || atomic.LoadInt32(&ptpc.Dht.mappedPort) != 0 {
+		t.Errorf("Port mapping wasn't removed")
+	}
+}
+
+// slowMapper maps port after a delay and records removal of the mapping
+type slowMapper struct {
+	delay    time.Duration
+	unmapped uint32
+}
+
+func (m *slowMapper) Name() string { return "slow" }
+
+func (m *slowMapper) Map(port int, lifetime time.Duration) (*net.UDPAddr, time.Duration, error) {
+	time.Sleep(m.delay)
+	return &net.UDPAddr{IP: net.ParseIP("203.0.113.5"), Port: port + 1}, lifetime, nil
+}
+
+func (m *slowMapper) Unmap(port int) error {
+	atomic.StoreUint32(&m.unmapped, 1)
+	return nil
+}
+
+func TestUnmapPortDuringRenewal(t *testing.T) {
+	ptpc := new(PeerToPeer)
+	ptpc.Init()
+	ptpc.Dht = new(DHTClient)
+	ptpc.Dht.ID = fmt.Sprintf("%036d", 0)
+	ptpc.portMapChecked = time.Now()
+	mapper := &slowMapper{delay: time.Millisecond * 200}
+	ptpc.portMapping = &PortMapping{
+		Protocol: mapper.Name(),
+		Internal: 6881,
+		External: &net.UDPAddr{IP: net.ParseIP("203.0.113.5"), Port: 6881},
+		Expires:  time.Now().Add(time.Minute),
+		lifetime: PortMapLifetime,
+		mapper:   mapper,
+	}
+	ptpc.checkPortMapping()
+	if atomic.LoadUint32(&ptpc.portMapChecking) == 0 {
+		t.Fatalf("Port mapping wasn't renewed")
+	}
+	ptpc.UnmapPort()
+	if atomic.LoadUint32(&ptpc.portMapChecking) != 0 {
+		t.Errorf("Renewal was still running after port was unmapped")
+	}
+	if ptpc.GetPortMapping() != nil || atomic.LoadUint32(&mapper.unmapped) == 0 || atomic.LoadInt32(&ptpc.Dht.mappedPort) != 0 {
+		t.Errorf("Renewed mapping was left after port was unmapped")
+	}
+
+	// Mapping isn't retried once port was unmapped
+	ptpc.portMapChecked = time.Now().Add(-PortMapRetryInterval * 2)
+	ptpc.checkPortMapping()
+	ptpc.MapPort()
+	if atomic.LoadUint32(&ptpc.portMapChecking) != 0 {
+		t.Errorf("Port mapping was retried after port was unmapped")
+	}
+}
@@ -0,0 +1,382 @@
+package ptp
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Port prediction extends hole punching for peers behind symmetric NAT,
+// where the port peer is mapped to for us differs from the one seen by
+// bootstrap node. Strategies are escalated on every failed punching round
+// and chosen by the NAT type detected with STUN:
+//   - sequential: NAT allocates ports with a constant step, so ports next
+//     to the known one are probed
+//   - birthday: NAT allocates random ports. Behind symmetric NAT we open
+//     many local sockets, so some of the new mappings hit ports the peer
+//     is probing. Behind cone NAT we probe many random ports of the peer
+//     from the main socket.
+// Probe socket that receives a packet is bound to the sender and carries
+// all further traffic to it
+
+// Port prediction constants
+const (
+	PredictSequentialRange = 16               // Ports probed next to the known one
+	PredictMaxDelta        = 16               // Larger port steps are treated as random
+	PredictBirthdayPorts   = 256              // Random ports probed from the main socket
+	PredictBirthdaySockets = 64               // Probe sockets opened behind symmetric NAT
+	PredictMaxSockets      = 256              // Probe sockets opened by all instances at once
+	PredictSocketTTL       = time.Second * 30 // Probe socket that received nothing is closed after this
+)
+
+// PredictionStrategy is a way to guess endpoint of a peer
+type PredictionStrategy int
+
+// Prediction strategies
+const (
+	PredictDirect PredictionStrategy = iota
+	PredictSequential
+	PredictBirthday
+)
+
+// StringifyStrategy returns name of a prediction strategy
+func StringifyStrategy(s PredictionStrategy) string {
+	switch s {
+	case PredictDirect:
+		return "direct"
+	case PredictSequential:
+		return "sequential"
+	case PredictBirthday:
+		return "birthday"
+	}
+	return "unknown"
+}
+
+// PredictionStats counts punching rounds that used a strategy and
+// introductions received over endpoints it predicted
+type PredictionStats struct {
+	Attempts  int
+	Successes int
+}
+
+// PortPrediction keeps probe sockets and statistics of an instance
+type PortPrediction struct {
+	stats   map[PredictionStrategy]*PredictionStats
+	sockets []*probeSocket
+	bound   map[string]*probeSocket // Probe sockets by remote endpoint
+	lock    sync.Mutex
+}
+
+type probeSocket struct {
+	socket   *Network
+	created  time.Time
+	lastRecv time.Time
+	remote   string
+	reserved bool // Whether socket is counted in probeSocketsOpen
+}
+
+// probeSocketsOpen counts probe sockets of all instances, so punching to
+// many peers behind symmetric NAT can't exhaust file descriptors
+var probeSocketsOpen int32
+
+// reserveProbeSocket takes a place for a new probe socket. Returns false
+// when all PredictMaxSockets places are taken
+func reserveProbeSocket() bool {
+	for {
+		open := atomic.LoadInt32(&probeSocketsOpen)
+		if open >= PredictMaxSockets {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&probeSocketsOpen, open, open+1) {
+			return true
+		}
+	}
+}
+
+func (ps *probeSocket) stop() {
+	ps.socket.Stop()
+	if ps.reserved {
+		ps.reserved = false
+		atomic.AddInt32(&probeSocketsOpen, -1)
+	}
+}
+
+func (pp *PortPrediction) init() {
+	pp.stats = make(map[PredictionStrategy]*PredictionStats)
+	pp.bound = make(map[string]*probeSocket)
+}
+
+func (pp *PortPrediction) count(s PredictionStrategy, success bool) {
+	pp.lock.Lock()
+	defer pp.lock.Unlock()
+	stats, exists := pp.stats[s]
+	if !exists {
+		stats = new(PredictionStats)
+		pp.stats[s] = stats
+	}
+	if success {
+		stats.Successes++
+	} else {
+		stats.Attempts++
+	}
+}
+
+// Stats returns copy of the statistics by strategy
+func (pp *PortPrediction) Stats() map[PredictionStrategy]PredictionStats {
+	pp.lock.Lock()
+	defer pp.lock.Unlock()
+	result := make(map[PredictionStrategy]PredictionStats)
+	for s, stats := range pp.stats {
+		result[s] = *stats
+	}
+	return result
+}
+
+// String returns statistics as successes/attempts of every strategy
+func (pp *PortPrediction) String() string {
+	stats := pp.Stats()
+	strategies := []int{}
+	for s := range stats {
+		strategies = append(strategies, int(s))
+	}
+	sort.Ints(strategies)
+	result := []string{}
+	for _, s := range strategies {
+		st := stats[PredictionStrategy(s)]
+		result = append(result, fmt.Sprintf("%s %d/%d", StringifyStrategy(PredictionStrategy(s)), st.Successes, st.Attempts))
+	}
+	if len(result) == 0 {
+		return "not used"
+	}
+	return strings.Join(result, ", ")
+}
+
+// socketFor returns probe socket bound to the endpoint
+func (pp *PortPrediction) socketFor(addr *net.UDPAddr) *Network {
+	pp.lock.Lock()
+	defer pp.lock.Unlock()
+	if ps, exists := pp.bound[addr.String()]; exists {
+		return ps.socket
+	}
+	return nil
+}
+
+// received marks probe socket as alive and binds it to the sender
+func (pp *PortPrediction) received(ps *probeSocket, src *net.UDPAddr) {
+	pp.lock.Lock()
+	defer pp.lock.Unlock()
+	ps.lastRecv = time.Now()
+	if ps.remote != "" {
+		return
+	}
+	if _, exists := pp.bound[src.String()]; exists {
+		return
+	}
+	Log(Debug, "Probe socket %d is bound to %s", ps.socket.GetPort(), src.String())
+	ps.remote = src.String()
+	pp.bound[ps.remote] = ps
+}
+
+// expire closes probe sockets that received nothing in time
+func (pp *PortPrediction) expire(idle time.Duration) {
+	pp.lock.Lock()
+	defer pp.lock.Unlock()
+	sockets := pp.sockets[:0]
+	for _, ps := range pp.sockets {
+		if (ps.remote == "" && time.Since(ps.created) > PredictSocketTTL) || (ps.remote != "" && time.Since(ps.lastRecv) > idle) {
+			ps.stop()
+			if ps.remote != "" {
+				delete(pp.bound, ps.remote)
+			}
+			continue
+		}
+		sockets = append(sockets, ps)
+	}
+	pp.sockets = sockets
+}
+
+func (pp *PortPrediction) close() {
+	pp.lock.Lock()
+	defer pp.lock.Unlock()
+	for _, ps := range pp.sockets {
+		ps.stop()
+	}
+	pp.sockets = nil
+	pp.bound = make(map[string]*probeSocket)
+}
+
+// openProbeSockets creates sockets for birthday probing. Fewer sockets
+// are opened when the budget of probe sockets is used up
+func (p *PeerToPeer) openProbeSockets(count int) []*Network {
+	result := []*Network{}
+	for i := 0; i < count; i++ {
+		if !reserveProbeSocket() {
+			Log(Debug, "Probe socket limit of %d is reached", PredictMaxSockets)
+			break
+		}
+		ps := &probeSocket{socket: new(Network), created: time.Now(), reserved: true}
+		err := ps.socket.Init("", 0)
+		if err != nil {
+			ps.stop()
+			Log(Debug, "Failed to open probe socket: %s", err)
+			break
+		}
+		go ps.socket.Listen(func(count int, src *net.UDPAddr, err error, data []byte) {
+			if ps.socket.Disposed() {
+				return
+			}
+			if err == nil {
+				p.Prediction.received(ps, src)
+			}
+			p.HandleP2PMessage(count, src, err, data)
+		})
+		p.Prediction.lock.Lock()
+		p.Prediction.sockets = append(p.Prediction.sockets, ps)
+		p.Prediction.lock.Unlock()
+		result = append(result, ps.socket)
+	}
+	return result
+}
+
+// publicEndpoints returns endpoints outside of private networks
+func publicEndpoints(eps []*net.UDPAddr) []*net.UDPAddr {
+	result := []*net.UDPAddr{}
+	for _, ep := range eps {
+		if private, err := isPrivateIP(ep.IP); err == nil && !private {
+			result = append(result, ep)
+		}
+	}
+	return result
+}
+
+// selectStrategies returns strategies for the punching round. First
+// round is always direct
+func selectStrategies(nat *NATInfo, round int) []PredictionStrategy {
+	result := []PredictionStrategy{PredictDirect}
+	if round == 0 || nat == nil {
+		return result
+	}
+	switch nat.Type {
+	case NATOpen, NATFullCone:
+		// Peer can reach us directly
+		return result
+	case NATSymmetric:
+		if predictableDelta(nat) != 0 {
+			result = append(result, PredictSequential)
+			if round > 1 {
+				result = append(result, PredictBirthday)
+			}
+		} else {
+			result = append(result, PredictBirthday)
+		}
+	default:
+		// Peer may be behind symmetric NAT
+		result = append(result, PredictSequential)
+		if round > 1 {
+			result = append(result, PredictBirthday)
+		}
+	}
+	return result
+}
+
+// predictableDelta returns port step of sequential NAT or 0
+func predictableDelta(nat *NATInfo) int {
+	if nat == nil || nat.Type != NATSymmetric || nat.Delta == 0 || nat.Delta > PredictMaxDelta || nat.Delta < -PredictMaxDelta {
+		return 0
+	}
+	return nat.Delta
+}
+
+// sequentialCandidates returns ports following the known one with a step
+func sequentialCandidates(ep *net.UDPAddr, delta, count int) []*net.UDPAddr {
+	result := []*net.UDPAddr{}
+	for i := 1; i <= count; i++ {
+		port := ep.Port + i*delta
+		if port <= 0 || port > 65535 {
+			break
+		}
+		result = append(result, &net.UDPAddr{IP: ep.IP, Port: port})
+	}
+	return result
+}
+
+// birthdayCandidates returns random unprivileged ports of the IP
+func birthdayCandidates(ip net.IP, count int, rnd *rand.Rand) []*net.UDPAddr {
+	result := []*net.UDPAddr{}
+	used := make(map[int]bool)
+	for len(result) < count && len(used) < 65535-1024 {
+		port := 1024 + rnd.Intn(65536-1024)
+		if used[port] {
+			continue
+		}
+		used[port] = true
+		result = append(result, &net.UDPAddr{IP: ip, Port: port})
+	}
+	return result
+}
+
+// predictEndpoints returns endpoints guessed with the strategy from the
+// public endpoints of the peer
+func (np *NetworkPeer) predictEndpoints(s PredictionStrategy, nat *NATInfo, public []*net.UDPAddr) []*net.UDPAddr {
+	result := []*net.UDPAddr{}
+	switch s {
+	case PredictSequential:
+		delta := predictableDelta(nat)
+		if delta == 0 {
+			delta = 1
+		}
+		for _, ep := range public {
+			result = append(result, sequentialCandidates(ep, delta, PredictSequentialRange)...)
+		}
+	case PredictBirthday:
+		rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+		ips := []net.IP{}
+		for _, ep := range public {
+			known := false
+			for _, ip := range ips {
+				known = known || ip.Equal(ep.IP)
+			}
+			if !known {
+				ips = append(ips, ep.IP)
+				result = append(result, birthdayCandidates(ep.IP, PredictBirthdayPorts, rnd)...)
+			}
+		}
+	}
+	np.lock.Lock()
+	if np.predicted == nil {
+		np.predicted = make(map[string]PredictionStrategy)
+	}
+	for _, ep := range result {
+		np.predicted[ep.String()] = s
+	}
+	np.lock.Unlock()
+	return result
+}
+
+// predictedBy returns strategy that predicted the endpoint
+func (np *NetworkPeer) predictedBy(addr *net.UDPAddr) (PredictionStrategy, bool) {
+	np.lock.RLock()
+	defer np.lock.RUnlock()
+	s, exists := np.predicted[addr.String()]
+	return s, exists
+}
+
+// countIntroduction credits strategy that found the endpoint
+func (p *PeerToPeer) countIntroduction(peer *NetworkPeer, endpoint, src *net.UDPAddr) {
+	if p.Prediction == nil || endpoint == nil || isRelayAddr(endpoint) || peer.isEndpointActive(endpoint) {
+		return
+	}
+	s, exists := peer.predictedBy(endpoint)
+	if p.Prediction.socketFor(src) != nil {
+		s, exists = PredictBirthday, true
+	}
+	if !exists {
+		s = PredictDirect
+	}
+	p.Prediction.count(s, true)
+}
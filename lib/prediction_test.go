@@ -0,0 +1,160 @@
+package ptp
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSelectStrategies(t *testing.T) {
+	sequential := &NATInfo{Type: NATSymmetric, Delta: 2}
+	random := &NATInfo{Type: NATSymmetric, Delta: 1000}
+	cases := []struct {
+		nat      *NATInfo
+		round    int
+		expected []PredictionStrategy
+	}{
+		{nil, 3, []PredictionStrategy{PredictDirect}},
+		{sequential, 0, []PredictionStrategy{PredictDirect}},
+		{&NATInfo{Type: NATFullCone}, 2, []PredictionStrategy{PredictDirect}},
+		{sequential, 1, []PredictionStrategy{PredictDirect, PredictSequential}},
+		{sequential, 2, []PredictionStrategy{PredictDirect, PredictSequential, PredictBirthday}},
+		{random, 1, []PredictionStrategy{PredictDirect, PredictBirthday}},
+		{&NATInfo{Type: NATPortRestricted}, 1, []PredictionStrategy{PredictDirect, PredictSequential}},
+		{&NATInfo{Type: NATPortRestricted}, 2, []PredictionStrategy{PredictDirect, PredictSequential, PredictBirthday}},
+	}
+	for _, c := range cases {
+		result := selectStrategies(c.nat, c.round)
+		if fmt.Sprint(result) != fmt.Sprint(c.expected) {
+			t.Errorf("Wrong strategies for %v in round %d: %v", c.nat, c.round, result)
+		}
+	}
+}
+
+func TestPredictionCandidates(t *testing.T) {
+	ep := &net.UDPAddr{IP: net.ParseIP("203.0.113.5"), Port: 65530}
+	candidates := sequentialCandidates(ep, 2, PredictSequentialRange)
+	if len(candidates) != 2 || candidates[0].Port != 65532 || candidates[1].Port != 65534 {
+		t.Errorf("Wrong sequential candidates: %v", candidates)
+	}
+	candidates = sequentialCandidates(&net.UDPAddr{IP: ep.IP, Port: 3}, -1, PredictSequentialRange)
+	if len(candidates) != 2 || candidates[1].Port != 1 {
+		t.Errorf("Wrong sequential candidates with negative delta: %v", candidates)
+	}
+
+	candidates = birthdayCandidates(ep.IP, PredictBirthdayPorts, rand.New(rand.NewSource(1)))
+	if len(candidates) != PredictBirthdayPorts {
+		t.Fatalf("Wrong number of birthday candidates: %d", len(candidates))
+	}
+	used := make(map[int]bool)
+	for _, c := range candidates {
+		if c.Port < 1024 || c.Port > 65535 || used[c.Port] || !c.IP.Equal(ep.IP) {
+			t.Errorf("Wrong birthday candidate: %s", c.String())
+		}
+		used[c.Port] = true
+	}
+
+	private := &net.UDPAddr{IP: net.ParseIP("192.168.1.10"), Port: 6881}
+	public := publicEndpoints([]*net.UDPAddr{private, ep})
+	if len(public) != 1 || public[0] != ep {
+		t.Errorf("Wrong public endpoints: %v", public)
+	}
+}
+
+func TestCountIntroduction(t *testing.T) {
+	ptpc := new(PeerToPeer)
+	ptpc.Init()
+	peer := new(NetworkPeer)
+	ep := &net.UDPAddr{IP: net.ParseIP("203.0.113.5"), Port: 40000}
+	predicted := peer.predictEndpoints(PredictSequential, &NATInfo{Type: NATSymmetric, Delta: 1}, []*net.UDPAddr{ep})
+	if len(predicted) != PredictSequentialRange || predicted[0].Port != 40001 {
+		t.Fatalf("Wrong predicted endpoints: %v", predicted)
+	}
+	ptpc.Prediction.count(PredictDirect, false)
+	ptpc.Prediction.count(PredictSequential, false)
+	ptpc.countIntroduction(peer, predicted[3], predicted[3])
+	ptpc.countIntroduction(peer, ep, ep)
+	stats := ptpc.Prediction.Stats()
+	if stats[PredictSequential] != (PredictionStats{Attempts: 1, Successes: 1}) || stats[PredictDirect] != (PredictionStats{Attempts: 1, Successes: 1}) {
+		t.Errorf("Wrong prediction stats: %v", stats)
+	}
+	if s := ptpc.Prediction.String(); s != "direct 1/1, sequential 1/1" {
+		t.Errorf("Wrong prediction stats string: %s", s)
+	}
+	empty := new(PortPrediction)
+	empty.init()
+	if s := empty.String(); s != "not used" {
+		t.Errorf("Wrong empty stats string: %s", s)
+	}
+}
+
+func TestProbeSocket(t *testing.T) {
+	ptpc := new(PeerToPeer)
+	ptpc.Init()
+	ptpc.UDPSocket = new(Network)
+	err := ptpc.UDPSocket.Init("127.0.0.1", 0)
+	if err != nil {
+		t.Fatalf("Failed to create socket: %s", err)
+	}
+	defer ptpc.UDPSocket.Stop()
+	remote, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("Failed to create socket: %s", err)
+	}
+	defer remote.Close()
+	addr := remote.LocalAddr().(*net.UDPAddr)
+
+	ps := &probeSocket{socket: new(Network), created: time.Now()}
+	err = ps.socket.Init("127.0.0.1", 0)
+	if err != nil {
+		t.Fatalf("Failed to create probe socket: %s", err)
+	}
+	ptpc.Prediction.sockets = append(ptpc.Prediction.sockets, ps)
+	ptpc.Prediction.received(ps, addr)
+
+	msg, _ := CreateMessageStatic(MsgTypePing, []byte("ping"))
+	if _, err := ptpc.sendMessage(msg, addr); err != nil {
+		t.Fatalf("Failed to send message: %s", err)
+	}
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1500)
+	_, src, err := remote.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("Message wasn't received: %s", err)
+	}
+	if src.Port != ps.socket.GetPort() {
+		t.Errorf("Message wasn't sent over bound probe socket: %d", src.Port)
+	}
+
+	ptpc.Prediction.expire(time.Hour)
+	if ptpc.Prediction.socketFor(addr) == nil {
+		t.Errorf("Active probe socket was expired")
+	}
+	ptpc.Prediction.expire(0)
+	if ptpc.Prediction.socketFor(addr) != nil || len(ptpc.Prediction.sockets) != 0 {
+		t.Errorf("Idle probe socket wasn't expired")
+	}
+}
+
+func TestProbeSocketLimit(t *testing.T) {
+	ptpc := new(PeerToPeer)
+	ptpc.Init()
+	atomic.StoreInt32(&probeSocketsOpen, PredictMaxSockets-1)
+	defer atomic.StoreInt32(&probeSocketsOpen, 0)
+
+	if !reserveProbeSocket() {
+		t.Fatalf("Last probe socket wasn't reserved")
+	}
+	if probes := ptpc.openProbeSockets(PredictBirthdaySockets); len(probes) != 0 {
+		t.Errorf("%d probe sockets were opened over the limit", len(probes))
+	}
+	ps := &probeSocket{socket: new(Network), created: time.Now().Add(-PredictSocketTTL * 2), reserved: true}
+	ptpc.Prediction.sockets = append(ptpc.Prediction.sockets, ps)
+	ptpc.Prediction.expire(0)
+	if open := atomic.LoadInt32(&probeSocketsOpen); open != PredictMaxSockets-1 {
+		t.Errorf("Expired probe socket wasn't released: %d", open)
+	}
+}
@@ -74,17 +74,17 @@ func (p *ProxyManager) new(endpoint *net.UDPAddr) error {
 	return nil
 }
 
-func (p *ProxyManager) check() {
+func (p *ProxyManager) check(tuning *Tuning) {
 	proxies := p.get()
 	for id, proxy := range proxies {
-		if proxy.Status == proxyConnecting && time.Since(proxy.Created) > time.Duration(10*time.Second) {
+		if proxy.Status == proxyConnecting && time.Since(proxy.Created) > tuning.ProxyConnectTimeout {
 			err := proxy.Close()
 			if err != nil {
 				Log(Debug, "Failed to close proxy: %s", err)
 			}
 			Log(Debug, "Failed to connect to proxy %s", id)
 		}
-		if proxy.Status == proxyActive && time.Since(proxy.LastUpdate) > time.Duration(90*time.Second) {
+		if proxy.Status == proxyActive && time.Since(proxy.LastUpdate) > tuning.ProxyIdleTimeout {
 			err := proxy.Close()
 			if err != nil {
 				Log(Debug, "Failed to close proxy: %s", err)
@@ -71,7 +71,7 @@ func TestCheck(t *testing.T) {
 	p.init()
 	p.proxies["10"] = prsrv1
 	p.proxies["11"] = prsrv2
-	p.check()
+	p.check(&DefaultTuning)
 	_, exists := p.proxies["10"]
 	if prsrv1.Addr != nil && prsrv1.Endpoint != nil && prsrv1.Status != proxyDisconnected && !exists {
 		t.Error("Error")
@@ -0,0 +1,484 @@
+package ptp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Peers that can't reach each other directly or over proxies may talk
+// through a third peer connected to both of them. Relaying is opt-in:
+// only instances started with `-relay` forward traffic of other peers.
+// Relay forwards messages untouched, so frames stay encrypted with the
+// swarm key.
+//
+// Path over a relay is represented by a synthetic endpoint from the
+// reserved 240.0.0.0/4 network. The rest of the code uses such endpoint
+// as any other endpoint of a peer, while sendMessage wraps messages sent
+// to it into relay messages.
+
+// Relay defaults
+const (
+	RelayDefaultSessions = 16               // Pairs of peers relayed at once
+	RelayDefaultRate     = 1024 * 1024      // Bytes per second forwarded for all sessions
+	RelaySessionTimeout  = time.Second * 30 // Session is released when unused for this long
+)
+
+// Kinds of relay messages
+const (
+	relayQuery byte = iota + 1 // Asks connected peer whether it can relay to another peer
+	relayOffer                 // Relay agrees and reports its RTT to the peer
+	relayData                  // Message forwarded over relay
+)
+
+// relayHeaderSize is a kind followed by destination and source IDs
+const relayHeaderSize = 1 + 36 + 36
+
+var relayNetwork = &net.IPNet{IP: net.IPv4(240, 0, 0, 0).To4(), Mask: net.CIDRMask(4, 32)}
+
+// RelayConfig is a relay section of the daemon config
+type RelayConfig struct {
+	Relay struct {
+		Sessions int `yaml:"sessions"`
+		Rate     int `yaml:"rate"`
+	} `yaml:"relay"`
+}
+
+// LoadRelayConfig returns relay limits from the daemon config
+func LoadRelayConfig(configPath string) (int, int) {
+	sessions, rate := RelayDefaultSessions, RelayDefaultRate
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return sessions, rate
+	}
+	config := &RelayConfig{}
+	err = yaml.Unmarshal(data, config)
+	if err != nil {
+		return sessions, rate
+	}
+	if config.Relay.Sessions > 0 {
+		sessions = config.Relay.Sessions
+	}
+	if config.Relay.Rate > 0 {
+		rate = config.Relay.Rate
+	}
+	return sessions, rate
+}
+
+// relayPath is a way to a peer over a relay
+type relayPath struct {
+	relay   string        // ID of the relaying peer
+	peer    string        // ID of the peer reached over relay
+	addr    *net.UDPAddr  // Synthetic endpoint of the path
+	latency time.Duration // Latency offered by relay, zero for paths opened by the peer
+}
+
+// RelayManager keeps paths to peers over relays and serves as a relay
+// for other peers when enabled
+type RelayManager struct {
+	Enabled     bool                  // Whether traffic of other peers is relayed
+	MaxSessions int                   // Pairs of peers relayed at once
+	MaxRate     int                   // Bytes per second forwarded for all sessions
+	paths       map[string]*relayPath // Paths by synthetic endpoint
+	next        uint32                // Last allocated synthetic address
+	sessions    map[string]time.Time  // Relayed pairs of peers by last use
+	tokens      float64               // Bytes that can be forwarded now
+	refilled    time.Time             // When tokens were refilled last time
+	forwarded   uint64                // Messages forwarded to other peers
+	dropped     uint64                // Messages dropped by limits
+	lock        sync.Mutex
+}
+
+func (r *RelayManager) init() {
+	r.MaxSessions = RelayDefaultSessions
+	r.MaxRate = RelayDefaultRate
+	r.paths = make(map[string]*relayPath)
+	r.sessions = make(map[string]time.Time)
+}
+
+// isRelayAddr returns true if the address is a synthetic endpoint of relay path
+func isRelayAddr(addr *net.UDPAddr) bool {
+	return addr != nil && relayNetwork.Contains(addr.IP)
+}
+
+// path returns synthetic endpoint of the path, allocating one if needed
+func (r *RelayManager) path(relay, peer string) *net.UDPAddr {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, path := range r.paths {
+		if path.relay == relay && path.peer == peer {
+			return path.addr
+		}
+	}
+	r.next++
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(relayNetwork.IP)|r.next&0x0fffffff)
+	addr := &net.UDPAddr{IP: ip, Port: 1}
+	r.paths[addr.String()] = &relayPath{relay: relay, peer: peer, addr: addr}
+	return addr
+}
+
+// offer records latency offered by relay. Returns synthetic endpoint of
+// the path unless another relay to the peer is faster
+func (r *RelayManager) offer(relay, peer string, latency time.Duration) *net.UDPAddr {
+	addr := r.path(relay, peer)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, path := range r.paths {
+		if path.peer == peer && path.relay != relay && path.latency > 0 && path.latency < latency {
+			return nil
+		}
+	}
+	r.paths[addr.String()].latency = latency
+	return addr
+}
+
+// lookup returns path with the synthetic endpoint
+func (r *RelayManager) lookup(addr *net.UDPAddr) (relayPath, bool) {
+	if r == nil || !isRelayAddr(addr) {
+		return relayPath{}, false
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	path, exists := r.paths[addr.String()]
+	if !exists {
+		return relayPath{}, false
+	}
+	return *path, true
+}
+
+// pathsTo returns synthetic endpoints of paths to the peer
+func (r *RelayManager) pathsTo(peer string) []*net.UDPAddr {
+	result := []*net.UDPAddr{}
+	if r == nil {
+		return result
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, path := range r.paths {
+		if path.peer == peer {
+			result = append(result, path.addr)
+		}
+	}
+	return result
+}
+
+// forget removes paths and sessions of the peer
+func (r *RelayManager) forget(id string) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for key, path := range r.paths {
+		if path.relay == id || path.peer == id {
+			delete(r.paths, key)
+		}
+	}
+	for key := range r.sessions {
+		if key[:36] == id || key[36:] == id {
+			delete(r.sessions, key)
+		}
+	}
+}
+
+func relaySession(a, b string) string {
+	if a > b {
+		return b + a
+	}
+	return a + b
+}
+
+// expire releases idle sessions. Must be called under lock
+func (r *RelayManager) expire(now time.Time) {
+	for key, used := range r.sessions {
+		if now.Sub(used) > RelaySessionTimeout {
+			delete(r.sessions, key)
+		}
+	}
+}
+
+// canRelay returns true if the pair of peers is relayed already or there
+// is a room for another session
+func (r *RelayManager) canRelay(src, dst string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.Enabled {
+		return false
+	}
+	r.expire(time.Now())
+	_, exists := r.sessions[relaySession(src, dst)]
+	return exists || len(r.sessions) < r.MaxSessions
+}
+
+// admit checks limits before forwarding a message of the given size
+func (r *RelayManager) admit(src, dst string, size int) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.Enabled {
+		return false
+	}
+	now := time.Now()
+	r.expire(now)
+	key := relaySession(src, dst)
+	if _, exists := r.sessions[key]; !exists && len(r.sessions) >= r.MaxSessions {
+		r.dropped++
+		return false
+	}
+	if r.refilled.IsZero() {
+		r.tokens = float64(r.MaxRate)
+	} else {
+		r.tokens += now.Sub(r.refilled).Seconds() * float64(r.MaxRate)
+		if r.tokens > float64(r.MaxRate) {
+			r.tokens = float64(r.MaxRate)
+		}
+	}
+	r.refilled = now
+	if r.tokens < float64(size) {
+		r.dropped++
+		return false
+	}
+	r.tokens -= float64(size)
+	r.sessions[key] = now
+	r.forwarded++
+	return true
+}
+
+// String returns relay state for debug output
+func (r *RelayManager) String() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	paths := []string{}
+	for _, path := range r.paths {
+		paths = append(paths, path.peer+" via "+path.relay)
+	}
+	sort.Strings(paths)
+	result := "disabled"
+	if r.Enabled {
+		r.expire(time.Now())
+		result = fmt.Sprintf("sessions %d/%d, forwarded %d, dropped %d", len(r.sessions), r.MaxSessions, r.forwarded, r.dropped)
+	}
+	if len(paths) > 0 {
+		result += fmt.Sprintf(", paths: %v", paths)
+	}
+	return result
+}
+
+func encodeRelay(kind byte, dst, src string, data []byte) []byte {
+	result := make([]byte, relayHeaderSize, relayHeaderSize+len(data))
+	result[0] = kind
+	copy(result[1:37], dst)
+	copy(result[37:73], src)
+	return append(result, data...)
+}
+
+func decodeRelay(data []byte) (byte, string, string, []byte, error) {
+	if len(data) < relayHeaderSize {
+		return 0, "", "", nil, fmt.Errorf("Relay message is too short: %d bytes", len(data))
+	}
+	kind := data[0]
+	if kind < relayQuery || kind > relayData {
+		return 0, "", "", nil, fmt.Errorf("Unknown relay message: %d", kind)
+	}
+	return kind, string(data[1:37]), string(data[37:73]), data[relayHeaderSize:], nil
+}
+
+// EnableRelay allows this instance to relay traffic between other peers
+func (p *PeerToPeer) EnableRelay(sessions, rate int) {
+	p.Relays.lock.Lock()
+	defer p.Relays.lock.Unlock()
+	p.Relays.Enabled = true
+	p.Relays.MaxSessions = sessions
+	p.Relays.MaxRate = rate
+	Log(Info, "Relaying traffic of peers: %d sessions, %d bytes/s", sessions, rate)
+}
+
+// RelayOf returns ID of the peer relaying the endpoint or empty string
+// if endpoint isn't a relay path
+func (p *PeerToPeer) RelayOf(addr *net.UDPAddr) string {
+	path, _ := p.Relays.lookup(addr)
+	return path.relay
+}
+
+// relayEndpoint returns endpoint of connected peer that can be used to relay
+func relayEndpoint(peer *NetworkPeer) *net.UDPAddr {
+	if peer == nil || peer.GetState() != PeerStateConnected {
+		return nil
+	}
+	endpoint := peer.GetEndpoint()
+	if endpoint == nil || isRelayAddr(endpoint) {
+		return nil
+	}
+	return endpoint
+}
+
+// endpointRTT returns RTT of the peer endpoint
+func endpointRTT(peer *NetworkPeer, addr *net.UDPAddr) time.Duration {
+	for _, ep := range peer.GetEndpoints() {
+		if ep.Addr.String() == addr.String() && ep.RTT > 0 {
+			return ep.RTT
+		}
+	}
+	return EndpointUnmeasuredRTT
+}
+
+// sendRelay sends relay message to the endpoint of relaying peer
+func (p *PeerToPeer) sendRelay(kind byte, dst, src string, data []byte, addr *net.UDPAddr) (int, error) {
+	msg, err := p.CreateMessage(MsgTypeRelay, encodeRelay(kind, dst, src, data), 0, true)
+	if err != nil {
+		return 0, err
+	}
+	return p.sendMessage(msg, addr)
+}
+
+// sendRelayed wraps message to the relay path and sends it to the relay
+func (p *PeerToPeer) sendRelayed(msg *P2PMessage, addr *net.UDPAddr) (int, error) {
+	path, exists := p.Relays.lookup(addr)
+	if !exists {
+		return 0, fmt.Errorf("Unknown relay path %s", addr.String())
+	}
+	endpoint := relayEndpoint(p.Peers.GetPeer(path.relay))
+	if endpoint == nil {
+		return 0, fmt.Errorf("Relay %s is not connected", path.relay)
+	}
+	return p.sendRelay(relayData, path.peer, p.Dht.ID, msg.Serialize(), endpoint)
+}
+
+// requestRelays asks connected peers whether they can relay to the peer
+func (p *PeerToPeer) requestRelays(peer *NetworkPeer) {
+	for id, relay := range p.Peers.Get() {
+		if id == peer.ID {
+			continue
+		}
+		endpoint := relayEndpoint(relay)
+		if endpoint == nil {
+			continue
+		}
+		_, err := p.sendRelay(relayQuery, peer.ID, p.Dht.ID, nil, endpoint)
+		if err != nil {
+			Log(Debug, "Failed to ask %s for relay: %s", id, err)
+		}
+	}
+}
+
+// HandleRelayMessage handles queries, offers and messages forwarded over relays
+func (p *PeerToPeer) HandleRelayMessage(msg *P2PMessage, srcAddr *net.UDPAddr) {
+	if isRelayAddr(srcAddr) {
+		Log(Debug, "Dropping relay message received over relay")
+		return
+	}
+	kind, dst, src, data, err := decodeRelay(msg.Data)
+	if err != nil {
+		Log(Debug, "%s", err)
+		return
+	}
+	from := p.Peers.GetPeer(src)
+	if from == nil {
+		Log(Debug, "Relay message from unknown peer %s", src)
+		return
+	}
+	switch {
+	case kind == relayQuery:
+		p.handleRelayQuery(from, dst, srcAddr)
+	case kind == relayOffer:
+		p.handleRelayOffer(from, dst, data, srcAddr)
+	case kind == relayData && dst == p.Dht.ID:
+		p.handleRelayed(src, data, srcAddr)
+	case kind == relayData:
+		p.forwardRelayed(from, dst, data, srcAddr)
+	}
+}
+
+func (p *PeerToPeer) handleRelayQuery(from *NetworkPeer, dst string, srcAddr *net.UDPAddr) {
+	if !from.isEndpointActive(srcAddr) {
+		return
+	}
+	to := p.Peers.GetPeer(dst)
+	endpoint := relayEndpoint(to)
+	if endpoint == nil {
+		return
+	}
+	if !p.Relays.canRelay(from.ID, dst) {
+		Log(Debug, "Can't relay from %s to %s: all sessions are busy", from.ID, dst)
+		return
+	}
+	rtt := make([]byte, 4)
+	binary.BigEndian.PutUint32(rtt, uint32(endpointRTT(to, endpoint)/time.Microsecond))
+	_, err := p.sendRelay(relayOffer, dst, p.Dht.ID, rtt, srcAddr)
+	if err != nil {
+		Log(Debug, "Failed to send relay offer to %s: %s", from.ID, err)
+	}
+}
+
+func (p *PeerToPeer) handleRelayOffer(relay *NetworkPeer, dst string, data []byte, srcAddr *net.UDPAddr) {
+	if len(data) < 4 || !relay.isEndpointActive(srcAddr) {
+		return
+	}
+	peer := p.Peers.GetPeer(dst)
+	if peer == nil {
+		return
+	}
+	for _, ep := range peer.GetEndpoints() {
+		if !isRelayAddr(ep.Addr) {
+			// Peer became reachable without relay
+			return
+		}
+	}
+	latency := time.Duration(binary.BigEndian.Uint32(data))*time.Microsecond + endpointRTT(relay, srcAddr)
+	addr := p.Relays.offer(relay.ID, dst, latency)
+	if addr == nil {
+		return
+	}
+	Log(Info, "Peer %s offers relay to %s with latency %s", relay.ID, dst, latency)
+	msg, err := p.CreateMessage(MsgTypeIntroReq, []byte(p.Dht.ID+addr.String()), 0, true)
+	if err != nil {
+		Log(Error, "Couldn't create an intro message: %s", err)
+		return
+	}
+	_, err = p.sendMessage(msg, addr)
+	if err != nil {
+		Log(Debug, "Failed to send introduction over relay %s: %s", relay.ID, err)
+	}
+}
+
+// handleRelayed passes message forwarded by relay to the handlers as if
+// it was received from the relay path
+func (p *PeerToPeer) handleRelayed(src string, data []byte, srcAddr *net.UDPAddr) {
+	var relay *NetworkPeer
+	for _, peer := range p.Peers.Get() {
+		if peer.isEndpointActive(srcAddr) {
+			relay = peer
+			break
+		}
+	}
+	if relay == nil || relay.ID == src {
+		Log(Debug, "Relayed message from %s came from unknown endpoint %s", src, srcAddr.String())
+		return
+	}
+	p.HandleP2PMessage(len(data), p.Relays.path(relay.ID, src), nil, data)
+}
+
+// forwardRelayed passes message to the destination peer
+func (p *PeerToPeer) forwardRelayed(from *NetworkPeer, dst string, data []byte, srcAddr *net.UDPAddr) {
+	if !from.isEndpointActive(srcAddr) {
+		return
+	}
+	endpoint := relayEndpoint(p.Peers.GetPeer(dst))
+	if endpoint == nil {
+		return
+	}
+	if !p.Relays.admit(from.ID, dst, len(data)) {
+		Log(Trace, "Relayed message from %s to %s was dropped by limits", from.ID, dst)
+		return
+	}
+	_, err := p.sendRelay(relayData, dst, from.ID, data, endpoint)
+	if err != nil {
+		Log(Debug, "Failed to relay message to %s: %s", dst, err)
+	}
+}
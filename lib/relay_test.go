@@ -0,0 +1,160 @@
+package ptp
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRelayEncoding(t *testing.T) {
+	dst := fmt.Sprintf("%036d", 1)
+	src := fmt.Sprintf("%036d", 2)
+	kind, d, s, data, err := decodeRelay(encodeRelay(relayData, dst, src, []byte("frame")))
+	if err != nil || kind != relayData || d != dst || s != src || string(data) != "frame" {
+		t.Errorf("Wrong decoded message: %d %s %s %s %v", kind, d, s, data, err)
+	}
+	if _, _, _, _, err := decodeRelay([]byte{relayQuery}); err == nil {
+		t.Errorf("Short relay message was accepted")
+	}
+	if _, _, _, _, err := decodeRelay(encodeRelay(42, dst, src, nil)); err == nil {
+		t.Errorf("Unknown relay message was accepted")
+	}
+}
+
+func TestRelayPaths(t *testing.T) {
+	r := new(RelayManager)
+	r.init()
+	a := r.path("relay-a", "peer")
+	if !isRelayAddr(a) || a.String() != r.path("relay-a", "peer").String() {
+		t.Fatalf("Wrong relay path: %s", a)
+	}
+	if isRelayAddr(&net.UDPAddr{IP: net.ParseIP("203.0.113.5"), Port: 1}) {
+		t.Errorf("Public address was taken for relay path")
+	}
+	if classify(a, nil) != EndpointRelay {
+		t.Errorf("Wrong class of relay path: %s", classify(a, nil))
+	}
+
+	// Slower relay isn't used when faster one is known
+	if r.offer("relay-a", "peer", time.Millisecond*20) == nil {
+		t.Errorf("First relay offer was rejected")
+	}
+	if r.offer("relay-b", "peer", time.Millisecond*50) != nil {
+		t.Errorf("Slower relay offer was accepted")
+	}
+	if b := r.offer("relay-b", "peer", time.Millisecond*10); b == nil || b.String() == a.String() {
+		t.Errorf("Faster relay offer was rejected: %v", b)
+	}
+	if path, exists := r.lookup(a); !exists || path.relay != "relay-a" || path.peer != "peer" {
+		t.Errorf("Wrong path lookup: %v", path)
+	}
+	if len(r.pathsTo("peer")) != 2 {
+		t.Errorf("Wrong paths to peer: %v", r.pathsTo("peer"))
+	}
+	r.forget("relay-a")
+	if _, exists := r.lookup(a); exists || len(r.pathsTo("peer")) != 1 {
+		t.Errorf("Paths over removed relay weren't forgotten")
+	}
+}
+
+func TestRelayLimits(t *testing.T) {
+	r := new(RelayManager)
+	r.init()
+	a := fmt.Sprintf("%036d", 1)
+	b := fmt.Sprintf("%036d", 2)
+	c := fmt.Sprintf("%036d", 3)
+	if r.canRelay(a, b) || r.admit(a, b, 10) {
+		t.Errorf("Disabled relay forwarded a message")
+	}
+	r.Enabled = true
+	r.MaxSessions = 1
+	r.MaxRate = 100
+	if !r.admit(a, b, 60) || !r.admit(b, a, 40) {
+		t.Errorf("Message within limits was dropped")
+	}
+	if r.admit(a, b, 10) {
+		t.Errorf("Message over rate limit was forwarded")
+	}
+	if r.canRelay(a, c) || !r.canRelay(b, a) {
+		t.Errorf("Wrong session limit")
+	}
+	r.sessions[relaySession(a, b)] = time.Now().Add(-RelaySessionTimeout * 2)
+	if !r.canRelay(a, c) {
+		t.Errorf("Idle session wasn't released")
+	}
+	if s := r.String(); s != "sessions 0/1, forwarded 2, dropped 1" {
+		t.Errorf("Wrong relay state: %s", s)
+	}
+}
+
+// relayPeer adds connected peer with the endpoint
+func relayPeer(ptpc *PeerToPeer, id string, endpoint *net.UDPAddr) {
+	np := &NetworkPeer{ID: id, State: PeerStateConnected, Endpoint: endpoint}
+	np.Endpoints = []PeerEndpoint{{Addr: endpoint, LastContact: time.Now()}}
+	ptpc.Peers.Update(id, np)
+}
+
+func TestRelayForwarding(t *testing.T) {
+	ptpc := new(PeerToPeer)
+	ptpc.Init()
+	ptpc.Dht = new(DHTClient)
+	ptpc.Dht.ID = fmt.Sprintf("%036d", 0)
+	ptpc.UDPSocket = new(Network)
+	err := ptpc.UDPSocket.Init("127.0.0.1", 0)
+	if err != nil {
+		t.Fatalf("Failed to create socket: %s", err)
+	}
+	defer ptpc.UDPSocket.Stop()
+	remote, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("Failed to create socket: %s", err)
+	}
+	defer remote.Close()
+	receive := func() (byte, string, string, []byte) {
+		remote.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 1500)
+		n, _, err := remote.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("Message wasn't received: %s", err)
+		}
+		msg, err := P2PMessageFromBytes(buf[:n])
+		if err != nil || msg.Header.Type != MsgTypeRelay {
+			t.Fatalf("Wrong message received: %v %v", msg, err)
+		}
+		kind, dst, src, data, err := decodeRelay(msg.Data)
+		if err != nil {
+			t.Fatalf("Failed to decode relay message: %s", err)
+		}
+		return kind, dst, src, data
+	}
+	relay := fmt.Sprintf("%036d", 1)
+	peer := fmt.Sprintf("%036d", 2)
+	relayPeer(ptpc, relay, remote.LocalAddr().(*net.UDPAddr))
+
+	// Message to relay path is wrapped and sent to the relay
+	msg, _ := CreateMessageStatic(MsgTypeNenc, []byte("frame"))
+	if _, err := ptpc.sendMessage(msg, ptpc.Relays.path(relay, peer)); err != nil {
+		t.Fatalf("Failed to send message over relay: %s", err)
+	}
+	kind, dst, src, data := receive()
+	inner, err := P2PMessageFromBytes(data)
+	if kind != relayData || dst != peer || src != ptpc.Dht.ID || err != nil || string(inner.Data) != "frame" {
+		t.Errorf("Wrong relayed message: %d %s %s %v", kind, dst, src, err)
+	}
+
+	// Relay forwards message of one peer to another connected peer
+	sender := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}
+	relayPeer(ptpc, peer, sender)
+	forwarded, _ := CreateMessageStatic(MsgTypeRelay, encodeRelay(relayData, relay, peer, data))
+	ptpc.HandleRelayMessage(forwarded, sender)
+	ptpc.Relays.Enabled = true
+	ptpc.HandleRelayMessage(forwarded, sender)
+	kind, dst, src, _ = receive()
+	if kind != relayData || dst != relay || src != peer {
+		t.Errorf("Wrong forwarded message: %d %s %s", kind, dst, src)
+	}
+	if s := ptpc.Relays.String(); s[:35] != "sessions 1/16, forwarded 1, dropped" {
+		t.Errorf("Wrong relay state: %s", s)
+	}
+}
@@ -0,0 +1,251 @@
+package ptp
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Peers may advertise networks located behind them (e.g. office LAN).
+// Advertised networks are installed as routes on the local interface with
+// the peer's overlay IP as a gateway and forwarding path picks the next-hop
+// peer by the longest prefix match
+
+type route struct {
+	Network *net.IPNet
+	ID      string // ID of a peer which advertised this network
+}
+
+// RouteTable stores networks advertised by peers
+type RouteTable struct {
+	routes []*route // Sorted by prefix length, longest first
+	lock   sync.RWMutex
+}
+
+// Init will initialize route table
+func (t *RouteTable) Init() {
+	t.routes = []*route{}
+}
+
+// set replaces list of networks advertised by specified peer. Network
+// that is already routed via another peer is kept with that peer.
+// Returns networks that has been added and removed
+func (t *RouteTable) set(id string, networks []*net.IPNet) ([]*net.IPNet, []*net.IPNet) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	added := []*net.IPNet{}
+	removed := []*net.IPNet{}
+	wanted := make(map[string]*net.IPNet)
+	for _, network := range networks {
+		wanted[network.String()] = network
+	}
+	routes := []*route{}
+	for _, r := range t.routes {
+		_, keep := wanted[r.Network.String()]
+		if r.ID == id && !keep {
+			removed = append(removed, r.Network)
+			continue
+		}
+		if keep {
+			if r.ID != id {
+				// Route stays with the first peer, so two peers advertising
+				// the same network don't take it from each other
+				Log(Warning, "Ignoring network %s advertised by %s: it's routed via peer %s", r.Network.String(), id, r.ID)
+			}
+			delete(wanted, r.Network.String())
+		}
+		routes = append(routes, r)
+	}
+	for _, network := range networks {
+		if _, exists := wanted[network.String()]; !exists {
+			continue
+		}
+		delete(wanted, network.String())
+		routes = append(routes, &route{Network: network, ID: id})
+		added = append(added, network)
+	}
+	sort.SliceStable(routes, func(i, j int) bool {
+		a, _ := routes[i].Network.Mask.Size()
+		b, _ := routes[j].Network.Mask.Size()
+		return a > b
+	})
+	t.routes = routes
+	return added, removed
+}
+
+// forget removes every network advertised by specified peer
+func (t *RouteTable) forget(id string) []*net.IPNet {
+	_, removed := t.set(id, nil)
+	return removed
+}
+
+// lookup returns ID of a peer which advertised the most specific
+// network containing specified address
+func (t *RouteTable) lookup(ip net.IP) (string, bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	for _, r := range t.routes {
+		if r.Network.Contains(ip) {
+			return r.ID, true
+		}
+	}
+	return "", false
+}
+
+// Get returns copy of the table in a form of Network -> Peer ID
+func (t *RouteTable) Get() map[string]string {
+	result := make(map[string]string)
+	t.lock.RLock()
+	for _, r := range t.routes {
+		result[r.Network.String()] = r.ID
+	}
+	t.lock.RUnlock()
+	return result
+}
+
+// ParseRoutes parses list of networks in CIDR notation
+// separated by specified separator
+func ParseRoutes(list, separator string) ([]*net.IPNet, error) {
+	result := []*net.IPNet{}
+	for _, cidr := range strings.Split(list, separator) {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse network %s: %s", cidr, err)
+		}
+		result = append(result, network)
+	}
+	return result, nil
+}
+
+// StringifyRoutes joins list of networks with specified separator
+func StringifyRoutes(networks []*net.IPNet, separator string) string {
+	result := []string{}
+	for _, network := range networks {
+		result = append(result, network.String())
+	}
+	return strings.Join(result, separator)
+}
+
+// updatePeerRoutes installs networks advertised by a peer on the
+// local interface and removes ones that are no longer advertised
+func (p *PeerToPeer) updatePeerRoutes(id string, gateway net.IP, networks []*net.IPNet) {
+	accepted := []*net.IPNet{}
+	for _, network := range networks {
+		if isDefaultRoute(network) {
+			// Default route is accepted only from the chosen exit node
+			if id == p.ExitNode && !p.ExitGateway {
+				accepted = append(accepted, network)
+			}
+			continue
+		}
+		if p.isLocalRoute(network) {
+			continue
+		}
+		if reason := p.routeConflict(network); reason != "" {
+			Log(Warning, "Ignoring network %s advertised by %s: it overlaps %s", network.String(), id, reason)
+			continue
+		}
+		accepted = append(accepted, network)
+	}
+	added, removed := p.RouteTable.set(id, accepted)
+	for _, network := range removed {
+		p.delPeerRoute(network, gateway)
+	}
+	for _, network := range added {
+		Log(Info, "Adding route to %s via peer %s", network.String(), id)
+		if isDefaultRoute(network) {
+			err := p.useExitNode(gateway)
+			if err != nil {
+				Log(Error, "Failed to use exit node %s: %s", id, err)
+			}
+			continue
+		}
+		err := p.Interface.AddRoute(network, gateway)
+		if err != nil {
+			Log(Error, "Failed to add route to %s: %s", network.String(), err)
+		}
+	}
+}
+
+// delPeerRoute removes route installed for a network of a peer
+func (p *PeerToPeer) delPeerRoute(network *net.IPNet, gateway net.IP) {
+	if isDefaultRoute(network) {
+		p.releaseExitNode()
+		return
+	}
+	err := p.Interface.DelRoute(network, gateway)
+	if err != nil {
+		Log(Error, "Failed to remove route to %s: %s", network.String(), err)
+	}
+}
+
+// removePeerRoutes removes every route installed for specified peer
+func (p *PeerToPeer) removePeerRoutes(id string, gateway net.IP) {
+	for _, network := range p.RouteTable.forget(id) {
+		p.delPeerRoute(network, gateway)
+	}
+}
+
+func networksOverlap(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// routeConflict checks whether network advertised by a peer would take
+// over traffic that must not go through the overlay: networks of local
+// interfaces, the overlay subnet itself and underlay addresses of
+// bootstrap nodes, proxies and peers. Returns description of the
+// conflict or empty string
+func (p *PeerToPeer) routeConflict(network *net.IPNet) string {
+	if p.Interface != nil && p.Interface.GetIP() != nil && p.Interface.GetMask() != nil {
+		mask := p.Interface.GetMask()
+		overlay := &net.IPNet{IP: p.Interface.GetIP().Mask(mask), Mask: mask}
+		if networksOverlap(network, overlay) {
+			return "overlay network " + overlay.String()
+		}
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err == nil {
+		for _, addr := range addrs {
+			local, ok := addr.(*net.IPNet)
+			if ok && networksOverlap(network, local) {
+				return "local network " + local.String()
+			}
+		}
+	}
+	for _, ip := range p.underlayAddresses() {
+		if network.Contains(ip) {
+			return "underlay address " + ip.String()
+		}
+	}
+	return ""
+}
+
+// isLocalRoute returns true if network is advertised by this instance
+func (p *PeerToPeer) isLocalRoute(network *net.IPNet) bool {
+	for _, local := range p.Routes {
+		if local.String() == network.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// routedPeer returns a peer which advertised network containing
+// specified address
+func (p *PeerToPeer) routedPeer(dst net.IP) *NetworkPeer {
+	id, exists := p.RouteTable.lookup(dst)
+	if !exists {
+		return nil
+	}
+	peer := p.Peers.GetPeer(id)
+	if peer == nil || peer.GetEndpoint() == nil {
+		return nil
+	}
+	return peer
+}
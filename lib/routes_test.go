@@ -0,0 +1,91 @@
+package ptp
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseRoutes(t *testing.T) {
+	routes, err := ParseRoutes("10.0.0.0/8, 192.168.1.0/24,", ",")
+	if err != nil || len(routes) != 2 {
+		t.Fatalf("Failed to parse routes: %v", err)
+	}
+	if StringifyRoutes(routes, ";") != "10.0.0.0/8;192.168.1.0/24" {
+		t.Errorf("Wrong routes: %s", StringifyRoutes(routes, ";"))
+	}
+	_, err = ParseRoutes("10.0.0.0/33", ",")
+	if err == nil {
+		t.Error("Malformed network was accepted")
+	}
+}
+
+func TestRouteTableLookup(t *testing.T) {
+	table := new(RouteTable)
+	table.Init()
+	wide, _ := ParseRoutes("10.0.0.0/8", ",")
+	narrow, _ := ParseRoutes("10.1.0.0/16,10.1.2.0/24", ",")
+	table.set("a", wide)
+	table.set("b", narrow)
+	cases := map[string]string{"10.2.0.1": "a", "10.1.0.1": "b", "10.1.2.3": "b"}
+	for ip, wait := range cases {
+		id, exists := table.lookup(net.ParseIP(ip))
+		if !exists || id != wait {
+			t.Errorf("Wrong peer for %s: %s", ip, id)
+		}
+	}
+	if _, exists := table.lookup(net.ParseIP("192.168.0.1")); exists {
+		t.Error("Route found for unknown network")
+	}
+}
+
+func TestRouteTableSet(t *testing.T) {
+	table := new(RouteTable)
+	table.Init()
+	first, _ := ParseRoutes("10.0.0.0/8,172.16.0.0/12", ",")
+	added, removed := table.set("a", first)
+	if len(added) != 2 || len(removed) != 0 {
+		t.Errorf("Wrong changes: +%d -%d", len(added), len(removed))
+	}
+	added, removed = table.set("a", first)
+	if len(added) != 0 || len(removed) != 0 {
+		t.Errorf("Repeated advertisement produced changes: +%d -%d", len(added), len(removed))
+	}
+	second, _ := ParseRoutes("10.0.0.0/8", ",")
+	added, removed = table.set("a", second)
+	if len(added) != 0 || len(removed) != 1 || removed[0].String() != "172.16.0.0/12" {
+		t.Errorf("Wrong changes: +%d -%d", len(added), len(removed))
+	}
+	added, removed = table.set("b", second)
+	if len(added) != 0 || len(removed) != 0 || table.Get()["10.0.0.0/8"] != "a" {
+		t.Errorf("Network moved to another peer: +%d -%d", len(added), len(removed))
+	}
+	removed = table.forget("a")
+	if len(removed) != 1 || len(table.Get()) != 0 {
+		t.Error("Routes were not forgotten")
+	}
+	added, _ = table.set("b", second)
+	if len(added) != 1 || table.Get()["10.0.0.0/8"] != "b" {
+		t.Error("Network of forgotten peer wasn't taken by another peer")
+	}
+}
+
+func TestRouteConflict(t *testing.T) {
+	ptpc := new(PeerToPeer)
+	ptpc.Peers = new(PeerList)
+	ptpc.Peers.Init()
+	addr, _ := net.ResolveUDPAddr("udp4", "203.0.113.5:6881")
+	np := &NetworkPeer{ID: "peer"}
+	np.addEndpoint(addr)
+	ptpc.Peers.Update(np.ID, np)
+	ptpc.StaticPeers = []*net.UDPAddr{{IP: net.ParseIP("192.0.2.10"), Port: 6881}}
+	conflicts, _ := ParseRoutes("127.1.0.0/16,0.0.0.0/1,203.0.113.0/24,192.0.2.0/24", ",")
+	for _, network := range conflicts {
+		if ptpc.routeConflict(network) == "" {
+			t.Errorf("Conflicting network was accepted: %s", network.String())
+		}
+	}
+	clean, _ := ParseRoutes("198.51.100.0/24", ",")
+	if reason := ptpc.routeConflict(clean[0]); reason != "" {
+		t.Errorf("Network was rejected: %s", reason)
+	}
+}
@@ -0,0 +1,225 @@
+package ptp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Static peers are configured by address and don't depend on bootstrap
+// nodes. Introduction requests are sent to every static address that has
+// no peer yet. Peer that introduces itself from a static address is added
+// to the list and connects with the usual hole punching and handshake,
+// skipping DHT requests of addresses, proxies and remote state. Peer ID
+// is bound to the static address only when it's signed with the swarm key
+
+// StaticProofMaxSkew limits age of accepted proofs of static peer ID
+const StaticProofMaxSkew = time.Minute
+
+// StaticProbeInterval is how often static addresses without peers are probed
+const StaticProbeInterval = time.Second * 5
+
+// StaticPeersConfig is a static peers section of the daemon config
+type StaticPeersConfig struct {
+	StaticPeers map[string][]string `yaml:"static-peers"` // Addresses of static peers by hash
+}
+
+// ParseStaticPeers reads comma-separated list of host:port addresses
+func ParseStaticPeers(list string) ([]*net.UDPAddr, error) {
+	result := []*net.UDPAddr{}
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		addr, err := net.ResolveUDPAddr("udp4", item)
+		if err != nil {
+			return nil, fmt.Errorf("Bad static peer %s: %s", item, err)
+		}
+		if addr.Port == 0 {
+			return nil, fmt.Errorf("Port of static peer %s is not specified", item)
+		}
+		result = appendUniqueAddr(result, addr)
+	}
+	return result, nil
+}
+
+// LoadStaticPeers returns static peers of the swarm from the daemon config
+// followed by the ones specified on start
+func LoadStaticPeers(configPath, hash, list string) ([]*net.UDPAddr, error) {
+	result := []*net.UDPAddr{}
+	data, err := ioutil.ReadFile(configPath)
+	if err == nil {
+		config := &StaticPeersConfig{}
+		err = yaml.Unmarshal(data, config)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse static peers config: %s", err)
+		}
+		configured, err := ParseStaticPeers(strings.Join(config.StaticPeers[hash], ","))
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, configured...)
+	}
+	specified, err := ParseStaticPeers(list)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range specified {
+		result = appendUniqueAddr(result, addr)
+	}
+	return result, nil
+}
+
+// HasStaticPeers returns true if the daemon config lists static peers
+// of any swarm
+func HasStaticPeers(configPath string) bool {
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return false
+	}
+	config := &StaticPeersConfig{}
+	if yaml.Unmarshal(data, config) != nil {
+		return false
+	}
+	for _, peers := range config.StaticPeers {
+		if len(peers) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func appendUniqueAddr(list []*net.UDPAddr, addr *net.UDPAddr) []*net.UDPAddr {
+	for _, a := range list {
+		if a.String() == addr.String() {
+			return list
+		}
+	}
+	return append(list, addr)
+}
+
+// matchStatic returns static address the message came from
+func (p *PeerToPeer) matchStatic(src *net.UDPAddr) *net.UDPAddr {
+	if src == nil {
+		return nil
+	}
+	for _, addr := range p.StaticPeers {
+		if addr.String() == src.String() {
+			return addr
+		}
+	}
+	return nil
+}
+
+// staticProof signs ID of the peer with time, so the peer can be added
+// from a static address only by members of the swarm
+func staticProof(key []byte, id string, sent time.Time) string {
+	data := make([]byte, 8, 8+sha256.Size)
+	binary.BigEndian.PutUint64(data, uint64(sent.UnixNano()))
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(id))
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(data))
+}
+
+// verifyStaticProof checks that proof signs ID of the peer and is fresh
+func verifyStaticProof(key []byte, id, proof string, now time.Time) error {
+	data, err := hex.DecodeString(proof)
+	if err != nil || len(data) != 8+sha256.Size {
+		return fmt.Errorf("Malformed proof")
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(id))
+	mac.Write(data[:8])
+	if !hmac.Equal(mac.Sum(nil), data[8:]) {
+		return fmt.Errorf("Signature mismatch")
+	}
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64(data[:8])))
+	if skew := now.Sub(sent); skew > StaticProofMaxSkew || skew < -StaticProofMaxSkew {
+		return fmt.Errorf("Proof is outdated: sent at %s", sent)
+	}
+	return nil
+}
+
+// splitIntroRequest returns endpoint of introduction request and proof
+// of the sender ID that is appended to requests sent to static addresses
+func splitIntroRequest(data string) (string, string) {
+	parts := strings.SplitN(data, ",auth=", 2)
+	if len(parts) != 2 {
+		return data, ""
+	}
+	return parts[0], parts[1]
+}
+
+// addStaticPeer adds peer that introduced itself from a static address
+// with a valid proof of its ID
+func (p *PeerToPeer) addStaticPeer(id, proof string, src *net.UDPAddr) *NetworkPeer {
+	addr := p.matchStatic(src)
+	if addr == nil || len(id) != 36 || id == p.Dht.ID {
+		return nil
+	}
+	peer := p.Peers.GetPeer(id)
+	if peer != nil {
+		return peer
+	}
+	key, _ := p.authKey()
+	if err := verifyStaticProof(key, id, proof, time.Now()); err != nil {
+		Log(Debug, "Introduction of %s from static address %s was rejected: %s", id, src.String(), err)
+		return nil
+	}
+	Log(Info, "Adding static peer %s at %s", id, src.String())
+	peer = new(NetworkPeer)
+	peer.ID = id
+	peer.Static = true
+	peer.KnownIPs = []*net.UDPAddr{addr}
+	peer.transition(PeerStateInit, "Introduced from static address "+src.String(), p)
+	peer.found()
+	p.Peers.Update(id, peer)
+	p.Peers.RunPeer(id, p)
+	return peer
+}
+
+// probeStaticPeers sends introduction requests to static addresses
+// that don't belong to any known peer
+func (p *PeerToPeer) probeStaticPeers() {
+	if len(p.StaticPeers) == 0 || time.Since(p.lastStaticProbe) < StaticProbeInterval {
+		return
+	}
+	p.lastStaticProbe = time.Now()
+	key, _ := p.authKey()
+	known := []*net.UDPAddr{}
+	for _, peer := range p.Peers.Get() {
+		known = append(known, peer.GetKnownIPs()...)
+	}
+	for _, addr := range p.StaticPeers {
+		found := false
+		for _, k := range known {
+			if k.String() == addr.String() {
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+		Log(Debug, "Probing static peer at %s", addr.String())
+		msg, err := p.CreateMessage(MsgTypeIntroReq, []byte(p.Dht.ID+addr.String()+",auth="+staticProof(key, p.Dht.ID, time.Now())), 0, true)
+		if err != nil {
+			Log(Error, "Couldn't create an intro message: %s", err)
+			continue
+		}
+		_, err = p.sendMessage(msg, addr)
+		if err != nil {
+			Log(Debug, "Failed to probe static peer %s: %s", addr.String(), err)
+		}
+	}
+}
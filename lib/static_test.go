@@ -0,0 +1,128 @@
+package ptp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseStaticPeers(t *testing.T) {
+	peers, err := ParseStaticPeers("192.168.1.10:6881, 192.168.1.11:6882,192.168.1.10:6881,")
+	if err != nil {
+		t.Fatalf("Failed to parse static peers: %s", err)
+	}
+	if len(peers) != 2 || peers[0].String() != "192.168.1.10:6881" || peers[1].String() != "192.168.1.11:6882" {
+		t.Errorf("Wrong static peers: %v", peers)
+	}
+	peers, err = ParseStaticPeers("")
+	if err != nil || len(peers) != 0 {
+		t.Errorf("Empty list wasn't accepted: %v %s", peers, err)
+	}
+	for _, bad := range []string{"192.168.1.10", "192.168.1.10:0", "192.168.1.10:port"} {
+		if _, err := ParseStaticPeers(bad); err == nil {
+			t.Errorf("Bad static peer was accepted: %s", bad)
+		}
+	}
+}
+
+func TestLoadStaticPeers(t *testing.T) {
+	f, err := ioutil.TempFile("", "p2p-static")
+	if err != nil {
+		t.Fatalf("Failed to create config: %s", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("iptool: /sbin/ip\nstatic-peers:\n  swarm: [192.168.1.10:6881]\n  other: [192.168.2.10:6881]\n")
+	f.Close()
+
+	peers, err := LoadStaticPeers(f.Name(), "swarm", "192.168.1.11:6881,192.168.1.10:6881")
+	if err != nil {
+		t.Fatalf("Failed to load static peers: %s", err)
+	}
+	if len(peers) != 2 || peers[0].String() != "192.168.1.10:6881" || peers[1].String() != "192.168.1.11:6881" {
+		t.Errorf("Wrong static peers: %v", peers)
+	}
+	peers, err = LoadStaticPeers(f.Name()+".missing", "swarm", "")
+	if err != nil || len(peers) != 0 {
+		t.Errorf("Missing config wasn't ignored: %v %s", peers, err)
+	}
+	if !HasStaticPeers(f.Name()) || HasStaticPeers(f.Name()+".missing") {
+		t.Errorf("Static peers in config weren't detected")
+	}
+}
+
+func TestAddStaticPeer(t *testing.T) {
+	ptpc := new(PeerToPeer)
+	ptpc.Init()
+	ptpc.Dht = new(DHTClient)
+	ptpc.Dht.ID = fmt.Sprintf("%036d", 0)
+	ptpc.UDPSocket = new(Network)
+	err := ptpc.UDPSocket.Init("127.0.0.1", 0)
+	if err != nil {
+		t.Fatalf("Failed to create socket: %s", err)
+	}
+	defer ptpc.UDPSocket.Stop()
+	ptpc.StaticPeers, _ = ParseStaticPeers("127.0.0.2:6881")
+
+	id := fmt.Sprintf("%036d", 1)
+	key, _ := ptpc.authKey()
+	proof := staticProof(key, id, time.Now())
+	static, _ := net.ResolveUDPAddr("udp4", "127.0.0.2:6881")
+	unknown, _ := net.ResolveUDPAddr("udp4", "127.0.0.3:6881")
+	if ptpc.addStaticPeer(id, proof, unknown) != nil {
+		t.Fatalf("Peer from unknown address was added")
+	}
+	natted, _ := net.ResolveUDPAddr("udp4", "127.0.0.2:40000")
+	if ptpc.addStaticPeer(id, proof, natted) != nil {
+		t.Fatalf("Peer from other port of static address was added")
+	}
+	if ptpc.addStaticPeer(ptpc.Dht.ID, staticProof(key, ptpc.Dht.ID, time.Now()), static) != nil {
+		t.Fatalf("Own ID was added as a peer")
+	}
+	if ptpc.addStaticPeer(id, "", static) != nil {
+		t.Fatalf("Peer without proof was added")
+	}
+	if ptpc.addStaticPeer(id, staticProof([]byte("other swarm"), id, time.Now()), static) != nil {
+		t.Fatalf("Peer with proof signed by other key was added")
+	}
+	if ptpc.addStaticPeer(fmt.Sprintf("%036d", 2), proof, static) != nil {
+		t.Fatalf("Proof of other peer was accepted")
+	}
+	if ptpc.addStaticPeer(id, staticProof(key, id, time.Now().Add(-StaticProofMaxSkew*2)), static) != nil {
+		t.Fatalf("Outdated proof was accepted")
+	}
+	peer := ptpc.addStaticPeer(id, proof, static)
+	if peer == nil || !peer.Static {
+		t.Fatalf("Static peer wasn't added")
+	}
+	if ptpc.addStaticPeer(id, proof, static) != peer {
+		t.Errorf("Static peer was added twice")
+	}
+	known := peer.GetKnownIPs()
+	if len(known) != 1 || known[0].String() != "127.0.0.2:6881" {
+		t.Errorf("Wrong addresses of static peer: %v", known)
+	}
+
+	// Static peer doesn't wait for DHT and starts connecting at once
+	deadline := time.Now().Add(time.Second)
+	for peer.GetState() != PeerStateConnecting {
+		if time.Now().After(deadline) {
+			t.Fatalf("Static peer didn't start connecting: %s", StringifyState(peer.GetState()))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	stopPeer(t, peer, ptpc)
+}
+
+func TestSplitIntroRequest(t *testing.T) {
+	endpoint, proof := splitIntroRequest("192.168.1.10:6881")
+	if endpoint != "192.168.1.10:6881" || proof != "" {
+		t.Errorf("Wrong request without proof: %s %s", endpoint, proof)
+	}
+	endpoint, proof = splitIntroRequest("192.168.1.10:6881,auth=0102")
+	if endpoint != "192.168.1.10:6881" || proof != "0102" {
+		t.Errorf("Wrong request with proof: %s %s", endpoint, proof)
+	}
+}
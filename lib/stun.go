@@ -0,0 +1,386 @@
+package ptp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// STUN client discovers address and port our socket is mapped to and
+// classifies NAT with the tests of RFC 5780. Servers have to provide
+// alternate address (OTHER-ADDRESS or CHANGED-ADDRESS of RFC 3489) for
+// classification, otherwise only mapped address is reported.
+// Instance runs the client on its peer-to-peer socket, so mapped port
+// is the one other peers will see
+
+// STUN constants
+const (
+	STUNTimeout                 = time.Second * 2        // How long to wait for response
+	STUNInterval                = time.Minute * 10       // How often NAT of an instance is checked
+	stunRetransmit              = time.Millisecond * 500 // Interval of request retransmissions
+	stunCookie           uint32 = 0x2112A442
+	stunHeaderSize              = 20
+	stunBindingRequest          = 0x0001
+	stunBindingSuccess          = 0x0101
+	stunBindingError            = 0x0111
+	stunMappedAddress           = 0x0001
+	stunChangeRequest           = 0x0003
+	stunChangedAddress          = 0x0005
+	stunXorMappedAddress        = 0x0020
+	stunOtherAddress            = 0x802C
+	stunChangeIP                = 0x04
+	stunChangePort              = 0x02
+)
+
+// DefaultSTUNServers are used when servers are not configured
+var DefaultSTUNServers = []string{"stun.stunprotocol.org:3478", "stun.l.google.com:19302"}
+
+// NATType is a behavior of NAT we are behind
+type NATType int
+
+// NAT types
+const (
+	NATUnknown        NATType = iota // Server doesn't support classification
+	NATOpen                          // Mapped address is local, no NAT
+	NATFullCone                      // Anyone may send to mapped address
+	NATRestricted                    // Only addresses we sent to may reply
+	NATPortRestricted                // Only address and port we sent to may reply
+	NATSymmetric                     // Mapping depends on destination
+)
+
+// StringifyNAT returns human-readable NAT type
+func StringifyNAT(t NATType) string {
+	switch t {
+	case NATOpen:
+		return "open"
+	case NATFullCone:
+		return "full-cone"
+	case NATRestricted:
+		return "restricted"
+	case NATPortRestricted:
+		return "port-restricted"
+	case NATSymmetric:
+		return "symmetric"
+	}
+	return "unknown"
+}
+
+// NATInfo is a result of STUN discovery
+type NATInfo struct {
+	Type    NATType      // Classified NAT type
+	Mapped  *net.UDPAddr // Address and port our socket is mapped to
+	Hairpin bool         // NAT forwards packets sent to own mapped address
+	Delta   int          // Port allocation step of symmetric NAT
+	Server  string       // STUN server that was used
+	Checked time.Time    // When discovery was finished
+}
+
+func (n *NATInfo) String() string {
+	if n.Type == NATSymmetric {
+		return fmt.Sprintf("%s NAT, mapped to %s, port delta: %d, hairpinning: %t (via %s)", StringifyNAT(n.Type), n.Mapped.String(), n.Delta, n.Hairpin, n.Server)
+	}
+	return fmt.Sprintf("%s NAT, mapped to %s, hairpinning: %t (via %s)", StringifyNAT(n.Type), n.Mapped.String(), n.Hairpin, n.Server)
+}
+
+// STUNConfig is a STUN section of the daemon config
+type STUNConfig struct {
+	Servers []string `yaml:"stun"`
+}
+
+// LoadSTUNServers returns STUN servers from the daemon config
+func LoadSTUNServers(configPath string) []string {
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return DefaultSTUNServers
+	}
+	config := &STUNConfig{}
+	err = yaml.Unmarshal(data, config)
+	if err != nil || len(config.Servers) == 0 {
+		return DefaultSTUNServers
+	}
+	return config.Servers
+}
+
+type stunMessage struct {
+	Type   uint16
+	TxID   [12]byte
+	Mapped *net.UDPAddr
+	Other  *net.UDPAddr
+}
+
+// STUNClient sends binding requests over a socket it doesn't own.
+// Responses are passed by the socket reader to Handle
+type STUNClient struct {
+	Timeout time.Duration // How long to wait for response
+	send    func([]byte, *net.UDPAddr) (int, error)
+	pending map[[12]byte]chan *stunMessage
+	lock    sync.Mutex
+}
+
+// NewSTUNClient creates a client that sends requests with provided function
+func NewSTUNClient(send func([]byte, *net.UDPAddr) (int, error)) *STUNClient {
+	return &STUNClient{
+		Timeout: STUNTimeout,
+		send:    send,
+		pending: make(map[[12]byte]chan *stunMessage),
+	}
+}
+
+// Handle consumes STUN message. Returns false if data is not STUN
+func (c *STUNClient) Handle(data []byte, src *net.UDPAddr) bool {
+	if !isSTUN(data) {
+		return false
+	}
+	msg, err := parseSTUN(data)
+	if err != nil {
+		Log(Debug, "Bad STUN message from %s: %s", src.String(), err)
+		return true
+	}
+	c.lock.Lock()
+	ch, exists := c.pending[msg.TxID]
+	c.lock.Unlock()
+	if exists {
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+	return true
+}
+
+// request sends binding request until response arrives or timeout passes
+func (c *STUNClient) request(server *net.UDPAddr, change uint32) (*stunMessage, error) {
+	var txid [12]byte
+	rand.Read(txid[:])
+	ch := make(chan *stunMessage, 1)
+	c.lock.Lock()
+	c.pending[txid] = ch
+	c.lock.Unlock()
+	defer func() {
+		c.lock.Lock()
+		delete(c.pending, txid)
+		c.lock.Unlock()
+	}()
+
+	data := buildSTUNRequest(txid, change)
+	deadline := time.After(c.Timeout)
+	ticker := time.NewTicker(stunRetransmit)
+	defer ticker.Stop()
+	for {
+		_, err := c.send(data, server)
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case msg := <-ch:
+			if msg.Type == stunBindingError {
+				return nil, fmt.Errorf("%s responded with error", server.String())
+			}
+			return msg, nil
+		case <-ticker.C:
+		case <-deadline:
+			return nil, fmt.Errorf("No response from %s", server.String())
+		}
+	}
+}
+
+// Classify runs NAT tests against the server
+func (c *STUNClient) Classify(server string, local []net.IP) (*NATInfo, error) {
+	addr, err := net.ResolveUDPAddr("udp4", server)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to resolve STUN server %s: %s", server, err)
+	}
+	first, err := c.request(addr, 0)
+	if err != nil {
+		return nil, err
+	}
+	if first.Mapped == nil {
+		return nil, fmt.Errorf("%s didn't report mapped address", server)
+	}
+	info := &NATInfo{Mapped: first.Mapped, Server: server}
+	for _, ip := range local {
+		if ip.Equal(first.Mapped.IP) {
+			info.Type = NATOpen
+		}
+	}
+	if info.Type != NATOpen && first.Other != nil {
+		if _, err := c.request(addr, stunChangeIP|stunChangePort); err == nil {
+			info.Type = NATFullCone
+		} else if second, err := c.request(first.Other, 0); err == nil && second.Mapped != nil && second.Mapped.String() != first.Mapped.String() {
+			info.Type = NATSymmetric
+			info.Delta = second.Mapped.Port - first.Mapped.Port
+		} else if _, err := c.request(addr, stunChangePort); err == nil {
+			info.Type = NATRestricted
+		} else {
+			info.Type = NATPortRestricted
+		}
+	}
+	if info.Type != NATOpen {
+		// Request sent to own mapped address comes back if NAT hairpins
+		_, err = c.request(first.Mapped, 0)
+		info.Hairpin = err == nil
+	}
+	info.Checked = time.Now()
+	return info, nil
+}
+
+// ClassifyAny tries servers one by one and prefers full classification
+func (c *STUNClient) ClassifyAny(servers []string, local []net.IP) (*NATInfo, error) {
+	var result *NATInfo
+	err := fmt.Errorf("No STUN servers")
+	for _, server := range servers {
+		info, e := c.Classify(server, local)
+		if e != nil {
+			err = e
+			continue
+		}
+		if result == nil || result.Type == NATUnknown {
+			result = info
+		}
+		if result.Type != NATUnknown {
+			break
+		}
+	}
+	if result == nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// DiscoverNAT classifies NAT using a temporary socket
+func DiscoverNAT(servers []string) (*NATInfo, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	local := []net.IP{}
+	addresses, _ := net.InterfaceAddrs()
+	for _, addr := range addresses {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			local = append(local, ipnet.IP)
+		}
+	}
+	defer conn.Close()
+	client := NewSTUNClient(conn.WriteToUDP)
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, src, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			client.Handle(buf[:n], src)
+		}
+	}()
+	return client.ClassifyAny(servers, local)
+}
+
+// GetNAT returns last result of STUN discovery on the instance socket
+func (p *PeerToPeer) GetNAT() *NATInfo {
+	p.natLock.RLock()
+	defer p.natLock.RUnlock()
+	return p.nat
+}
+
+// checkNAT runs STUN discovery on the instance socket periodically
+func (p *PeerToPeer) checkNAT() {
+	if p.stun == nil || len(p.STUNServers) == 0 || time.Since(p.natChecked) < STUNInterval {
+		return
+	}
+	if !atomic.CompareAndSwapUint32(&p.natChecking, 0, 1) {
+		return
+	}
+	p.natChecked = time.Now()
+	go func() {
+		defer atomic.StoreUint32(&p.natChecking, 0)
+		nat, err := p.stun.ClassifyAny(p.STUNServers, p.LocalIPs)
+		if err != nil {
+			Log(Debug, "STUN discovery failed: %s", err)
+			return
+		}
+		Log(Info, "Instance socket is behind %s", nat.String())
+		p.natLock.Lock()
+		p.nat = nat
+		p.natLock.Unlock()
+	}()
+}
+
+func isSTUN(data []byte) bool {
+	return len(data) >= stunHeaderSize && data[0]&0xC0 == 0 && binary.BigEndian.Uint32(data[4:8]) == stunCookie
+}
+
+func buildSTUNRequest(txid [12]byte, change uint32) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, uint16(stunBindingRequest))
+	length := uint16(0)
+	if change != 0 {
+		length = 8
+	}
+	binary.Write(buf, binary.BigEndian, length)
+	binary.Write(buf, binary.BigEndian, stunCookie)
+	buf.Write(txid[:])
+	if change != 0 {
+		binary.Write(buf, binary.BigEndian, uint16(stunChangeRequest))
+		binary.Write(buf, binary.BigEndian, uint16(4))
+		binary.Write(buf, binary.BigEndian, change)
+	}
+	return buf.Bytes()
+}
+
+func parseSTUN(data []byte) (*stunMessage, error) {
+	length := int(binary.BigEndian.Uint16(data[2:4]))
+	if len(data) < stunHeaderSize+length {
+		return nil, fmt.Errorf("Message is truncated")
+	}
+	msg := &stunMessage{Type: binary.BigEndian.Uint16(data[0:2])}
+	copy(msg.TxID[:], data[8:20])
+	attrs := data[stunHeaderSize : stunHeaderSize+length]
+	for len(attrs) >= 4 {
+		attrType := binary.BigEndian.Uint16(attrs[0:2])
+		attrLen := int(binary.BigEndian.Uint16(attrs[2:4]))
+		if len(attrs) < 4+attrLen {
+			return nil, fmt.Errorf("Attribute is truncated")
+		}
+		value := attrs[4 : 4+attrLen]
+		switch attrType {
+		case stunXorMappedAddress:
+			msg.Mapped = parseSTUNAddress(value, true)
+		case stunMappedAddress:
+			if msg.Mapped == nil {
+				msg.Mapped = parseSTUNAddress(value, false)
+			}
+		case stunOtherAddress, stunChangedAddress:
+			msg.Other = parseSTUNAddress(value, false)
+		}
+		padded := (attrLen + 3) &^ 3
+		if len(attrs) < 4+padded {
+			break
+		}
+		attrs = attrs[4+padded:]
+	}
+	return msg, nil
+}
+
+// parseSTUNAddress reads IPv4 address attribute
+func parseSTUNAddress(value []byte, xor bool) *net.UDPAddr {
+	if len(value) < 8 || value[1] != 0x01 {
+		return nil
+	}
+	port := binary.BigEndian.Uint16(value[2:4])
+	ip := binary.BigEndian.Uint32(value[4:8])
+	if xor {
+		port ^= uint16(stunCookie >> 16)
+		ip ^= stunCookie
+	}
+	result := &net.UDPAddr{IP: make(net.IP, 4), Port: int(port)}
+	binary.BigEndian.PutUint32(result.IP, ip)
+	return result
+}
@@ -0,0 +1,231 @@
+package ptp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSTUN is a server with two addresses and two ports
+type fakeSTUN struct {
+	conns     [2][2]*net.UDPConn // [ip][port]
+	symmetric bool               // Report different mapping for each server address
+}
+
+func newFakeSTUN(t *testing.T, symmetric bool) *fakeSTUN {
+	s := &fakeSTUN{symmetric: symmetric}
+	for i, ip := range []string{"127.0.0.1", "127.0.0.2"} {
+		for j := range s.conns[i] {
+			port := 0
+			if i == 1 {
+				port = s.conns[0][j].LocalAddr().(*net.UDPAddr).Port
+			}
+			conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP(ip), Port: port})
+			if err != nil {
+				t.Skipf("Can't listen on %s: %s", ip, err)
+			}
+			s.conns[i][j] = conn
+		}
+	}
+	for i := range s.conns {
+		for j := range s.conns[i] {
+			go s.serve(i, j)
+		}
+	}
+	return s
+}
+
+func (s *fakeSTUN) addr(i, j int) *net.UDPAddr {
+	return s.conns[i][j].LocalAddr().(*net.UDPAddr)
+}
+
+func (s *fakeSTUN) close() {
+	for i := range s.conns {
+		for j := range s.conns[i] {
+			s.conns[i][j].Close()
+		}
+	}
+}
+
+func (s *fakeSTUN) serve(i, j int) {
+	buf := make([]byte, 1500)
+	for {
+		n, src, err := s.conns[i][j].ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		change := uint32(0)
+		if n >= stunHeaderSize+8 && binary.BigEndian.Uint16(buf[20:22]) == stunChangeRequest {
+			change = binary.BigEndian.Uint32(buf[24:28])
+		}
+		mapped := &net.UDPAddr{IP: src.IP, Port: src.Port}
+		if s.symmetric && i == 1 {
+			mapped.Port++
+		}
+		ri, rj := i, j
+		if change&stunChangeIP != 0 {
+			ri = 1 - i
+		}
+		if change&stunChangePort != 0 {
+			rj = 1 - j
+		}
+		response := new(bytes.Buffer)
+		binary.Write(response, binary.BigEndian, uint16(stunBindingSuccess))
+		binary.Write(response, binary.BigEndian, uint16(24))
+		response.Write(buf[4:20])
+		response.Write(encodeSTUNAddress(stunXorMappedAddress, mapped, true))
+		response.Write(encodeSTUNAddress(stunOtherAddress, s.addr(1-i, 1-j), false))
+		s.conns[ri][rj].WriteToUDP(response.Bytes(), src)
+	}
+}
+
+func encodeSTUNAddress(attr uint16, addr *net.UDPAddr, xor bool) []byte {
+	port := uint16(addr.Port)
+	ip := binary.BigEndian.Uint32(addr.IP.To4())
+	if xor {
+		port ^= uint16(stunCookie >> 16)
+		ip ^= stunCookie
+	}
+	buf := make([]byte, 12)
+	binary.BigEndian.PutUint16(buf[0:2], attr)
+	binary.BigEndian.PutUint16(buf[2:4], 8)
+	buf[5] = 0x01
+	binary.BigEndian.PutUint16(buf[6:8], port)
+	binary.BigEndian.PutUint32(buf[8:12], ip)
+	return buf
+}
+
+// newFilteringClient emulates inbound filtering of NAT: packets are
+// accepted only from addresses (or addresses and ports) we sent to
+func newFilteringClient(t *testing.T, filter NATType) (*STUNClient, *net.UDPConn) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("Failed to create socket: %s", err)
+	}
+	var lock sync.Mutex
+	sent := map[string]bool{}
+	client := NewSTUNClient(func(data []byte, addr *net.UDPAddr) (int, error) {
+		lock.Lock()
+		sent[addr.String()] = true
+		sent[addr.IP.String()] = true
+		lock.Unlock()
+		return conn.WriteToUDP(data, addr)
+	})
+	client.Timeout = time.Millisecond * 300
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, src, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			lock.Lock()
+			drop := (filter == NATRestricted && !sent[src.IP.String()]) || (filter == NATPortRestricted && !sent[src.String()])
+			lock.Unlock()
+			if !drop {
+				client.Handle(buf[:n], src)
+			}
+		}
+	}()
+	return client, conn
+}
+
+func TestSTUNMessage(t *testing.T) {
+	var txid [12]byte
+	copy(txid[:], "transaction1")
+	request := buildSTUNRequest(txid, stunChangePort)
+	if !isSTUN(request) {
+		t.Fatalf("Request is not recognized as STUN")
+	}
+	msg, err := parseSTUN(request)
+	if err != nil || msg.Type != stunBindingRequest || msg.TxID != txid {
+		t.Errorf("Failed to parse request: %+v %v", msg, err)
+	}
+	p2p, _ := CreateMessageStatic(MsgTypePing, []byte("0123456789abcdefghij"))
+	if isSTUN(p2p.Serialize()) {
+		t.Errorf("P2P message is recognized as STUN")
+	}
+	mapped := &net.UDPAddr{IP: net.ParseIP("203.0.113.5").To4(), Port: 40000}
+	data := append(request[:20:20], encodeSTUNAddress(stunXorMappedAddress, mapped, true)...)
+	binary.BigEndian.PutUint16(data[2:4], 12)
+	msg, err = parseSTUN(data)
+	if err != nil || msg.Mapped == nil || msg.Mapped.String() != mapped.String() {
+		t.Errorf("Wrong XOR mapped address: %+v %v", msg, err)
+	}
+	if _, err := parseSTUN(data[:25]); err == nil {
+		t.Errorf("Truncated message was accepted")
+	}
+}
+
+func TestSTUNClassify(t *testing.T) {
+	cases := []struct {
+		filter    NATType
+		symmetric bool
+		expected  NATType
+	}{
+		{NATFullCone, false, NATFullCone},
+		{NATRestricted, false, NATRestricted},
+		{NATPortRestricted, false, NATPortRestricted},
+		{NATPortRestricted, true, NATSymmetric},
+	}
+	for _, c := range cases {
+		server := newFakeSTUN(t, c.symmetric)
+		client, conn := newFilteringClient(t, c.filter)
+		info, err := client.Classify(server.addr(0, 0).String(), nil)
+		if err != nil {
+			t.Fatalf("Failed to classify NAT: %s", err)
+		}
+		if info.Type != c.expected {
+			t.Errorf("Wrong NAT type: %s instead of %s", StringifyNAT(info.Type), StringifyNAT(c.expected))
+		}
+		if info.Mapped.String() != conn.LocalAddr().String() {
+			t.Errorf("Wrong mapped address: %s", info.Mapped.String())
+		}
+		if !info.Hairpin {
+			t.Errorf("Hairpinning wasn't detected")
+		}
+		if c.symmetric && info.Delta != 1 {
+			t.Errorf("Wrong port delta: %d", info.Delta)
+		}
+		conn.Close()
+		server.close()
+	}
+
+	server := newFakeSTUN(t, false)
+	defer server.close()
+	primary := server.addr(0, 0).String()
+	client, conn := newFilteringClient(t, NATFullCone)
+	defer conn.Close()
+	info, err := client.Classify(primary, []net.IP{net.ParseIP("127.0.0.1")})
+	if err != nil || info.Type != NATOpen {
+		t.Errorf("Local mapped address wasn't classified as open: %v %v", info, err)
+	}
+	info, err = client.ClassifyAny([]string{"127.0.0.1:1", primary}, nil)
+	if err != nil || info.Server != primary {
+		t.Errorf("Second server wasn't used: %v %v", info, err)
+	}
+}
+
+func TestLoadSTUNServers(t *testing.T) {
+	f, err := ioutil.TempFile("", "p2p-stun")
+	if err != nil {
+		t.Fatalf("Failed to create config: %s", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("iptool: /sbin/ip\nstun: [stun.example.com:3478]\n")
+	f.Close()
+
+	servers := LoadSTUNServers(f.Name())
+	if len(servers) != 1 || servers[0] != "stun.example.com:3478" {
+		t.Errorf("Wrong STUN servers: %v", servers)
+	}
+	servers = LoadSTUNServers(f.Name() + ".missing")
+	if len(servers) != len(DefaultSTUNServers) {
+		t.Errorf("Default STUN servers weren't used: %v", servers)
+	}
+}
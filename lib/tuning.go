@@ -0,0 +1,326 @@
+package ptp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Tuning holds timeouts and retry policies of an instance. Values are
+// taken from a profile and may be overridden one by one in the daemon
+// config and with `p2p start -tune`
+
+// Tuning profiles
+const (
+	TuningLAN     = "lan"
+	TuningDefault = "default"
+	TuningMobile  = "mobile"
+)
+
+// Tuning is a set of timeouts and retry policies
+type Tuning struct {
+	Profile              string        // Name of the profile values are based on
+	RequestIPInterval    time.Duration // Interval between requests of peer addresses
+	RequestIPAttempts    int           // Requests of addresses before disconnect
+	WaitProxyTimeout     time.Duration // How long to wait for proxies from DHT
+	StateRecheckInterval time.Duration // How often state is reported while waiting for peer
+	WaitConnectTimeout   time.Duration // How long to wait for peer to join connection
+	DesyncTimeout        time.Duration // How long peer may wait for us while connecting
+	ConnectTimeout       time.Duration // How long to wait for the first endpoint
+	PunchRounds          int           // Introduction requests sent to every endpoint while punching
+	RepunchInterval      time.Duration // Connected peer with a single endpoint is punched again after this period
+	MaintenanceInterval  time.Duration // Interval of routing and pings in connected state
+	CooldownTimeout      time.Duration // First pause after many failed connection attempts
+	CooldownAttempts     int           // Failed connection attempts before cooldown
+	BackoffMax           time.Duration // Longest pause between connection attempts
+	PingInterval         time.Duration // How often endpoints are pinged
+	EndpointTimeout      time.Duration // Endpoint without replies for this long is removed
+	PingLossLimit        int           // Endpoint is removed after this number of pings lost in a row
+	LastFindTimeout      time.Duration // Peer without endpoints and DHT updates for this long is disconnected
+	DHTUpdateInterval    time.Duration // How often peers and proxies are requested from DHT
+	DHTWaitTimeout       time.Duration // How long to wait for IP from DHT
+	InitialFindDelay     time.Duration // Delay of the first request of peers
+	ProxyConnectTimeout  time.Duration // How long to wait for proxy to accept us
+	ProxyIdleTimeout     time.Duration // Proxy without updates for this long is disconnected
+	IdleTimeout          time.Duration // Peer without traffic for this long becomes idle in lazy mode
+}
+
+// TuningConfig is a tuning section of the daemon config
+type TuningConfig struct {
+	Tuning struct {
+		Profile   string            `yaml:"profile"`
+		Overrides map[string]string `yaml:"overrides"`
+	} `yaml:"tuning"`
+}
+
+// DefaultTuning is used when no profile was specified
+var DefaultTuning = Tuning{
+	Profile:              TuningDefault,
+	RequestIPInterval:    time.Second * 1,
+	RequestIPAttempts:    5,
+	WaitProxyTimeout:     time.Second * 4,
+	StateRecheckInterval: time.Second * 5,
+	WaitConnectTimeout:   time.Second * 30,
+	DesyncTimeout:        time.Second * 3,
+	ConnectTimeout:       time.Second * 30,
+	PunchRounds:          10,
+	RepunchInterval:      time.Second * 30,
+	MaintenanceInterval:  time.Millisecond * 500,
+	CooldownTimeout:      time.Second * 30,
+	CooldownAttempts:     10,
+	BackoffMax:           time.Minute * 5,
+	PingInterval:         time.Second * 3,
+	EndpointTimeout:      time.Second * 10,
+	PingLossLimit:        3,
+	LastFindTimeout:      time.Second * 90,
+	DHTUpdateInterval:    time.Second * 30,
+	DHTWaitTimeout:       time.Second * 3,
+	InitialFindDelay:     time.Second * 5,
+	ProxyConnectTimeout:  time.Second * 10,
+	ProxyIdleTimeout:     time.Second * 90,
+	IdleTimeout:          time.Minute * 5,
+}
+
+// tuningProfiles modify default values
+var tuningProfiles = map[string]func(t *Tuning){
+	TuningDefault: func(t *Tuning) {},
+	// Peers are close to each other: fail fast and notice dead endpoints quickly
+	TuningLAN: func(t *Tuning) {
+		t.RequestIPInterval = time.Millisecond * 500
+		t.WaitProxyTimeout = time.Second * 1
+		t.StateRecheckInterval = time.Second * 2
+		t.WaitConnectTimeout = time.Second * 10
+		t.DesyncTimeout = time.Second * 1
+		t.ConnectTimeout = time.Second * 10
+		t.PunchRounds = 5
+		t.RepunchInterval = time.Second * 10
+		t.MaintenanceInterval = time.Millisecond * 250
+		t.CooldownTimeout = time.Second * 10
+		t.BackoffMax = time.Minute * 1
+		t.PingInterval = time.Second * 1
+		t.EndpointTimeout = time.Second * 4
+		t.LastFindTimeout = time.Second * 60
+		t.DHTUpdateInterval = time.Second * 15
+		t.InitialFindDelay = time.Second * 1
+	},
+	// Slow and lossy links: be patient and ping less often
+	TuningMobile: func(t *Tuning) {
+		t.RequestIPInterval = time.Second * 2
+		t.RequestIPAttempts = 8
+		t.WaitProxyTimeout = time.Second * 8
+		t.StateRecheckInterval = time.Second * 10
+		t.WaitConnectTimeout = time.Second * 60
+		t.DesyncTimeout = time.Second * 6
+		t.ConnectTimeout = time.Second * 60
+		t.PunchRounds = 15
+		t.RepunchInterval = time.Second * 60
+		t.MaintenanceInterval = time.Second * 1
+		t.CooldownTimeout = time.Second * 60
+		t.BackoffMax = time.Minute * 10
+		t.PingInterval = time.Second * 5
+		t.EndpointTimeout = time.Second * 20
+		t.PingLossLimit = 4
+		t.LastFindTimeout = time.Second * 180
+		t.DHTUpdateInterval = time.Second * 60
+		t.DHTWaitTimeout = time.Second * 10
+		t.ProxyConnectTimeout = time.Second * 20
+		t.ProxyIdleTimeout = time.Second * 180
+		t.IdleTimeout = time.Minute * 2
+	},
+}
+
+// NewTuning returns values of the profile. Empty name means default profile
+func NewTuning(profile string) (*Tuning, error) {
+	if profile == "" {
+		profile = TuningDefault
+	}
+	apply, exists := tuningProfiles[profile]
+	if !exists {
+		return nil, fmt.Errorf("Unknown tuning profile: %s", profile)
+	}
+	t := DefaultTuning
+	t.Profile = profile
+	apply(&t)
+	return &t, nil
+}
+
+// fields maps override keys to values
+func (t *Tuning) fields() map[string]interface{} {
+	return map[string]interface{}{
+		"request-ip-interval":    &t.RequestIPInterval,
+		"request-ip-attempts":    &t.RequestIPAttempts,
+		"wait-proxy-timeout":     &t.WaitProxyTimeout,
+		"state-recheck-interval": &t.StateRecheckInterval,
+		"wait-connect-timeout":   &t.WaitConnectTimeout,
+		"desync-timeout":         &t.DesyncTimeout,
+		"connect-timeout":        &t.ConnectTimeout,
+		"punch-rounds":           &t.PunchRounds,
+		"repunch-interval":       &t.RepunchInterval,
+		"maintenance-interval":   &t.MaintenanceInterval,
+		"cooldown-timeout":       &t.CooldownTimeout,
+		"cooldown-attempts":      &t.CooldownAttempts,
+		"backoff-max":            &t.BackoffMax,
+		"ping-interval":          &t.PingInterval,
+		"endpoint-timeout":       &t.EndpointTimeout,
+		"ping-loss-limit":        &t.PingLossLimit,
+		"last-find-timeout":      &t.LastFindTimeout,
+		"dht-update-interval":    &t.DHTUpdateInterval,
+		"dht-wait-timeout":       &t.DHTWaitTimeout,
+		"initial-find-delay":     &t.InitialFindDelay,
+		"proxy-connect-timeout":  &t.ProxyConnectTimeout,
+		"proxy-idle-timeout":     &t.ProxyIdleTimeout,
+		"idle-timeout":           &t.IdleTimeout,
+	}
+}
+
+// Set overrides single value. Durations are specified in Go format, e.g. 1m30s
+func (t *Tuning) Set(key, value string) error {
+	field, exists := t.fields()[key]
+	if !exists {
+		return fmt.Errorf("Unknown tuning option: %s", key)
+	}
+	switch v := field.(type) {
+	case *time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("Bad duration for %s: %s", key, value)
+		}
+		*v = d
+	case *int:
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("Bad number for %s: %s", key, value)
+		}
+		*v = n
+	}
+	return nil
+}
+
+// Override applies comma-separated list of key=value pairs
+func (t *Tuning) Override(list string) error {
+	for _, pair := range strings.Split(list, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("Malformed tuning option: %s", pair)
+		}
+		err := t.Set(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// String returns every value of the tuning in key=value form
+func (t *Tuning) String() string {
+	fields := t.fields()
+	keys := []string{}
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := "profile=" + t.Profile
+	for _, key := range keys {
+		switch v := fields[key].(type) {
+		case *time.Duration:
+			result += "," + key + "=" + v.String()
+		case *int:
+			result += "," + key + "=" + strconv.Itoa(*v)
+		}
+	}
+	return result
+}
+
+// LoadTuning builds tuning of an instance. Profile and overrides specified
+// on start take precedence over the ones from the daemon config
+func LoadTuning(configPath, profile, overrides string) (*Tuning, error) {
+	config := &TuningConfig{}
+	data, err := ioutil.ReadFile(configPath)
+	if err == nil {
+		err = yaml.Unmarshal(data, config)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse tuning config: %s", err)
+		}
+	}
+	if profile == "" {
+		profile = config.Tuning.Profile
+	}
+	t, err := NewTuning(profile)
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for key := range config.Tuning.Overrides {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		err = t.Set(key, config.Tuning.Overrides[key])
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = t.Override(overrides)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// stateTimeout returns duration of the timer armed when peer enters a state
+func (t *Tuning) stateTimeout(state PeerState) (time.Duration, bool) {
+	switch state {
+	case PeerStateRequestedIP:
+		return t.RequestIPInterval, true
+	case PeerStateWaitingForProxy:
+		return t.WaitProxyTimeout, true
+	case PeerStateWaitingToConnect:
+		return t.StateRecheckInterval, true
+	case PeerStateConnecting:
+		return t.DesyncTimeout, true
+	case PeerStateConnected:
+		return t.MaintenanceInterval, true
+	}
+	return 0, false
+}
+
+// backoffRand is a source of backoff jitter seeded per process, so
+// daemons on different hosts don't share the same jitter sequence
+var backoffRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+var backoffRandLock sync.Mutex
+
+// backoff returns pause of the cooldown with the number since the last
+// connection. Pause is doubled with every cooldown up to BackoffMax and
+// half of it is random, so peers of a swarm don't retry all at once
+func (t *Tuning) backoff(cooldown int) time.Duration {
+	delay := t.CooldownTimeout
+	for i := 1; i < cooldown && delay < t.BackoffMax; i++ {
+		delay *= 2
+	}
+	if delay > t.BackoffMax {
+		delay = t.BackoffMax
+	}
+	backoffRandLock.Lock()
+	jitter := backoffRand.Int63n(int64(delay/2) + 1)
+	backoffRandLock.Unlock()
+	return delay/2 + time.Duration(jitter)
+}
+
+// tuning returns tuning of the instance or default values if it wasn't set
+func (p *PeerToPeer) tuning() *Tuning {
+	if p.Tuning == nil {
+		return &DefaultTuning
+	}
+	return p.Tuning
+}
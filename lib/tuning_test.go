@@ -0,0 +1,139 @@
+package ptp
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewTuning(t *testing.T) {
+	def, err := NewTuning("")
+	if err != nil {
+		t.Fatalf("Failed to create default tuning: %s", err)
+	}
+	if *def != DefaultTuning {
+		t.Errorf("Empty profile doesn't match default tuning")
+	}
+	lan, err := NewTuning(TuningLAN)
+	if err != nil {
+		t.Fatalf("Failed to create lan tuning: %s", err)
+	}
+	mobile, err := NewTuning(TuningMobile)
+	if err != nil {
+		t.Fatalf("Failed to create mobile tuning: %s", err)
+	}
+	if !(lan.ConnectTimeout < def.ConnectTimeout && def.ConnectTimeout < mobile.ConnectTimeout) {
+		t.Errorf("Connect timeouts are not ordered: %s %s %s", lan.ConnectTimeout, def.ConnectTimeout, mobile.ConnectTimeout)
+	}
+	if DefaultTuning.Profile != TuningDefault {
+		t.Errorf("Default tuning was modified by profile")
+	}
+	_, err = NewTuning("satellite")
+	if err == nil {
+		t.Errorf("Unknown profile was accepted")
+	}
+}
+
+func TestTuningOverride(t *testing.T) {
+	tuning, _ := NewTuning(TuningDefault)
+	err := tuning.Override("connect-timeout=45s, cooldown-attempts=5,")
+	if err != nil {
+		t.Fatalf("Failed to override tuning: %s", err)
+	}
+	if tuning.ConnectTimeout != time.Second*45 {
+		t.Errorf("Wrong connect timeout: %s", tuning.ConnectTimeout)
+	}
+	if tuning.CooldownAttempts != 5 {
+		t.Errorf("Wrong cooldown attempts: %d", tuning.CooldownAttempts)
+	}
+	if tuning.Override("punch-rounds=4,repunch-interval=1m") != nil || tuning.PunchRounds != 4 || tuning.RepunchInterval != time.Minute {
+		t.Errorf("Punching wasn't overridden: %d %s", tuning.PunchRounds, tuning.RepunchInterval)
+	}
+	bad := []string{
+		"unknown=1s",
+		"connect-timeout",
+		"connect-timeout=soon",
+		"connect-timeout=-1s",
+		"cooldown-attempts=0",
+		"cooldown-attempts=1s",
+	}
+	for _, list := range bad {
+		if tuning.Override(list) == nil {
+			t.Errorf("Bad override was accepted: %s", list)
+		}
+	}
+	if !strings.Contains(tuning.String(), "connect-timeout=45s") {
+		t.Errorf("Override is missing from string: %s", tuning.String())
+	}
+}
+
+func TestTuningBackoff(t *testing.T) {
+	tuning, _ := NewTuning(TuningDefault)
+	tuning.CooldownTimeout = time.Second * 10
+	tuning.BackoffMax = time.Second * 60
+	cases := []struct {
+		cooldown int
+		delay    time.Duration
+	}{
+		{1, time.Second * 10},
+		{2, time.Second * 20},
+		{3, time.Second * 40},
+		{4, time.Second * 60},
+		{20, time.Second * 60},
+	}
+	for _, c := range cases {
+		seen := map[time.Duration]bool{}
+		for i := 0; i < 20; i++ {
+			pause := tuning.backoff(c.cooldown)
+			if pause < c.delay/2 || pause > c.delay {
+				t.Fatalf("Wrong pause of cooldown %d: %s", c.cooldown, pause)
+			}
+			seen[pause] = true
+		}
+		if len(seen) < 2 {
+			t.Errorf("Pause of cooldown %d has no jitter", c.cooldown)
+		}
+	}
+	if tuning.Set("backoff-max", "2m") != nil || tuning.BackoffMax != time.Minute*2 {
+		t.Errorf("Backoff limit wasn't overridden")
+	}
+}
+
+func TestLoadTuning(t *testing.T) {
+	f, err := ioutil.TempFile("", "p2p-tuning")
+	if err != nil {
+		t.Fatalf("Failed to create config: %s", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("iptool: /sbin/ip\ntuning:\n  profile: mobile\n  overrides:\n    connect-timeout: 2m\n    ping-interval: 7s\n")
+	f.Close()
+
+	tuning, err := LoadTuning(f.Name(), "", "ping-interval=4s")
+	if err != nil {
+		t.Fatalf("Failed to load tuning: %s", err)
+	}
+	if tuning.Profile != TuningMobile {
+		t.Errorf("Profile from config wasn't used: %s", tuning.Profile)
+	}
+	if tuning.ConnectTimeout != time.Minute*2 {
+		t.Errorf("Override from config wasn't used: %s", tuning.ConnectTimeout)
+	}
+	if tuning.PingInterval != time.Second*4 {
+		t.Errorf("Override from start wasn't preferred: %s", tuning.PingInterval)
+	}
+
+	tuning, err = LoadTuning(f.Name(), TuningLAN, "")
+	if err != nil {
+		t.Fatalf("Failed to load tuning: %s", err)
+	}
+	if tuning.Profile != TuningLAN {
+		t.Errorf("Profile from start wasn't preferred: %s", tuning.Profile)
+	}
+
+	tuning, err = LoadTuning(f.Name()+".missing", "", "")
+	if err != nil || *tuning != DefaultTuning {
+		t.Errorf("Missing config didn't result in default tuning: %v", err)
+	}
+}
@@ -1,6 +1,10 @@
 package ptp
 
-import "net"
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
 
 const (
 	flagTruncated = 0x1
@@ -16,6 +20,26 @@ type ifReq struct {
 	pad   [0x28 - 0x10 - 2]byte
 }
 
+// InterfaceMode is a type of virtual network device
+type InterfaceMode int
+
+// Interface modes
+const (
+	InterfaceTAP InterfaceMode = 0 // Layer 2 device. Ethernet frames are read and written
+	InterfaceTUN InterfaceMode = 1 // Layer 3 device. Plain IP packets are read and written
+)
+
+// ParseInterfaceMode converts name of the mode into InterfaceMode
+func ParseInterfaceMode(mode string) (InterfaceMode, error) {
+	switch mode {
+	case "", "tap":
+		return InterfaceTAP, nil
+	case "tun":
+		return InterfaceTUN, nil
+	}
+	return InterfaceTAP, fmt.Errorf("Unknown interface mode: %s", mode)
+}
+
 // Packet represents a packet received on TUN/TAP interface
 type Packet struct {
 	Protocol int
@@ -33,6 +57,11 @@ type TAP interface {
 	SetHardwareAddress(net.HardwareAddr)
 	SetIP(net.IP)
 	SetMask(net.IPMask)
+	GetMode() InterfaceMode
+	SetMode(InterfaceMode)
+	AddRoute(*net.IPNet, net.IP) error
+	DelRoute(*net.IPNet, net.IP) error
+	DelNeighbor(net.IP) error
 	Init(string) error
 	Open() error
 	Close() error
@@ -41,3 +70,40 @@ type TAP interface {
 	WritePacket(*Packet) error
 	Run()
 }
+
+// ipPacketProtocol returns EtherType of an IP packet read from TUN device
+func ipPacketProtocol(b []byte) int {
+	if len(b) == 0 {
+		return 0
+	}
+	switch b[0] >> 4 {
+	case 4:
+		return int(PacketIPv4)
+	case 6:
+		return int(PacketIPv6)
+	}
+	return 0
+}
+
+// wrapFrame puts an IP packet into Ethernet frame
+func wrapFrame(dst, src net.HardwareAddr, proto int, payload []byte) []byte {
+	frame := make([]byte, 14+len(payload))
+	copy(frame[0:6], dst)
+	copy(frame[6:12], src)
+	binary.BigEndian.PutUint16(frame[12:14], uint16(proto))
+	copy(frame[14:], payload)
+	return frame
+}
+
+// unwrapFrame returns an IP packet carried by Ethernet frame.
+// Nil is returned for frames of other protocols
+func unwrapFrame(frame []byte) []byte {
+	if len(frame) < 14 {
+		return nil
+	}
+	proto := PacketType(binary.BigEndian.Uint16(frame[12:14]))
+	if proto != PacketIPv4 && proto != PacketIPv6 {
+		return nil
+	}
+	return frame[14:]
+}
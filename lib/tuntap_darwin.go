@@ -12,6 +12,7 @@ import (
 
 const (
 	ConfigDir  string = "/usr/local/etc"
+	CaptureDir string = "/var/lib/p2p/captures"
 	DefaultMTU int    = 1376
 )
 
@@ -57,6 +58,7 @@ type TAPDarwin struct {
 	Name string           // Network interface name
 	Tool string           // Path to `ip`
 	MTU  int              // MTU value
+	Mode InterfaceMode    // TAP or TUN
 	file *os.File         // Interface descriptor
 }
 
@@ -105,6 +107,16 @@ func (t *TAPDarwin) SetMask(mask net.IPMask) {
 	t.Mask = mask
 }
 
+// GetMode returns whether device is TAP or TUN
+func (t *TAPDarwin) GetMode() InterfaceMode {
+	return t.Mode
+}
+
+// SetMode will set device mode. Only TAP is supported on Darwin
+func (t *TAPDarwin) SetMode(mode InterfaceMode) {
+	t.Mode = mode
+}
+
 // Init will initialize TAP interface creation process
 func (t *TAPDarwin) Init(name string) error {
 	t.Name = name
@@ -114,6 +126,9 @@ func (t *TAPDarwin) Init(name string) error {
 // Open will open a file descriptor for a new interface
 func (t *TAPDarwin) Open() error {
 	var err error
+	if t.Mode == InterfaceTUN {
+		return fmt.Errorf("TUN mode is not supported on this platform")
+	}
 	t.file, err = os.OpenFile("/dev/"+t.Name, os.O_RDWR, 0)
 	if err != nil {
 		return err
@@ -149,6 +164,24 @@ func (t *TAPDarwin) Configure() error {
 	return nil
 }
 
+// AddRoute will route specified network through the gateway
+func (t *TAPDarwin) AddRoute(network *net.IPNet, gateway net.IP) error {
+	Log(Debug, "Executing: route -n add -net %s %s", network.String(), gateway.String())
+	return exec.Command("route", "-n", "add", "-net", network.String(), gateway.String()).Run()
+}
+
+// DelRoute will remove route to specified network
+func (t *TAPDarwin) DelRoute(network *net.IPNet, gateway net.IP) error {
+	Log(Debug, "Executing: route -n delete -net %s", network.String())
+	return exec.Command("route", "-n", "delete", "-net", network.String()).Run()
+}
+
+// DelNeighbor will remove ARP entry
+func (t *TAPDarwin) DelNeighbor(ip net.IP) error {
+	Log(Debug, "Executing: arp -d %s", ip.String())
+	return exec.Command("arp", "-d", ip.String()).Run()
+}
+
 // ReadPacket will read single packet from network interface
 func (t *TAPDarwin) ReadPacket() (*Packet, error) {
 	buf := make([]byte, 4096)
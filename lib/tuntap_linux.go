@@ -9,6 +9,7 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"strings"
 	"syscall"
 	"unsafe"
 )
@@ -16,6 +17,7 @@ import (
 // Constants
 const (
 	ConfigDir  string = "/usr/local/etc"
+	CaptureDir string = "/var/lib/p2p/captures"
 	DefaultMTU int    = 1376
 )
 
@@ -62,6 +64,7 @@ type TAPLinux struct {
 	Name string           // Network interface name
 	Tool string           // Path to `ip`
 	MTU  int              // MTU value
+	Mode InterfaceMode    // TAP or TUN
 	file *os.File         // Interface descriptor
 }
 
@@ -110,6 +113,16 @@ func (t *TAPLinux) SetMask(mask net.IPMask) {
 	t.Mask = mask
 }
 
+// GetMode returns whether device is TAP or TUN
+func (t *TAPLinux) GetMode() InterfaceMode {
+	return t.Mode
+}
+
+// SetMode will set device mode. Must be called before Open
+func (t *TAPLinux) SetMode(mode InterfaceMode) {
+	t.Mode = mode
+}
+
 // Init will initialize TAP interface creation process
 func (t *TAPLinux) Init(name string) error {
 	t.Name = name
@@ -166,6 +179,10 @@ func (t *TAPLinux) Configure() error {
 	if err != nil {
 		return err
 	}
+	if t.Mode == InterfaceTUN {
+		// TUN devices doesn't have hardware address
+		return nil
+	}
 	err = t.linkDown()
 	if err != nil {
 		return err
@@ -188,6 +205,10 @@ func (t *TAPLinux) ReadPacket() (*Packet, error) {
 
 	var pkt *Packet
 	pkt = &Packet{Packet: buf[0:n]}
+	if t.Mode == InterfaceTUN {
+		pkt.Protocol = ipPacketProtocol(buf[0:n])
+		return pkt, nil
+	}
 	pkt.Protocol = int(binary.BigEndian.Uint16(buf[12:14]))
 	return pkt, nil
 }
@@ -213,7 +234,11 @@ func (t *TAPLinux) createInterface() error {
 	var req ifReq
 	req.Flags = 0
 	copy(req.Name[:15], t.Name)
-	req.Flags |= iffTap
+	if t.Mode == InterfaceTUN {
+		req.Flags |= iffTun
+	} else {
+		req.Flags |= iffTap
+	}
 	req.Flags |= iffnopi
 	_, _, err := syscall.Syscall(syscall.SYS_IOCTL, t.file.Fd(), uintptr(syscall.TUNSETIFF), uintptr(unsafe.Pointer(&req)))
 	if err != 0 {
@@ -275,6 +300,31 @@ func (t *TAPLinux) setMac() error {
 	return err
 }
 
+// AddRoute will route specified network through the interface using
+// gateway as a next hop. TUN devices doesn't need a gateway. Existing
+// routes are never replaced
+func (t *TAPLinux) AddRoute(network *net.IPNet, gateway net.IP) error {
+	args := []string{"route", "add", network.String()}
+	if t.Mode == InterfaceTAP && gateway != nil {
+		args = append(args, "via", gateway.String())
+	}
+	args = append(args, "dev", t.Name)
+	Log(Debug, "Executing: %s %s", t.Tool, strings.Join(args, " "))
+	return exec.Command(t.Tool, args...).Run()
+}
+
+// DelRoute will remove route to specified network from the interface
+func (t *TAPLinux) DelRoute(network *net.IPNet, gateway net.IP) error {
+	Log(Debug, "Executing: %s route del %s dev %s", t.Tool, network.String(), t.Name)
+	return exec.Command(t.Tool, "route", "del", network.String(), "dev", t.Name).Run()
+}
+
+// DelNeighbor will remove ARP entry from the interface
+func (t *TAPLinux) DelNeighbor(ip net.IP) error {
+	Log(Debug, "Executing: %s neigh del %s dev %s", t.Tool, ip.String(), t.Name)
+	return exec.Command(t.Tool, "neigh", "del", ip.String(), "dev", t.Name).Run()
+}
+
 // FilterInterface will return true if this interface needs to be filtered out
 func FilterInterface(infName, infIP string) bool {
 	Log(Trace, "ping -4 -w 1 -c 1 -I %s ptest.subutai.io", infName)
@@ -0,0 +1,56 @@
+package ptp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestParseInterfaceMode(t *testing.T) {
+	modes := map[string]InterfaceMode{"": InterfaceTAP, "tap": InterfaceTAP, "tun": InterfaceTUN}
+	for name, wait := range modes {
+		get, err := ParseInterfaceMode(name)
+		if err != nil || get != wait {
+			t.Errorf("Wrong mode for %q: %d, %v", name, get, err)
+		}
+	}
+	_, err := ParseInterfaceMode("tan")
+	if err == nil {
+		t.Error("Unknown mode was accepted")
+	}
+}
+
+func TestIPPacketProtocol(t *testing.T) {
+	if ipPacketProtocol([]byte{0x45, 0x00}) != int(PacketIPv4) {
+		t.Error("IPv4 packet was not detected")
+	}
+	if ipPacketProtocol([]byte{0x60, 0x00}) != int(PacketIPv6) {
+		t.Error("IPv6 packet was not detected")
+	}
+	if ipPacketProtocol([]byte{}) != 0 || ipPacketProtocol([]byte{0x10}) != 0 {
+		t.Error("Garbage was detected as IP packet")
+	}
+}
+
+func TestWrapFrame(t *testing.T) {
+	dst, _ := net.ParseMAC("06:00:00:00:00:01")
+	src, _ := net.ParseMAC("06:00:00:00:00:02")
+	payload := []byte{0x45, 0x00, 0x00, 0x14}
+	frame := wrapFrame(dst, src, int(PacketIPv4), payload)
+	if len(frame) != 14+len(payload) {
+		t.Fatalf("Wrong frame length: %d", len(frame))
+	}
+	if !bytes.Equal(frame[0:6], dst) || !bytes.Equal(frame[6:12], src) {
+		t.Error("Wrong addresses in frame")
+	}
+	if !bytes.Equal(unwrapFrame(frame), payload) {
+		t.Error("Payload was not unwrapped")
+	}
+	arp := wrapFrame(dst, src, int(PacketARP), payload)
+	if unwrapFrame(arp) != nil {
+		t.Error("ARP frame was unwrapped")
+	}
+	if unwrapFrame([]byte{0x01}) != nil {
+		t.Error("Short frame was unwrapped")
+	}
+}
@@ -18,6 +18,7 @@ import (
 // Windows platform specific constants
 const (
 	ConfigDir        string         = "C:\\ProgramData\\Subutai\\etc"
+	CaptureDir       string         = "C:\\ProgramData\\Subutai\\captures"
 	DefaultMTU       int            = 1376
 	NetworkKey       string         = "SYSTEM\\CurrentControlSet\\Control\\Network\\{4D36E972-E325-11CE-BFC1-08002BE10318}"
 	AdapterKey       string         = "SYSTEM\\CurrentControlSet\\Control\\Class\\{4D36E972-E325-11CE-BFC1-08002BE10318}"
@@ -89,6 +90,7 @@ type TAPWindows struct {
 	Interface string // ?????????????????
 	Tool      string // Path to `ip`
 	MTU       int    // MTU value
+	Mode      InterfaceMode
 	file      syscall.Handle
 	Handle    syscall.Handle
 	Rx        chan []byte
@@ -172,6 +174,16 @@ func (t *TAPWindows) SetMask(mask net.IPMask) {
 	t.Mask = mask
 }
 
+// GetMode returns whether device is TAP or TUN
+func (t *TAPWindows) GetMode() InterfaceMode {
+	return t.Mode
+}
+
+// SetMode will set device mode. Only TAP is supported on Windows
+func (t *TAPWindows) SetMode(mode InterfaceMode) {
+	t.Mode = mode
+}
+
 // Init will initialize TAP interface creation process
 func (t *TAPWindows) Init(name string) error {
 	t.Name = name
@@ -179,6 +191,9 @@ func (t *TAPWindows) Init(name string) error {
 }
 
 func (t *TAPWindows) Open() error {
+	if t.Mode == InterfaceTUN {
+		return fmt.Errorf("TUN mode is not supported on this platform")
+	}
 	handle, err := t.queryNetworkKey()
 	if err != nil {
 		Log(Error, "Failed to query Windows registry: %v", err)
@@ -241,6 +256,29 @@ func (t *TAPWindows) Configure() error {
 	return nil
 }
 
+// AddRoute will route specified network through the gateway
+func (t *TAPWindows) AddRoute(network *net.IPNet, gateway net.IP) error {
+	return t.netsh(fmt.Sprintf(`netsh interface ip add route %s "%s" %s`, network.String(), t.Interface, gateway.String()))
+}
+
+// DelRoute will remove route to specified network
+func (t *TAPWindows) DelRoute(network *net.IPNet, gateway net.IP) error {
+	return t.netsh(fmt.Sprintf(`netsh interface ip delete route %s "%s" %s`, network.String(), t.Interface, gateway.String()))
+}
+
+// DelNeighbor will remove ARP entry from the interface
+func (t *TAPWindows) DelNeighbor(ip net.IP) error {
+	return t.netsh(fmt.Sprintf(`netsh interface ip delete neighbors "%s" %s`, t.Interface, ip.String()))
+}
+
+func (t *TAPWindows) netsh(cmd string) error {
+	netsh := exec.Command("netsh")
+	netsh.SysProcAttr = &syscall.SysProcAttr{}
+	Log(Debug, "Executing: %s", cmd)
+	netsh.SysProcAttr.CmdLine = cmd
+	return netsh.Run()
+}
+
 // Run will start read/write goroutines
 func (t *TAPWindows) Run() {
 	Log(Info, "Listening for TAP interface")
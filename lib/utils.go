@@ -80,6 +80,8 @@ func StringifyState(state PeerState) string {
 		return "Stopped"
 	case PeerStateCooldown:
 		return "Cooldown"
+	case PeerStateIdle:
+		return "Idle"
 	}
 	return "Unknown"
 }
@@ -1,9 +1,5 @@
 package ptp
 
-import (
-	"time"
-)
-
 // PacketVersion is a version of packet used in DHT communication
 const PacketVersion int32 = 20005
 
@@ -29,6 +25,9 @@ const (
 	MsgTypeProxy             = 8  // Information about proxy (forwarder)
 	MsgTypeBadTun            = 9  // Notifies about dead tunnel
 	MsgTypeConf              = 10 // Confirmation
+	MsgTypeMacs              = 11 // Hardware addresses learned in bridge mode
+	MsgTypeRelay             = 12 // Message forwarded by a peer between two others
+	MsgTypeGoodbye           = 13 // Peer is leaving the swarm
 )
 
 // List of commands used in DHT
@@ -71,13 +70,5 @@ const (
 	PeerStateDisconnect                 = 8  // We're disconnecting
 	PeerStateStop                       = 9  // Peer has been stopped and now can be removed from list of peers
 	PeerStateCooldown                   = 10 // Peer is in cooldown mode
-)
-
-// Timeouts and retries
-const (
-	DHTMaxRetries         int           = 10
-	DHCPMaxRetries        int           = 10
-	PeerPingTimeout       time.Duration = time.Second * 1
-	WaitProxyTimeout      time.Duration = time.Second * 5
-	HandshakeProxyTimeout time.Duration = time.Second * 3
+	PeerStateIdle                       = 11 // Peer is known, but not connected until traffic for it appears
 )
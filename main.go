@@ -5,6 +5,7 @@ import (
 	"net"
 	"os"
 	"runtime/pprof"
+	"sync"
 	"time"
 
 	ptp "github.com/subutai-io/p2p/lib"
@@ -23,6 +24,20 @@ var InterfaceNames []string
 // OutboundIP is an outbound IP address detected by STUN
 var OutboundIP net.IP
 
+// OutboundNAT is a result of STUN discovery on daemon start
+var OutboundNAT *ptp.NATInfo
+
+// outboundLock protects OutboundIP and OutboundNAT, which are set by
+// discovery running in background
+var outboundLock sync.RWMutex
+
+// getOutbound returns outbound IP and NAT detected so far
+func getOutbound() (net.IP, *ptp.NATInfo) {
+	outboundLock.RLock()
+	defer outboundLock.RUnlock()
+	return OutboundIP, OutboundNAT
+}
+
 var SignalChannel chan os.Signal
 
 var ReadyToServe bool
@@ -80,6 +95,36 @@ func main() {
 		LogLevel       string // Log level
 		RemoveService  bool   // If yes - service will be removed (used with service)
 		InstallService bool   // If yes - service will be installed (used with service)
+		Flood          string // Which broadcast/multicast frames should be flooded to peers
+		Snooping       bool   // Whether IGMP/MLD snooping is enabled
+		StormLimit     int    // Maximum number of flooded frames per second
+		Bridge         bool   // Whether instance should learn hardware addresses behind TAP
+		Mode           string // Type of the network interface: tap or tun
+		Routes         string // Comma-separated list of networks behind this peer
+		Rules          string // Path to a firewall rules file
+		RuleAdd        string // Firewall rule to append
+		RuleRemove     int    // Position of a firewall rule to remove
+		RuleDefault    string // Default firewall action
+		PeerID         string // ID of a peer
+		PeerHistory    bool   // Whether state changes of a peer should be displayed
+		CaptureFile    string // Output file of a capture
+		CaptureOuter   bool   // Whether capture should record outer P2P messages
+		CaptureStop    bool   // Stop running capture
+		PeerName       string // Name of this peer announced to other peers
+		DNS            bool   // Whether overlay DNS should be started
+		DNSUpstream    string // Upstream DNS server
+		DHCPPool       string // Range of addresses for DHCP server
+		ExitGateway    bool   // Whether this instance routes internet traffic of peers
+		ExitNode       string // ID of a peer used as internet gateway
+		Weights        string // Configuration of endpoint selection
+		Endpoint       string // Endpoint of a peer
+		Reconnect      bool   // Reconnect a peer skipping backoff
+		Profile        string // Tuning profile of timeouts and retries
+		Tune           string // Overrides of tuning values
+		StaticPeers    string // Addresses of peers used without bootstrap nodes
+		Relay          bool   // Whether this instance relays traffic between peers
+		Lazy           bool   // Whether peers are connected only when traffic for them appears
+		MaxPeers       int    // Limit of connected peers in lazy mode
 	)
 
 	app := cli.NewApp()
@@ -229,9 +274,154 @@ func main() {
 					Usage:       "Force proxy servers usage",
 					Destination: &UseForwarders,
 				},
+				cli.StringFlag{
+					Name:        "flood",
+					Usage:       "Flood broadcast and multicast frames to peers. Possible values: none, broadcast, all",
+					Value:       "none",
+					Destination: &Flood,
+				},
+				cli.BoolFlag{
+					Name:        "snooping",
+					Usage:       "Send multicast only to peers subscribed to a group using IGMP/MLD snooping",
+					Destination: &Snooping,
+				},
+				cli.IntFlag{
+					Name:        "storm-limit",
+					Usage:       "Maximum number of flooded broadcast and multicast frames per second. 0 means unlimited",
+					Value:       0,
+					Destination: &StormLimit,
+				},
+				cli.BoolFlag{
+					Name:        "bridge",
+					Usage:       "Bridge mode: learn hardware addresses of hosts attached to the same bridge as p2p interface",
+					Destination: &Bridge,
+				},
+				cli.StringFlag{
+					Name:        "mode",
+					Usage:       "Type of p2p interface. \"tap\" emulates Ethernet, \"tun\" routes plain IP packets. TUN is supported on Linux only",
+					Value:       "tap",
+					Destination: &Mode,
+				},
+				cli.StringFlag{
+					Name:        "routes",
+					Usage:       "Comma-separated list of networks in CIDR notation located behind this peer. Other peers will route these networks through this instance",
+					Value:       "",
+					Destination: &Routes,
+				},
+				cli.StringFlag{
+					Name:        "rules",
+					Usage:       "Path to a YAML file with firewall rules",
+					Value:       "",
+					Destination: &Rules,
+				},
+				cli.StringFlag{
+					Name:        "name",
+					Usage:       "Name of this peer. Other peers resolve it as <name>.<hash> with -dns",
+					Value:       "",
+					Destination: &PeerName,
+				},
+				cli.BoolFlag{
+					Name:        "dns",
+					Usage:       "Run DNS server on p2p interface that resolves peer names",
+					Destination: &DNS,
+				},
+				cli.StringFlag{
+					Name:        "dns-upstream",
+					Usage:       "DNS server for queries outside of the swarm. Detected from /etc/resolv.conf if not specified",
+					Value:       "",
+					Destination: &DNSUpstream,
+				},
+				cli.StringFlag{
+					Name:        "dhcp-pool",
+					Usage:       "Run DHCP server for hosts bridged onto p2p interface with specified range of addresses, e.g. 10.10.10.100-10.10.10.150. Of peers with overlapping ranges only the one with the lowest ID answers",
+					Value:       "",
+					Destination: &DHCPPool,
+				},
+				cli.BoolFlag{
+					Name:        "exit",
+					Usage:       "Serve as exit node: advertise default route and NAT traffic of peers through this host",
+					Destination: &ExitGateway,
+				},
+				cli.StringFlag{
+					Name:        "exit-node",
+					Usage:       "Route internet traffic through the peer with specified ID",
+					Value:       "",
+					Destination: &ExitNode,
+				},
+				cli.StringFlag{
+					Name:        "endpoint-weights",
+					Usage:       "Weights of endpoint selection, e.g. lan=0.5,internet=1,proxy=1.5,relay=2,loss=10,hysteresis=0.2",
+					Value:       "",
+					Destination: &Weights,
+				},
+				cli.StringFlag{
+					Name:        "profile",
+					Usage:       "Tuning profile of connection timeouts and retries: lan, default or mobile",
+					Value:       "",
+					Destination: &Profile,
+				},
+				cli.StringFlag{
+					Name:        "tune",
+					Usage:       "Override tuning values, e.g. connect-timeout=45s,cooldown-attempts=5",
+					Value:       "",
+					Destination: &Tune,
+				},
+				cli.StringFlag{
+					Name:        "peer",
+					Usage:       "Connect to static peers without bootstrap node: host:port[,host:port]. Requires -ip",
+					Value:       "",
+					Destination: &StaticPeers,
+				},
+				cli.BoolFlag{
+					Name:        "relay",
+					Usage:       "Relay traffic between peers of the swarm that can't connect to each other",
+					Destination: &Relay,
+				},
+				cli.BoolFlag{
+					Name:        "lazy",
+					Usage:       "Connect to peers only when traffic for them appears and disconnect idle peers",
+					Destination: &Lazy,
+				},
+				cli.IntFlag{
+					Name:        "max-peers",
+					Usage:       "Maximum number of connected peers in lazy mode. Least recently used peer is disconnected to connect another one",
+					Value:       0,
+					Destination: &MaxPeers,
+				},
 			},
 			Action: func(c *cli.Context) error {
-				CommandStart(RPCPort, IP, Infohash, Mac, InterfaceName, DHTRouters, Keyfile, Key, Until, UseForwarders, UDPPort)
+				CommandStart(RPCPort, &DaemonArgs{
+					IP:         IP,
+					Hash:       Infohash,
+					Mac:        Mac,
+					Dev:        InterfaceName,
+					Dht:        DHTRouters,
+					Keyfile:    Keyfile,
+					Key:        Key,
+					TTL:        Until,
+					Fwd:        UseForwarders,
+					Port:       UDPPort,
+					Flood:      Flood,
+					Snooping:   Snooping,
+					StormLimit: StormLimit,
+					Bridge:     Bridge,
+					Mode:       Mode,
+					Routes:     Routes,
+					Rules:      Rules,
+					Name:       PeerName,
+					DNS:        DNS,
+					Upstream:   DNSUpstream,
+					DHCPPool:   DHCPPool,
+					Exit:       ExitGateway,
+					ExitNode:   ExitNode,
+					Weights:    Weights,
+					Profile:    Profile,
+					Tune:       Tune,
+					Static:     StaticPeers,
+					Relay:      Relay,
+					Lazy:       Lazy,
+					MaxPeers:   MaxPeers,
+				})
 				return nil
 			},
 		},
@@ -340,9 +530,141 @@ func main() {
 					Value:       "",
 					Destination: &Infohash,
 				},
+				cli.StringFlag{
+					Name:        "peer",
+					Usage:       "ID of a peer which endpoint should be pinned or which should be reconnected. Must be used with combination of -endpoint or -reconnect",
+					Value:       "",
+					Destination: &PeerID,
+				},
+				cli.StringFlag{
+					Name:        "endpoint",
+					Usage:       "Endpoint that should be used for communication with the peer or `auto` for automatic selection",
+					Value:       "",
+					Destination: &Endpoint,
+				},
+				cli.BoolFlag{
+					Name:        "reconnect",
+					Usage:       "Reconnect the peer immediately, skipping backoff after failed attempts",
+					Destination: &Reconnect,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				CommandSet(RPCPort, LogLevel, Infohash, "", Key, Until, PeerID, Endpoint, Reconnect)
+				return nil
+			},
+		},
+		{
+			Name:  "firewall",
+			Usage: "Manage firewall rules of an instance",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:        "rpc-port",
+					Usage:       "RPC port",
+					Value:       52523,
+					Destination: &RPCPort,
+				},
+				cli.StringFlag{
+					Name:        "hash",
+					Usage:       "Infohash of the instance",
+					Value:       "",
+					Destination: &Infohash,
+				},
+				cli.StringFlag{
+					Name:        "add",
+					Usage:       "Append rule, e.g. \"action=allow,direction=in,protocol=tcp,port=22,network=10.10.10.0/24,peer=ID\"",
+					Value:       "",
+					Destination: &RuleAdd,
+				},
+				cli.IntFlag{
+					Name:        "remove",
+					Usage:       "Remove rule by its number in the list",
+					Value:       0,
+					Destination: &RuleRemove,
+				},
+				cli.StringFlag{
+					Name:        "load",
+					Usage:       "Replace rules with contents of a YAML file",
+					Value:       "",
+					Destination: &Rules,
+				},
+				cli.StringFlag{
+					Name:        "default",
+					Usage:       "Action for packets that didn't match any rule: allow or deny",
+					Value:       "",
+					Destination: &RuleDefault,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				CommandFirewall(RPCPort, Infohash, RuleAdd, RuleRemove, Rules, RuleDefault)
+				return nil
+			},
+		},
+		{
+			Name:  "capture",
+			Usage: "Record overlay traffic of an instance into a pcapng file",
+			Description: "Capture files are written by the daemon into " + ptp.CaptureDir + ". Output is specified\n" +
+				"   by a file name only, e.g. -o file.pcapng, paths are rejected. Full path of the file is\n" +
+				"   printed when capture starts",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:        "rpc-port",
+					Usage:       "RPC port",
+					Value:       52523,
+					Destination: &RPCPort,
+				},
+				cli.StringFlag{
+					Name:        "hash",
+					Usage:       "Infohash of the instance",
+					Value:       "",
+					Destination: &Infohash,
+				},
+				cli.StringFlag{
+					Name:        "peer",
+					Usage:       "Record only traffic of the peer with specified ID",
+					Value:       "",
+					Destination: &PeerID,
+				},
+				cli.StringFlag{
+					Name:        "o",
+					Usage:       "Name of a new output file created in " + ptp.CaptureDir + ". Paths are not accepted",
+					Value:       "",
+					Destination: &CaptureFile,
+				},
+				cli.BoolFlag{
+					Name:        "outer",
+					Usage:       "Record P2P messages sent and received over the network along with overlay frames",
+					Destination: &CaptureOuter,
+				},
+				cli.BoolFlag{
+					Name:        "stop",
+					Usage:       "Stop running capture",
+					Destination: &CaptureStop,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				CommandCapture(RPCPort, Infohash, PeerID, CaptureFile, CaptureOuter, CaptureStop)
+				return nil
+			},
+		},
+		{
+			Name:  "leases",
+			Usage: "Display addresses leased by DHCP server of an instance",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:        "rpc-port",
+					Usage:       "RPC port",
+					Value:       52523,
+					Destination: &RPCPort,
+				},
+				cli.StringFlag{
+					Name:        "hash",
+					Usage:       "Infohash of the instance",
+					Value:       "",
+					Destination: &Infohash,
+				},
 			},
 			Action: func(c *cli.Context) error {
-				CommandSet(RPCPort, LogLevel, Infohash, "", Key, Until)
+				CommandLeases(RPCPort, Infohash)
 				return nil
 			},
 		},
@@ -372,9 +694,26 @@ func main() {
 					Value:       52523,
 					Destination: &RPCPort,
 				},
+				cli.StringFlag{
+					Name:        "hash",
+					Usage:       "Infohash of the instance",
+					Value:       "",
+					Destination: &Infohash,
+				},
+				cli.StringFlag{
+					Name:        "peer",
+					Usage:       "Display status of the peer with specified ID",
+					Value:       "",
+					Destination: &PeerID,
+				},
+				cli.BoolFlag{
+					Name:        "history",
+					Usage:       "Display recent state changes of the peer",
+					Destination: &PeerHistory,
+				},
 			},
 			Action: func(c *cli.Context) error {
-				CommandStatus(RPCPort)
+				CommandStatus(RPCPort, Infohash, PeerID, PeerHistory)
 				return nil
 			},
 		},
@@ -33,6 +33,7 @@ type request struct {
 	Interfaces bool   `json:"interfaces"` // Used for show request
 	All        bool   `json:"all"`        // Used for show request
 	Bind       bool   `json:"bind"`       // User for show request
+	Peer       string `json:"peer"`       // Used for peer request
 }
 
 type RESTResponse struct {
@@ -53,6 +54,10 @@ func setupRESTHandlers(port int, d *Daemon) {
 	http.HandleFunc("/rest/v1/status", d.execRESTStatus)
 	http.HandleFunc("/rest/v1/debug", d.execRESTDebug)
 	http.HandleFunc("/rest/v1/set", d.execRESTSet)
+	http.HandleFunc("/rest/v1/firewall", d.execRESTFirewall)
+	http.HandleFunc("/rest/v1/capture", d.execRESTCapture)
+	http.HandleFunc("/rest/v1/leases", d.execRESTLeases)
+	http.HandleFunc("/rest/v1/peer", d.execRESTPeer)
 
 	go func() {
 		err := http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
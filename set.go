@@ -9,8 +9,12 @@ import (
 )
 
 // Set modifies different options of P2P daemon
-func CommandSet(rpcPort int, log, hash, keyfile, key, ttl string) {
-	out, err := sendRequest(rpcPort, "set", &DaemonArgs{Log: log, Keyfile: keyfile, Key: key, TTL: ttl})
+func CommandSet(rpcPort int, log, hash, keyfile, key, ttl, peer, endpoint string, reconnect bool) {
+	if peer != "" && (hash == "" || (endpoint == "" && !reconnect)) {
+		fmt.Printf("Hash and either endpoint or reconnect must be specified for the peer\n")
+		os.Exit(1)
+	}
+	out, err := sendRequest(rpcPort, "set", &DaemonArgs{Log: log, Hash: hash, Keyfile: keyfile, Key: key, TTL: ttl, Peer: peer, Endpoint: endpoint, Reconnect: reconnect})
 	if err != nil {
 		fmt.Println(err.Error())
 		os.Exit(1)
@@ -36,6 +40,10 @@ func (d *Daemon) execRESTSet(w http.ResponseWriter, r *http.Request) {
 			Name:  "log",
 			Value: args.Log,
 		}, response)
+	} else if args.Peer != "" && args.Reconnect {
+		d.ReconnectPeer(args, response)
+	} else if args.Peer != "" {
+		d.SetEndpoint(args, response)
 	} else {
 		response.ExitCode = 0
 		response.Output = "Unknown command"
@@ -78,6 +86,48 @@ func (p *Daemon) SetLog(args *NameValueArg, resp *Response) error {
 	return nil
 }
 
+// SetEndpoint pins endpoint of a peer
+func (p *Daemon) SetEndpoint(args *DaemonArgs, resp *Response) error {
+	resp.ExitCode = 0
+	inst := p.Instances.GetInstance(args.Hash)
+	if inst == nil {
+		resp.ExitCode = 1
+		resp.Output = "Instance with hash " + args.Hash + " was not found"
+		return nil
+	}
+	err := inst.PTP.PinEndpoint(args.Peer, args.Endpoint)
+	if err != nil {
+		resp.ExitCode = 1
+		resp.Output = err.Error()
+		return nil
+	}
+	if args.Endpoint == "" || args.Endpoint == "auto" {
+		resp.Output = "Endpoint of peer " + args.Peer + " will be selected automatically"
+	} else {
+		resp.Output = "Endpoint of peer " + args.Peer + " has been pinned to " + args.Endpoint
+	}
+	return nil
+}
+
+// ReconnectPeer restarts connection with a peer
+func (p *Daemon) ReconnectPeer(args *DaemonArgs, resp *Response) error {
+	resp.ExitCode = 0
+	inst := p.Instances.GetInstance(args.Hash)
+	if inst == nil {
+		resp.ExitCode = 1
+		resp.Output = "Instance with hash " + args.Hash + " was not found"
+		return nil
+	}
+	err := inst.PTP.ReconnectPeer(args.Peer)
+	if err != nil {
+		resp.ExitCode = 1
+		resp.Output = err.Error()
+		return nil
+	}
+	resp.Output = "Peer " + args.Peer + " is reconnecting"
+	return nil
+}
+
 // AddKey adds a new crypto-key
 func (p *Daemon) AddKey(args *RunArgs, resp *Response) error {
 	resp.ExitCode = 0
@@ -20,6 +20,7 @@ type ShowOutput struct {
 	Code            int    `json:"code"`
 	InterfaceName   string `json:"interface"`
 	Hash            string `json:"hash"`
+	Name            string `json:"name"`
 }
 
 // Show outputs information about P2P instances and interfaces
@@ -67,13 +68,13 @@ func CommandShow(queryPort int, hash, ip string, interfaces, all, bind bool) {
 			fmt.Println("No data available")
 			os.Exit(102)
 		} else {
-			fmt.Println("< Peer ID >\t< IP >\t< Endpoint >\t< HW >")
+			fmt.Println("< Peer ID >\t< IP >\t< Endpoint >\t< HW >\t< Name >")
 			for _, m := range show {
 				if m.Code != 0 {
 					fmt.Println(m.Error)
 					os.Exit(m.Code)
 				}
-				fmt.Printf("%s\t%s\t%s\t%s\n", m.ID, m.IP, m.Endpoint, m.HardwareAddress)
+				fmt.Printf("%s\t%s\t%s\t%s\t%s\n", m.ID, m.IP, m.Endpoint, m.HardwareAddress, m.Name)
 			}
 			os.Exit(0)
 		}
@@ -169,8 +170,8 @@ func (d *Daemon) showOutput(data []ShowOutput) ([]byte, error) {
 func (d *Daemon) showIP(ip string, instance *P2PInstance) ([]byte, error) {
 	peers := instance.PTP.Peers.Get()
 	for _, peer := range peers {
-		if peer.PeerLocalIP.String() == ip {
-			if peer.State == ptp.PeerStateConnected {
+		if peer.GetIP().String() == ip {
+			if peer.GetState() == ptp.PeerStateConnected {
 				out := []ShowOutput{
 					ShowOutput{
 						Text: "Integrated with " + ip,
@@ -196,9 +197,10 @@ func (d *Daemon) showHash(instance *P2PInstance) ([]byte, error) {
 	for _, peer := range peers {
 		s := ShowOutput{
 			ID:              peer.ID,
-			IP:              peer.PeerLocalIP.String(),
-			Endpoint:        peer.Endpoint.String(),
-			HardwareAddress: peer.PeerHW.String(),
+			IP:              peer.GetIP().String(),
+			Endpoint:        peer.GetEndpoint().String(),
+			HardwareAddress: peer.GetHardwareAddress().String(),
+			Name:            peer.GetName(),
 		}
 		out = append(out, s)
 	}
@@ -6,41 +6,113 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 
 	ptp "github.com/subutai-io/p2p/lib"
 )
 
 // CommandStart will create new P2P instance
-func CommandStart(restPort int, ip, hash, mac, dev, dht, keyfile, key, ttl string, fwd bool, port int) {
-	args := &DaemonArgs{}
-	args.IP = ip
-	if hash == "" {
+func CommandStart(restPort int, args *DaemonArgs) {
+	if args.Hash == "" {
 		fmt.Printf("Hash cannot be empty. Please start new instances with -hash VALUE argument\n")
 		os.Exit(12)
 	}
-	args.Hash = hash
-	if mac != "" {
-		_, err := net.ParseMAC(mac)
+	if args.Mac != "" {
+		_, err := net.ParseMAC(args.Mac)
 		if err != nil {
 			fmt.Printf("Invalid MAC address provided\n")
 			os.Exit(13)
 		}
 	}
-	args.Mac = mac
-	args.Dev = dev
-	if dht != "" {
-		_, err := net.ResolveUDPAddr("udp4", dht)
+	if args.Dht != "" {
+		_, err := net.ResolveUDPAddr("udp4", args.Dht)
 		if err != nil {
 			fmt.Printf("Invalid DHT node address provided. Please specify correct DHT address in form HOST:PORT\n")
 			os.Exit(14)
 		}
 	}
-	args.Dht = dht
-	args.Keyfile = keyfile
-	args.Key = key
-	args.TTL = ttl
-	args.Fwd = fwd
-	args.Port = port
+	_, err := ptp.ParseFloodMode(args.Flood)
+	if err != nil {
+		fmt.Printf("%s. Possible values: none, broadcast, all\n", err)
+		os.Exit(15)
+	}
+	if args.StormLimit < 0 {
+		fmt.Printf("Storm control limit can't be negative\n")
+		os.Exit(16)
+	}
+	mode, err := ptp.ParseInterfaceMode(args.Mode)
+	if err != nil {
+		fmt.Printf("%s. Possible values: tap, tun\n", err)
+		os.Exit(17)
+	}
+	if mode == ptp.InterfaceTUN && args.Bridge {
+		fmt.Printf("Bridge mode requires TAP interface\n")
+		os.Exit(18)
+	}
+	_, err = ptp.ParseRoutes(args.Routes, ",")
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		os.Exit(19)
+	}
+	if args.Name != "" {
+		err = ptp.ValidatePeerName(args.Name)
+		if err != nil {
+			fmt.Printf("%s\n", err)
+			os.Exit(21)
+		}
+	}
+	if args.DHCPPool != "" {
+		_, _, err = ptp.ParseDHCPPool(args.DHCPPool)
+		if err != nil {
+			fmt.Printf("%s\n", err)
+			os.Exit(22)
+		}
+		if mode == ptp.InterfaceTUN {
+			fmt.Printf("DHCP server requires TAP interface\n")
+			os.Exit(23)
+		}
+	}
+	if args.Exit && args.ExitNode != "" {
+		fmt.Printf("Instance can't be an exit node and use another exit node at the same time\n")
+		os.Exit(24)
+	}
+	_, err = ptp.ParseEndpointWeights(args.Weights)
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		os.Exit(25)
+	}
+	tuning, err := ptp.NewTuning(args.Profile)
+	if err == nil {
+		err = tuning.Override(args.Tune)
+	}
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		os.Exit(26)
+	}
+	_, err = ptp.ParseStaticPeers(args.Static)
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		os.Exit(27)
+	}
+	if args.Static != "" && args.IP == "dhcp" {
+		fmt.Printf("Static peers can't get IP from bootstrap node. Specify IP address with -ip\n")
+		os.Exit(27)
+	}
+	if args.MaxPeers < 0 {
+		fmt.Printf("Maximum number of peers can't be negative\n")
+		os.Exit(28)
+	}
+	if args.MaxPeers > 0 && !args.Lazy {
+		fmt.Printf("Maximum number of peers is supported in lazy mode only. Specify -lazy\n")
+		os.Exit(28)
+	}
+	if args.Rules != "" {
+		args.Rules, err = filepath.Abs(args.Rules)
+		if err != nil {
+			fmt.Printf("Bad rules file path: %s\n", err)
+			os.Exit(20)
+		}
+	}
 
 	out, err := sendRequest(restPort, "start", args)
 	if err != nil {
@@ -64,16 +136,36 @@ func (d *Daemon) execRESTStart(w http.ResponseWriter, r *http.Request) {
 	}
 	response := new(Response)
 	d.run(&RunArgs{
-		IP:      args.IP,
-		Mac:     args.Mac,
-		Dev:     args.Dev,
-		Hash:    args.Hash,
-		Dht:     args.Dht,
-		Keyfile: args.Keyfile,
-		Key:     args.Key,
-		TTL:     args.TTL,
-		Fwd:     args.Fwd,
-		Port:    args.Port,
+		IP:         args.IP,
+		Mac:        args.Mac,
+		Dev:        args.Dev,
+		Hash:       args.Hash,
+		Dht:        args.Dht,
+		Keyfile:    args.Keyfile,
+		Key:        args.Key,
+		TTL:        args.TTL,
+		Fwd:        args.Fwd,
+		Port:       args.Port,
+		Flood:      args.Flood,
+		Snooping:   args.Snooping,
+		StormLimit: args.StormLimit,
+		Bridge:     args.Bridge,
+		Mode:       args.Mode,
+		Routes:     args.Routes,
+		Rules:      args.Rules,
+		Name:       args.Name,
+		DNS:        args.DNS,
+		Upstream:   args.Upstream,
+		DHCPPool:   args.DHCPPool,
+		Exit:       args.Exit,
+		ExitNode:   args.ExitNode,
+		Weights:    args.Weights,
+		Profile:    args.Profile,
+		Tune:       args.Tune,
+		Static:     args.Static,
+		Relay:      args.Relay,
+		Lazy:       args.Lazy,
+		MaxPeers:   args.MaxPeers,
 	}, response)
 	resp, err := getResponse(response.ExitCode, response.Output)
 	if err != nil {
@@ -116,17 +208,86 @@ func (d *Daemon) run(args *RunArgs, resp *Response) error {
 			}
 		}
 
+		// Arguments are validated before the instance acquires interface,
+		// socket and goroutines
+		mode, err := ptp.ParseInterfaceMode(args.Mode)
+		if err != nil {
+			resp.Output = resp.Output + err.Error()
+			resp.ExitCode = 1
+			return err
+		}
+		routes, err := ptp.ParseRoutes(args.Routes, ",")
+		if err != nil {
+			resp.Output = resp.Output + err.Error()
+			resp.ExitCode = 1
+			return err
+		}
+		weights, err := ptp.ParseEndpointWeights(args.Weights)
+		if err != nil {
+			resp.Output = resp.Output + err.Error()
+			resp.ExitCode = 1
+			return err
+		}
+		tuning, err := ptp.LoadTuning(ptp.ConfigDir+"/p2p/config.yaml", args.Profile, args.Tune)
+		if err != nil {
+			resp.Output = resp.Output + err.Error()
+			resp.ExitCode = 1
+			return err
+		}
+		staticPeers, err := ptp.LoadStaticPeers(ptp.ConfigDir+"/p2p/config.yaml", args.Hash, args.Static)
+		if err != nil {
+			resp.Output = resp.Output + err.Error()
+			resp.ExitCode = 1
+			return err
+		}
+		if len(staticPeers) > 0 && args.IP == "dhcp" {
+			resp.Output = resp.Output + "Static peers require IP address"
+			resp.ExitCode = 1
+			return errors.New("Static peers require IP address")
+		}
+		flood, err := ptp.ParseFloodMode(args.Flood)
+		if err != nil {
+			ptp.Log(ptp.Warning, "%s. Flooding disabled", err)
+		}
+
+		outboundIP, _ := getOutbound()
 		newInst := new(P2PInstance)
 		newInst.ID = args.Hash
 		newInst.Args = *args
-		newInst.PTP = ptp.New(args.IP, args.Mac, args.Dev, "", args.Hash, args.Dht, args.Keyfile, args.Key, args.TTL, "", args.Fwd, args.Port, usedIPs, OutboundIP)
+		newInst.PTP = ptp.New(args.IP, args.Mac, args.Dev, "", args.Hash, args.Dht, args.Keyfile, args.Key, args.TTL, "", args.Fwd, args.Port, usedIPs, outboundIP)
 		if newInst.PTP == nil {
 			resp.Output = resp.Output + "Failed to create P2P Instance"
 			resp.ExitCode = 1
 			return errors.New("Failed to create P2P Instance")
 		}
+		newInst.PTP.Multicast.Configure(flood, args.Snooping, args.StormLimit)
+		newInst.PTP.Interface.SetMode(mode)
+		newInst.PTP.Routes = routes
+		if args.Rules != "" {
+			err = newInst.PTP.Firewall.LoadRules(args.Rules)
+			if err != nil {
+				newInst.PTP.Close()
+				resp.Output = resp.Output + err.Error()
+				resp.ExitCode = 1
+				return err
+			}
+		}
+		newInst.PTP.Name = args.Name
+		newInst.PTP.ExitNode = args.ExitNode
+		newInst.PTP.Lazy = args.Lazy
+		newInst.PTP.MaxActivePeers = args.MaxPeers
+		newInst.PTP.EndpointWeights = weights
+		newInst.PTP.Tuning = tuning
+		newInst.PTP.StaticPeers = staticPeers
+		newInst.PTP.STUNServers = ptp.LoadSTUNServers(ptp.ConfigDir + "/p2p/config.yaml")
+		if args.Relay {
+			newInst.PTP.EnableRelay(ptp.LoadRelayConfig(ptp.ConfigDir + "/p2p/config.yaml"))
+		}
+		if args.Bridge && mode == ptp.InterfaceTAP {
+			newInst.PTP.EnableBridge()
+		}
 
-		err := bootstrap.registerInstance(newInst.ID, newInst)
+		err = bootstrap.registerInstance(newInst.ID, newInst)
 		if err != nil {
 			ptp.Log(ptp.Error, "Failed to register instance with bootstrap nodes: %s", err.Error())
 			newInst.PTP.Close()
@@ -138,8 +299,24 @@ func (d *Daemon) run(args *RunArgs, resp *Response) error {
 		go newInst.PTP.ReadDHT()
 		newInst.PTP.Dht.LocalPort = newInst.PTP.UDPSocket.GetPort()
 		newInst.PTP.FindNetworkAddresses()
+		if !args.Fwd {
+			newInst.PTP.MapPort()
+		}
+		if !args.Fwd {
+			err = newInst.PTP.StartDiscovery()
+			if err != nil {
+				ptp.Log(ptp.Warning, "%s", err)
+			}
+		}
+
+		// Instance may run without bootstrap nodes only when peers can
+		// be found otherwise
 		err = newInst.PTP.Dht.Connect(newInst.PTP.LocalIPs, newInst.PTP.ProxyManager.GetList())
-		if err != nil {
+		if err != nil && len(newInst.PTP.StaticPeers) > 0 {
+			ptp.Log(ptp.Warning, "%s. Only static and LAN peers will be available", err)
+		} else if err != nil && newInst.PTP.Discovery != nil {
+			ptp.Log(ptp.Warning, "%s. Only LAN peers will be available", err)
+		} else if err != nil {
 			newInst.PTP.Close()
 			bootstrap.unregisterInstance(newInst.ID)
 			resp.Output = resp.Output + err.Error()
@@ -156,6 +333,24 @@ func (d *Daemon) run(args *RunArgs, resp *Response) error {
 			resp.ExitCode = 603
 			return errors.New("Failed to configure network interface")
 		}
+		if args.Exit {
+			err = newInst.PTP.EnableExitGateway()
+			if err != nil {
+				ptp.Log(ptp.Error, "Failed to enable exit node: %s", err)
+			}
+		}
+		if args.DNS {
+			err = newInst.PTP.StartDNS(args.Upstream)
+			if err != nil {
+				ptp.Log(ptp.Error, "%s", err)
+			}
+		}
+		if args.DHCPPool != "" && newInst.PTP.Interface.GetMode() == ptp.InterfaceTAP {
+			err = newInst.PTP.StartDHCP(args.DHCPPool)
+			if err != nil {
+				ptp.Log(ptp.Error, "%s", err)
+			}
+		}
 		go newInst.PTP.ListenInterface()
 
 		// Saving interface name
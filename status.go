@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"time"
 
 	ptp "github.com/subutai-io/p2p/lib"
 )
@@ -21,14 +22,48 @@ type statusInstance struct {
 }
 
 type statusPeer struct {
-	ID        string `json:"id"`
-	IP        string `json:"ip"`
-	State     string `json:"state"`
-	LastError string `json:"lastError"`
+	ID        string            `json:"id"`
+	IP        string            `json:"ip"`
+	State     string            `json:"state"`
+	LastError string            `json:"lastError"`
+	Endpoint  string            `json:"endpoint"`
+	Endpoints []*statusEndpoint `json:"endpoints"`
 }
 
-// CommandStatus outputs connectivity status of each peer
-func CommandStatus(restPort int) {
+type statusEndpoint struct {
+	Addr   string  `json:"addr"`
+	RTT    float64 `json:"rtt"`    // Smoothed round trip time in milliseconds
+	Jitter float64 `json:"jitter"` // Jitter in milliseconds
+	Loss   float64 `json:"loss"`   // Percentage of lost pings
+}
+
+type peerResponse struct {
+	ID          string             `json:"id"`
+	IP          string             `json:"ip"`
+	State       string             `json:"state"`
+	RemoteState string             `json:"remoteState"`
+	Endpoint    string             `json:"endpoint"`
+	LastError   string             `json:"lastError"`
+	History     []*peerStateChange `json:"history"`
+	Error       string             `json:"error"`
+	Code        int                `json:"code"`
+}
+
+type peerStateChange struct {
+	Time     time.Time `json:"time"`
+	From     string    `json:"from"`
+	To       string    `json:"to"`
+	Reason   string    `json:"reason"`
+	Endpoint string    `json:"endpoint"`
+}
+
+// CommandStatus outputs connectivity status of each peer or
+// status of a single peer when hash and peer ID are specified
+func CommandStatus(restPort int, hash, peer string, history bool) {
+	if peer != "" || history {
+		commandPeerStatus(restPort, hash, peer, history)
+		return
+	}
 	out, err := sendRequestRaw(restPort, "status", &request{})
 	if err != nil {
 		fmt.Println(err.Error())
@@ -50,6 +85,11 @@ func CommandStatus(restPort int) {
 		fmt.Printf("%s|%s\n", instance.ID, instance.IP)
 		for _, peer := range instance.Peers {
 			fmt.Printf("%s|%s|State:%s|", peer.ID, peer.IP, peer.State)
+			for _, ep := range peer.Endpoints {
+				if ep.Addr == peer.Endpoint {
+					fmt.Printf("RTT:%.1fms|Jitter:%.1fms|Loss:%.0f%%|", ep.RTT, ep.Jitter, ep.Loss)
+				}
+			}
 			if peer.LastError != "" {
 				fmt.Printf("LastError:%s", peer.LastError)
 			}
@@ -59,6 +99,42 @@ func CommandStatus(restPort int) {
 	os.Exit(0)
 }
 
+func commandPeerStatus(restPort int, hash, id string, history bool) {
+	if hash == "" || id == "" {
+		fmt.Printf("Both hash and peer ID must be specified\n")
+		os.Exit(1)
+	}
+	out, err := sendRequestRaw(restPort, "peer", &request{Hash: hash, Peer: id})
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	response := new(peerResponse)
+	err = json.Unmarshal(out, response)
+	if err != nil {
+		fmt.Printf("Failed to unmarshal peer response: %s", err)
+		os.Exit(125)
+	}
+
+	if response.Code != 0 {
+		fmt.Println(response.Error)
+		os.Exit(response.Code)
+	}
+
+	fmt.Printf("%s|%s|State:%s|RemoteState:%s|Endpoint:%s|", response.ID, response.IP, response.State, response.RemoteState, response.Endpoint)
+	if response.LastError != "" {
+		fmt.Printf("LastError:%s", response.LastError)
+	}
+	fmt.Printf("\n")
+	if history {
+		for _, change := range response.History {
+			fmt.Printf("%s|%s -> %s|%s|%s\n", change.Time.Format(time.RFC3339Nano), change.From, change.To, change.Endpoint, change.Reason)
+		}
+	}
+	os.Exit(0)
+}
+
 func (d *Daemon) execRESTStatus(w http.ResponseWriter, r *http.Request) {
 	args := new(DaemonArgs)
 	err := getJSON(r.Body, args)
@@ -94,14 +170,91 @@ func (d *Daemon) Status() (*statusResponse, error) {
 		}
 		peers := inst.PTP.Peers.Get()
 		for _, peer := range peers {
-			instance.Peers = append(instance.Peers, &statusPeer{
+			status := &statusPeer{
 				ID:        peer.ID,
-				IP:        peer.PeerLocalIP.String(),
-				State:     ptp.StringifyState(peer.State),
-				LastError: peer.LastError,
-			})
+				IP:        peer.GetIP().String(),
+				State:     ptp.StringifyState(peer.GetState()),
+				LastError: peer.GetLastError(),
+				Endpoints: []*statusEndpoint{},
+			}
+			if endpoint := peer.GetEndpoint(); endpoint != nil {
+				status.Endpoint = endpoint.String()
+			}
+			for _, ep := range peer.GetEndpoints() {
+				status.Endpoints = append(status.Endpoints, &statusEndpoint{
+					Addr:   ep.Addr.String(),
+					RTT:    float64(ep.RTT) / float64(time.Millisecond),
+					Jitter: float64(ep.Jitter) / float64(time.Millisecond),
+					Loss:   ep.Loss,
+				})
+			}
+			instance.Peers = append(instance.Peers, status)
 		}
 		response.Instances = append(response.Instances, instance)
 	}
 	return response, nil
 }
+
+// execRESTPeer responds with status and state history of a peer. Instance
+// and peer may be passed either in request body or as hash and id query
+// parameters of GET request
+func (d *Daemon) execRESTPeer(w http.ResponseWriter, r *http.Request) {
+	args := new(DaemonArgs)
+	err := getJSON(r.Body, args)
+	if handleMarshalError(err, w) != nil {
+		return
+	}
+	query := r.URL.Query()
+	if query.Get("hash") != "" {
+		args.Hash = query.Get("hash")
+	}
+	if query.Get("id") != "" {
+		args.Peer = query.Get("id")
+	}
+	output, err := json.Marshal(d.PeerStatus(args.Hash, args.Peer))
+	if err != nil {
+		ptp.Log(ptp.Error, "Failed to marshal peer response: %s", err)
+		return
+	}
+	w.Write(output)
+}
+
+// PeerStatus returns state and recent state changes of a peer
+func (d *Daemon) PeerStatus(hash, id string) *peerResponse {
+	response := &peerResponse{History: []*peerStateChange{}}
+	if !ReadyToServe {
+		response.Code = 105
+		response.Error = "P2P Daemon is in initialization state"
+		return response
+	}
+	inst := d.Instances.GetInstance(hash)
+	if inst == nil {
+		response.Code = 1
+		response.Error = "Instance with hash " + hash + " was not found"
+		return response
+	}
+	peer := inst.PTP.Peers.GetPeer(id)
+	if peer == nil {
+		response.Code = 2
+		response.Error = "Peer " + id + " was not found"
+		return response
+	}
+	response.ID = peer.ID
+	response.IP = peer.GetIP().String()
+	response.State = ptp.StringifyState(peer.GetState())
+	response.RemoteState = ptp.StringifyState(peer.GetRemoteState())
+	if endpoint := peer.GetEndpoint(); endpoint != nil {
+		response.Endpoint = endpoint.String()
+	}
+	response.LastError = peer.GetLastError()
+	for _, change := range peer.History() {
+		response.History = append(response.History, &peerStateChange{
+			Time:     change.Time,
+			From:     ptp.StringifyState(change.From),
+			To:       ptp.StringifyState(change.To),
+			Reason:   change.Reason,
+			Endpoint: change.Endpoint,
+		})
+	}
+	return response
+}